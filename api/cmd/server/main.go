@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -13,9 +15,36 @@ import (
 	"github.com/EpicMandM/esxi-lab-provider/api/internal/service"
 )
 
+// commands are the operator subcommands. Without a subcommand the binary
+// performs one scheduler run. Commands log to stderr and write their report
+// to stdout.
+var commands = map[string]func(log *logger.Logger, args []string) error{
+	"accounts":   runAccounts,
+	"plan":       runPlan,
+	"quarantine": runQuarantine,
+	"selectors":  runSelectors,
+	"snapshots":  runSnapshots,
+	"usage":      runUsage,
+}
+
 func main() {
 	log := logger.New()
 
+	if len(os.Args) > 1 {
+		cmd, ok := commands[os.Args[1]]
+		if !ok {
+			log.Error("Unknown command", logger.F("COMMAND", os.Args[1]))
+			os.Exit(2)
+		}
+		log = configureLogger(logger.NewWithWriter(os.Stderr))
+		if err := cmd(log, os.Args[2:]); err != nil {
+			log.Error("Command failed", logger.F("COMMAND", os.Args[1]), logger.Error(err))
+			os.Exit(1)
+		}
+		return
+	}
+
+	log = configureLogger(log)
 	if err := run(log); err != nil {
 		log.Error("Application error", logger.Error(err))
 		os.Exit(1)
@@ -25,43 +54,13 @@ func main() {
 func run(log *logger.Logger) error {
 	ctx := context.Background()
 
-	if os.Getenv("GOOGLE_APPLICATION_CREDENTIALS") == "" {
-		if sa := os.Getenv("SERVICE_ACCOUNT_PATH"); sa != "" {
-			_ = os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", sa)
-		}
-	}
+	useServiceAccount()
 
-	var appMetrics *metrics.Metrics
-	meter, shutdownMetrics, err := metrics.InitProvider(ctx)
-	if err != nil {
-		log.Warn("Metrics initialisation failed, continuing without metrics", logger.Error(err))
-	} else {
-		defer func() {
-			shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-			defer cancel()
-			if serr := shutdownMetrics(shutdownCtx); serr != nil {
-				log.Warn("Failed to flush metrics on shutdown", logger.Error(serr))
-			}
-		}()
-		appMetrics, err = metrics.New(meter)
-		if err != nil {
-			log.Warn("Failed to create metric instruments, continuing without metrics", logger.Error(err))
-			appMetrics = nil
-		} else {
-			log.Info("Metrics initialized", logger.Status("ready"))
-		}
-	}
-
-	configPath := getEnvOrDefault("CONFIG_PATH", "./data/user_config.toml")
-	featureCfg, err := service.LoadFeatureConfig(configPath)
-	if err != nil {
-		log.Error("Failed to load feature config", logger.Error(err), logger.F("path", configPath))
-		return err
-	}
+	appMetrics, shutdownMetrics := initMetrics(ctx, log)
+	defer shutdownMetrics()
 
-	infraCfg, err := config.LoadWithFile(resolveEnvFile())
+	featureCfg, infraCfg, err := loadConfig(log)
 	if err != nil {
-		log.Error("Failed to load .env", logger.Error(err))
 		return err
 	}
 
@@ -76,6 +75,11 @@ func run(log *logger.Logger) error {
 		log.Error("Failed to initialize VMware service", logger.Error(err))
 		return err
 	}
+	vmwareSvc.SetPasswordPolicy(featureCfg.PasswordPolicy)
+	if err := vmwareSvc.CheckSelectors(&featureCfg.ESXi); err != nil {
+		log.Error("Invalid VM selectors", logger.Error(err))
+		return err
+	}
 
 	var emailSvc service.EmailSender
 	smtpHost := getEnvOrDefault("SMTP_HOST", "smtp.gmail.com")
@@ -90,6 +94,7 @@ func run(log *logger.Logger) error {
 			smtpPassword = strings.TrimSpace(string(passwordBytes))
 		}
 	}
+	log.AddSecret(smtpPassword)
 	smtpFrom := getEnvOrDefault("SMTP_FROM", smtpUsername)
 	testEmailOnly := os.Getenv("TEST_EMAIL_ONLY")
 	if smtpUsername != "" && smtpPassword != "" {
@@ -112,6 +117,7 @@ func run(log *logger.Logger) error {
 	if featureCfg.WireGuard.Enabled {
 		featureCfg.WireGuard.OPNsenseAPIKey = os.Getenv("OPNSENSE_API_KEY")
 		featureCfg.WireGuard.OPNsenseAPISecret = os.Getenv("OPNSENSE_API_SECRET")
+		log.AddSecret(featureCfg.WireGuard.OPNsenseAPIKey, featureCfg.WireGuard.OPNsenseAPISecret)
 
 		var opnsense service.OPNsenseAPI
 		if featureCfg.WireGuard.AutoRegisterPeers && featureCfg.WireGuard.OPNsenseURL != "" && featureCfg.WireGuard.OPNsenseAPIKey != "" {
@@ -135,6 +141,12 @@ func run(log *logger.Logger) error {
 		log.Info("WireGuard service not enabled in configuration")
 	}
 
+	health, err := service.LoadHealthTracker(featureCfg.Quarantine)
+	if err != nil {
+		log.Warn("Pod health state unavailable, continuing without quarantine", logger.Error(err))
+		health = nil
+	}
+
 	orch := &orchestrator.Orchestrator{
 		Logger:     log,
 		Calendar:   calendarSvc,
@@ -143,11 +155,327 @@ func run(log *logger.Logger) error {
 		WireGuard:  wireguardSvc,
 		FeatureCfg: featureCfg,
 		Metrics:    appMetrics,
+		Health:     health,
 	}
 
 	return orch.Run()
 }
 
+// useServiceAccount points the Google client libraries at
+// SERVICE_ACCOUNT_PATH unless GOOGLE_APPLICATION_CREDENTIALS is already set.
+func useServiceAccount() {
+	if os.Getenv("GOOGLE_APPLICATION_CREDENTIALS") == "" {
+		if sa := os.Getenv("SERVICE_ACCOUNT_PATH"); sa != "" {
+			_ = os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", sa)
+		}
+	}
+}
+
+// initMetrics sets up the metrics provider and instruments. Metrics are
+// optional: on failure it logs a warning and returns nil metrics. The
+// returned func flushes pending metrics and must be called before exit.
+func initMetrics(ctx context.Context, log *logger.Logger) (*metrics.Metrics, func()) {
+	cfg := metrics.ConfigFromEnv()
+	if cfg.Disabled() {
+		log.Info("Metrics disabled", logger.Status("disabled"))
+		return nil, func() {}
+	}
+	meter, shutdownMetrics, err := metrics.InitProvider(ctx, cfg)
+	if err != nil {
+		log.Warn("Metrics initialisation failed, continuing without metrics", logger.Error(err))
+		return nil, func() {}
+	}
+	shutdown := func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if serr := shutdownMetrics(shutdownCtx); serr != nil {
+			log.Warn("Failed to flush metrics on shutdown", logger.Error(serr))
+		}
+	}
+	appMetrics, err := metrics.New(meter)
+	if err != nil {
+		log.Warn("Failed to create metric instruments, continuing without metrics", logger.Error(err))
+		return nil, shutdown
+	}
+	log.Info("Metrics initialized", logger.Status("ready"), logger.F("EXPORTER", cfg.Name()))
+	return appMetrics, shutdown
+}
+
+// loadConfig loads user_config.toml and .env.
+func loadConfig(log *logger.Logger) (*service.FeatureConfig, *config.Config, error) {
+	configPath := getEnvOrDefault("CONFIG_PATH", "./data/user_config.toml")
+	featureCfg, err := service.LoadFeatureConfig(configPath)
+	if err != nil {
+		log.Error("Failed to load feature config", logger.Error(err), logger.F("path", configPath))
+		return nil, nil, err
+	}
+
+	infraCfg, err := config.LoadWithFile(resolveEnvFile())
+	if err != nil {
+		log.Error("Failed to load .env", logger.Error(err))
+		return nil, nil, err
+	}
+
+	if err := featureCfg.ESXi.LoadGuestCredentials(); err != nil {
+		log.Error("Failed to load guest credentials", logger.Error(err))
+		return nil, nil, err
+	}
+
+	for _, ep := range infraCfg.Endpoints() {
+		log.AddSecret(ep.Password)
+	}
+	for _, r := range featureCfg.ESXi.GuestProvisioning {
+		log.AddSecret(r.GuestPassword)
+	}
+	return featureCfg, infraCfg, nil
+}
+
+// runSelectors lists the VMs each configured selector resolves to in the
+// current inventory, without changing anything.
+func runSelectors(log *logger.Logger, _ []string) error {
+	ctx := context.Background()
+
+	featureCfg, infraCfg, err := loadConfig(log)
+	if err != nil {
+		return err
+	}
+
+	vmwareSvc, err := service.NewVMwareService(ctx, infraCfg, log)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := vmwareSvc.Close(ctx); cerr != nil {
+			log.Error("Failed to close VMware service", logger.Error(cerr))
+		}
+	}()
+	if err := vmwareSvc.CheckSelectors(&featureCfg.ESXi); err != nil {
+		return err
+	}
+
+	orch := &orchestrator.Orchestrator{Logger: log, VMware: vmwareSvc, FeatureCfg: featureCfg}
+	vmList, err := orch.FetchVMInventory()
+	if err != nil {
+		return err
+	}
+	return orchestrator.WriteSelectorReport(os.Stdout, orch.ResolveSelectors(vmList.VMs))
+}
+
+// runPlan validates every configured pod against its pod template and lists
+// which pods a run would use, without changing anything.
+func runPlan(log *logger.Logger, _ []string) error {
+	ctx := context.Background()
+
+	featureCfg, infraCfg, err := loadConfig(log)
+	if err != nil {
+		return err
+	}
+
+	vmwareSvc, err := service.NewVMwareService(ctx, infraCfg, log)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := vmwareSvc.Close(ctx); cerr != nil {
+			log.Error("Failed to close VMware service", logger.Error(cerr))
+		}
+	}()
+	if err := vmwareSvc.CheckSelectors(&featureCfg.ESXi); err != nil {
+		return err
+	}
+
+	health, err := service.LoadHealthTracker(featureCfg.Quarantine)
+	if err != nil {
+		return err
+	}
+
+	orch := &orchestrator.Orchestrator{Logger: log, VMware: vmwareSvc, FeatureCfg: featureCfg, Health: health}
+	vmList, err := orch.FetchVMInventory()
+	if err != nil {
+		return err
+	}
+	_, statuses := orch.ValidatePods(vmList.VMs, orch.SelectAllVMs(vmList))
+	return orchestrator.WritePlan(os.Stdout, statuses)
+}
+
+// runUsage samples CPU, memory, disk and network usage of every pod VM and
+// exports it as metrics. Pods the last scheduler run gave a booking that is
+// still active are flagged as in session. It is meant to run every few
+// minutes from its own timer.
+func runUsage(log *logger.Logger, _ []string) error {
+	ctx := context.Background()
+	useServiceAccount()
+
+	appMetrics, shutdownMetrics := initMetrics(ctx, log)
+	defer shutdownMetrics()
+
+	featureCfg, infraCfg, err := loadConfig(log)
+	if err != nil {
+		return err
+	}
+
+	calendarSvc, err := service.NewCalendarService(ctx, featureCfg.Calendar)
+	if err != nil {
+		return err
+	}
+
+	vmwareSvc, err := service.NewVMwareService(ctx, infraCfg, log)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := vmwareSvc.Close(ctx); cerr != nil {
+			log.Error("Failed to close VMware service", logger.Error(cerr))
+		}
+	}()
+	if err := vmwareSvc.CheckSelectors(&featureCfg.ESXi); err != nil {
+		return err
+	}
+
+	health, err := service.LoadHealthTracker(featureCfg.Quarantine)
+	if err != nil {
+		log.Warn("Pod health state unavailable, continuing without quarantine", logger.Error(err))
+		health = nil
+	}
+
+	// Inventory and calendar metrics belong to scheduler runs, so they are
+	// fetched before metrics are attached.
+	orch := &orchestrator.Orchestrator{Logger: log, Calendar: calendarSvc, VMware: vmwareSvc, FeatureCfg: featureCfg, Health: health}
+	vmList, err := orch.FetchVMInventory()
+	if err != nil {
+		return err
+	}
+	activeEvents, err := orch.FetchActiveEvents()
+	if err != nil {
+		return err
+	}
+
+	orch.Metrics = appMetrics
+	return orch.CollectUsage(orch.SelectAllVMs(vmList), orch.AssignedPods(activeEvents))
+}
+
+// runSnapshots reports the snapshot chain health of every pod VM, without
+// consolidating anything.
+func runSnapshots(log *logger.Logger, _ []string) error {
+	ctx := context.Background()
+
+	featureCfg, infraCfg, err := loadConfig(log)
+	if err != nil {
+		return err
+	}
+
+	vmwareSvc, err := service.NewVMwareService(ctx, infraCfg, log)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := vmwareSvc.Close(ctx); cerr != nil {
+			log.Error("Failed to close VMware service", logger.Error(cerr))
+		}
+	}()
+	if err := vmwareSvc.CheckSelectors(&featureCfg.ESXi); err != nil {
+		return err
+	}
+
+	featureCfg.SnapshotHealth.Enabled = true
+	featureCfg.SnapshotHealth.Consolidate = false
+	orch := &orchestrator.Orchestrator{Logger: log, VMware: vmwareSvc, FeatureCfg: featureCfg}
+	vmList, err := orch.FetchVMInventory()
+	if err != nil {
+		return err
+	}
+	checks := orch.CheckSnapshotHealth(orch.SelectAllVMs(vmList), nil, time.Now())
+	return orchestrator.WriteSnapshotReport(os.Stdout, checks)
+}
+
+// runAccounts prints the differences between the lab accounts and role on
+// each ESXi host and the configuration. "accounts apply" also makes the
+// changes.
+func runAccounts(log *logger.Logger, args []string) error {
+	apply := len(args) > 0 && args[0] == "apply"
+	if len(args) > 0 && !apply {
+		return fmt.Errorf("usage: accounts [apply]")
+	}
+	ctx := context.Background()
+
+	featureCfg, infraCfg, err := loadConfig(log)
+	if err != nil {
+		return err
+	}
+
+	vmwareSvc, err := service.NewVMwareService(ctx, infraCfg, log)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := vmwareSvc.Close(ctx); cerr != nil {
+			log.Error("Failed to close VMware service", logger.Error(cerr))
+		}
+	}()
+
+	vmwareSvc.SetPasswordPolicy(featureCfg.PasswordPolicy)
+
+	orch := &orchestrator.Orchestrator{Logger: log, VMware: vmwareSvc, FeatureCfg: featureCfg}
+	changes, err := orch.ReconcileAccounts(apply)
+	if werr := orchestrator.WriteAccountDiff(os.Stdout, changes); werr != nil && err == nil {
+		err = werr
+	}
+	return err
+}
+
+// runQuarantine lists failing and quarantined pods. "quarantine release
+// USER..." returns repaired pods to rotation without waiting for a clean run.
+func runQuarantine(log *logger.Logger, args []string) error {
+	configPath := getEnvOrDefault("CONFIG_PATH", "./data/user_config.toml")
+	featureCfg, err := service.LoadFeatureConfig(configPath)
+	if err != nil {
+		return err
+	}
+	health, err := service.LoadHealthTracker(featureCfg.Quarantine)
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 0 {
+		return orchestrator.WriteQuarantineReport(os.Stdout, health.Pods())
+	}
+	if args[0] != "release" || len(args) < 2 {
+		return fmt.Errorf("usage: quarantine [release USER...]")
+	}
+	for _, user := range args[1:] {
+		if health.Release(user) {
+			log.Info("Pod released from quarantine", logger.Action("quarantine"), logger.Status("released"), logger.User(user))
+		} else {
+			log.Warn("Pod is not quarantined", logger.User(user))
+		}
+	}
+	return health.Save()
+}
+
+// configureLogger applies LOG_FORMAT and LOG_LEVEL, turns off secret
+// redaction when LOG_REVEAL_SECRETS is set, for debugging a single run by
+// hand, and returns a logger adding a fresh run ID to every line.
+func configureLogger(log *logger.Logger) *logger.Logger {
+	format, ferr := logger.ParseFormat(os.Getenv("LOG_FORMAT"))
+	if ferr == nil {
+		ferr = log.SetFormat(format)
+	}
+	level, lerr := logger.ParseLevel(os.Getenv("LOG_LEVEL"))
+	log.SetLevel(level)
+	log = log.With(logger.RunID(logger.NewRunID()))
+	if ferr != nil {
+		log.Warn("Failed to apply LOG_FORMAT, using text", logger.Error(ferr))
+	}
+	if lerr != nil {
+		log.Warn("Invalid LOG_LEVEL, using debug", logger.Error(lerr))
+	}
+	if reveal, _ := strconv.ParseBool(os.Getenv("LOG_REVEAL_SECRETS")); reveal {
+		log.RevealSecrets()
+		log.Warn("Secrets are logged in clear text, unset LOG_REVEAL_SECRETS after debugging")
+	}
+	return log
+}
+
 func resolveEnvFile() string {
 	if path := os.Getenv("ENV_PATH"); path != "" {
 		return path
@@ -1,9 +1,15 @@
 package main
 
 import (
+	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/EpicMandM/esxi-lab-provider/api/internal/logger"
+	"github.com/EpicMandM/esxi-lab-provider/api/internal/service"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -41,3 +47,25 @@ func TestResolveEnvFile_FindsLocalEnv(t *testing.T) {
 
 	assert.Equal(t, ".env", resolveEnvFile())
 }
+
+func TestRunQuarantine_Release(t *testing.T) {
+	dir := t.TempDir()
+	statePath := filepath.Join(dir, "pod_health.json")
+	configPath := filepath.Join(dir, "user_config.toml")
+	require.NoError(t, os.WriteFile(configPath, []byte(fmt.Sprintf("[quarantine]\nstate_path = %q\n", statePath)), 0o644))
+	t.Setenv("CONFIG_PATH", configPath)
+
+	cfg := service.QuarantineConfig{StatePath: statePath}
+	health, err := service.LoadHealthTracker(cfg)
+	require.NoError(t, err)
+	health.RecordFailure("alice", "vm-alice not restored", time.Now())
+	require.NoError(t, health.Save())
+
+	log := logger.NewWithWriter(io.Discard)
+	require.Error(t, runQuarantine(log, []string{"release"}))
+	require.NoError(t, runQuarantine(log, []string{"release", "alice"}))
+
+	health, err = service.LoadHealthTracker(cfg)
+	require.NoError(t, err)
+	assert.False(t, health.Quarantined("alice"))
+}
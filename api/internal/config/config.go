@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/joho/godotenv"
 )
@@ -13,6 +14,19 @@ type Config struct {
 	ESXiUsername string
 	ESXiPassword string
 	ESXiInsecure bool
+
+	// Hosts lists additional vSphere endpoints (standalone ESXi hosts or
+	// ESXi hosts managed by the primary vCenter) from ESXI_HOSTS.
+	Hosts []Endpoint
+}
+
+// Endpoint is the connection information for one vSphere endpoint.
+type Endpoint struct {
+	Name     string
+	URL      string
+	Username string
+	Password string
+	Insecure bool
 }
 
 // Load loads configuration from environment variables.
@@ -34,6 +48,7 @@ func LoadWithFile(envFile string) (*Config, error) {
 		ESXiPassword: os.Getenv("ESXI_PASSWORD"),
 		ESXiInsecure: parseInsecure(os.Getenv("ESXI_INSECURE")),
 	}
+	cfg.Hosts = cfg.loadHosts(os.Getenv("ESXI_HOSTS"))
 
 	if err := cfg.Validate(); err != nil {
 		return nil, err
@@ -42,6 +57,45 @@ func LoadWithFile(envFile string) (*Config, error) {
 	return cfg, nil
 }
 
+// loadHosts reads the additional endpoints named in the comma-separated
+// ESXI_HOSTS list. Each host NAME is configured by ESXI_<NAME>_URL and may
+// override ESXI_<NAME>_USERNAME, ESXI_<NAME>_PASSWORD and ESXI_<NAME>_INSECURE;
+// unset values fall back to the primary ESXI_* settings.
+func (c *Config) loadHosts(list string) []Endpoint {
+	var hosts []Endpoint
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		prefix := "ESXI_" + envKey(name) + "_"
+		ep := Endpoint{
+			Name:     name,
+			URL:      os.Getenv(prefix + "URL"),
+			Username: getEnvOr(prefix+"USERNAME", c.ESXiUsername),
+			Password: getEnvOr(prefix+"PASSWORD", c.ESXiPassword),
+			Insecure: c.ESXiInsecure,
+		}
+		if v := os.Getenv(prefix + "INSECURE"); v != "" {
+			ep.Insecure = parseInsecure(v)
+		}
+		hosts = append(hosts, ep)
+	}
+	return hosts
+}
+
+// Endpoints returns the primary endpoint followed by any additional hosts.
+func (c *Config) Endpoints() []Endpoint {
+	primary := Endpoint{
+		Name:     "primary",
+		URL:      c.ESXiURL,
+		Username: c.ESXiUsername,
+		Password: c.ESXiPassword,
+		Insecure: c.ESXiInsecure,
+	}
+	return append([]Endpoint{primary}, c.Hosts...)
+}
+
 // Validate checks if all required fields are set.
 func (c *Config) Validate() error {
 	if c.ESXiURL == "" {
@@ -53,6 +107,11 @@ func (c *Config) Validate() error {
 	if c.ESXiPassword == "" {
 		return fmt.Errorf("ESXI_PASSWORD is required")
 	}
+	for _, h := range c.Hosts {
+		if h.URL == "" {
+			return fmt.Errorf("ESXI_%s_URL is required for host %q", envKey(h.Name), h.Name)
+		}
+	}
 	return nil
 }
 
@@ -61,3 +120,25 @@ func parseInsecure(s string) bool {
 	b, _ := strconv.ParseBool(s)
 	return b
 }
+
+// envKey converts a host name into the form used in environment variable
+// names: upper case with every non-alphanumeric character replaced by '_'.
+func envKey(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+}
+
+func getEnvOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
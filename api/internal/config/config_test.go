@@ -176,3 +176,47 @@ func TestValidate_MissingPassword(t *testing.T) {
 	require.Error(t, err)
 	assert.Contains(t, err.Error(), "ESXI_PASSWORD is required")
 }
+
+func TestLoad_AdditionalHosts(t *testing.T) {
+	t.Setenv("ESXI_URL", "https://vcenter.example.com")
+	t.Setenv("ESXI_USERNAME", "admin")
+	t.Setenv("ESXI_PASSWORD", "password")
+	t.Setenv("ESXI_INSECURE", "true")
+	t.Setenv("ESXI_HOSTS", "esxi-01.lab, esxi-02")
+	t.Setenv("ESXI_ESXI_01_LAB_URL", "https://esxi-01.lab")
+	t.Setenv("ESXI_ESXI_02_URL", "https://esxi-02")
+	t.Setenv("ESXI_ESXI_02_USERNAME", "root")
+	t.Setenv("ESXI_ESXI_02_PASSWORD", "rootpass")
+	t.Setenv("ESXI_ESXI_02_INSECURE", "false")
+
+	cfg, err := Load()
+	require.NoError(t, err)
+	require.Len(t, cfg.Hosts, 2)
+
+	assert.Equal(t, Endpoint{Name: "esxi-01.lab", URL: "https://esxi-01.lab", Username: "admin", Password: "password", Insecure: true}, cfg.Hosts[0])
+	assert.Equal(t, Endpoint{Name: "esxi-02", URL: "https://esxi-02", Username: "root", Password: "rootpass", Insecure: false}, cfg.Hosts[1])
+
+	eps := cfg.Endpoints()
+	require.Len(t, eps, 3)
+	assert.Equal(t, "primary", eps[0].Name)
+	assert.Equal(t, "https://vcenter.example.com", eps[0].URL)
+}
+
+func TestLoad_AdditionalHostMissingURL(t *testing.T) {
+	t.Setenv("ESXI_URL", "https://esxi.example.com")
+	t.Setenv("ESXI_USERNAME", "admin")
+	t.Setenv("ESXI_PASSWORD", "password")
+	t.Setenv("ESXI_HOSTS", "esxi-02")
+	t.Setenv("ESXI_ESXI_02_URL", "")
+
+	_, err := Load()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "ESXI_ESXI_02_URL is required")
+}
+
+func TestEndpoints_SingleHost(t *testing.T) {
+	cfg := &Config{ESXiURL: "https://esxi", ESXiUsername: "u", ESXiPassword: "p"}
+	eps := cfg.Endpoints()
+	require.Len(t, eps, 1)
+	assert.Equal(t, "https://esxi", eps[0].URL)
+}
@@ -0,0 +1,165 @@
+package logger
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Format is the output format of a logger.
+type Format string
+
+// Output formats.
+const (
+	// FormatText is the historic journald format, LEVEL=... MESSAGE=...
+	// with unquoted values.
+	FormatText Format = "text"
+	// FormatLogfmt is logfmt with values quoted where needed and a TIME
+	// field.
+	FormatLogfmt Format = "logfmt"
+	// FormatJSON writes one JSON object per line.
+	FormatJSON Format = "json"
+	// FormatJournald sends every line to the journald native socket, see
+	// JournalHandler.
+	FormatJournald Format = "journald"
+)
+
+// ParseFormat parses an output format name. An empty name is FormatText.
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(strings.ToLower(strings.TrimSpace(s))); f {
+	case "":
+		return FormatText, nil
+	case FormatText, FormatLogfmt, FormatJSON, FormatJournald:
+		return f, nil
+	}
+	return FormatText, fmt.Errorf("unknown log format %q (want text, logfmt, json or journald)", s)
+}
+
+// ParseLevel parses a minimum level name: debug, info, warn (or warning)
+// or error. An empty name is debug.
+func ParseLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return slog.LevelDebug, fmt.Errorf("unknown log level %q (want debug, info, warn or error)", s)
+}
+
+// NewWithHandler creates a logger that passes every line to h as a
+// slog record. Secrets are redacted before h sees them.
+func NewWithHandler(h slog.Handler) *Logger {
+	l := NewWithWriter(io.Discard)
+	l.handler = h
+	return l
+}
+
+// SetFormat selects the output format for the logger's writer. With
+// FormatJournald the writer only receives lines journald did not take; the
+// format is left unchanged when the journald socket cannot be opened.
+func (l *Logger) SetFormat(f Format) error {
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug, ReplaceAttr: replaceSlogAttr}
+	switch f {
+	case FormatLogfmt:
+		l.handler = slog.NewTextHandler(l.writer, opts)
+	case FormatJSON:
+		l.handler = slog.NewJSONHandler(l.writer, opts)
+	case FormatJournald:
+		h, err := NewJournalHandler(journalSocket, journalIdentifier(), l.writer)
+		if err != nil {
+			return err
+		}
+		l.handler = h
+	default:
+		l.handler = nil
+	}
+	return nil
+}
+
+// SetLevel drops lines below level.
+func (l *Logger) SetLevel(level slog.Level) {
+	l.level = level
+}
+
+// With returns a logger that adds fields to every line, such as the run
+// ID. It shares the writer and known secrets of l.
+func (l *Logger) With(fields ...Field) *Logger {
+	l.registerSecrets(fields)
+	child := *l
+	child.fields = append(slices.Clip(l.fields), fields...)
+	return &child
+}
+
+// NewRunID returns a random ID correlating the lines of one run.
+func NewRunID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// levelName returns the name of level in the log, as journald expects it.
+func levelName(level slog.Level) string {
+	switch {
+	case level >= slog.LevelError:
+		return "ERROR"
+	case level >= slog.LevelWarn:
+		return "WARNING"
+	case level >= slog.LevelInfo:
+		return "INFO"
+	default:
+		return "DEBUG"
+	}
+}
+
+// replaceSlogAttr renames slog's built-in keys to the ones of the text
+// format.
+func replaceSlogAttr(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) > 0 {
+		return a
+	}
+	switch a.Key {
+	case slog.TimeKey:
+		a.Key = "TIME"
+	case slog.LevelKey:
+		a.Key = "LEVEL"
+		if level, ok := a.Value.Any().(slog.Level); ok {
+			a.Value = slog.StringValue(levelName(level))
+		}
+	case slog.MessageKey:
+		a.Key = "MESSAGE"
+	}
+	return a
+}
+
+// handle passes a line to the slog handler. Numbers and booleans keep
+// their type; everything else is written as a redacted string.
+func (l *Logger) handle(level slog.Level, msg string, fields []Field) {
+	ctx := context.Background()
+	if !l.handler.Enabled(ctx, level) {
+		return
+	}
+	r := slog.NewRecord(time.Now(), level, msg, 0)
+	for _, f := range fields {
+		r.AddAttrs(slog.Attr{Key: f.Key, Value: l.slogValue(f.Value)})
+	}
+	_ = l.handler.Handle(ctx, r)
+}
+
+func (l *Logger) slogValue(value any) slog.Value {
+	switch v := value.(type) {
+	case bool, int, int64, uint64, float64:
+		return slog.AnyValue(v)
+	}
+	return slog.StringValue(l.render(value))
+}
@@ -0,0 +1,112 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseFormat(t *testing.T) {
+	for in, want := range map[string]Format{"": FormatText, "text": FormatText, "logfmt": FormatLogfmt, " JSON ": FormatJSON, "journald": FormatJournald} {
+		got, err := ParseFormat(in)
+		require.NoError(t, err, in)
+		assert.Equal(t, want, got, in)
+	}
+	_, err := ParseFormat("xml")
+	assert.Error(t, err)
+}
+
+func TestParseLevel(t *testing.T) {
+	for in, want := range map[string]slog.Level{"": slog.LevelDebug, "info": slog.LevelInfo, "WARNING": slog.LevelWarn, "warn": slog.LevelWarn, "error": slog.LevelError} {
+		got, err := ParseLevel(in)
+		require.NoError(t, err, in)
+		assert.Equal(t, want, got, in)
+	}
+	_, err := ParseLevel("verbose")
+	assert.Error(t, err)
+}
+
+func TestSetFormat_Logfmt(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewWithWriter(&buf)
+	require.NoError(t, l.SetFormat(FormatLogfmt))
+	l.Warn("pod not ready", VM("vm-alice"), Reason("guest tools \"not running\""), Count(3))
+
+	out := buf.String()
+	assert.True(t, strings.HasPrefix(out, "TIME="), out)
+	assert.Contains(t, out, ` LEVEL=WARNING MESSAGE="pod not ready" VM=vm-alice REASON="guest tools \"not running\"" COUNT=3`)
+}
+
+func TestSetFormat_JSON(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewWithWriter(&buf)
+	require.NoError(t, l.SetFormat(FormatJSON))
+	l.Info("password rotated", User("alice"), Password("s3cret-pass"), Count(2), Error(errors.New("old s3cret-pass rejected")))
+
+	var line map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+	assert.Equal(t, "INFO", line["LEVEL"])
+	assert.Equal(t, "password rotated", line["MESSAGE"])
+	assert.Equal(t, "alice", line["USER"])
+	assert.Equal(t, Fingerprint("s3cret-pass"), line["PASSWORD"])
+	assert.Equal(t, float64(2), line["COUNT"])
+	assert.Equal(t, "old "+Fingerprint("s3cret-pass")+" rejected", line["ERROR"])
+	assert.NotContains(t, buf.String(), "s3cret-pass")
+}
+
+func TestSetLevel(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewWithWriter(&buf)
+	l.SetLevel(slog.LevelInfo)
+	l.Debug("hidden")
+	l.Info("shown")
+	assert.Equal(t, "LEVEL=INFO MESSAGE=shown\n", buf.String())
+}
+
+func TestWith_AddsFieldsToEveryLine(t *testing.T) {
+	var buf bytes.Buffer
+	root := NewWithWriter(&buf)
+	l := root.With(RunID("abc123"))
+	l.Info("first", VM("vm-alice"))
+	l.Error("second")
+	root.Info("root")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 3)
+	assert.Equal(t, "LEVEL=INFO MESSAGE=first RUN_ID=abc123 VM=vm-alice", lines[0])
+	assert.Equal(t, "LEVEL=ERROR MESSAGE=second RUN_ID=abc123", lines[1])
+	assert.Equal(t, "LEVEL=INFO MESSAGE=root", lines[2])
+}
+
+func TestWith_SharesSecrets(t *testing.T) {
+	var buf bytes.Buffer
+	root := NewWithWriter(&buf)
+	l := root.With(RunID("abc123"))
+	root.AddSecret("hunter22")
+	l.Info("login with hunter22")
+	assert.NotContains(t, buf.String(), "hunter22")
+}
+
+func TestNewWithHandler(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewWithHandler(slog.NewJSONHandler(&buf, nil))
+	l.AddSecret("hunter22")
+	l.Info("token hunter22", F("ok", true))
+
+	var line map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+	assert.Equal(t, "token "+Fingerprint("hunter22"), line["msg"])
+	assert.Equal(t, true, line["ok"])
+}
+
+func TestNewRunID(t *testing.T) {
+	a, b := NewRunID(), NewRunID()
+	assert.Len(t, a, 16)
+	assert.NotEqual(t, a, b)
+}
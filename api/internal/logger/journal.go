@@ -0,0 +1,178 @@
+package logger
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// journalSocket is the journald native protocol socket.
+var journalSocket = "/run/systemd/journal/socket"
+
+// maxJournalFieldName is the longest field name journald accepts.
+const maxJournalFieldName = 64
+
+// reservedJournalFields are the fields every entry carries. Attributes with
+// these names are skipped so no field is written twice.
+var reservedJournalFields = map[string]bool{
+	"MESSAGE":           true,
+	"PRIORITY":          true,
+	"LEVEL":             true,
+	"SYSLOG_IDENTIFIER": true,
+}
+
+// JournalHandler is a slog handler that sends every line to journald over
+// its native socket protocol, so each field becomes a journal field that
+// journalctl can match on, e.g. journalctl USER=lab-user-2. Levels become
+// syslog priorities. Lines journald does not take, e.g. because it is not
+// running, are written to a fallback writer in the text format instead.
+type JournalHandler struct {
+	conn       *net.UnixConn
+	addr       *net.UnixAddr
+	identifier string
+	fallback   io.Writer
+	attrs      []slog.Attr // keys already carry their group prefix
+	prefix     string      // from WithGroup, for record attrs
+}
+
+// NewJournalHandler returns a handler sending to the journald socket at
+// path, with SYSLOG_IDENTIFIER set to identifier.
+func NewJournalHandler(path, identifier string, fallback io.Writer) (*JournalHandler, error) {
+	// An unbound datagram socket; every line is sent to path.
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open journald socket: %w", err)
+	}
+	return &JournalHandler{
+		conn:       conn,
+		addr:       &net.UnixAddr{Name: path, Net: "unixgram"},
+		identifier: identifier,
+		fallback:   fallback,
+	}, nil
+}
+
+// Enabled reports true for every level; the logger filters levels.
+func (h *JournalHandler) Enabled(context.Context, slog.Level) bool {
+	return true
+}
+
+// Handle sends r as one journal entry.
+func (h *JournalHandler) Handle(_ context.Context, r slog.Record) error {
+	var buf bytes.Buffer
+	writeJournalField(&buf, "MESSAGE", r.Message)
+	writeJournalField(&buf, "PRIORITY", fmt.Sprint(journalPriority(r.Level)))
+	writeJournalField(&buf, "LEVEL", levelName(r.Level))
+	if h.identifier != "" {
+		writeJournalField(&buf, "SYSLOG_IDENTIFIER", h.identifier)
+	}
+	line := fmt.Sprintf("LEVEL=%s MESSAGE=%s", levelName(r.Level), r.Message)
+	add := func(name string, v slog.Value) {
+		key := journalFieldName(name)
+		if key == "" || reservedJournalFields[key] {
+			return
+		}
+		value := v.Resolve().String()
+		writeJournalField(&buf, key, value)
+		line += fmt.Sprintf(" %s=%s", name, value)
+	}
+	for _, a := range h.attrs {
+		add(a.Key, a.Value)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		add(h.prefix+a.Key, a.Value)
+		return true
+	})
+
+	if _, err := h.conn.WriteToUnix(buf.Bytes(), h.addr); err != nil {
+		if h.fallback != nil {
+			_, _ = fmt.Fprintln(h.fallback, line)
+		}
+		return err
+	}
+	return nil
+}
+
+// WithAttrs returns a handler adding attrs to every entry.
+func (h *JournalHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	child := *h
+	child.attrs = append(append([]slog.Attr(nil), h.attrs...), attrs...)
+	for i := len(h.attrs); i < len(child.attrs); i++ {
+		child.attrs[i].Key = h.prefix + child.attrs[i].Key
+	}
+	return &child
+}
+
+// WithGroup returns a handler prefixing the following fields with name.
+func (h *JournalHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	child := *h
+	child.prefix = h.prefix + name + "_"
+	return &child
+}
+
+// Close closes the socket.
+func (h *JournalHandler) Close() error {
+	return h.conn.Close()
+}
+
+// journalPriority maps a level to a syslog priority.
+func journalPriority(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return 3
+	case level >= slog.LevelWarn:
+		return 4
+	case level >= slog.LevelInfo:
+		return 6
+	default:
+		return 7
+	}
+}
+
+// journalFieldName turns key into a valid journal field name: upper case
+// letters, digits and underscores, not starting with an underscore or a
+// digit. It returns "" when nothing is left.
+func journalFieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+	name = strings.TrimLeft(name, "_0123456789")
+	if len(name) > maxJournalFieldName {
+		name = name[:maxJournalFieldName]
+	}
+	return name
+}
+
+// writeJournalField appends a field in the native protocol: KEY=value on
+// one line, or for values with a newline the key, the little-endian 64-bit
+// length and the raw value.
+func writeJournalField(buf *bytes.Buffer, key, value string) {
+	if !strings.Contains(value, "\n") {
+		buf.WriteString(key + "=" + value + "\n")
+		return
+	}
+	buf.WriteString(key + "\n")
+	_ = binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value + "\n")
+}
+
+// journalIdentifier is the SYSLOG_IDENTIFIER of the process: its binary
+// name.
+func journalIdentifier() string {
+	return filepath.Base(os.Args[0])
+}
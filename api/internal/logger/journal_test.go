@@ -0,0 +1,193 @@
+package logger
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// listenJournal stands in for journald on a unix datagram socket and
+// returns its path and a function reading the next entry.
+func listenJournal(t *testing.T) (string, func() map[string]string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "journal.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return path, func() map[string]string {
+		t.Helper()
+		buf := make([]byte, 64*1024)
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		n, err := conn.Read(buf)
+		require.NoError(t, err)
+		return parseJournalEntry(t, buf[:n])
+	}
+}
+
+// parseJournalEntry decodes a native protocol datagram, failing on a field
+// written twice.
+func parseJournalEntry(t *testing.T, b []byte) map[string]string {
+	t.Helper()
+	fields := map[string]string{}
+	for len(b) > 0 {
+		nl := bytes.IndexByte(b, '\n')
+		require.GreaterOrEqual(t, nl, 0)
+		line := b[:nl]
+		if key, value, ok := bytes.Cut(line, []byte("=")); ok {
+			require.NotContains(t, fields, string(key), "field written twice")
+			fields[string(key)] = string(value)
+			b = b[nl+1:]
+			continue
+		}
+		size := binary.LittleEndian.Uint64(b[nl+1 : nl+9])
+		require.NotContains(t, fields, string(line), "field written twice")
+		fields[string(line)] = string(b[nl+9 : nl+9+int(size)])
+		b = b[nl+9+int(size)+1:]
+	}
+	return fields
+}
+
+func TestJournal_FieldsAndPriority(t *testing.T) {
+	path, next := listenJournal(t)
+	h, err := NewJournalHandler(path, "esxi-lab", nil)
+	require.NoError(t, err)
+	defer func() { _ = h.Close() }()
+
+	l := NewWithHandler(h).With(RunID("abc123"))
+	l.Warn("Password rotated", Action("rotate"), Status("success"), VM("vm-alice"), User("lab-user-2"), Password("s3cret-pass"), F("file", "x.toml"))
+
+	e := next()
+	assert.Equal(t, "Password rotated", e["MESSAGE"])
+	assert.Equal(t, "4", e["PRIORITY"])
+	assert.Equal(t, "WARNING", e["LEVEL"])
+	assert.Equal(t, "esxi-lab", e["SYSLOG_IDENTIFIER"])
+	assert.Equal(t, "abc123", e["RUN_ID"])
+	assert.Equal(t, "rotate", e["ACTION"])
+	assert.Equal(t, "success", e["STATUS"])
+	assert.Equal(t, "vm-alice", e["VM"])
+	assert.Equal(t, "lab-user-2", e["USER"])
+	assert.Equal(t, Fingerprint("s3cret-pass"), e["PASSWORD"])
+	assert.Equal(t, "x.toml", e["FILE"])
+}
+
+func TestJournal_ReservedFieldsNotOverwritten(t *testing.T) {
+	path, next := listenJournal(t)
+	h, err := NewJournalHandler(path, "esxi-lab", nil)
+	require.NoError(t, err)
+	defer func() { _ = h.Close() }()
+
+	NewWithHandler(h).Info("Run started", F("message", "other"), F("PRIORITY", "0"), F("level", "x"), F("syslog_identifier", "y"), User("lab-user-1"))
+	e := next()
+	assert.Equal(t, "Run started", e["MESSAGE"])
+	assert.Equal(t, "6", e["PRIORITY"])
+	assert.Equal(t, "INFO", e["LEVEL"])
+	assert.Equal(t, "esxi-lab", e["SYSLOG_IDENTIFIER"])
+	assert.Equal(t, "lab-user-1", e["USER"])
+}
+
+func TestJournal_GroupThenAttrs(t *testing.T) {
+	path, next := listenJournal(t)
+	h, err := NewJournalHandler(path, "", nil)
+	require.NoError(t, err)
+	defer func() { _ = h.Close() }()
+
+	grouped := h.WithGroup("vm").WithAttrs([]slog.Attr{slog.String("name", "Pod-1_Client")})
+	require.NoError(t, grouped.Handle(context.Background(), slog.NewRecord(time.Now(), slog.LevelInfo, "m", 0)))
+	e := next()
+	assert.Equal(t, "Pod-1_Client", e["VM_NAME"])
+	assert.NotContains(t, e, "VM_VM_NAME")
+}
+
+func TestJournal_AttrsThenGroup(t *testing.T) {
+	path, next := listenJournal(t)
+	h, err := NewJournalHandler(path, "", nil)
+	require.NoError(t, err)
+	defer func() { _ = h.Close() }()
+
+	grouped := h.WithAttrs([]slog.Attr{slog.String("run_id", "abc")}).WithGroup("vm")
+	r := slog.NewRecord(time.Now(), slog.LevelInfo, "m", 0)
+	r.AddAttrs(slog.String("name", "Pod-1_Client"))
+	require.NoError(t, grouped.Handle(context.Background(), r))
+	e := next()
+	assert.Equal(t, "abc", e["RUN_ID"], "attrs added before the group keep their name")
+	assert.NotContains(t, e, "VM_RUN_ID")
+	assert.Equal(t, "Pod-1_Client", e["VM_NAME"])
+}
+
+func TestJournal_Priorities(t *testing.T) {
+	path, next := listenJournal(t)
+	h, err := NewJournalHandler(path, "", nil)
+	require.NoError(t, err)
+	defer func() { _ = h.Close() }()
+
+	l := NewWithHandler(h)
+	l.Debug("d")
+	l.Info("i")
+	l.Error("e")
+	assert.Equal(t, "7", next()["PRIORITY"])
+	assert.Equal(t, "6", next()["PRIORITY"])
+	e := next()
+	assert.Equal(t, "3", e["PRIORITY"])
+	assert.NotContains(t, e, "SYSLOG_IDENTIFIER")
+}
+
+func TestJournal_MultilineValue(t *testing.T) {
+	path, next := listenJournal(t)
+	h, err := NewJournalHandler(path, "", nil)
+	require.NoError(t, err)
+	defer func() { _ = h.Close() }()
+
+	NewWithHandler(h).Error("Restore failed", F("ERROR", "line one\nline two"))
+	e := next()
+	assert.Equal(t, "line one\nline two", e["ERROR"])
+	assert.Equal(t, "Restore failed", e["MESSAGE"])
+}
+
+func TestJournal_FallbackWhenSocketMissing(t *testing.T) {
+	var buf bytes.Buffer
+	h, err := NewJournalHandler(filepath.Join(t.TempDir(), "missing.sock"), "", &buf)
+	require.NoError(t, err)
+	defer func() { _ = h.Close() }()
+
+	NewWithHandler(h).Info("Run started", User("alice"))
+	assert.Equal(t, "LEVEL=INFO MESSAGE=Run started USER=alice\n", buf.String())
+}
+
+func TestSetFormat_Journald(t *testing.T) {
+	path, next := listenJournal(t)
+	old := journalSocket
+	journalSocket = path
+	defer func() { journalSocket = old }()
+
+	var buf bytes.Buffer
+	l := NewWithWriter(&buf)
+	require.NoError(t, l.SetFormat(FormatJournald))
+	l.Info("hello", User("bob"))
+	e := next()
+	assert.Equal(t, "hello", e["MESSAGE"])
+	assert.Equal(t, "bob", e["USER"])
+	assert.Empty(t, buf.String())
+}
+
+func TestJournalFieldName(t *testing.T) {
+	for in, want := range map[string]string{
+		"USER":      "USER",
+		"file":      "FILE",
+		"vm.name":   "VM_NAME",
+		"_PID":      "PID",
+		"9lives":    "LIVES",
+		"!!!":       "",
+		"TEST_MAIL": "TEST_MAIL",
+	} {
+		assert.Equal(t, want, journalFieldName(in), in)
+	}
+}
@@ -3,52 +3,70 @@ package logger
 import (
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
+	"slices"
 )
 
 // Logger provides structured logging for journald
 type Logger struct {
-	writer io.Writer
+	writer  io.Writer
+	handler slog.Handler // nil for FormatText
+	level   slog.Level
+	fields  []Field // added to every line, see With
+	secrets *secretSet
+	reveal  bool
 }
 
 // New creates a new logger instance
 func New() *Logger {
-	return &Logger{
-		writer: os.Stdout,
-	}
+	return NewWithWriter(os.Stdout)
 }
 
 // NewWithWriter creates a logger with a custom writer
 func NewWithWriter(w io.Writer) *Logger {
 	return &Logger{
-		writer: w,
+		writer:  w,
+		level:   slog.LevelDebug,
+		secrets: &secretSet{values: make(map[string]struct{})},
 	}
 }
 
 // Info logs informational messages
 func (l *Logger) Info(msg string, fields ...Field) {
-	l.log("INFO", msg, fields...)
+	l.log(slog.LevelInfo, msg, fields...)
 }
 
 // Error logs error messages
 func (l *Logger) Error(msg string, fields ...Field) {
-	l.log("ERROR", msg, fields...)
+	l.log(slog.LevelError, msg, fields...)
 }
 
 // Warn logs warning messages
 func (l *Logger) Warn(msg string, fields ...Field) {
-	l.log("WARNING", msg, fields...)
+	l.log(slog.LevelWarn, msg, fields...)
 }
 
 // Debug logs debug messages
 func (l *Logger) Debug(msg string, fields ...Field) {
-	l.log("DEBUG", msg, fields...)
+	l.log(slog.LevelDebug, msg, fields...)
 }
 
-func (l *Logger) log(level, msg string, fields ...Field) {
-	output := fmt.Sprintf("LEVEL=%s MESSAGE=%s", level, msg)
+func (l *Logger) log(level slog.Level, msg string, fields ...Field) {
+	if level < l.level {
+		return
+	}
+	// Register secret fields first, so their values are also caught in the
+	// message and the other fields of the same line.
+	l.registerSecrets(fields)
+	fields = append(slices.Clip(l.fields), fields...)
+	if l.handler != nil {
+		l.handle(level, l.scrub(msg), fields)
+		return
+	}
+	output := fmt.Sprintf("LEVEL=%s MESSAGE=%s", levelName(level), l.scrub(msg))
 	for _, field := range fields {
-		output += fmt.Sprintf(" %s=%v", field.Key, field.Value)
+		output += fmt.Sprintf(" %s=%s", field.Key, l.render(field.Value))
 	}
 	_, _ = fmt.Fprintln(l.writer, output)
 }
@@ -72,10 +90,11 @@ func User(value string) Field       { return F("USER", value) }
 func Count(value int) Field         { return F("COUNT", value) }
 func Error(value error) Field       { return F("ERROR", value) }
 func Snapshot(value string) Field   { return F("SNAPSHOT", value) }
-func Password(value string) Field   { return F("PASSWORD", value) }
+func Password(value string) Field   { return F("PASSWORD", Secret(value)) }
 func VMIndex(value int) Field       { return F("VM_INDEX", value) }
 func Events(value int) Field        { return F("EVENTS", value) }
 func Restored(value int) Field      { return F("RESTORED", value) }
 func Failed(value int) Field        { return F("FAILED", value) }
 func TimeWindow(value string) Field { return F("TIME_WINDOW", value) }
 func Reason(value string) Field     { return F("REASON", value) }
+func RunID(value string) Field      { return F("RUN_ID", value) }
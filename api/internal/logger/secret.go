@@ -0,0 +1,103 @@
+package logger
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// minSecretLength is the shortest value treated as a known secret; shorter
+// values would redact unrelated text.
+const minSecretLength = 4
+
+// Secret is a field value that is never written in clear text. It is
+// logged as a short fingerprint of the value, so support can tell whether
+// two lines carry the same secret or match one they hold, without the log
+// revealing it.
+type Secret string
+
+// String returns the redacted form of the secret.
+func (s Secret) String() string {
+	return Fingerprint(string(s))
+}
+
+// Fingerprint returns the redacted form of value: the first eight hex
+// digits of its SHA-256, e.g. "[REDACTED:9f86d081]".
+func Fingerprint(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return "[REDACTED:" + hex.EncodeToString(sum[:4]) + "]"
+}
+
+// secretSet holds the known secret values of a logger.
+type secretSet struct {
+	mu     sync.RWMutex
+	values map[string]struct{}
+}
+
+// AddSecret registers values that must never appear in the log, such as
+// credentials read from the environment. Every message and field is
+// scanned for them and each occurrence replaced by its fingerprint. Values
+// logged as a Secret field are registered automatically.
+func (l *Logger) AddSecret(values ...string) {
+	l.secrets.mu.Lock()
+	defer l.secrets.mu.Unlock()
+	for _, v := range values {
+		if len(v) >= minSecretLength {
+			l.secrets.values[v] = struct{}{}
+		}
+	}
+}
+
+// registerSecrets adds the values of Secret fields to the known secrets.
+func (l *Logger) registerSecrets(fields []Field) {
+	for _, field := range fields {
+		if secret, ok := field.Value.(Secret); ok {
+			l.AddSecret(string(secret))
+		}
+	}
+}
+
+// RevealSecrets makes the logger write secrets in clear text. It is meant
+// for debugging a single run only.
+func (l *Logger) RevealSecrets() {
+	l.reveal = true
+}
+
+// render formats a field value, redacting secrets.
+func (l *Logger) render(value any) string {
+	if secret, ok := value.(Secret); ok {
+		if l.reveal {
+			return string(secret)
+		}
+		return secret.String()
+	}
+	return l.scrub(fmt.Sprintf("%v", value))
+}
+
+// scrub replaces every known secret in s by its fingerprint. Longer
+// secrets are replaced first, so a secret containing another is not
+// partially revealed.
+func (l *Logger) scrub(s string) string {
+	if l.reveal {
+		return s
+	}
+	l.secrets.mu.RLock()
+	defer l.secrets.mu.RUnlock()
+	var found []string
+	for v := range l.secrets.values {
+		if strings.Contains(s, v) {
+			found = append(found, v)
+		}
+	}
+	if len(found) == 0 {
+		return s
+	}
+	slices.SortFunc(found, func(a, b string) int { return len(b) - len(a) })
+	for _, v := range found {
+		s = strings.ReplaceAll(s, v, Fingerprint(v))
+	}
+	return s
+}
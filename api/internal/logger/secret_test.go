@@ -0,0 +1,54 @@
+package logger
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPassword_Redacted(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewWithWriter(&buf)
+	l.Info("User password rotated", User("lab-user-1"), Password("S3cret-pass"))
+	output := buf.String()
+	assert.NotContains(t, output, "S3cret-pass")
+	assert.Contains(t, output, "PASSWORD="+Fingerprint("S3cret-pass"))
+	assert.Regexp(t, `PASSWORD=\[REDACTED:[0-9a-f]{8}\]`, output)
+}
+
+func TestKnownSecretsScrubbedFromOtherFields(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewWithWriter(&buf)
+	l.AddSecret("api-secret-123", "x")
+	l.Info("Rotated", Password("S3cret-pass"))
+	buf.Reset()
+
+	l.Error("login failed for S3cret-pass",
+		Error(errors.New("POST /api?secret=api-secret-123: 401")),
+		F("DETAIL", "x marks the spot"))
+	output := buf.String()
+	assert.NotContains(t, output, "S3cret-pass", "secret logged earlier is remembered")
+	assert.NotContains(t, output, "api-secret-123")
+	assert.Contains(t, output, "secret="+Fingerprint("api-secret-123")+": 401")
+	assert.Contains(t, output, "DETAIL=x marks the spot", "values shorter than the minimum are not secrets")
+}
+
+func TestScrub_LongestSecretFirst(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewWithWriter(&buf)
+	l.AddSecret("abcd", "abcdefgh")
+	l.Info("token abcdefgh")
+	assert.Equal(t, "LEVEL=INFO MESSAGE=token "+Fingerprint("abcdefgh")+"\n", buf.String())
+}
+
+func TestRevealSecrets(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewWithWriter(&buf)
+	l.AddSecret("api-secret-123")
+	l.RevealSecrets()
+	l.Debug("revealed", Password("S3cret-pass"), F("KEY", "api-secret-123"))
+	assert.Contains(t, buf.String(), "PASSWORD=S3cret-pass")
+	assert.Contains(t, buf.String(), "KEY=api-secret-123")
+}
@@ -0,0 +1,124 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	gcpexporter "github.com/GoogleCloudPlatform/opentelemetry-operations-go/exporter/metric"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	otelprom "go.opentelemetry.io/otel/exporters/prometheus"
+	"go.opentelemetry.io/otel/exporters/stdout/stdoutmetric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+)
+
+// Exporters selectable with METRICS_EXPORTER.
+const (
+	ExporterGCP        = "gcp"
+	ExporterPrometheus = "prometheus"
+	ExporterOTLPHTTP   = "otlp-http"
+	ExporterOTLPGRPC   = "otlp-grpc"
+	ExporterStdout     = "stdout"
+	ExporterNone       = "none"
+)
+
+const defaultPrometheusAddr = ":9464"
+
+// Config selects where metrics are exported.
+type Config struct {
+	// Exporter is one of the Exporter constants (default ExporterGCP).
+	Exporter string
+	// PrometheusAddr is the listen address of the /metrics endpoint
+	// (default ":9464").
+	PrometheusAddr string
+
+	// stdout receives the stdout exporter's output (default os.Stdout).
+	stdout io.Writer
+}
+
+// ConfigFromEnv reads METRICS_EXPORTER and METRICS_PROMETHEUS_ADDR. The
+// OTLP exporters read the standard OTEL_EXPORTER_OTLP_* variables
+// themselves, e.g. OTEL_EXPORTER_OTLP_ENDPOINT.
+func ConfigFromEnv() Config {
+	return Config{
+		Exporter:       strings.ToLower(strings.TrimSpace(os.Getenv("METRICS_EXPORTER"))),
+		PrometheusAddr: os.Getenv("METRICS_PROMETHEUS_ADDR"),
+	}
+}
+
+// Name returns Exporter, or the default when unset.
+func (c Config) Name() string {
+	if c.Exporter == "" {
+		return ExporterGCP
+	}
+	return c.Exporter
+}
+
+// Disabled reports whether metrics are turned off.
+func (c Config) Disabled() bool {
+	return c.Name() == ExporterNone
+}
+
+// newReader returns the reader for the configured exporter and a function
+// releasing what the reader needs besides the provider, such as the
+// Prometheus HTTP server.
+func newReader(ctx context.Context, cfg Config) (sdkmetric.Reader, func(context.Context) error, error) {
+	noop := func(context.Context) error { return nil }
+	var exporter sdkmetric.Exporter
+	var err error
+	switch cfg.Name() {
+	case ExporterGCP:
+		exporter, err = gcpexporter.New()
+	case ExporterOTLPHTTP:
+		exporter, err = otlpmetrichttp.New(ctx)
+	case ExporterOTLPGRPC:
+		exporter, err = otlpmetricgrpc.New(ctx)
+	case ExporterStdout:
+		w := cfg.stdout
+		if w == nil {
+			w = os.Stdout
+		}
+		exporter, err = stdoutmetric.New(stdoutmetric.WithWriter(w))
+	case ExporterPrometheus:
+		return newPrometheusReader(cfg)
+	default:
+		return nil, nil, fmt.Errorf("unknown metrics exporter %q (want %s, %s, %s, %s, %s or %s)", cfg.Exporter,
+			ExporterGCP, ExporterPrometheus, ExporterOTLPHTTP, ExporterOTLPGRPC, ExporterStdout, ExporterNone)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("create %s exporter: %w", cfg.Name(), err)
+	}
+	return sdkmetric.NewPeriodicReader(exporter), noop, nil
+}
+
+// newPrometheusReader serves the metrics on /metrics at PrometheusAddr for
+// as long as the process runs. The returned function stops the server.
+func newPrometheusReader(cfg Config) (sdkmetric.Reader, func(context.Context) error, error) {
+	reg := prometheus.NewRegistry()
+	exporter, err := otelprom.New(otelprom.WithRegisterer(reg))
+	if err != nil {
+		return nil, nil, fmt.Errorf("create prometheus exporter: %w", err)
+	}
+	addr := cfg.PrometheusAddr
+	if addr == "" {
+		addr = defaultPrometheusAddr
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("listen on %s for prometheus: %w", addr, err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	// Serve returns once the server is shut down.
+	go func() { _ = srv.Serve(ln) }()
+	return exporter, srv.Shutdown, nil
+}
@@ -0,0 +1,88 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// freeAddr returns a local address no one is listening on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	require.NoError(t, ln.Close())
+	return addr
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Setenv("METRICS_EXPORTER", " Prometheus ")
+	t.Setenv("METRICS_PROMETHEUS_ADDR", "127.0.0.1:9999")
+	cfg := ConfigFromEnv()
+	assert.Equal(t, ExporterPrometheus, cfg.Name())
+	assert.Equal(t, "127.0.0.1:9999", cfg.PrometheusAddr)
+	assert.False(t, cfg.Disabled())
+
+	assert.Equal(t, ExporterGCP, Config{}.Name())
+	assert.True(t, Config{Exporter: ExporterNone}.Disabled())
+}
+
+func TestInitProvider_UnknownExporter(t *testing.T) {
+	_, _, err := InitProvider(context.Background(), Config{Exporter: "statsd"})
+	assert.ErrorContains(t, err, `unknown metrics exporter "statsd"`)
+}
+
+func TestInitProvider_Prometheus(t *testing.T) {
+	ctx := context.Background()
+	addr := freeAddr(t)
+	meter, shutdown, err := InitProvider(ctx, Config{Exporter: ExporterPrometheus, PrometheusAddr: addr})
+	require.NoError(t, err)
+
+	m, err := New(meter)
+	require.NoError(t, err)
+	m.VMRestoreTotal.Add(ctx, 2, metric.WithAttributes(attribute.String("status", "success")))
+
+	resp, err := http.Get("http://" + addr + "/metrics")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, string(body), `lab_vm_restore_total{`)
+	assert.Contains(t, string(body), `status="success"`)
+
+	require.NoError(t, shutdown(ctx))
+	_, err = http.Get("http://" + addr + "/metrics")
+	assert.Error(t, err, "endpoint stops on shutdown")
+}
+
+func TestInitProvider_PrometheusAddrInUse(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = ln.Close() }()
+
+	_, _, err = InitProvider(context.Background(), Config{Exporter: ExporterPrometheus, PrometheusAddr: ln.Addr().String()})
+	assert.ErrorContains(t, err, "listen on")
+}
+
+func TestInitProvider_Stdout(t *testing.T) {
+	ctx := context.Background()
+	var buf bytes.Buffer
+	meter, shutdown, err := InitProvider(ctx, Config{Exporter: ExporterStdout, stdout: &buf})
+	require.NoError(t, err)
+
+	m, err := New(meter)
+	require.NoError(t, err)
+	m.RunTotal.Add(ctx, 1)
+	require.NoError(t, shutdown(ctx))
+	assert.Contains(t, buf.String(), "lab.run.total")
+}
@@ -1,7 +1,8 @@
 // Package metrics defines all application metrics and provides helpers for
 // initialising and shutting down the OTel MeterProvider for batch (cron)
-// runs. Metrics are exported directly to Google Cloud Monitoring via the
-// GoogleCloud OTel exporter — no collector daemon is required.
+// runs. By default metrics are exported directly to Google Cloud Monitoring
+// via the GoogleCloud OTel exporter — no collector daemon is required.
+// METRICS_EXPORTER selects a Prometheus endpoint, OTLP or stdout instead.
 //
 // Each Run() call is a fresh process, so counters use delta temporality:
 // every run reports its own increments rather than a lifetime total.
@@ -10,9 +11,9 @@ package metrics
 
 import (
 	"context"
+	"errors"
 	"fmt"
 
-	gcpexporter "github.com/GoogleCloudPlatform/opentelemetry-operations-go/exporter/metric"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/metric"
 	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
@@ -32,13 +33,30 @@ type Metrics struct {
 	PasswordRotateTotal  metric.Int64Counter
 
 	// Tier-2: operational visibility
-	WireGuardKeyRotateTotal metric.Int64Counter
-	WireGuardPeerRegTotal   metric.Int64Counter
-	CalendarFetchDuration   metric.Float64Histogram
+	WireGuardKeyRotateTotal  metric.Int64Counter
+	WireGuardPeerRegTotal    metric.Int64Counter
+	CalendarFetchDuration    metric.Float64Histogram
+	PodValidationTotal       metric.Int64Counter
+	VMPowerActionTotal       metric.Int64Counter
+	SnapshotWarningTotal     metric.Int64Counter
+	SnapshotConsolidateTotal metric.Int64Counter
+	VMPermissionChangeTotal  metric.Int64Counter
 
 	// Tier-3: inventory / nice-to-have
 	VMInventoryTotal metric.Int64UpDownCounter
 	RunTotal         metric.Int64Counter
+
+	// Usage: sampled by the usage command
+	VMCPUUsage          metric.Float64Gauge
+	VMMemoryUsage       metric.Float64Gauge
+	VMDiskThroughput    metric.Int64Gauge
+	VMNetworkThroughput metric.Int64Gauge
+	PodSessionActive    metric.Int64Gauge
+
+	// Snapshot health: recorded per pod VM by the snapshot health check
+	VMSnapshotDepth     metric.Int64Gauge
+	VMSnapshotDeltaSize metric.Int64Gauge
+	DatastoreFree       metric.Float64Gauge
 }
 
 // New creates all OTel instruments using the given meter.
@@ -114,6 +132,41 @@ func New(meter metric.Meter) (*Metrics, error) {
 		return nil, fmt.Errorf("lab.calendar.fetch.duration: %w", err)
 	}
 
+	if m.PodValidationTotal, err = meter.Int64Counter(
+		"lab.pod.validation.total",
+		metric.WithDescription("Number of pods validated against their template, by status and reason"),
+	); err != nil {
+		return nil, fmt.Errorf("lab.pod.validation.total: %w", err)
+	}
+
+	if m.VMPowerActionTotal, err = meter.Int64Counter(
+		"lab.vm.power.action.total",
+		metric.WithDescription("Number of VM power actions taken by idle power management, by action and status"),
+	); err != nil {
+		return nil, fmt.Errorf("lab.vm.power.action.total: %w", err)
+	}
+
+	if m.SnapshotWarningTotal, err = meter.Int64Counter(
+		"lab.vm.snapshot.warning.total",
+		metric.WithDescription("Number of snapshot chain warnings raised by the snapshot health check, by kind"),
+	); err != nil {
+		return nil, fmt.Errorf("lab.vm.snapshot.warning.total: %w", err)
+	}
+
+	if m.SnapshotConsolidateTotal, err = meter.Int64Counter(
+		"lab.vm.snapshot.consolidate.total",
+		metric.WithDescription("Number of VM disk consolidations attempted, by status"),
+	); err != nil {
+		return nil, fmt.Errorf("lab.vm.snapshot.consolidate.total: %w", err)
+	}
+
+	if m.VMPermissionChangeTotal, err = meter.Int64Counter(
+		"lab.vm.permission.change.total",
+		metric.WithDescription("Number of time-boxed VM permissions granted or revoked, by action and status"),
+	); err != nil {
+		return nil, fmt.Errorf("lab.vm.permission.change.total: %w", err)
+	}
+
 	// Tier-3
 	if m.VMInventoryTotal, err = meter.Int64UpDownCounter(
 		"lab.vm.inventory.total",
@@ -129,34 +182,100 @@ func New(meter metric.Meter) (*Metrics, error) {
 		return nil, fmt.Errorf("lab.run.total: %w", err)
 	}
 
+	// Usage
+	if m.VMCPUUsage, err = meter.Float64Gauge(
+		"lab.vm.cpu.usage",
+		metric.WithDescription("CPU usage of a lab VM as a percentage of its configured vCPUs"),
+		metric.WithUnit("%"),
+	); err != nil {
+		return nil, fmt.Errorf("lab.vm.cpu.usage: %w", err)
+	}
+
+	if m.VMMemoryUsage, err = meter.Float64Gauge(
+		"lab.vm.memory.usage",
+		metric.WithDescription("Active memory of a lab VM as a percentage of its configured memory"),
+		metric.WithUnit("%"),
+	); err != nil {
+		return nil, fmt.Errorf("lab.vm.memory.usage: %w", err)
+	}
+
+	if m.VMDiskThroughput, err = meter.Int64Gauge(
+		"lab.vm.disk.throughput",
+		metric.WithDescription("Disk throughput of a lab VM"),
+		metric.WithUnit("KBy/s"),
+	); err != nil {
+		return nil, fmt.Errorf("lab.vm.disk.throughput: %w", err)
+	}
+
+	if m.VMNetworkThroughput, err = meter.Int64Gauge(
+		"lab.vm.network.throughput",
+		metric.WithDescription("Network throughput of a lab VM"),
+		metric.WithUnit("KBy/s"),
+	); err != nil {
+		return nil, fmt.Errorf("lab.vm.network.throughput: %w", err)
+	}
+
+	if m.PodSessionActive, err = meter.Int64Gauge(
+		"lab.pod.session.active",
+		metric.WithDescription("1 if the pod is assigned to a booking active at sampling time, otherwise 0"),
+	); err != nil {
+		return nil, fmt.Errorf("lab.pod.session.active: %w", err)
+	}
+
+	// Snapshot health
+	if m.VMSnapshotDepth, err = meter.Int64Gauge(
+		"lab.vm.snapshot.depth",
+		metric.WithDescription("Depth of the snapshot a lab VM runs from"),
+	); err != nil {
+		return nil, fmt.Errorf("lab.vm.snapshot.depth: %w", err)
+	}
+
+	if m.VMSnapshotDeltaSize, err = meter.Int64Gauge(
+		"lab.vm.snapshot.delta.size",
+		metric.WithDescription("Total size of a lab VM's delta disks"),
+		metric.WithUnit("MBy"),
+	); err != nil {
+		return nil, fmt.Errorf("lab.vm.snapshot.delta.size: %w", err)
+	}
+
+	if m.DatastoreFree, err = meter.Float64Gauge(
+		"lab.datastore.free",
+		metric.WithDescription("Free space of a datastore holding lab VMs"),
+		metric.WithUnit("%"),
+	); err != nil {
+		return nil, fmt.Errorf("lab.datastore.free: %w", err)
+	}
+
 	return m, nil
 }
 
-// InitProvider initialises a Google Cloud Monitoring MeterProvider and
-// registers it as the global OTel provider. Call the returned shutdown
-// function (with a deadline context) before the process exits to flush
-// all metrics.
+// InitProvider initialises a MeterProvider exporting to the exporter
+// selected by cfg and registers it as the global OTel provider. Call the
+// returned shutdown function (with a deadline context) before the process
+// exits to flush all metrics.
 //
-// The GCP project and credentials are resolved automatically from
-// Application Default Credentials (GOOGLE_APPLICATION_CREDENTIALS env var
-// or the service account key deployed alongside the binary).
-func InitProvider(ctx context.Context) (meter metric.Meter, shutdown func(context.Context) error, err error) {
-	exporter, err := gcpexporter.New()
+// For the default Google Cloud Monitoring exporter, the GCP project and
+// credentials are resolved automatically from Application Default
+// Credentials (GOOGLE_APPLICATION_CREDENTIALS env var or the service
+// account key deployed alongside the binary).
+func InitProvider(ctx context.Context, cfg Config) (meter metric.Meter, shutdown func(context.Context) error, err error) {
+	reader, stop, err := newReader(ctx, cfg)
 	if err != nil {
-		return nil, nil, fmt.Errorf("create googlecloud exporter: %w", err)
+		return nil, nil, err
 	}
 
 	provider := sdkmetric.NewMeterProvider(
-		sdkmetric.WithReader(
-			sdkmetric.NewPeriodicReader(exporter),
-		),
+		sdkmetric.WithReader(reader),
 	)
 
 	otel.SetMeterProvider(provider)
 
 	meter = provider.Meter(instrumentationName)
 
-	return meter, provider.Shutdown, nil
+	shutdown = func(ctx context.Context) error {
+		return errors.Join(provider.Shutdown(ctx), stop(ctx))
+	}
+	return meter, shutdown, nil
 }
 
 // Noop returns a no-op meter. Use in tests or when metrics are disabled.
@@ -2,22 +2,74 @@ package models
 
 import "time"
 
-// VMSnapshot represents a snapshot of a virtual machine.
+// VMSnapshot represents a snapshot of a virtual machine. Snapshots keep the
+// tree structure of the vSphere snapshot hierarchy: each snapshot lists its
+// direct children.
 type VMSnapshot struct {
-	Name        string    `json:"name"`
-	Description string    `json:"description"`
-	Created     time.Time `json:"created"`
-	State       string    `json:"state"`
-	Quiesced    bool      `json:"quiesced"`
+	ID          string       `json:"id"`
+	Name        string       `json:"name"`
+	Description string       `json:"description"`
+	Created     time.Time    `json:"created"`
+	State       string       `json:"state"`
+	Quiesced    bool         `json:"quiesced"`
+	Current     bool         `json:"current"`
+	Children    []VMSnapshot `json:"children"`
 }
 
+// VM is the inventory view of a virtual machine. Field names and JSON keys
+// are part of the inventory output consumed by other tools; add new fields
+// rather than renaming existing ones.
 type VM struct {
-	Name      string       `json:"name"`
-	Snapshots []VMSnapshot `json:"snapshots"`
+	Name         string            `json:"name"`
+	InstanceUUID string            `json:"instance_uuid"`
+	PowerState   string            `json:"power_state"`
+	GuestOS      string            `json:"guest_os"`
+	IPAddresses  []string          `json:"ip_addresses"`
+	ToolsStatus  string            `json:"tools_status"`
+	Host         string            `json:"host"`
+	ResourcePool string            `json:"resource_pool"`
+	Folder       string            `json:"folder"`
+	Annotation   string            `json:"annotation"`
+	Attributes   map[string]string `json:"attributes"`
+	Snapshots    []VMSnapshot      `json:"snapshots"`
+}
+
+// AllSnapshots returns every snapshot of the VM in depth-first order,
+// parents before their children.
+func (vm VM) AllSnapshots() []VMSnapshot {
+	var result []VMSnapshot
+	var walk func([]VMSnapshot)
+	walk = func(tree []VMSnapshot) {
+		for _, s := range tree {
+			result = append(result, s)
+			walk(s.Children)
+		}
+	}
+	walk(vm.Snapshots)
+	return result
+}
+
+// CurrentSnapshot returns the snapshot the VM is currently running from, or
+// nil if the VM has no current snapshot.
+func (vm VM) CurrentSnapshot() *VMSnapshot {
+	for _, s := range vm.AllSnapshots() {
+		if s.Current {
+			return &s
+		}
+	}
+	return nil
+}
+
+// VMInventoryError records a VM whose properties could not be retrieved.
+type VMInventoryError struct {
+	VM    string `json:"vm,omitempty"`
+	Ref   string `json:"ref"`
+	Error string `json:"error"`
 }
 
 type VMListResponse struct {
-	ESXiName string `json:"esxi_name"`
-	TotalVMs int    `json:"total_vms"`
-	VMs      []VM   `json:"vms"`
+	ESXiName string             `json:"esxi_name"`
+	TotalVMs int                `json:"total_vms"`
+	VMs      []VM               `json:"vms"`
+	Errors   []VMInventoryError `json:"errors,omitempty"`
 }
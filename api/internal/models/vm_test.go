@@ -73,3 +73,79 @@ func TestVM_EmptySnapshots(t *testing.T) {
 	require.NoError(t, err)
 	assert.Contains(t, string(data), `"name":"empty-vm"`)
 }
+
+func TestVMListResponse_ErrorsOmittedWhenEmpty(t *testing.T) {
+	data, err := json.Marshal(VMListResponse{ESXiName: "esxi"})
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), `"errors"`)
+
+	data, err = json.Marshal(VMListResponse{Errors: []VMInventoryError{{VM: "vm1", Ref: "vm-1", Error: "boom"}}})
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"errors":[{"vm":"vm1","ref":"vm-1","error":"boom"}]`)
+}
+
+func TestVM_AllSnapshots_DepthFirst(t *testing.T) {
+	vm := VM{
+		Snapshots: []VMSnapshot{
+			{Name: "base", Children: []VMSnapshot{
+				{Name: "a", Children: []VMSnapshot{{Name: "a1"}}},
+				{Name: "b"},
+			}},
+			{Name: "other"},
+		},
+	}
+
+	var names []string
+	for _, s := range vm.AllSnapshots() {
+		names = append(names, s.Name)
+	}
+	assert.Equal(t, []string{"base", "a", "a1", "b", "other"}, names)
+}
+
+func TestVM_CurrentSnapshot(t *testing.T) {
+	vm := VM{
+		Snapshots: []VMSnapshot{
+			{Name: "base", Children: []VMSnapshot{{Name: "golden", Current: true}}},
+		},
+	}
+	current := vm.CurrentSnapshot()
+	require.NotNil(t, current)
+	assert.Equal(t, "golden", current.Name)
+
+	assert.Nil(t, VM{Snapshots: []VMSnapshot{{Name: "base"}}}.CurrentSnapshot())
+}
+
+func TestVM_JSONShape(t *testing.T) {
+	vm := VM{
+		Name:         "Pod-1_FortiGate",
+		PowerState:   "poweredOn",
+		GuestOS:      "Other Linux",
+		IPAddresses:  []string{"10.0.1.1"},
+		ToolsStatus:  "guestToolsRunning",
+		Host:         "esxi-01",
+		ResourcePool: "Resources",
+		Folder:       "vm",
+		Annotation:   "firewall",
+		Attributes:   map[string]string{"lab.pod": "1"},
+		Snapshots: []VMSnapshot{
+			{ID: "snap-1", Name: "golden", Current: true, Children: []VMSnapshot{}},
+		},
+	}
+
+	data, err := json.Marshal(vm)
+	require.NoError(t, err)
+
+	var raw map[string]any
+	require.NoError(t, json.Unmarshal(data, &raw))
+	for _, key := range []string{
+		"name", "power_state", "guest_os", "ip_addresses", "tools_status",
+		"host", "resource_pool", "folder", "annotation", "attributes", "snapshots",
+	} {
+		assert.Contains(t, raw, key)
+	}
+
+	snap := raw["snapshots"].([]any)[0].(map[string]any)
+	for _, key := range []string{"id", "name", "description", "created", "state", "quiesced", "current", "children"} {
+		assert.Contains(t, snap, key)
+	}
+}
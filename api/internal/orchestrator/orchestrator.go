@@ -3,7 +3,11 @@ package orchestrator
 import (
 	"context"
 	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
 	"strings"
+	"text/tabwriter"
 	"time"
 
 	"go.opentelemetry.io/otel/attribute"
@@ -31,10 +35,20 @@ type Orchestrator struct {
 	WireGuard  service.WireGuardManager
 	FeatureCfg *service.FeatureConfig
 	Metrics    *metrics.Metrics
+	// Health tracks pod failures across runs for quarantine. Nil disables
+	// quarantine; broken pods still lose their booking to a spare.
+	Health *service.HealthTracker
+
+	// refused holds the pods this run's capacity check left without room
+	// on their host. They take no booking and are not powered on.
+	refused map[string]bool
 }
 
 // Run executes the full orchestration: fetch inventory → check calendar →
-// restore all VMs → rotate passwords + send emails for active bookings.
+// validate pods → check host capacity → restore all VMs → rotate passwords →
+// check the new credentials while assigning bookings → grant booked users
+// their pod's VMs + send emails for active bookings → power idle pods down →
+// record the handover state.
 // Snapshot revert happens on every inventory host every run, regardless
 // of whether a booking exists.
 // Returns an error if any critical step fails.
@@ -51,6 +65,7 @@ func (o *Orchestrator) Run() error {
 			o.Logger.Error("Failed to close VMware service", logger.Error(cerr))
 		}
 	}()
+	defer o.saveHealth()
 
 	activeEvents, err := o.FetchActiveEvents()
 	if err != nil {
@@ -61,8 +76,15 @@ func (o *Orchestrator) Run() error {
 		o.Logger.Info("No active calendar events", logger.Action("calendar"), logger.Status("no_active_events"))
 	}
 
-	pairs := o.SelectAllVMs(vmList)
+	allPods := o.SelectAllVMs(vmList)
+	pairs, statuses := o.ValidatePods(vmList.VMs, allPods)
+	for _, status := range statuses {
+		if !status.Available() {
+			o.recordPodFailure(status.User, status.Reason())
+		}
+	}
 	if len(pairs) == 0 {
+		o.ReconcilePermissions(allPods, nil)
 		if len(activeEvents) > 0 {
 			o.recordRunOutcome(ctx_background(), time.Since(runStart), "failure")
 			return fmt.Errorf("no VMs available in inventory")
@@ -71,9 +93,17 @@ func (o *Orchestrator) Run() error {
 		return nil
 	}
 
-	if err := o.RestoreVMs(pairs, activeEvents); err != nil {
+	o.CheckCapacity(pairs, len(activeEvents))
+	results, bookings, restoreErr := o.restorePods(pairs, activeEvents)
+	booked := bookedUsers(results, bookings)
+	o.saveAssignment(results, bookings)
+	o.ReconcilePermissions(excludePods(allPods, pairs), nil)
+	o.CheckSnapshotHealth(pairs, booked, time.Now())
+	o.ManagePower(pairs, booked, time.Now())
+	o.RecordRun(results, bookings, runStart)
+	if restoreErr != nil {
 		o.recordRunOutcome(ctx_background(), time.Since(runStart), "failure")
-		return err
+		return restoreErr
 	}
 	o.recordRunOutcome(ctx_background(), time.Since(runStart), "success")
 	return nil
@@ -106,6 +136,15 @@ func (o *Orchestrator) FetchVMInventory() (*models.VMListResponse, error) {
 	o.Logger.Info("VM inventory fetched", logger.Action("startup"), logger.Status("vm_inventory"), logger.Count(len(vmList.VMs)))
 	o.LogVMInventory(vmList.VMs)
 
+	for _, invErr := range vmList.Errors {
+		o.Logger.Warn("VM missing from inventory",
+			logger.Action("startup"),
+			logger.Status("vm_inventory_partial"),
+			logger.VM(invErr.VM),
+			logger.F("REF", invErr.Ref),
+			logger.F("MESSAGE", invErr.Error))
+	}
+
 	if o.Metrics != nil {
 		o.Metrics.VMInventoryTotal.Add(context.Background(), int64(len(vmList.VMs)))
 	}
@@ -113,16 +152,33 @@ func (o *Orchestrator) FetchVMInventory() (*models.VMListResponse, error) {
 	return vmList, nil
 }
 
-// LogVMInventory logs details about each VM and its snapshots.
+// LogVMInventory logs details about each VM and its snapshot tree.
 func (o *Orchestrator) LogVMInventory(vms []models.VM) {
 	for _, vm := range vms {
-		o.Logger.Info("VM found", logger.VM(vm.Name), logger.F("SNAPSHOT_COUNT", len(vm.Snapshots)))
-		for _, snapshot := range vm.Snapshots {
-			o.Logger.Info("Snapshot details",
-				logger.Snapshot(snapshot.Name),
-				logger.F("STATE", snapshot.State),
-				logger.F("CREATED", snapshot.Created.Format("2006-01-02 15:04:05")))
+		o.Logger.Info("VM found",
+			logger.VM(vm.Name),
+			logger.F("POWER_STATE", vm.PowerState),
+			logger.F("HOST", vm.Host),
+			logger.F("SNAPSHOT_COUNT", len(vm.AllSnapshots())))
+		o.logSnapshotTree(vm.Snapshots, "")
+	}
+}
+
+// logSnapshotTree logs each snapshot with its parent so the hierarchy can be
+// reconstructed from the log.
+func (o *Orchestrator) logSnapshotTree(snapshots []models.VMSnapshot, parent string) {
+	for _, snapshot := range snapshots {
+		fields := []logger.Field{
+			logger.Snapshot(snapshot.Name),
+			logger.F("STATE", snapshot.State),
+			logger.F("CREATED", snapshot.Created.Format("2006-01-02 15:04:05")),
+			logger.F("CURRENT", snapshot.Current),
 		}
+		if parent != "" {
+			fields = append(fields, logger.F("PARENT", parent))
+		}
+		o.Logger.Info("Snapshot details", fields...)
+		o.logSnapshotTree(snapshot.Children, snapshot.Name)
 	}
 }
 
@@ -215,8 +271,8 @@ func FilterActiveEvents(events []*calendar.Event, now time.Time) []EventInfo {
 	return activeEvents
 }
 
-// SelectVMsToRestore selects which VMs to restore based on configured prefix mappings.
-// All inventory VMs whose names start with a configured prefix are included.
+// SelectVMsToRestore selects which VMs to restore based on the configured
+// selectors. All inventory VMs matching a user's selectors are included.
 func (o *Orchestrator) SelectVMsToRestore(vmList *models.VMListResponse, eventCount int) []service.UserVMPair {
 	pairs := o.SelectConfiguredVMs(vmList.VMs, eventCount)
 
@@ -230,15 +286,15 @@ func (o *Orchestrator) SelectVMsToRestore(vmList *models.VMListResponse, eventCo
 	return pairs
 }
 
-// SelectConfiguredVMs picks all inventory VMs whose names start with any of the
-// configured prefixes for each user, up to eventCount user-VM pairs.
+// SelectConfiguredVMs picks all inventory VMs matching each user's
+// selectors, up to eventCount user-VM pairs.
 func (o *Orchestrator) SelectConfiguredVMs(vms []models.VM, eventCount int) []service.UserVMPair {
 	var pairs []service.UserVMPair
 
-	for _, p := range o.FeatureCfg.ESXi.UserVMPairs() {
-		validVMs := FindVMsByPrefixes(vms, p.VMs)
+	for _, u := range o.FeatureCfg.ESXi.UserSelectors() {
+		validVMs := FindVMsBySelectors(vms, u.Selectors)
 		if len(validVMs) > 0 {
-			pairs = append(pairs, service.UserVMPair{User: p.User, VMs: validVMs})
+			pairs = append(pairs, service.UserVMPair{User: u.User, VMs: validVMs})
 			if len(pairs) >= eventCount {
 				break
 			}
@@ -251,10 +307,20 @@ func (o *Orchestrator) SelectConfiguredVMs(vms []models.VM, eventCount int) []se
 // FindVMsByPrefixes returns the names of all VMs from the inventory whose names
 // start with at least one of the given prefixes. Order matches the inventory order.
 func FindVMsByPrefixes(vms []models.VM, prefixes []string) []string {
+	selectors := make([]service.VMSelector, len(prefixes))
+	for i, prefix := range prefixes {
+		selectors[i] = service.VMSelector{Prefix: prefix}
+	}
+	return FindVMsBySelectors(vms, selectors)
+}
+
+// FindVMsBySelectors returns the names of all VMs from the inventory matched
+// by at least one of the selectors. Order matches the inventory order.
+func FindVMsBySelectors(vms []models.VM, selectors []service.VMSelector) []string {
 	var matched []string
 	for _, vm := range vms {
-		for _, prefix := range prefixes {
-			if strings.HasPrefix(vm.Name, prefix) {
+		for _, s := range selectors {
+			if s.Matches(vm) {
 				matched = append(matched, vm.Name)
 				break
 			}
@@ -263,67 +329,231 @@ func FindVMsByPrefixes(vms []models.VM, prefixes []string) []string {
 	return matched
 }
 
+// SelectorResolution lists the VMs one configured selector resolves to.
+type SelectorResolution struct {
+	User     string
+	Selector string
+	VMs      []string
+}
+
+// ResolveSelectors resolves every configured selector against the inventory,
+// in user order.
+func (o *Orchestrator) ResolveSelectors(vms []models.VM) []SelectorResolution {
+	var result []SelectorResolution
+	for _, u := range o.FeatureCfg.ESXi.UserSelectors() {
+		for _, s := range u.Selectors {
+			result = append(result, SelectorResolution{
+				User:     u.User,
+				Selector: s.String(),
+				VMs:      FindVMsBySelectors(vms, []service.VMSelector{s}),
+			})
+		}
+	}
+	return result
+}
+
+// WriteSelectorReport writes one line per selector with the VMs it resolves
+// to, marking selectors that match nothing.
+func WriteSelectorReport(w io.Writer, resolutions []SelectorResolution) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "USER\tSELECTOR\tVMS")
+	for _, r := range resolutions {
+		vms := strings.Join(r.VMs, ", ")
+		if vms == "" {
+			vms = "(none)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", r.User, r.Selector, vms)
+	}
+	return tw.Flush()
+}
+
+// PodStatus is the result of validating one pod against its template.
+type PodStatus struct {
+	User        string
+	Template    string
+	VMs         []string
+	Issues      []service.PodIssue
+	Spare       bool
+	Quarantined bool
+}
+
+// Available reports whether the pod matched its template.
+func (p PodStatus) Available() bool { return len(p.Issues) == 0 }
+
+// Reason joins the pod's issues for logs and reports.
+func (p PodStatus) Reason() string {
+	reasons := make([]string, len(p.Issues))
+	for i, issue := range p.Issues {
+		reasons[i] = issue.String()
+	}
+	return strings.Join(reasons, "; ")
+}
+
+// ValidatePods checks every pod against its pod template and returns the
+// pods that are complete, along with the status of every pod. Incomplete
+// pods are logged and left out, so they are neither restored nor assigned
+// to a booking. Pods without a template are always available.
+func (o *Orchestrator) ValidatePods(vms []models.VM, pairs []service.UserVMPair) ([]service.UserVMPair, []PodStatus) {
+	byName := make(map[string]models.VM, len(vms))
+	for _, vm := range vms {
+		byName[vm.Name] = vm
+	}
+
+	available := make([]service.UserVMPair, 0, len(pairs))
+	statuses := make([]PodStatus, 0, len(pairs))
+	for _, p := range pairs {
+		status := PodStatus{
+			User:        p.User,
+			VMs:         p.VMs,
+			Spare:       o.isSpare(p.User),
+			Quarantined: o.Health != nil && o.Health.Quarantined(p.User),
+		}
+		if t := o.FeatureCfg.ESXi.TemplateFor(p.User); t != nil {
+			podVMs := make([]models.VM, 0, len(p.VMs))
+			for _, name := range p.VMs {
+				podVMs = append(podVMs, byName[name])
+			}
+			status.Template = t.Name
+			status.Issues = t.Check(podVMs)
+		}
+		statuses = append(statuses, status)
+		o.recordPodValidation(status)
+
+		if status.Available() {
+			available = append(available, p)
+			continue
+		}
+		o.Logger.Warn("Pod unavailable",
+			logger.Action("pod_validation"),
+			logger.Status("unavailable"),
+			logger.User(p.User),
+			logger.F("TEMPLATE", status.Template),
+			logger.Reason(status.Reason()))
+	}
+	return available, statuses
+}
+
+// recordPodValidation records lab.pod.validation.total. Unavailable pods are
+// counted once per issue kind.
+func (o *Orchestrator) recordPodValidation(status PodStatus) {
+	if o.Metrics == nil {
+		return
+	}
+	ctx := context.Background()
+	if status.Available() {
+		o.Metrics.PodValidationTotal.Add(ctx, 1,
+			metric.WithAttributeSet(attribute.NewSet(attribute.String("status", "available"))))
+		return
+	}
+	seen := make(map[string]bool)
+	for _, issue := range status.Issues {
+		if seen[issue.Kind] {
+			continue
+		}
+		seen[issue.Kind] = true
+		o.Metrics.PodValidationTotal.Add(ctx, 1,
+			metric.WithAttributeSet(attribute.NewSet(
+				attribute.String("status", "unavailable"),
+				attribute.String("reason", issue.Kind),
+			)))
+	}
+}
+
+// WritePlan writes one line per pod with its template, status and, for
+// unavailable pods, the reason. Status is one of available, spare,
+// quarantined or unavailable.
+func WritePlan(w io.Writer, statuses []PodStatus) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "USER\tTEMPLATE\tSTATUS\tVMS\tREASON")
+	for _, p := range statuses {
+		template, state := p.Template, "available"
+		if template == "" {
+			template = "-"
+		}
+		switch {
+		case !p.Available():
+			state = "unavailable"
+		case p.Quarantined:
+			state = "quarantined"
+		case p.Spare:
+			state = "spare"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", p.User, template, state, strings.Join(p.VMs, ", "), p.Reason())
+	}
+	return tw.Flush()
+}
+
 // RestoreVMs restores VMs, rotates passwords, generates WireGuard configs,
 // and sends notification emails.
 func (o *Orchestrator) RestoreVMs(pairs []service.UserVMPair, activeEvents []EventInfo) error {
+	_, _, err := o.restorePods(pairs, activeEvents)
+	return err
+}
+
+// restorePods does the work of RestoreVMs and also returns the restore
+// results and, per result, the email of the booking it was given ("" for
+// none).
+func (o *Orchestrator) restorePods(pairs []service.UserVMPair, activeEvents []EventInfo) ([]service.RestoreResult, []string, error) {
 	eventCount := len(activeEvents)
-	snapshotName := "<latest>"
-	if o.FeatureCfg.ESXi.SnapshotName != nil {
-		snapshotName = *o.FeatureCfg.ESXi.SnapshotName
-	}
+	policy := o.FeatureCfg.ESXi.SnapshotPolicy()
 
-	// Build flat VM/user lists for the VMware service.
-	// The first VM per pair is paired with the user for password rotation;
-	// additional VMs per pair use an empty user (snapshot revert only).
-	var vmsToRestore []string
-	var usersForRestore []string
+	vmCount := 0
 	for _, p := range pairs {
-		for j, vm := range p.VMs {
-			vmsToRestore = append(vmsToRestore, vm)
-			if j == 0 {
-				usersForRestore = append(usersForRestore, p.User)
-			} else {
-				usersForRestore = append(usersForRestore, "")
-			}
-		}
+		vmCount += len(p.VMs)
 	}
 
 	o.Logger.Info("Starting VM restore",
 		logger.Action("restore"),
 		logger.Status("starting"),
 		logger.Events(eventCount),
-		logger.F("VMS_TO_RESTORE", len(vmsToRestore)),
-		logger.Snapshot(snapshotName))
+		logger.F("VMS_TO_RESTORE", vmCount),
+		logger.Snapshot(policy.Default),
+		logger.F("SNAPSHOT_RULES", len(policy.Rules)))
+
+	results := o.VMware.RestoreVMsWithPasswordRotation(context.Background(), pairs, policy)
+	// New passwords may show up in errors logged below.
+	for _, r := range results {
+		o.Logger.AddSecret(r.Password)
+	}
 
-	restoreErrors, passwords := o.VMware.RestoreVMsWithPasswordRotation(context.Background(), vmsToRestore, usersForRestore, snapshotName)
+	guestPasswords := make(map[string]string)
+	for _, r := range o.ProvisionGuests(restoredPairs(results)) {
+		if r.Err == nil {
+			guestPasswords[r.VM] = r.Password
+		}
+	}
 
-	// Record VM restore outcomes (success = total - failures, failure = len(restoreErrors))
-	if o.Metrics != nil {
-		successCount := int64(len(vmsToRestore) - len(restoreErrors))
-		failCount := int64(len(restoreErrors))
-		if successCount > 0 {
-			o.Metrics.VMRestoreTotal.Add(context.Background(), successCount,
-				metric.WithAttributeSet(attribute.NewSet(attribute.String("status", "success"))))
+	rotated := 0
+	for _, r := range results {
+		if r.PasswordRotated() {
+			rotated++
 		}
-		if failCount > 0 {
-			o.Metrics.VMRestoreTotal.Add(context.Background(), failCount,
-				metric.WithAttributeSet(attribute.NewSet(attribute.String("status", "failure"))))
+	}
+	assigned := o.assignBookings(results, activeEvents)
+	// Recorded after the credential checks, so each pod's outcome counts
+	// once per run.
+	o.recordRestoreHealth(results)
+	bookings := make([]string, len(results))
+	for i, k := range assigned {
+		if k >= 0 {
+			bookings[i] = activeEvents[k].Email
 		}
 	}
+	// Pods that failed their credential check or took no booking lose the
+	// permissions granted for the check.
+	o.ReconcilePermissions(pairs, bookedUsers(results, bookings))
 
-	if len(passwords) > 0 {
+	if rotated > 0 {
 		o.Logger.Info("Password rotation completed", logger.Action("password_rotation"), logger.Status("completed"))
 
-		// Record password rotations (one per entry returned by the VMware service)
-		if o.Metrics != nil {
-			o.Metrics.PasswordRotateTotal.Add(context.Background(), int64(len(passwords)),
-				metric.WithAttributeSet(attribute.NewSet(attribute.String("status", "success"))))
-		}
-
 		wireguardConfigs := make(map[string]string)
 		if o.WireGuard != nil {
-			for i, p := range pairs {
+			// Tunnel addresses are assigned by position in the sorted user
+			// list, not in pairs, which lacks pods that failed validation.
+			users := o.FeatureCfg.ESXi.Users()
+			for _, p := range pairs {
 				username := p.User
+				i := slices.Index(users, username)
 				_, pubKey, err := o.WireGuard.RotateUserKey(username)
 				if o.Metrics != nil {
 					wgKeyStatus := "success"
@@ -364,99 +594,1146 @@ func (o *Orchestrator) RestoreVMs(pairs []service.UserVMPair, activeEvents []Eve
 			}
 		}
 
-		for i, p := range pairs {
-			username := p.User
-			if password, ok := passwords[username]; ok {
-				o.Logger.Info("User password rotated", logger.User(username), logger.Password(password))
+		for i, r := range results {
+			username := r.User
+			if !r.PasswordRotated() {
+				continue
+			}
+			o.Logger.Info("User password rotated", logger.User(username))
+			if o.Email == nil || assigned[i] < 0 || activeEvents[assigned[i]].Email == "" {
+				continue
+			}
+			event := activeEvents[assigned[i]]
 
-				if o.Email != nil && i < len(activeEvents) && activeEvents[i].Email != "" {
-					vmName := ""
-					if len(p.VMs) > 0 {
-						vmName = p.VMs[0]
-					}
+			vmNames := podVMNames(r)
+			access := o.vmAccess(username, vmNames, guestPasswords)
 
-					var attachment *service.EmailAttachment
-					if wgConfig, ok := wireguardConfigs[username]; ok {
-						attachment = &service.EmailAttachment{
-							Filename: fmt.Sprintf("%s-wireguard.conf", username),
-							Content:  []byte(wgConfig),
-							MimeType: "application/x-wireguard-profile",
-						}
-					}
+			var attachment *service.EmailAttachment
+			if wgConfig, ok := wireguardConfigs[username]; ok {
+				attachment = &service.EmailAttachment{
+					Filename: fmt.Sprintf("%s-wireguard.conf", username),
+					Content:  []byte(wgConfig),
+					MimeType: "application/x-wireguard-profile",
+				}
+			}
 
-					hasAttachment := "false"
-					if attachment != nil {
-						hasAttachment = "true"
-					}
+			hasAttachment := "false"
+			if attachment != nil {
+				hasAttachment = "true"
+			}
 
-					err := o.Email.SendPasswordEmailWithAttachment(activeEvents[i].Email, vmName, username, password, attachment)
-					if o.Metrics != nil {
-						emailStatus := "success"
-						if err != nil {
-							emailStatus = "failure"
-						}
-						o.Metrics.EmailSendTotal.Add(context.Background(), 1,
-							metric.WithAttributeSet(attribute.NewSet(
-								attribute.String("status", emailStatus),
-								attribute.String("has_attachment", hasAttachment),
-							)))
-					}
-					if err != nil {
-						o.Logger.Error("Failed to send password email",
-							logger.F("EMAIL", activeEvents[i].Email),
-							logger.User(username),
-							logger.Error(err))
-					} else {
-						logMsg := "Password email sent"
-						if attachment != nil {
-							logMsg += " with WireGuard config"
-						}
-						o.Logger.Info(logMsg,
-							logger.F("EMAIL", activeEvents[i].Email),
-							logger.User(username),
-							logger.VM(vmName))
-					}
+			err := o.Email.SendCredentialsEmail(service.CredentialEmail{
+				To:         event.Email,
+				Username:   username,
+				Password:   r.Password,
+				VMs:        access,
+				Attachment: attachment,
+			})
+			if o.Metrics != nil {
+				emailStatus := "success"
+				if err != nil {
+					emailStatus = "failure"
+				}
+				o.Metrics.EmailSendTotal.Add(context.Background(), 1,
+					metric.WithAttributeSet(attribute.NewSet(
+						attribute.String("status", emailStatus),
+						attribute.String("has_attachment", hasAttachment),
+					)))
+			}
+			if err != nil {
+				o.Logger.Error("Failed to send password email",
+					logger.F("EMAIL", event.Email),
+					logger.User(username),
+					logger.Error(err))
+			} else {
+				logMsg := "Password email sent"
+				if attachment != nil {
+					logMsg += " with WireGuard config"
 				}
+				o.Logger.Info(logMsg,
+					logger.F("EMAIL", event.Email),
+					logger.User(username),
+					logger.VM(strings.Join(vmNames, ",")))
 			}
 		}
 	}
 
-	if len(restoreErrors) > 0 {
-		for i, errMsg := range restoreErrors {
-			o.Logger.Error("VM restore failed", logger.VMIndex(i), logger.F("MESSAGE", errMsg))
+	o.recordRestoreMetrics(results)
+
+	failedVMs, failedRotations := 0, 0
+	for _, r := range results {
+		for _, vm := range r.FailedVMs() {
+			failedVMs++
+			o.Logger.Error("VM restore failed", logger.VM(vm.VM), logger.User(r.User), logger.F("SELECTOR", vm.Selector), logger.Error(vm.Err))
+		}
+		if r.RotationErr != nil {
+			failedRotations++
+			o.Logger.Error("Password rotation failed", logger.User(r.User), logger.Error(r.RotationErr))
 		}
+	}
+	if failedVMs > 0 || failedRotations > 0 {
 		o.Logger.Error("Restore partially failed",
 			logger.Action("restore"),
 			logger.Status("partial_failure"),
-			logger.Restored(len(vmsToRestore)-len(restoreErrors)),
-			logger.Failed(len(restoreErrors)))
-		return fmt.Errorf("restore partially failed: %d of %d VMs had errors", len(restoreErrors), len(vmsToRestore))
+			logger.Restored(vmCount-failedVMs),
+			logger.Failed(failedVMs),
+			logger.F("ROTATIONS_FAILED", failedRotations))
+		return results, bookings, fmt.Errorf("restore partially failed: %d of %d VMs failed, %d password rotations failed", failedVMs, vmCount, failedRotations)
 	}
 
 	o.Logger.Info("Restore completed successfully",
 		logger.Action("restore"),
 		logger.Status("success"),
 		logger.Events(eventCount),
-		logger.F("VMS_RESTORED", len(vmsToRestore)),
-		logger.F("PASSWORDS_ROTATED", len(passwords)))
+		logger.F("VMS_RESTORED", vmCount),
+		logger.F("PASSWORDS_ROTATED", rotated))
+	return results, bookings, nil
+}
+
+// healthy reports whether a pod can take a booking: every VM restored, the
+// password rotated, room on its host and the pod not quarantined, or
+// released by this clean run.
+func (o *Orchestrator) healthy(r service.RestoreResult) bool {
+	if len(r.FailedVMs()) > 0 || !r.PasswordRotated() || o.refused[r.User] {
+		return false
+	}
+	return o.Health == nil || !o.Health.Quarantined(r.User) || o.Health.ReleasedBySuccess(r.User)
+}
+
+// isSpare reports whether the user's pod is a configured hot spare.
+func (o *Orchestrator) isSpare(user string) bool {
+	return slices.Contains(o.FeatureCfg.Quarantine.SpareUsers, user)
+}
+
+// assignBookings maps each restore result to the index of the booking it
+// serves, or -1. Booking k goes to the k-th regular pod. When that pod is
+// not healthy or fails its credential check the booking moves to the first
+// healthy spare that passes it: regular pods left over after every booking
+// is placed, then the configured spare pods. Bookings that find no such pod
+// are logged and get no credentials.
+func (o *Orchestrator) assignBookings(results []service.RestoreResult, events []EventInfo) []int {
+	checked := make(map[int]bool)
+	usable := func(i int) bool {
+		if !o.healthy(results[i]) {
+			return false
+		}
+		if checked[i] {
+			return true
+		}
+		checked[i] = true
+		return o.checkCredentials(&results[i])
+	}
+
+	assigned := make([]int, len(results))
+	var regular, spares []int
+	for i, r := range results {
+		assigned[i] = -1
+		if o.isSpare(r.User) {
+			spares = append(spares, i)
+		} else {
+			regular = append(regular, i)
+		}
+	}
+	if len(regular) > len(events) {
+		spares = slices.Concat(regular[len(events):], spares)
+		regular = regular[:len(events)]
+	}
+
+	next := 0
+	for k, event := range events {
+		original := ""
+		if k < len(regular) {
+			original = results[regular[k]].User
+			if usable(regular[k]) {
+				assigned[regular[k]] = k
+				continue
+			}
+		}
+		for next < len(spares) && !usable(spares[next]) {
+			next++
+		}
+		if next < len(spares) {
+			spare := results[spares[next]].User
+			assigned[spares[next]] = k
+			next++
+			o.Logger.Warn("Booking reassigned to spare pod",
+				logger.F("EMAIL", event.Email),
+				logger.User(spare),
+				logger.F("ORIGINAL_USER", original))
+			continue
+		}
+		if event.Email != "" {
+			o.Logger.Warn("Credential email skipped",
+				logger.F("EMAIL", event.Email),
+				logger.User(original),
+				logger.Reason("pod not healthy and no spare pod available"))
+		}
+	}
+	return assigned
+}
+
+// checkCredentials logs in as the pod's user with the new password before
+// the pod takes a booking, granting the user the pod's permissions first so
+// the check sees the VMs. A failed check marks the rotation failed, which
+// counts towards quarantine like a broken restore.
+func (o *Orchestrator) checkCredentials(r *service.RestoreResult) bool {
+	vmNames := podVMNames(*r)
+	o.ReconcilePermissions([]service.UserVMPair{{User: r.User, VMs: vmNames}}, map[string]bool{r.User: true})
+	err := o.VMware.VerifyCredentials(context.Background(), r.User, r.Password, vmNames)
+	if err == nil {
+		return true
+	}
+	r.RotationErr = fmt.Errorf("credential check failed: %w", err)
+	o.Logger.Error("Credential check failed, pod not assigned",
+		logger.Action("credential_check"),
+		logger.Status("failed"),
+		logger.User(r.User),
+		logger.Error(err))
+	return false
+}
+
+// podVMNames returns the names of the VMs in a restore result.
+func podVMNames(r service.RestoreResult) []string {
+	names := make([]string, len(r.VMs))
+	for i, vm := range r.VMs {
+		names[i] = vm.VM
+	}
+	return names
+}
+
+// recordRestoreHealth feeds restore outcomes into the health tracker: pods
+// with a failed VM or a failed password rotation, including a failed
+// credential check, count a failure, the others a success.
+func (o *Orchestrator) recordRestoreHealth(results []service.RestoreResult) {
+	if o.Health == nil {
+		return
+	}
+	for _, r := range results {
+		failed := r.FailedVMs()
+		if len(failed) > 0 {
+			o.recordPodFailure(r.User, fmt.Sprintf("%s not restored: %v", failed[0].VM, failed[0].Err))
+			continue
+		}
+		if r.RotationErr != nil {
+			o.recordPodFailure(r.User, r.RotationErr.Error())
+			continue
+		}
+		if o.Health.RecordSuccess(r.User) {
+			o.Logger.Info("Pod released from quarantine", logger.Action("quarantine"), logger.Status("released"), logger.User(r.User))
+			o.notifyOperators(
+				fmt.Sprintf("Pod released from quarantine: %s", r.User),
+				fmt.Sprintf("The pod of %s restored cleanly and is back in rotation.\n", r.User))
+		}
+	}
+}
+
+// recordPodFailure records a failed run for the user's pod and quarantines
+// it once the failure threshold is reached.
+func (o *Orchestrator) recordPodFailure(user, reason string) {
+	if o.Health == nil || !o.Health.RecordFailure(user, reason, time.Now()) {
+		return
+	}
+	o.Logger.Warn("Pod quarantined", logger.Action("quarantine"), logger.Status("quarantined"), logger.User(user), logger.Reason(reason))
+	o.notifyOperators(
+		fmt.Sprintf("Pod quarantined: %s", user),
+		fmt.Sprintf("The pod of %s was quarantined and will not be assigned to bookings.\n\nReason: %s\n\n"+
+			"It is released automatically after a clean restore, or manually with:\n\n  esxi-lab-scheduler quarantine release %s\n",
+			user, reason, user))
+}
+
+// notifyOperators emails a notice to every configured operator address.
+func (o *Orchestrator) notifyOperators(subject, body string) {
+	for _, to := range o.FeatureCfg.Quarantine.OperatorEmails {
+		if o.Email == nil {
+			o.Logger.Warn("Operator notification not sent, email is not configured", logger.F("EMAIL", to), logger.F("SUBJECT", subject))
+			continue
+		}
+		if err := o.Email.SendNotification(to, subject, body); err != nil {
+			o.Logger.Error("Failed to send operator notification", logger.F("EMAIL", to), logger.Error(err))
+		}
+	}
+}
+
+// saveAssignment persists which pod each booking was given, next to the pod
+// health state, so the usage command can tell which pods are in session.
+// Nothing is saved without a health tracker.
+func (o *Orchestrator) saveAssignment(results []service.RestoreResult, bookings []string) {
+	if o.Health == nil {
+		return
+	}
+	var pods []service.PodAssignment
+	for i, r := range results {
+		if i < len(bookings) && bookings[i] != "" {
+			pods = append(pods, service.PodAssignment{User: r.User, Booking: bookings[i]})
+		}
+	}
+	if err := service.SaveAssignment(o.FeatureCfg.Quarantine.AssignmentPath(), pods); err != nil {
+		o.Logger.Error("Failed to save pod assignment", logger.Error(err))
+	}
+}
+
+// AssignedPods returns the users whose pod the last run gave a booking that
+// is still among activeEvents. Without a saved assignment no pod is.
+func (o *Orchestrator) AssignedPods(activeEvents []EventInfo) map[string]bool {
+	pods, err := service.LoadAssignment(o.FeatureCfg.Quarantine.AssignmentPath())
+	if err != nil {
+		o.Logger.Warn("Pod assignment unavailable, no pod flagged in session", logger.Error(err))
+	}
+	assigned := make(map[string]bool)
+	for _, p := range pods {
+		if slices.ContainsFunc(activeEvents, func(e EventInfo) bool { return e.Email == p.Booking }) {
+			assigned[p.User] = true
+		}
+	}
+	return assigned
+}
+
+// saveHealth persists the health tracker, if any.
+func (o *Orchestrator) saveHealth() {
+	if o.Health == nil {
+		return
+	}
+	if err := o.Health.Save(); err != nil {
+		o.Logger.Error("Failed to save pod health state", logger.Error(err))
+	}
+}
+
+// WriteQuarantineReport writes one line per tracked pod with its failure
+// count and, for quarantined pods, since when and why.
+func WriteQuarantineReport(w io.Writer, pods []service.PodHealth) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "USER\tSTATUS\tFAILURES\tSINCE\tREASON")
+	for _, p := range pods {
+		state, since := "failing", "-"
+		if p.Quarantined {
+			state, since = "quarantined", p.Since.Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n", p.User, state, p.Failures, since, p.Reason)
+	}
+	return tw.Flush()
+}
+
+// PowerChange is one power action taken by ManagePower.
+type PowerChange struct {
+	User   string
+	VM     string
+	Action service.PowerAction
+	Err    error
+}
+
+// ManagePower keeps as many pods powered on as there are bookings active or
+// starting within the warm-up window and idles the others, leaving
+// always-on VMs untouched. The pods in booked, which this run gave an
+// active booking, stay on; bookings beyond those, such as ones starting
+// within the window, take further pods in assignment order: regular pods,
+// then spares. Quarantined pods are always idled. Power-ons are checked
+// against host capacity and staggered. Nothing is changed when power
+// management is disabled or the calendar cannot be read.
+func (o *Orchestrator) ManagePower(pairs []service.UserVMPair, booked map[string]bool, now time.Time) []PowerChange {
+	cfg := o.FeatureCfg.Power
+	if !cfg.Enabled || len(pairs) == 0 {
+		return nil
+	}
+
+	until := now.Add(time.Duration(cfg.Warmup()) * time.Minute)
+	events, err := o.Calendar.ListEvents(now.Format(time.RFC3339), until.Format(time.RFC3339))
+	if err != nil {
+		o.Logger.Error("Power management skipped, failed to fetch upcoming bookings", logger.Action("power"), logger.Error(err))
+		return nil
+	}
+	bookings := CountBookings(events, now, until)
+
+	var onPods []service.UserVMPair
+	for _, p := range pairs {
+		if booked[p.User] {
+			onPods = append(onPods, p)
+		}
+	}
+	for _, p := range o.rankPods(pairs) {
+		if len(onPods) >= bookings {
+			break
+		}
+		if !booked[p.User] {
+			onPods = append(onPods, p)
+		}
+	}
+	keepOn := make(map[string]bool)
+	for _, p := range onPods {
+		keepOn[p.User] = true
+	}
+
+	// Idle first, so the capacity it frees is available to power-ons.
+	ctx := context.Background()
+	var changes []PowerChange
+	for _, p := range pairs {
+		if keepOn[p.User] {
+			continue
+		}
+		for _, vm := range p.VMs {
+			if !cfg.IsAlwaysOn(vm) {
+				changes = o.applyPower(ctx, changes, p.User, vm, cfg.Idle())
+			}
+		}
+	}
+
+	admitted, shortfalls := o.planPowerOn(ctx, onPods)
+	stagger := time.Duration(cfg.Capacity.StaggerSeconds) * time.Second
+	for i, p := range admitted {
+		before := len(changes)
+		for _, vm := range p.VMs {
+			changes = o.applyPower(ctx, changes, p.User, vm, service.PowerOn)
+		}
+		if stagger > 0 && len(changes) > before && i < len(admitted)-1 {
+			sleep(stagger)
+		}
+	}
+
+	poweredOn, idled, failed := 0, 0, 0
+	for _, c := range changes {
+		switch {
+		case c.Err != nil:
+			failed++
+		case c.Action == service.PowerOn:
+			poweredOn++
+		default:
+			idled++
+		}
+	}
+	o.Logger.Info("Power management completed",
+		logger.Action("power"),
+		logger.Status("completed"),
+		logger.F("BOOKINGS", bookings),
+		logger.F("WARMUP_MINUTES", cfg.Warmup()),
+		logger.F("PODS_ON", len(keepOn)),
+		logger.F("POWERED_ON", poweredOn),
+		logger.F("IDLED", idled),
+		logger.F("REFUSED", len(shortfalls)),
+		logger.Failed(failed))
+	return changes
+}
+
+// rankPods returns the pods in the order bookings are given to them:
+// regular pods, then spares. Quarantined pods and pods refused for lack of
+// host capacity are left out.
+func (o *Orchestrator) rankPods(pairs []service.UserVMPair) []service.UserVMPair {
+	var regular, spares []service.UserVMPair
+	for _, p := range pairs {
+		switch {
+		case o.Health != nil && o.Health.Quarantined(p.User), o.refused[p.User]:
+		case o.isSpare(p.User):
+			spares = append(spares, p)
+		default:
+			regular = append(regular, p)
+		}
+	}
+	return slices.Concat(regular, spares)
+}
+
+// CollectUsage samples the resource usage of every pod VM and records it
+// as gauges labelled with the VM, pod and lab user. The pods in active,
+// which hold a booking in session, are flagged as such.
+func (o *Orchestrator) CollectUsage(pairs []service.UserVMPair, active map[string]bool) error {
+	var vmNames []string
+	owner := make(map[string]string)
+	for _, p := range pairs {
+		for _, vm := range p.VMs {
+			vmNames = append(vmNames, vm)
+			owner[vm] = p.User
+		}
+	}
+
+	ctx := context.Background()
+	usage, err := o.VMware.VMUsage(ctx, vmNames)
+	if err != nil {
+		o.Logger.Error("Failed to collect VM usage", logger.Action("usage"), logger.Error(err))
+		if len(usage) == 0 {
+			return err
+		}
+	}
+
+	if o.Metrics != nil {
+		for _, p := range pairs {
+			var flag int64
+			if active[p.User] {
+				flag = 1
+			}
+			o.Metrics.PodSessionActive.Record(ctx, flag,
+				metric.WithAttributeSet(attribute.NewSet(
+					attribute.String("pod", podName(p)),
+					attribute.String("user", p.User),
+				)))
+		}
+	}
+	for _, u := range usage {
+		user := owner[u.VM]
+		o.Logger.Debug("VM usage sampled",
+			logger.VM(u.VM),
+			logger.User(user),
+			logger.F("CPU_PERCENT", u.CPUPercent),
+			logger.F("MEMORY_PERCENT", u.MemoryPercent),
+			logger.F("DISK_KBPS", u.DiskKBps),
+			logger.F("NETWORK_KBPS", u.NetworkKBps))
+		if o.Metrics == nil {
+			continue
+		}
+		attrs := metric.WithAttributeSet(attribute.NewSet(
+			attribute.String("vm", u.VM),
+			attribute.String("pod", podName(service.UserVMPair{User: user, VMs: []string{u.VM}})),
+			attribute.String("user", user),
+			attribute.Bool("active", active[user]),
+		))
+		o.Metrics.VMCPUUsage.Record(ctx, u.CPUPercent, attrs)
+		o.Metrics.VMMemoryUsage.Record(ctx, u.MemoryPercent, attrs)
+		o.Metrics.VMDiskThroughput.Record(ctx, u.DiskKBps, attrs)
+		o.Metrics.VMNetworkThroughput.Record(ctx, u.NetworkKBps, attrs)
+	}
+
+	o.Logger.Info("VM usage collected",
+		logger.Action("usage"),
+		logger.Status("completed"),
+		logger.Count(len(usage)),
+		logger.F("ACTIVE_PODS", len(active)))
+	return err
+}
+
+// podName returns the pod label for p: the name part before the first "_"
+// of its first VM ("Pod-1" for "Pod-1_FortiGate"), or the user when VM
+// names carry no pod prefix.
+func podName(p service.UserVMPair) string {
+	if len(p.VMs) > 0 {
+		if prefix, _, ok := strings.Cut(p.VMs[0], "_"); ok {
+			return prefix
+		}
+	}
+	return p.User
+}
+
+// sleep pauses between staggered power-ons; tests replace it.
+var sleep = time.Sleep
+
+// applyPower applies action to vm and appends the change, if any, to
+// changes.
+func (o *Orchestrator) applyPower(ctx context.Context, changes []PowerChange, user, vm string, action service.PowerAction) []PowerChange {
+	changed, err := o.VMware.SetPowerState(ctx, vm, action)
+	if !changed && err == nil {
+		return changes
+	}
+	o.recordPowerAction(ctx, action, outcome(err))
+	if err != nil {
+		o.Logger.Error("Power action failed", logger.Action(string(action)), logger.VM(vm), logger.User(user), logger.Error(err))
+	} else {
+		o.Logger.Info("Power action applied", logger.Action(string(action)), logger.VM(vm), logger.User(user))
+	}
+	return append(changes, PowerChange{User: user, VM: vm, Action: action, Err: err})
+}
+
+// CheckCapacity runs the host capacity plan for the pods the active
+// bookings will take, in booking order, before they are restored. It runs
+// whether or not power management is enabled. Pods that do not fit are
+// refused: they take no booking, so it moves to a spare, and they are left
+// powered off. It returns the refused pods.
+func (o *Orchestrator) CheckCapacity(pairs []service.UserVMPair, bookings int) []service.CapacityShortfall {
+	o.refused = nil
+	ranked := o.rankPods(pairs)
+	_, shortfalls := o.planPowerOn(context.Background(), ranked[:min(bookings, len(ranked))])
+	if len(shortfalls) > 0 {
+		o.refused = make(map[string]bool)
+		for _, s := range shortfalls {
+			o.refused[s.User] = true
+		}
+	}
+	return shortfalls
+}
+
+// planPowerOn returns the pods that fit within host capacity headroom.
+// Refused pods are logged, counted and reported to the operators. If
+// capacity cannot be read, every pod is powered on unchecked.
+func (o *Orchestrator) planPowerOn(ctx context.Context, pods []service.UserVMPair) ([]service.UserVMPair, []service.CapacityShortfall) {
+	if len(pods) == 0 {
+		return nil, nil
+	}
+	admitted, shortfalls, err := o.VMware.PlanPowerOn(ctx, pods, o.FeatureCfg.Power.Capacity)
+	if err != nil {
+		o.Logger.Warn("Host capacity unavailable, powering on without capacity checks", logger.Action("power"), logger.Error(err))
+		return pods, nil
+	}
+	if len(shortfalls) == 0 {
+		return admitted, nil
+	}
+
+	var body strings.Builder
+	body.WriteString("These pods are booked but were not powered on because their hosts lack capacity:\n\n")
+	for _, s := range shortfalls {
+		o.recordPowerAction(ctx, service.PowerOn, "refused")
+		o.Logger.Error("Pod power-on refused, host capacity exceeded",
+			logger.Action("power"),
+			logger.User(s.User),
+			logger.F("HOST", s.Host),
+			logger.F("RESOURCE", s.Resource),
+			logger.F("NEEDED", s.Needed),
+			logger.F("FREE", s.Free))
+		fmt.Fprintf(&body, "  - %s\n", s)
+	}
+	body.WriteString("\nFree capacity on the hosts or lower power.capacity headroom, then rerun.\n")
+	o.notifyOperators(fmt.Sprintf("Host capacity shortfall: %d pod(s) not powered on", len(shortfalls)), body.String())
+	return admitted, shortfalls
+}
+
+// recordPowerAction records lab.vm.power.action.total.
+func (o *Orchestrator) recordPowerAction(ctx context.Context, action service.PowerAction, status string) {
+	if o.Metrics == nil {
+		return
+	}
+	o.Metrics.VMPowerActionTotal.Add(ctx, 1,
+		metric.WithAttributeSet(attribute.NewSet(
+			attribute.String("action", string(action)),
+			attribute.String("status", status),
+		)))
+}
+
+// CountBookings returns the number of timed events that overlap
+// [from, until).
+func CountBookings(events []*calendar.Event, from, until time.Time) int {
+	count := 0
+	for _, event := range events {
+		if event.Start == nil || event.End == nil {
+			continue
+		}
+		start, err := time.Parse(time.RFC3339, event.Start.DateTime)
+		if err != nil {
+			continue
+		}
+		end, err := time.Parse(time.RFC3339, event.End.DateTime)
+		if err != nil {
+			continue
+		}
+		if start.Before(until) && end.After(from) {
+			count++
+		}
+	}
+	return count
+}
+
+// RecordRun saves what the run handed over: each pod's booking and restore
+// outcome and, when enabled, a console screenshot of every restored VM, so
+// support can check a pod's state at session start later. It runs after
+// power management, so booked pods are captured running. Nothing is saved
+// when run records are disabled.
+func (o *Orchestrator) RecordRun(results []service.RestoreResult, bookings []string, started time.Time) *service.RunRecord {
+	cfg := o.FeatureCfg.RunRecords
+	if !cfg.Enabled {
+		return nil
+	}
+
+	ctx := context.Background()
+	rec := service.NewRunRecord(cfg, started)
+	captured, failed := 0, 0
+	for i, r := range results {
+		pod := service.PodRecord{User: r.User}
+		if i < len(bookings) {
+			pod.Booking = bookings[i]
+		}
+		for _, vm := range r.VMs {
+			v := service.VMRecord{VM: vm.VM, Snapshot: vm.Snapshot, PowerState: vm.PowerState}
+			if vm.Err != nil {
+				v.Error = vm.Err.Error()
+			} else if cfg.Screenshots {
+				file := vm.VM + ".png"
+				ready, err := o.VMware.CaptureScreenshot(ctx, vm.VM, filepath.Join(rec.Dir(), file), cfg.ReadyTimeout())
+				v.GuestReady = ready
+				if err != nil {
+					failed++
+					v.ScreenshotError = err.Error()
+					o.Logger.Warn("Console screenshot failed", logger.Action("screenshot"), logger.VM(vm.VM), logger.User(r.User), logger.Error(err))
+				} else {
+					captured++
+					v.Screenshot = file
+					o.Logger.Debug("Console screenshot saved", logger.Action("screenshot"), logger.VM(vm.VM), logger.F("GUEST_READY", ready))
+				}
+			}
+			pod.VMs = append(pod.VMs, v)
+		}
+		rec.Pods = append(rec.Pods, pod)
+	}
+
+	if err := rec.Save(); err != nil {
+		o.Logger.Error("Failed to save run record", logger.Action("run_record"), logger.Error(err))
+		return rec
+	}
+	o.Logger.Info("Run record saved",
+		logger.Action("run_record"),
+		logger.Status("saved"),
+		logger.F("DIR", rec.Dir()),
+		logger.F("SCREENSHOTS", captured),
+		logger.Failed(failed))
+	return rec
+}
+
+// ReconcilePermissions makes the configured role on each pod's VMs match
+// the bookings: users in booked hold it on their own pod's VMs, every other
+// lab user's permission on a pod VM is revoked. This both grants and
+// removes time-boxed access and undoes drift such as a manual grant or a
+// revoke missed by an earlier run. A VM whose permissions cannot be
+// reconciled is logged and skipped. Nothing is changed when time-boxed
+// permissions are disabled.
+func (o *Orchestrator) ReconcilePermissions(pairs []service.UserVMPair, booked map[string]bool) []service.PermissionChange {
+	cfg := o.FeatureCfg.Permissions
+	if !cfg.Enabled || len(pairs) == 0 {
+		return nil
+	}
+
+	ctx := context.Background()
+	labUsers := o.FeatureCfg.ESXi.Users()
+	var changes []service.PermissionChange
+	failed := 0
+	for _, p := range pairs {
+		grantTo := ""
+		if booked[p.User] {
+			grantTo = p.User
+		}
+		for _, vm := range p.VMs {
+			applied, err := o.VMware.ReconcileVMPermissions(ctx, vm, grantTo, labUsers, cfg.RoleName())
+			for _, c := range applied {
+				o.Logger.Info("VM permission changed",
+					logger.Action("permissions"),
+					logger.Status(c.Action),
+					logger.VM(c.VM),
+					logger.User(c.User),
+					logger.F("ROLE", cfg.RoleName()))
+				o.recordPermissionChange(ctx, c.Action, "success")
+			}
+			changes = append(changes, applied...)
+			if err != nil {
+				failed++
+				o.Logger.Error("Failed to reconcile VM permissions", logger.Action("permissions"), logger.VM(vm), logger.User(p.User), logger.Error(err))
+				o.recordPermissionChange(ctx, "reconcile", "failure")
+			}
+		}
+	}
+
+	granted := 0
+	for _, c := range changes {
+		if c.Action == service.PermissionGrant {
+			granted++
+		}
+	}
+	o.Logger.Info("VM permissions reconciled",
+		logger.Action("permissions"),
+		logger.Status("completed"),
+		logger.F("BOOKED_PODS", len(booked)),
+		logger.F("GRANTED", granted),
+		logger.F("REVOKED", len(changes)-granted),
+		logger.Failed(failed))
+	return changes
+}
+
+// excludePods returns the pods of all that are not in pairs, such as pods
+// that failed validation.
+func excludePods(all, pairs []service.UserVMPair) []service.UserVMPair {
+	var rest []service.UserVMPair
+	for _, p := range all {
+		if !slices.ContainsFunc(pairs, func(q service.UserVMPair) bool { return q.User == p.User }) {
+			rest = append(rest, p)
+		}
+	}
+	return rest
+}
+
+// bookedUsers returns the users whose pods were given a booking.
+func bookedUsers(results []service.RestoreResult, bookings []string) map[string]bool {
+	booked := make(map[string]bool)
+	for i, r := range results {
+		if i < len(bookings) && bookings[i] != "" {
+			booked[r.User] = true
+		}
+	}
+	return booked
+}
+
+// recordPermissionChange records lab.vm.permission.change.total.
+func (o *Orchestrator) recordPermissionChange(ctx context.Context, action, status string) {
+	if o.Metrics == nil {
+		return
+	}
+	o.Metrics.VMPermissionChangeTotal.Add(ctx, 1,
+		metric.WithAttributeSet(attribute.NewSet(
+			attribute.String("action", action),
+			attribute.String("status", status),
+		)))
+}
+
+// ReconcileAccounts compares the lab accounts and role on every ESXi host
+// with the user mappings and, when apply is set, creates missing accounts,
+// removes stale ones and updates the role's privileges. Without apply the
+// changes are only logged as planned. Failed changes are logged and
+// counted; an error is returned if any failed.
+func (o *Orchestrator) ReconcileAccounts(apply bool) ([]service.AccountChange, error) {
+	ctx := context.Background()
+	role := o.FeatureCfg.Permissions.RoleName()
+	changes, err := o.VMware.PlanAccounts(ctx, o.FeatureCfg.ESXi.Users(), role, o.FeatureCfg.Accounts)
+	if err != nil {
+		o.Logger.Error("Failed to read ESXi accounts", logger.Action("accounts"), logger.Error(err))
+		return changes, err
+	}
+
+	failed := 0
+	for _, c := range changes {
+		if !apply {
+			o.Logger.Info("Account change planned", logger.Action("accounts"), logger.Status(c.Kind), logger.F("HOST", c.Host), logger.F("NAME", c.Name))
+			continue
+		}
+		if err := o.VMware.ApplyAccountChange(ctx, c); err != nil {
+			failed++
+			o.Logger.Error("Account change failed", logger.Action("accounts"), logger.Status(c.Kind), logger.F("HOST", c.Host), logger.F("NAME", c.Name), logger.Error(err))
+			continue
+		}
+		o.Logger.Info("Account change applied", logger.Action("accounts"), logger.Status(c.Kind), logger.F("HOST", c.Host), logger.F("NAME", c.Name))
+	}
+
+	o.Logger.Info("Account reconciliation completed",
+		logger.Action("accounts"),
+		logger.Status("completed"),
+		logger.F("DRY_RUN", !apply),
+		logger.Count(len(changes)),
+		logger.Failed(failed))
+	if failed > 0 {
+		return changes, fmt.Errorf("%d of %d account changes failed", failed, len(changes))
+	}
+	return changes, nil
+}
+
+// WriteAccountDiff writes the planned account changes as a diff grouped by
+// host: "+" creates, "-" removes and "~" updates.
+func WriteAccountDiff(w io.Writer, changes []service.AccountChange) error {
+	if len(changes) == 0 {
+		_, err := fmt.Fprintln(w, "No changes. ESXi accounts match the configuration.")
+		return err
+	}
+	host := ""
+	for _, c := range changes {
+		if c.Host != host {
+			host = c.Host
+			if _, err := fmt.Fprintf(w, "%s:\n", host); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "  %s\n", c); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-// SelectAllVMs returns UserVMPairs for all inventory VMs whose names match a
-// configured prefix in user_vm_mappings. All matching VMs per user are included.
+// SnapshotCheck is the snapshot chain health of one pod VM.
+type SnapshotCheck struct {
+	User         string
+	Health       service.VMSnapshotHealth
+	Warnings     []service.SnapshotWarning
+	Consolidated bool
+	Err          error // consolidation error
+}
+
+// CheckSnapshotHealth checks the snapshot chains of every pod VM, logs and
+// records a metric for each warning, and records chain depth, delta size and
+// datastore free space as gauges. With consolidation enabled, VMs needing
+// it are consolidated unless their pod holds a booking active or starting
+// within the quiet window. The pods in booked, which this run gave an active
+// booking, are busy; further bookings take pods in assignment order, as for
+// power management. Nothing is checked when the check is disabled.
+func (o *Orchestrator) CheckSnapshotHealth(pairs []service.UserVMPair, booked map[string]bool, now time.Time) []SnapshotCheck {
+	cfg := o.FeatureCfg.SnapshotHealth
+	if !cfg.Enabled || len(pairs) == 0 {
+		return nil
+	}
+
+	var vmNames []string
+	owner := make(map[string]string)
+	for _, p := range pairs {
+		for _, vm := range p.VMs {
+			vmNames = append(vmNames, vm)
+			owner[vm] = p.User
+		}
+	}
+
+	ctx := context.Background()
+	health, err := o.VMware.SnapshotHealth(ctx, vmNames)
+	if err != nil {
+		o.Logger.Error("Failed to check snapshot health", logger.Action("snapshot_health"), logger.Error(err))
+	}
+
+	checks := make([]SnapshotCheck, 0, len(health))
+	warned := 0
+	for _, h := range health {
+		c := SnapshotCheck{User: owner[h.VM], Health: h, Warnings: h.Warnings(cfg)}
+		for _, w := range c.Warnings {
+			o.Logger.Warn("Snapshot chain unhealthy",
+				logger.VM(h.VM),
+				logger.User(c.User),
+				logger.F("CHECK", w.Kind),
+				logger.Reason(w.Message))
+		}
+		if len(c.Warnings) > 0 {
+			warned++
+		}
+		o.recordSnapshotHealth(ctx, c)
+		checks = append(checks, c)
+	}
+
+	consolidated, failed := 0, 0
+	if cfg.Consolidate && slices.ContainsFunc(checks, func(c SnapshotCheck) bool { return c.Health.ConsolidationNeeded }) {
+		busy, err := o.busyPods(pairs, booked, now, cfg.Quiet())
+		if err != nil {
+			o.Logger.Error("Snapshot consolidation skipped, failed to fetch upcoming bookings", logger.Action("consolidate"), logger.Error(err))
+		}
+		for i := range checks {
+			c := &checks[i]
+			if err != nil || !c.Health.ConsolidationNeeded {
+				continue
+			}
+			if busy[c.User] {
+				o.Logger.Info("Snapshot consolidation deferred, pod is booked",
+					logger.Action("consolidate"),
+					logger.VM(c.Health.VM),
+					logger.User(c.User))
+				continue
+			}
+			c.Err = o.VMware.ConsolidateDisks(ctx, c.Health.VM)
+			if c.Err != nil {
+				failed++
+				o.Logger.Error("Snapshot consolidation failed", logger.Action("consolidate"), logger.VM(c.Health.VM), logger.Error(c.Err))
+			} else {
+				consolidated++
+				c.Consolidated = true
+				o.Logger.Info("Snapshot disks consolidated", logger.Action("consolidate"), logger.Status("completed"), logger.VM(c.Health.VM))
+			}
+			if o.Metrics != nil {
+				o.Metrics.SnapshotConsolidateTotal.Add(ctx, 1,
+					metric.WithAttributeSet(attribute.NewSet(attribute.String("status", outcome(c.Err)))))
+			}
+		}
+	}
+
+	o.Logger.Info("Snapshot health checked",
+		logger.Action("snapshot_health"),
+		logger.Status("completed"),
+		logger.Count(len(checks)),
+		logger.F("WARNED", warned),
+		logger.F("CONSOLIDATED", consolidated),
+		logger.Failed(failed))
+	return checks
+}
+
+// busyPods returns the users whose pods hold a booking active or starting
+// within the next quietMinutes: the pods in booked, then as many more in
+// assignment order as there are bookings beyond them.
+func (o *Orchestrator) busyPods(pairs []service.UserVMPair, booked map[string]bool, now time.Time, quietMinutes int) (map[string]bool, error) {
+	until := now.Add(time.Duration(quietMinutes) * time.Minute)
+	events, err := o.Calendar.ListEvents(now.Format(time.RFC3339), until.Format(time.RFC3339))
+	if err != nil {
+		return nil, err
+	}
+	bookings := CountBookings(events, now, until)
+	busy := make(map[string]bool)
+	for _, p := range pairs {
+		if booked[p.User] {
+			busy[p.User] = true
+		}
+	}
+	for _, p := range o.rankPods(pairs) {
+		if len(busy) >= bookings {
+			break
+		}
+		busy[p.User] = true
+	}
+	return busy, nil
+}
+
+// recordSnapshotHealth records lab.vm.snapshot.depth,
+// lab.vm.snapshot.delta.size, lab.datastore.free and one
+// lab.vm.snapshot.warning.total per warning.
+func (o *Orchestrator) recordSnapshotHealth(ctx context.Context, c SnapshotCheck) {
+	if o.Metrics == nil {
+		return
+	}
+	attrs := metric.WithAttributeSet(attribute.NewSet(
+		attribute.String("vm", c.Health.VM),
+		attribute.String("user", c.User),
+	))
+	o.Metrics.VMSnapshotDepth.Record(ctx, int64(c.Health.SnapshotDepth), attrs)
+	o.Metrics.VMSnapshotDeltaSize.Record(ctx, c.Health.DeltaDiskMB, attrs)
+	for _, ds := range c.Health.Datastores {
+		o.Metrics.DatastoreFree.Record(ctx, ds.FreePercent(),
+			metric.WithAttributeSet(attribute.NewSet(attribute.String("datastore", ds.Name))))
+	}
+	for _, w := range c.Warnings {
+		o.Metrics.SnapshotWarningTotal.Add(ctx, 1,
+			metric.WithAttributeSet(attribute.NewSet(
+				attribute.String("kind", w.Kind),
+				attribute.String("vm", c.Health.VM),
+			)))
+	}
+}
+
+// WriteSnapshotReport prints the snapshot chain health of each pod VM as a
+// table.
+func WriteSnapshotReport(w io.Writer, checks []SnapshotCheck) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "VM\tUSER\tDEPTH\tDELTA_MB\tCONSOLIDATE\tDATASTORE_FREE\tWARNINGS")
+	for _, c := range checks {
+		var free []string
+		for _, ds := range c.Health.Datastores {
+			free = append(free, fmt.Sprintf("%s %.0f%%", ds.Name, ds.FreePercent()))
+		}
+		consolidate := "no"
+		if c.Health.ConsolidationNeeded {
+			consolidate = "needed"
+		}
+		warnings := "-"
+		if len(c.Warnings) > 0 {
+			var kinds []string
+			for _, w := range c.Warnings {
+				kinds = append(kinds, w.Kind)
+			}
+			warnings = strings.Join(kinds, ",")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\t%s\t%s\n",
+			c.Health.VM, c.User, c.Health.SnapshotDepth, c.Health.DeltaDiskMB, consolidate, strings.Join(free, ", "), warnings)
+	}
+	return tw.Flush()
+}
+
+// recordRestoreMetrics records lab.vm.restore.total and
+// lab.vm.restore.duration per VM and lab.password.rotation.total per user.
+func (o *Orchestrator) recordRestoreMetrics(results []service.RestoreResult) {
+	if o.Metrics == nil {
+		return
+	}
+	ctx := context.Background()
+	for _, r := range results {
+		for _, vm := range r.VMs {
+			attrs := attribute.NewSet(attribute.String("status", outcome(vm.Err)))
+			o.Metrics.VMRestoreTotal.Add(ctx, 1, metric.WithAttributeSet(attrs))
+			o.Metrics.VMRestoreDuration.Record(ctx, vm.Duration.Seconds(), metric.WithAttributeSet(attrs))
+		}
+		switch {
+		case r.PasswordRotated():
+			o.Metrics.PasswordRotateTotal.Add(ctx, 1,
+				metric.WithAttributeSet(attribute.NewSet(attribute.String("status", "success"))))
+		case r.RotationErr != nil:
+			o.Metrics.PasswordRotateTotal.Add(ctx, 1,
+				metric.WithAttributeSet(attribute.NewSet(attribute.String("status", "failure"))))
+		}
+	}
+}
+
+// outcome maps an error to the status attribute used by the metrics.
+func outcome(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// restoredPairs returns the pairs reduced to the VMs that were restored.
+func restoredPairs(results []service.RestoreResult) []service.UserVMPair {
+	var pairs []service.UserVMPair
+	for _, r := range results {
+		p := service.UserVMPair{User: r.User}
+		for _, vm := range r.VMs {
+			if vm.Err == nil {
+				p.VMs = append(p.VMs, vm.VM)
+			}
+		}
+		if len(p.VMs) > 0 {
+			pairs = append(pairs, p)
+		}
+	}
+	return pairs
+}
+
+// vmAccess builds the per-VM access details for a credential email: console
+// links for every VM of the pair plus any guest password set by provisioning.
+func (o *Orchestrator) vmAccess(username string, vms []string, guestPasswords map[string]string) []service.VMAccess {
+	links := make(map[string]service.ConsoleLink)
+	for _, l := range o.VMware.ConsoleLinks(context.Background(), username, vms) {
+		links[l.VM] = l
+	}
+
+	access := make([]service.VMAccess, len(vms))
+	for i, vm := range vms {
+		access[i] = service.VMAccess{
+			Name:          vm,
+			HostClientURL: links[vm].HostClientURL,
+			VMRCURL:       links[vm].VMRCURL,
+			GuestPassword: guestPasswords[vm],
+		}
+	}
+	return access
+}
+
+// ProvisionGuests runs the configured guest provisioning rules inside every
+// VM of the given pairs after restore. VMs without a matching rule are
+// skipped; failures are logged per VM and do not fail the run.
+func (o *Orchestrator) ProvisionGuests(pairs []service.UserVMPair) []service.GuestProvisionResult {
+	rules := o.FeatureCfg.ESXi.GuestProvisioning
+	if len(rules) == 0 {
+		return nil
+	}
+
+	var targets []service.GuestTarget
+	for _, p := range pairs {
+		for _, vm := range p.VMs {
+			targets = append(targets, service.GuestTarget{VM: vm, User: p.User})
+		}
+	}
+
+	results := o.VMware.ProvisionGuests(context.Background(), rules, targets)
+
+	failed := 0
+	for _, r := range results {
+		if r.Err == nil {
+			continue
+		}
+		failed++
+		for _, step := range r.Steps {
+			if step.Err != nil {
+				o.Logger.Error("Guest provisioning step failed",
+					logger.VM(r.VM),
+					logger.User(r.User),
+					logger.F("STEP", step.Step),
+					logger.F("EXIT_CODE", step.ExitCode),
+					logger.Error(step.Err))
+			}
+		}
+	}
+	o.Logger.Info("Guest provisioning completed",
+		logger.Action("guest_provision"),
+		logger.Status("completed"),
+		logger.Count(len(results)),
+		logger.Failed(failed))
+	return results
+}
+
+// SelectAllVMs returns UserVMPairs for all inventory VMs matched by the
+// configured selectors (user_vm_mappings prefixes and user_vm_selectors).
+// All matching VMs per user are included.
 func (o *Orchestrator) SelectAllVMs(vmList *models.VMListResponse) []service.UserVMPair {
 	if vmList == nil || len(vmList.VMs) == 0 {
 		return nil
 	}
 
 	var pairs []service.UserVMPair
-	for _, p := range o.FeatureCfg.ESXi.UserVMPairs() {
-		validVMs := FindVMsByPrefixes(vmList.VMs, p.VMs)
+	for _, u := range o.FeatureCfg.ESXi.UserSelectors() {
+		validVMs := FindVMsBySelectors(vmList.VMs, u.Selectors)
 		if len(validVMs) > 0 {
-			pairs = append(pairs, service.UserVMPair{User: p.User, VMs: validVMs})
-		} else {
-			for _, prefix := range p.VMs {
-				o.Logger.Warn("No VMs found in inventory for configured prefix", logger.VM(prefix), logger.User(p.User))
+			pairs = append(pairs, service.UserVMPair{User: u.User, VMs: validVMs})
+			continue
+		}
+		for _, sel := range u.Selectors {
+			if sel.Prefix != "" {
+				o.Logger.Warn("No VMs found in inventory for configured prefix", logger.VM(sel.Prefix), logger.User(u.User))
+			} else {
+				o.Logger.Warn("No VMs found in inventory for configured selector", logger.F("SELECTOR", sel.String()), logger.User(u.User))
 			}
 		}
 	}
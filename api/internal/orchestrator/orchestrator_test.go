@@ -3,7 +3,12 @@ package orchestrator
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 
@@ -15,15 +20,28 @@ import (
 	"github.com/stretchr/testify/require"
 	"go.opentelemetry.io/otel"
 	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
 	"google.golang.org/api/calendar/v3"
 )
 
 // --- mocks ---
 
 type mockVMware struct {
-	listFn    func(ctx context.Context) (*models.VMListResponse, error)
-	restoreFn func(ctx context.Context, vms, users []string, snap string) ([]string, map[string]string)
-	closeFn   func(ctx context.Context) error
+	listFn      func(ctx context.Context) (*models.VMListResponse, error)
+	restoreFn   func(ctx context.Context, pairs []service.UserVMPair, policy service.SnapshotPolicy) []service.RestoreResult
+	provisionFn func(ctx context.Context, rules []service.GuestProvisionRule, targets []service.GuestTarget) []service.GuestProvisionResult
+	consoleFn   func(ctx context.Context, username string, vms []string) []service.ConsoleLink
+	powerFn     func(ctx context.Context, vm string, action service.PowerAction) (bool, error)
+	planFn      func(ctx context.Context, pairs []service.UserVMPair, cfg service.CapacityConfig) ([]service.UserVMPair, []service.CapacityShortfall, error)
+	usageFn     func(ctx context.Context, vmNames []string) ([]service.VMUsage, error)
+	healthFn    func(ctx context.Context, vmNames []string) ([]service.VMSnapshotHealth, error)
+	consolidFn  func(ctx context.Context, vm string) error
+	shotFn      func(ctx context.Context, vm, path string, readyTimeout time.Duration) (bool, error)
+	permFn      func(ctx context.Context, vm, grantTo string, labUsers []string, role string) ([]service.PermissionChange, error)
+	accountsFn  func(ctx context.Context, users []string, role string, cfg service.AccountConfig) ([]service.AccountChange, error)
+	applyFn     func(ctx context.Context, c service.AccountChange) error
+	verifyFn    func(ctx context.Context, username, password string, vms []string) error
+	closeFn     func(ctx context.Context) error
 }
 
 func (m *mockVMware) ListVMSnapshots(ctx context.Context) (*models.VMListResponse, error) {
@@ -33,13 +51,122 @@ func (m *mockVMware) ListVMSnapshots(ctx context.Context) (*models.VMListRespons
 	return &models.VMListResponse{}, nil
 }
 
-func (m *mockVMware) RestoreVMsWithPasswordRotation(ctx context.Context, vms, users []string, snap string) ([]string, map[string]string) {
+func (m *mockVMware) RestoreVMsWithPasswordRotation(ctx context.Context, pairs []service.UserVMPair, policy service.SnapshotPolicy) []service.RestoreResult {
 	if m.restoreFn != nil {
-		return m.restoreFn(ctx, vms, users, snap)
+		return m.restoreFn(ctx, pairs, policy)
+	}
+	return restoreWith(nil)(ctx, pairs, policy)
+}
+
+// restoreWith returns a restoreFn that restores every VM except failedVMs
+// and rotates the passwords of the users listed in passwords. Users whose
+// primary VM failed are not rotated.
+func restoreWith(passwords map[string]string, failedVMs ...string) func(context.Context, []service.UserVMPair, service.SnapshotPolicy) []service.RestoreResult {
+	return func(ctx context.Context, pairs []service.UserVMPair, policy service.SnapshotPolicy) []service.RestoreResult {
+		results := make([]service.RestoreResult, 0, len(pairs))
+		for _, p := range pairs {
+			r := service.RestoreResult{User: p.User}
+			for _, vm := range p.VMs {
+				rule := policy.For(vm)
+				res := service.VMRestoreResult{VM: vm, Selector: rule.String(), Snapshot: rule.Snapshot, PowerState: "poweredOff"}
+				if slices.Contains(failedVMs, vm) {
+					res.Err = fmt.Errorf("failed to restore %s", vm)
+				}
+				r.VMs = append(r.VMs, res)
+			}
+			if primary := r.Primary(); primary != nil && primary.Err == nil {
+				r.Password = passwords[p.User]
+			}
+			results = append(results, r)
+		}
+		return results
+	}
+}
+
+func (m *mockVMware) ProvisionGuests(ctx context.Context, rules []service.GuestProvisionRule, targets []service.GuestTarget) []service.GuestProvisionResult {
+	if m.provisionFn != nil {
+		return m.provisionFn(ctx, rules, targets)
+	}
+	return nil
+}
+
+func (m *mockVMware) ConsoleLinks(ctx context.Context, username string, vms []string) []service.ConsoleLink {
+	if m.consoleFn != nil {
+		return m.consoleFn(ctx, username, vms)
+	}
+	return nil
+}
+
+func (m *mockVMware) SetPowerState(ctx context.Context, vm string, action service.PowerAction) (bool, error) {
+	if m.powerFn != nil {
+		return m.powerFn(ctx, vm, action)
+	}
+	return false, nil
+}
+
+func (m *mockVMware) PlanPowerOn(ctx context.Context, pairs []service.UserVMPair, cfg service.CapacityConfig) ([]service.UserVMPair, []service.CapacityShortfall, error) {
+	if m.planFn != nil {
+		return m.planFn(ctx, pairs, cfg)
+	}
+	return pairs, nil, nil
+}
+
+func (m *mockVMware) VMUsage(ctx context.Context, vmNames []string) ([]service.VMUsage, error) {
+	if m.usageFn != nil {
+		return m.usageFn(ctx, vmNames)
+	}
+	return nil, nil
+}
+
+func (m *mockVMware) SnapshotHealth(ctx context.Context, vmNames []string) ([]service.VMSnapshotHealth, error) {
+	if m.healthFn != nil {
+		return m.healthFn(ctx, vmNames)
+	}
+	return nil, nil
+}
+
+func (m *mockVMware) ConsolidateDisks(ctx context.Context, vm string) error {
+	if m.consolidFn != nil {
+		return m.consolidFn(ctx, vm)
+	}
+	return nil
+}
+
+func (m *mockVMware) CaptureScreenshot(ctx context.Context, vm, path string, readyTimeout time.Duration) (bool, error) {
+	if m.shotFn != nil {
+		return m.shotFn(ctx, vm, path, readyTimeout)
+	}
+	return false, fmt.Errorf("no screenshot")
+}
+
+func (m *mockVMware) ReconcileVMPermissions(ctx context.Context, vm, grantTo string, labUsers []string, role string) ([]service.PermissionChange, error) {
+	if m.permFn != nil {
+		return m.permFn(ctx, vm, grantTo, labUsers, role)
+	}
+	return nil, nil
+}
+
+func (m *mockVMware) PlanAccounts(ctx context.Context, users []string, role string, cfg service.AccountConfig) ([]service.AccountChange, error) {
+	if m.accountsFn != nil {
+		return m.accountsFn(ctx, users, role, cfg)
 	}
 	return nil, nil
 }
 
+func (m *mockVMware) ApplyAccountChange(ctx context.Context, c service.AccountChange) error {
+	if m.applyFn != nil {
+		return m.applyFn(ctx, c)
+	}
+	return nil
+}
+
+func (m *mockVMware) VerifyCredentials(ctx context.Context, username, password string, vms []string) error {
+	if m.verifyFn != nil {
+		return m.verifyFn(ctx, username, password, vms)
+	}
+	return nil
+}
+
 func (m *mockVMware) Close(ctx context.Context) error {
 	if m.closeFn != nil {
 		return m.closeFn(ctx)
@@ -59,13 +186,19 @@ func (m *mockCalendar) ListEvents(min, max string) ([]*calendar.Event, error) {
 }
 
 type mockEmail struct {
-	calls []emailCall
-	errFn func() error
+	calls   []emailCall
+	notices []noticeCall
+	errFn   func() error
+}
+
+type noticeCall struct {
+	to, subject, body string
 }
 
 type emailCall struct {
 	to, vmName, username, password string
 	attachment                     *service.EmailAttachment
+	vms                            []service.VMAccess
 }
 
 func (m *mockEmail) SendPasswordEmail(to, vmName, username, password string) error {
@@ -73,7 +206,23 @@ func (m *mockEmail) SendPasswordEmail(to, vmName, username, password string) err
 }
 
 func (m *mockEmail) SendPasswordEmailWithAttachment(to, vmName, username, password string, att *service.EmailAttachment) error {
-	m.calls = append(m.calls, emailCall{to: to, vmName: vmName, username: username, password: password, attachment: att})
+	return m.SendCredentialsEmail(service.CredentialEmail{
+		To: to, Username: username, Password: password,
+		VMs: []service.VMAccess{{Name: vmName}}, Attachment: att,
+	})
+}
+
+func (m *mockEmail) SendNotification(to, subject, body string) error {
+	m.notices = append(m.notices, noticeCall{to: to, subject: subject, body: body})
+	return nil
+}
+
+func (m *mockEmail) SendCredentialsEmail(msg service.CredentialEmail) error {
+	call := emailCall{to: msg.To, username: msg.Username, password: msg.Password, attachment: msg.Attachment, vms: msg.VMs}
+	if len(msg.VMs) > 0 {
+		call.vmName = msg.VMs[0].Name
+	}
+	m.calls = append(m.calls, call)
 	if m.errFn != nil {
 		return m.errFn()
 	}
@@ -133,9 +282,10 @@ func newTestOrch() (*Orchestrator, *bytes.Buffer) {
 }
 
 // setTestMetrics wires a real OTel meter so metric instrumentation in the orchestrator is exercised.
-func setTestMetrics(t *testing.T, o *Orchestrator) {
+func setTestMetrics(t *testing.T, o *Orchestrator) *sdkmetric.ManualReader {
 	t.Helper()
-	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(sdkmetric.NewManualReader()))
+	reader := sdkmetric.NewManualReader()
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
 	prev := otel.GetMeterProvider()
 	otel.SetMeterProvider(mp)
 	t.Cleanup(func() {
@@ -146,6 +296,25 @@ func setTestMetrics(t *testing.T, o *Orchestrator) {
 	m, err := metrics.New(meter)
 	require.NoError(t, err)
 	o.Metrics = m
+	return reader
+}
+
+// gaugePoints collects the data points of the named gauge.
+func gaugePoints[N int64 | float64](t *testing.T, reader *sdkmetric.ManualReader, name string) []metricdata.DataPoint[N] {
+	t.Helper()
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name == name {
+				g, ok := m.Data.(metricdata.Gauge[N])
+				require.True(t, ok, "%s is not a gauge", name)
+				return g.DataPoints
+			}
+		}
+	}
+	t.Fatalf("metric %s not recorded", name)
+	return nil
 }
 
 // --- FindVMsByPrefixes tests ---
@@ -396,6 +565,26 @@ func TestFetchVMInventory_Error(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestFetchVMInventory_PartialFailureLogged(t *testing.T) {
+	o, buf := newTestOrch()
+	o.VMware = &mockVMware{
+		listFn: func(ctx context.Context) (*models.VMListResponse, error) {
+			return &models.VMListResponse{
+				VMs:      []models.VM{{Name: "vm1"}},
+				TotalVMs: 1,
+				Errors:   []models.VMInventoryError{{VM: "vm2", Ref: "vm-42", Error: "NoPermission"}},
+			}, nil
+		},
+	}
+
+	result, err := o.FetchVMInventory()
+	require.NoError(t, err)
+	assert.Len(t, result.VMs, 1)
+	assert.Contains(t, buf.String(), "STATUS=vm_inventory_partial")
+	assert.Contains(t, buf.String(), "VM=vm2")
+	assert.Contains(t, buf.String(), "REF=vm-42")
+}
+
 // --- LogVMInventory tests ---
 
 func TestLogVMInventory(t *testing.T) {
@@ -415,6 +604,27 @@ func TestLogVMInventory(t *testing.T) {
 	assert.Contains(t, output, "snap1")
 }
 
+func TestLogVMInventory_SnapshotTree(t *testing.T) {
+	o, buf := newTestOrch()
+	vms := []models.VM{
+		{
+			Name:       "vm1",
+			PowerState: "poweredOn",
+			Host:       "esxi-01",
+			Snapshots: []models.VMSnapshot{
+				{Name: "base", Children: []models.VMSnapshot{{Name: "golden", Current: true}}},
+			},
+		},
+	}
+
+	o.LogVMInventory(vms)
+	output := buf.String()
+	assert.Contains(t, output, "POWER_STATE=poweredOn")
+	assert.Contains(t, output, "HOST=esxi-01")
+	assert.Contains(t, output, "SNAPSHOT_COUNT=2")
+	assert.Contains(t, output, "SNAPSHOT=golden STATE= CREATED=0001-01-01 00:00:00 CURRENT=true PARENT=base")
+}
+
 // --- SelectVMsToRestore tests ---
 
 func TestSelectVMsToRestore_AllConfigured(t *testing.T) {
@@ -524,9 +734,7 @@ func TestFetchActiveEventsAt_CalendarError(t *testing.T) {
 func TestRestoreVMs_SuccessNoWireGuardNoEmail(t *testing.T) {
 	o, buf := newTestOrch()
 	o.VMware = &mockVMware{
-		restoreFn: func(ctx context.Context, vms, users []string, snap string) ([]string, map[string]string) {
-			return nil, map[string]string{"alice": "newpw"}
-		},
+		restoreFn: restoreWith(map[string]string{"alice": "newpw"}),
 	}
 
 	pairs := []service.UserVMPair{{User: "alice", VMs: []string{"vm-alice"}}}
@@ -544,9 +752,7 @@ func TestRestoreVMs_WithEmailAndWireGuard(t *testing.T) {
 	o.Email = email
 	o.WireGuard = wg
 	o.VMware = &mockVMware{
-		restoreFn: func(ctx context.Context, vms, users []string, snap string) ([]string, map[string]string) {
-			return nil, map[string]string{"alice": "pw123"}
-		},
+		restoreFn: restoreWith(map[string]string{"alice": "pw123"}),
 	}
 
 	pairs := []service.UserVMPair{{User: "alice", VMs: []string{"vm-alice"}}}
@@ -564,9 +770,7 @@ func TestRestoreVMs_WithEmailAndWireGuard(t *testing.T) {
 func TestRestoreVMs_PartialFailure(t *testing.T) {
 	o, _ := newTestOrch()
 	o.VMware = &mockVMware{
-		restoreFn: func(ctx context.Context, vms, users []string, snap string) ([]string, map[string]string) {
-			return []string{"vm-alice failed"}, map[string]string{"bob": "pw"}
-		},
+		restoreFn: restoreWith(map[string]string{"bob": "pw"}, "vm-alice"),
 	}
 
 	pairs := []service.UserVMPair{{User: "alice", VMs: []string{"vm-alice"}}, {User: "bob", VMs: []string{"vm-bob"}}}
@@ -580,9 +784,7 @@ func TestRestoreVMs_PartialFailure(t *testing.T) {
 func TestRestoreVMs_NoPasswordsRotated(t *testing.T) {
 	o, buf := newTestOrch()
 	o.VMware = &mockVMware{
-		restoreFn: func(ctx context.Context, vms, users []string, snap string) ([]string, map[string]string) {
-			return nil, nil
-		},
+		restoreFn: restoreWith(nil),
 	}
 
 	pairs := []service.UserVMPair{{User: "alice", VMs: []string{"vm-alice"}}}
@@ -598,9 +800,9 @@ func TestRestoreVMs_SnapshotNameFromConfig(t *testing.T) {
 	snapName := "clean-state"
 	o.FeatureCfg.ESXi.SnapshotName = &snapName
 	o.VMware = &mockVMware{
-		restoreFn: func(ctx context.Context, vms, users []string, snap string) ([]string, map[string]string) {
-			assert.Equal(t, "clean-state", snap)
-			return nil, nil
+		restoreFn: func(ctx context.Context, pairs []service.UserVMPair, policy service.SnapshotPolicy) []service.RestoreResult {
+			assert.Equal(t, "clean-state", policy.Default)
+			return restoreWith(nil)(ctx, pairs, policy)
 		},
 	}
 
@@ -617,9 +819,7 @@ func TestRestoreVMs_WireGuardKeyRotationError(t *testing.T) {
 		},
 	}
 	o.VMware = &mockVMware{
-		restoreFn: func(ctx context.Context, vms, users []string, snap string) ([]string, map[string]string) {
-			return nil, map[string]string{"alice": "pw"}
-		},
+		restoreFn: restoreWith(map[string]string{"alice": "pw"}),
 	}
 
 	err := o.RestoreVMs([]service.UserVMPair{{User: "alice", VMs: []string{"vm"}}}, []EventInfo{{Summary: "S", Email: "a@ex.com"}})
@@ -627,6 +827,28 @@ func TestRestoreVMs_WireGuardKeyRotationError(t *testing.T) {
 	assert.Contains(t, buf.String(), "Failed to rotate WireGuard key")
 }
 
+func TestRestoreVMs_WireGuardAddressKeyedOnUser(t *testing.T) {
+	o, _ := newTestOrch()
+	indexes := make(map[string][]int)
+	o.WireGuard = &mockWireGuard{
+		registerPeerFn: func(u, _ string, i int) error {
+			indexes[u] = append(indexes[u], i)
+			return nil
+		},
+		genConfigFn: func(u string, i int) (string, error) {
+			indexes[u] = append(indexes[u], i)
+			return "[Interface]\n", nil
+		},
+	}
+	o.VMware = &mockVMware{restoreFn: restoreWith(map[string]string{"bob": "pw"})}
+
+	// alice's pod failed validation, so bob is first in pairs but keeps
+	// the second tunnel address.
+	err := o.RestoreVMs([]service.UserVMPair{{User: "bob", VMs: []string{"vm-bob"}}}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]int{"bob": {1, 1}}, indexes)
+}
+
 func TestRestoreVMs_WireGuardConfigGenError(t *testing.T) {
 	o, buf := newTestOrch()
 	o.WireGuard = &mockWireGuard{
@@ -635,9 +857,7 @@ func TestRestoreVMs_WireGuardConfigGenError(t *testing.T) {
 		},
 	}
 	o.VMware = &mockVMware{
-		restoreFn: func(ctx context.Context, vms, users []string, snap string) ([]string, map[string]string) {
-			return nil, map[string]string{"alice": "pw"}
-		},
+		restoreFn: restoreWith(map[string]string{"alice": "pw"}),
 	}
 
 	err := o.RestoreVMs([]service.UserVMPair{{User: "alice", VMs: []string{"vm"}}}, []EventInfo{{Summary: "S", Email: "a@ex.com"}})
@@ -653,9 +873,7 @@ func TestRestoreVMs_RegisterPeerError(t *testing.T) {
 		},
 	}
 	o.VMware = &mockVMware{
-		restoreFn: func(ctx context.Context, vms, users []string, snap string) ([]string, map[string]string) {
-			return nil, map[string]string{"alice": "pw"}
-		},
+		restoreFn: restoreWith(map[string]string{"alice": "pw"}),
 	}
 
 	err := o.RestoreVMs([]service.UserVMPair{{User: "alice", VMs: []string{"vm"}}}, []EventInfo{{Summary: "S", Email: "a@ex.com"}})
@@ -667,9 +885,7 @@ func TestRestoreVMs_EmailError(t *testing.T) {
 	o, buf := newTestOrch()
 	o.Email = &mockEmail{errFn: func() error { return fmt.Errorf("smtp error") }}
 	o.VMware = &mockVMware{
-		restoreFn: func(ctx context.Context, vms, users []string, snap string) ([]string, map[string]string) {
-			return nil, map[string]string{"alice": "pw"}
-		},
+		restoreFn: restoreWith(map[string]string{"alice": "pw"}),
 	}
 
 	pairs := []service.UserVMPair{{User: "alice", VMs: []string{"vm-alice"}}}
@@ -680,14 +896,79 @@ func TestRestoreVMs_EmailError(t *testing.T) {
 	assert.Contains(t, buf.String(), "Failed to send password email")
 }
 
+func TestRestoreVMs_CredentialCheckFailureMovesBookingToSpare(t *testing.T) {
+	email := &mockEmail{}
+	o, buf := newTestOrch()
+	o.Email = email
+	o.FeatureCfg.Permissions = service.PermissionConfig{Enabled: true}
+	o.Health = newTestHealth(t, o.FeatureCfg.Quarantine)
+	var steps []string
+	o.VMware = &mockVMware{
+		restoreFn: restoreWith(map[string]string{"alice": "pw-a", "bob": "pw-b", "carol": "pw-c"}),
+		permFn: func(ctx context.Context, vm, grantTo string, labUsers []string, role string) ([]service.PermissionChange, error) {
+			steps = append(steps, "permissions "+vm+" "+grantTo)
+			return nil, nil
+		},
+		verifyFn: func(ctx context.Context, username, password string, vms []string) error {
+			steps = append(steps, "verify "+username)
+			if username == "bob" {
+				return fmt.Errorf("login as bob on esxi-1 failed: InvalidLogin")
+			}
+			return nil
+		},
+	}
+
+	pairs := []service.UserVMPair{
+		{User: "alice", VMs: []string{"vm-alice"}},
+		{User: "bob", VMs: []string{"vm-bob"}},
+		{User: "carol", VMs: []string{"vm-carol"}},
+	}
+	events := []EventInfo{{Summary: "S", Email: "a@ex.com"}, {Summary: "S", Email: "b@ex.com"}}
+
+	err := o.RestoreVMs(pairs, events)
+	assert.EqualError(t, err, "restore partially failed: 0 of 3 VMs failed, 1 password rotations failed")
+	assert.Equal(t, []string{
+		"permissions vm-alice alice", "verify alice",
+		"permissions vm-bob bob", "verify bob",
+		"permissions vm-carol carol", "verify carol",
+		"permissions vm-alice alice", "permissions vm-bob ", "permissions vm-carol carol",
+	}, steps, "permissions granted before each check and revoked from the failed pod after assignment")
+	require.Len(t, email.calls, 2)
+	assert.Equal(t, "a@ex.com", email.calls[0].to)
+	assert.Equal(t, "b@ex.com", email.calls[1].to)
+	assert.Equal(t, "carol", email.calls[1].username)
+	assert.True(t, o.Health.Quarantined("bob"))
+
+	output := buf.String()
+	assert.Contains(t, output, "MESSAGE=Credential check failed, pod not assigned")
+	assert.Contains(t, output, "MESSAGE=Booking reassigned to spare pod")
+	assert.Contains(t, output, "credential check failed: login as bob")
+}
+
+func TestRestoreVMs_PasswordRedactedInLog(t *testing.T) {
+	o, buf := newTestOrch()
+	o.VMware = &mockVMware{
+		restoreFn: func(ctx context.Context, pairs []service.UserVMPair, policy service.SnapshotPolicy) []service.RestoreResult {
+			return []service.RestoreResult{{
+				User:     "alice",
+				VMs:      []service.VMRestoreResult{{VM: "vm-alice", Err: fmt.Errorf("revert failed after rotating to Rotated-pw-1")}},
+				Password: "Rotated-pw-1",
+			}}
+		},
+	}
+
+	_ = o.RestoreVMs([]service.UserVMPair{{User: "alice", VMs: []string{"vm-alice"}}}, nil)
+	output := buf.String()
+	assert.Contains(t, output, "MESSAGE=User password rotated USER=alice\n")
+	assert.NotContains(t, output, "Rotated-pw-1", "not even inside an error")
+}
+
 func TestRestoreVMs_NoEmailForEvent(t *testing.T) {
 	email := &mockEmail{}
 	o, _ := newTestOrch()
 	o.Email = email
 	o.VMware = &mockVMware{
-		restoreFn: func(ctx context.Context, vms, users []string, snap string) ([]string, map[string]string) {
-			return nil, map[string]string{"alice": "pw"}
-		},
+		restoreFn: restoreWith(map[string]string{"alice": "pw"}),
 	}
 
 	pairs := []service.UserVMPair{{User: "alice", VMs: []string{"vm-alice"}}}
@@ -703,9 +984,7 @@ func TestRestoreVMs_PasswordNotInMap(t *testing.T) {
 	o, _ := newTestOrch()
 	o.Email = email
 	o.VMware = &mockVMware{
-		restoreFn: func(ctx context.Context, vms, users []string, snap string) ([]string, map[string]string) {
-			return nil, map[string]string{"bob": "pw"} // alice not in map
-		},
+		restoreFn: restoreWith(map[string]string{"bob": "pw"}), // alice not in map
 	}
 
 	pairs := []service.UserVMPair{{User: "alice", VMs: []string{"vm-alice"}}}
@@ -722,9 +1001,7 @@ func TestRestoreVMs_EmailWithoutWireGuard(t *testing.T) {
 	o.Email = email
 	// No WireGuard service
 	o.VMware = &mockVMware{
-		restoreFn: func(ctx context.Context, vms, users []string, snap string) ([]string, map[string]string) {
-			return nil, map[string]string{"alice": "pw"}
-		},
+		restoreFn: restoreWith(map[string]string{"alice": "pw"}),
 	}
 
 	pairs := []service.UserVMPair{{User: "alice", VMs: []string{"vm-alice"}}}
@@ -821,9 +1098,7 @@ func TestRun_HappyPath(t *testing.T) {
 				VMs: []models.VM{{Name: "vm-alice"}, {Name: "vm-bob"}},
 			}, nil
 		},
-		restoreFn: func(ctx context.Context, vms, users []string, snap string) ([]string, map[string]string) {
-			return nil, map[string]string{"alice": "pw-alice"}
-		},
+		restoreFn: restoreWith(map[string]string{"alice": "pw-alice"}),
 	}
 	now := time.Now()
 	o.Calendar = &mockCalendar{
@@ -868,13 +1143,11 @@ func TestRun_CloseError(t *testing.T) {
 
 func TestRestoreVMs_MultipleVMsPerPair(t *testing.T) {
 	o, buf := newTestOrch()
-	var capturedVMs []string
-	var capturedUsers []string
+	var captured []service.UserVMPair
 	o.VMware = &mockVMware{
-		restoreFn: func(ctx context.Context, vms, users []string, snap string) ([]string, map[string]string) {
-			capturedVMs = vms
-			capturedUsers = users
-			return nil, map[string]string{"alice": "pw"}
+		restoreFn: func(ctx context.Context, pairs []service.UserVMPair, policy service.SnapshotPolicy) []service.RestoreResult {
+			captured = pairs
+			return restoreWith(map[string]string{"alice": "pw"})(ctx, pairs, policy)
 		},
 	}
 
@@ -884,8 +1157,7 @@ func TestRestoreVMs_MultipleVMsPerPair(t *testing.T) {
 
 	err := o.RestoreVMs(pairs, events)
 	assert.NoError(t, err)
-	assert.Equal(t, []string{"vm-fg", "vm-client"}, capturedVMs)
-	assert.Equal(t, []string{"alice", ""}, capturedUsers) // only first VM gets user
+	assert.Equal(t, pairs, captured)
 	assert.Contains(t, buf.String(), "Restore completed successfully")
 }
 
@@ -894,9 +1166,7 @@ func TestRestoreVMs_MoreEventsThanPairs(t *testing.T) {
 	o, _ := newTestOrch()
 	o.Email = email
 	o.VMware = &mockVMware{
-		restoreFn: func(ctx context.Context, vms, users []string, snap string) ([]string, map[string]string) {
-			return nil, map[string]string{"alice": "pw"}
-		},
+		restoreFn: restoreWith(map[string]string{"alice": "pw"}),
 	}
 
 	// 1 pair but 2 events
@@ -1033,9 +1303,7 @@ func TestRun_HappyPath_WithMetrics(t *testing.T) {
 				VMs: []models.VM{{Name: "vm-alice"}, {Name: "vm-bob"}},
 			}, nil
 		},
-		restoreFn: func(ctx context.Context, vms, users []string, snap string) ([]string, map[string]string) {
-			return nil, map[string]string{"alice": "pw-alice"}
-		},
+		restoreFn: restoreWith(map[string]string{"alice": "pw-alice"}),
 	}
 	now := time.Now()
 	o.Calendar = &mockCalendar{
@@ -1143,9 +1411,7 @@ func TestRun_RestorePartialFailure_WithMetrics(t *testing.T) {
 				VMs: []models.VM{{Name: "vm-alice"}, {Name: "vm-bob"}},
 			}, nil
 		},
-		restoreFn: func(ctx context.Context, vms, users []string, snap string) ([]string, map[string]string) {
-			return []string{"vm-alice failed"}, map[string]string{}
-		},
+		restoreFn: restoreWith(map[string]string{}, "vm-alice"),
 	}
 	now := time.Now()
 	o.Calendar = &mockCalendar{
@@ -1173,9 +1439,7 @@ func TestRestoreVMs_WithEmailAndWireGuard_WithMetrics(t *testing.T) {
 	o.Email = email
 	o.WireGuard = wg
 	o.VMware = &mockVMware{
-		restoreFn: func(ctx context.Context, vms, users []string, snap string) ([]string, map[string]string) {
-			return nil, map[string]string{"alice": "pw123"}
-		},
+		restoreFn: restoreWith(map[string]string{"alice": "pw123"}),
 	}
 
 	pairs := []service.UserVMPair{{User: "alice", VMs: []string{"vm-alice"}}}
@@ -1191,9 +1455,7 @@ func TestRestoreVMs_PartialFailure_WithMetrics(t *testing.T) {
 	o, _ := newTestOrch()
 	setTestMetrics(t, o)
 	o.VMware = &mockVMware{
-		restoreFn: func(ctx context.Context, vms, users []string, snap string) ([]string, map[string]string) {
-			return []string{"vm-alice failed"}, map[string]string{"bob": "pw"}
-		},
+		restoreFn: restoreWith(map[string]string{"bob": "pw"}, "vm-alice"),
 	}
 
 	pairs := []service.UserVMPair{{User: "alice", VMs: []string{"vm-alice"}}, {User: "bob", VMs: []string{"vm-bob"}}}
@@ -1213,9 +1475,7 @@ func TestRestoreVMs_WireGuardKeyRotationError_WithMetrics(t *testing.T) {
 		},
 	}
 	o.VMware = &mockVMware{
-		restoreFn: func(ctx context.Context, vms, users []string, snap string) ([]string, map[string]string) {
-			return nil, map[string]string{"alice": "pw"}
-		},
+		restoreFn: restoreWith(map[string]string{"alice": "pw"}),
 	}
 
 	err := o.RestoreVMs([]service.UserVMPair{{User: "alice", VMs: []string{"vm"}}}, []EventInfo{{Summary: "S", Email: "a@ex.com"}})
@@ -1232,9 +1492,7 @@ func TestRestoreVMs_RegisterPeerError_WithMetrics(t *testing.T) {
 		},
 	}
 	o.VMware = &mockVMware{
-		restoreFn: func(ctx context.Context, vms, users []string, snap string) ([]string, map[string]string) {
-			return nil, map[string]string{"alice": "pw"}
-		},
+		restoreFn: restoreWith(map[string]string{"alice": "pw"}),
 	}
 
 	err := o.RestoreVMs([]service.UserVMPair{{User: "alice", VMs: []string{"vm"}}}, []EventInfo{{Summary: "S", Email: "a@ex.com"}})
@@ -1247,9 +1505,7 @@ func TestRestoreVMs_EmailError_WithMetrics(t *testing.T) {
 	setTestMetrics(t, o)
 	o.Email = &mockEmail{errFn: func() error { return fmt.Errorf("smtp error") }}
 	o.VMware = &mockVMware{
-		restoreFn: func(ctx context.Context, vms, users []string, snap string) ([]string, map[string]string) {
-			return nil, map[string]string{"alice": "pw"}
-		},
+		restoreFn: restoreWith(map[string]string{"alice": "pw"}),
 	}
 
 	pairs := []service.UserVMPair{{User: "alice", VMs: []string{"vm-alice"}}}
@@ -1264,9 +1520,7 @@ func TestRestoreVMs_NoPasswordsRotated_WithMetrics(t *testing.T) {
 	o, buf := newTestOrch()
 	setTestMetrics(t, o)
 	o.VMware = &mockVMware{
-		restoreFn: func(ctx context.Context, vms, users []string, snap string) ([]string, map[string]string) {
-			return nil, nil
-		},
+		restoreFn: restoreWith(nil),
 	}
 
 	pairs := []service.UserVMPair{{User: "alice", VMs: []string{"vm-alice"}}}
@@ -1276,3 +1530,1087 @@ func TestRestoreVMs_NoPasswordsRotated_WithMetrics(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Contains(t, buf.String(), "Restore completed successfully")
 }
+
+// --- ProvisionGuests tests ---
+
+func TestProvisionGuests_NoRules(t *testing.T) {
+	o, _ := newTestOrch()
+	called := false
+	o.VMware = &mockVMware{
+		provisionFn: func(ctx context.Context, rules []service.GuestProvisionRule, targets []service.GuestTarget) []service.GuestProvisionResult {
+			called = true
+			return nil
+		},
+	}
+
+	results := o.ProvisionGuests([]service.UserVMPair{{User: "alice", VMs: []string{"vm-alice"}}})
+	assert.Nil(t, results)
+	assert.False(t, called)
+}
+
+func TestProvisionGuests_TargetsEveryVMWithUser(t *testing.T) {
+	o, buf := newTestOrch()
+	o.FeatureCfg.ESXi.GuestProvisioning = []service.GuestProvisionRule{{VMPrefixes: []string{"Pod-1_Client"}}}
+	var got []service.GuestTarget
+	o.VMware = &mockVMware{
+		provisionFn: func(ctx context.Context, rules []service.GuestProvisionRule, targets []service.GuestTarget) []service.GuestProvisionResult {
+			got = targets
+			return []service.GuestProvisionResult{
+				{VM: "Pod-1_Client_Deb", User: "alice"},
+				{
+					VM:    "Pod-1_Client_Win",
+					User:  "alice",
+					Err:   fmt.Errorf("/bin/sh: exited with code 2"),
+					Steps: []service.GuestStepResult{{Step: "/bin/sh", ExitCode: 2, Err: fmt.Errorf("exited with code 2")}},
+				},
+			}
+		},
+	}
+
+	results := o.ProvisionGuests([]service.UserVMPair{{User: "alice", VMs: []string{"Pod-1_FortiGate", "Pod-1_Client_Deb", "Pod-1_Client_Win"}}})
+	require.Len(t, results, 2)
+	assert.Equal(t, []service.GuestTarget{
+		{VM: "Pod-1_FortiGate", User: "alice"},
+		{VM: "Pod-1_Client_Deb", User: "alice"},
+		{VM: "Pod-1_Client_Win", User: "alice"},
+	}, got)
+
+	output := buf.String()
+	assert.Contains(t, output, "Guest provisioning step failed")
+	assert.Contains(t, output, "VM=Pod-1_Client_Win")
+	assert.Contains(t, output, "EXIT_CODE=2")
+	assert.Contains(t, output, "FAILED=1")
+}
+
+func TestRestoreVMs_EmailListsEveryVM(t *testing.T) {
+	email := &mockEmail{}
+	o, _ := newTestOrch()
+	o.Email = email
+	o.FeatureCfg.ESXi.GuestProvisioning = []service.GuestProvisionRule{{VMPrefixes: []string{"Pod-1_Client"}}}
+	o.VMware = &mockVMware{
+		restoreFn: restoreWith(map[string]string{"alice": "pw123"}),
+		provisionFn: func(ctx context.Context, rules []service.GuestProvisionRule, targets []service.GuestTarget) []service.GuestProvisionResult {
+			return []service.GuestProvisionResult{{VM: "Pod-1_Client", User: "alice", Password: "guest-pw"}}
+		},
+		consoleFn: func(ctx context.Context, username string, vms []string) []service.ConsoleLink {
+			links := make([]service.ConsoleLink, len(vms))
+			for i, vm := range vms {
+				links[i] = service.ConsoleLink{VM: vm, HostClientURL: "https://esxi/" + vm, VMRCURL: "vmrc://" + username + "@esxi/" + vm}
+			}
+			return links
+		},
+	}
+
+	pairs := []service.UserVMPair{{User: "alice", VMs: []string{"Pod-1_FortiGate", "Pod-1_Client"}}}
+	events := []EventInfo{{Summary: "Session", Email: "alice@example.com"}}
+
+	require.NoError(t, o.RestoreVMs(pairs, events))
+	require.Len(t, email.calls, 1)
+	assert.Equal(t, []service.VMAccess{
+		{Name: "Pod-1_FortiGate", HostClientURL: "https://esxi/Pod-1_FortiGate", VMRCURL: "vmrc://alice@esxi/Pod-1_FortiGate"},
+		{Name: "Pod-1_Client", HostClientURL: "https://esxi/Pod-1_Client", VMRCURL: "vmrc://alice@esxi/Pod-1_Client", GuestPassword: "guest-pw"},
+	}, email.calls[0].vms)
+}
+
+func TestRestoreVMs_PrimaryFailureSkipsEmail(t *testing.T) {
+	email := &mockEmail{}
+	o, buf := newTestOrch()
+	o.Email = email
+	o.VMware = &mockVMware{
+		restoreFn: restoreWith(map[string]string{"alice": "pw-a", "bob": "pw-b"}, "vm-alice"),
+	}
+
+	pairs := []service.UserVMPair{{User: "alice", VMs: []string{"vm-alice"}}, {User: "bob", VMs: []string{"vm-bob"}}}
+	events := []EventInfo{{Summary: "S1", Email: "alice@ex.com"}, {Summary: "S2", Email: "bob@ex.com"}}
+
+	err := o.RestoreVMs(pairs, events)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "1 of 2 VMs failed")
+	require.Len(t, email.calls, 1)
+	assert.Equal(t, "bob@ex.com", email.calls[0].to)
+
+	output := buf.String()
+	assert.Contains(t, output, "Credential email skipped")
+	assert.Contains(t, output, "EMAIL=alice@ex.com")
+	assert.Contains(t, output, "VM=vm-alice")
+}
+
+func TestRestoreVMs_RotationFailureReported(t *testing.T) {
+	o, buf := newTestOrch()
+	o.VMware = &mockVMware{
+		restoreFn: func(ctx context.Context, pairs []service.UserVMPair, policy service.SnapshotPolicy) []service.RestoreResult {
+			return []service.RestoreResult{{
+				User:        "alice",
+				VMs:         []service.VMRestoreResult{{VM: "vm-alice"}},
+				RotationErr: fmt.Errorf("no direct ESXi connection configured"),
+			}}
+		},
+	}
+
+	err := o.RestoreVMs([]service.UserVMPair{{User: "alice", VMs: []string{"vm-alice"}}}, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "0 of 1 VMs failed, 1 password rotations failed")
+	assert.Contains(t, buf.String(), "Password rotation failed")
+	assert.Contains(t, buf.String(), "USER=alice")
+}
+
+// --- selector tests ---
+
+func TestFindVMsBySelectors_InventoryOrderNoDuplicates(t *testing.T) {
+	vms := []models.VM{
+		{Name: "Pod-1_Client", Folder: "Pod-1"},
+		{Name: "Pod-1_FortiGate", Folder: "Pod-1", Attributes: map[string]string{"lab-pod": "1"}},
+		{Name: "Pod-1_x", Folder: "Scratch"},
+		{Name: "Renamed-FW", Attributes: map[string]string{"lab-pod": "1"}},
+	}
+	got := FindVMsBySelectors(vms, []service.VMSelector{
+		{Attribute: "lab-pod", Value: "1"},
+		{Folder: "Pod-1"},
+	})
+	assert.Equal(t, []string{"Pod-1_Client", "Pod-1_FortiGate", "Renamed-FW"}, got)
+}
+
+func TestSelectAllVMs_AttributeSelectors(t *testing.T) {
+	o, buf := newTestOrch()
+	o.FeatureCfg.ESXi.UserVMMappings = nil
+	o.FeatureCfg.ESXi.UserVMSelectors = map[string][]service.VMSelector{
+		"alice": {{Attribute: "lab-pod", Value: "1"}},
+		"bob":   {{ResourcePool: "Pod-2"}},
+	}
+	vmList := &models.VMListResponse{VMs: []models.VM{
+		{Name: "fw-a", Attributes: map[string]string{"lab-pod": "1"}},
+		{Name: "client-a", Attributes: map[string]string{"lab-pod": "1"}},
+		{Name: "fw-b", ResourcePool: "Pod-3"},
+	}}
+
+	pairs := o.SelectAllVMs(vmList)
+	assert.Equal(t, []service.UserVMPair{{User: "alice", VMs: []string{"fw-a", "client-a"}}}, pairs)
+	assert.Contains(t, buf.String(), "No VMs found in inventory for configured selector")
+	assert.Contains(t, buf.String(), "SELECTOR=resource_pool Pod-2")
+}
+
+func TestResolveSelectors_Report(t *testing.T) {
+	o, _ := newTestOrch()
+	o.FeatureCfg.ESXi.UserVMMappings = map[string][]string{"alice": {"Pod-1_"}}
+	o.FeatureCfg.ESXi.UserVMSelectors = map[string][]service.VMSelector{"alice": {{Folder: "Spare"}}}
+	vms := []models.VM{{Name: "Pod-1_FortiGate"}, {Name: "Pod-1_Client"}}
+
+	res := o.ResolveSelectors(vms)
+	assert.Equal(t, []SelectorResolution{
+		{User: "alice", Selector: "prefix Pod-1_", VMs: []string{"Pod-1_FortiGate", "Pod-1_Client"}},
+		{User: "alice", Selector: "folder Spare"},
+	}, res)
+
+	var out bytes.Buffer
+	require.NoError(t, WriteSelectorReport(&out, res))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 3)
+	assert.Regexp(t, `^USER\s+SELECTOR\s+VMS$`, lines[0])
+	assert.Regexp(t, `^alice\s+prefix Pod-1_\s+Pod-1_FortiGate, Pod-1_Client$`, lines[1])
+	assert.Regexp(t, `^alice\s+folder Spare\s+\(none\)$`, lines[2])
+}
+
+// --- Pod validation tests ---
+
+func TestValidatePods_MarksIncompletePodsUnavailable(t *testing.T) {
+	o, buf := newTestOrch()
+	setTestMetrics(t, o)
+	o.FeatureCfg.ESXi.PodTemplates = []service.PodTemplate{
+		{Name: "fortigate-lab", Roles: []string{"FortiGate", "Client"}, Snapshot: "clean"},
+	}
+	clean := []models.VMSnapshot{{Name: "clean"}}
+	vms := []models.VM{
+		{Name: "Pod-1_FortiGate", Snapshots: clean},
+		{Name: "Pod-1_Client", Snapshots: clean},
+		{Name: "Pod-2_FortiGate", Snapshots: clean},
+		{Name: "Pod-3_FortiGate", Snapshots: clean},
+		{Name: "Pod-3_Client"},
+	}
+	pairs := []service.UserVMPair{
+		{User: "alice", VMs: []string{"Pod-1_FortiGate", "Pod-1_Client"}},
+		{User: "bob", VMs: []string{"Pod-2_FortiGate"}},
+		{User: "carol", VMs: []string{"Pod-3_FortiGate", "Pod-3_Client"}},
+	}
+
+	available, statuses := o.ValidatePods(vms, pairs)
+	assert.Equal(t, pairs[:1], available)
+	require.Len(t, statuses, 3)
+	assert.True(t, statuses[0].Available())
+	assert.Equal(t, "no VM for role Client", statuses[1].Reason())
+	assert.Equal(t, "Pod-3_Client has no snapshots", statuses[2].Reason())
+	assert.Contains(t, buf.String(), "MESSAGE=Pod unavailable")
+	assert.Contains(t, buf.String(), "USER=carol")
+}
+
+func TestValidatePods_NoTemplateIsAvailable(t *testing.T) {
+	o, buf := newTestOrch()
+	pairs := []service.UserVMPair{{User: "alice", VMs: []string{"vm-alice"}}}
+
+	available, statuses := o.ValidatePods([]models.VM{{Name: "vm-alice"}}, pairs)
+	assert.Equal(t, pairs, available)
+	assert.Equal(t, []PodStatus{{User: "alice", VMs: []string{"vm-alice"}}}, statuses)
+	assert.NotContains(t, buf.String(), "Pod unavailable")
+}
+
+func TestRun_SkipsUnavailablePods(t *testing.T) {
+	o, _ := newTestOrch()
+	o.FeatureCfg.ESXi.PodTemplates = []service.PodTemplate{{Name: "lab", Users: []string{"alice"}, Roles: []string{"FortiGate"}}}
+	email := &mockEmail{}
+	o.Email = email
+	var restored []service.UserVMPair
+	o.VMware = &mockVMware{
+		listFn: func(ctx context.Context) (*models.VMListResponse, error) {
+			// alice's pod has no FortiGate VM, so it is unavailable.
+			return &models.VMListResponse{VMs: []models.VM{{Name: "vm-alice"}, {Name: "vm-bob"}}}, nil
+		},
+		restoreFn: func(ctx context.Context, pairs []service.UserVMPair, policy service.SnapshotPolicy) []service.RestoreResult {
+			restored = pairs
+			return restoreWith(map[string]string{"bob": "pw-bob"})(ctx, pairs, policy)
+		},
+	}
+	now := time.Now()
+	o.Calendar = &mockCalendar{
+		listFn: func(min, max string) ([]*calendar.Event, error) {
+			return []*calendar.Event{{
+				Summary: "student@ex.com",
+				Start:   &calendar.EventDateTime{DateTime: now.Add(-30 * time.Minute).Format(time.RFC3339)},
+				End:     &calendar.EventDateTime{DateTime: now.Add(30 * time.Minute).Format(time.RFC3339)},
+			}}, nil
+		},
+	}
+
+	require.NoError(t, o.Run())
+	assert.Equal(t, []service.UserVMPair{{User: "bob", VMs: []string{"vm-bob"}}}, restored)
+	require.Len(t, email.calls, 1)
+	assert.Equal(t, "student@ex.com", email.calls[0].to)
+}
+
+func TestWritePlan(t *testing.T) {
+	var out bytes.Buffer
+	require.NoError(t, WritePlan(&out, []PodStatus{
+		{User: "alice", Template: "lab", VMs: []string{"Pod-1_FortiGate", "Pod-1_Client"}},
+		{User: "bob", Template: "lab", VMs: []string{"Pod-2_FortiGate"}, Issues: []service.PodIssue{
+			{Kind: service.PodIssueMissingRole, Message: "no VM for role Client"},
+		}},
+		{User: "carol", VMs: []string{"vm-carol"}},
+	}))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 4)
+	assert.Regexp(t, `^USER\s+TEMPLATE\s+STATUS\s+VMS\s+REASON$`, lines[0])
+	assert.Regexp(t, `^alice\s+lab\s+available\s+Pod-1_FortiGate, Pod-1_Client\s*$`, lines[1])
+	assert.Regexp(t, `^bob\s+lab\s+unavailable\s+Pod-2_FortiGate\s+no VM for role Client$`, lines[2])
+	assert.Regexp(t, `^carol\s+-\s+available\s+vm-carol\s*$`, lines[3])
+}
+
+// --- Quarantine and spare tests ---
+
+func newTestHealth(t *testing.T, cfg service.QuarantineConfig) *service.HealthTracker {
+	t.Helper()
+	cfg.StatePath = filepath.Join(t.TempDir(), "pod_health.json")
+	h, err := service.LoadHealthTracker(cfg)
+	require.NoError(t, err)
+	return h
+}
+
+func TestRestoreVMs_BrokenPodBookingMovesToSpare(t *testing.T) {
+	email := &mockEmail{}
+	o, buf := newTestOrch()
+	o.Email = email
+	o.FeatureCfg.Quarantine = service.QuarantineConfig{SpareUsers: []string{"spare"}, OperatorEmails: []string{"ops@ex.com"}}
+	o.Health = newTestHealth(t, o.FeatureCfg.Quarantine)
+	o.VMware = &mockVMware{
+		restoreFn: restoreWith(map[string]string{"alice": "pw-a", "bob": "pw-b", "spare": "pw-s"}, "vm-alice-2"),
+	}
+
+	pairs := []service.UserVMPair{
+		{User: "alice", VMs: []string{"vm-alice", "vm-alice-2"}},
+		{User: "bob", VMs: []string{"vm-bob"}},
+		{User: "spare", VMs: []string{"vm-spare"}},
+	}
+	events := []EventInfo{{Summary: "S1", Email: "s1@ex.com"}, {Summary: "S2", Email: "s2@ex.com"}}
+
+	err := o.RestoreVMs(pairs, events)
+	require.Error(t, err)
+	require.Len(t, email.calls, 2)
+	assert.Equal(t, "s2@ex.com", email.calls[0].to, "bob's pod keeps its booking")
+	assert.Equal(t, "bob", email.calls[0].username)
+	assert.Equal(t, "s1@ex.com", email.calls[1].to)
+	assert.Equal(t, "spare", email.calls[1].username)
+
+	assert.True(t, o.Health.Quarantined("alice"))
+	require.Len(t, email.notices, 1)
+	assert.Equal(t, "ops@ex.com", email.notices[0].to)
+	assert.Equal(t, "Pod quarantined: alice", email.notices[0].subject)
+	assert.Contains(t, email.notices[0].body, "vm-alice-2 not restored")
+
+	output := buf.String()
+	assert.Contains(t, output, "MESSAGE=Pod quarantined")
+	assert.Contains(t, output, "MESSAGE=Booking reassigned to spare pod")
+	assert.Contains(t, output, "ORIGINAL_USER=alice")
+}
+
+func TestRestoreVMs_QuarantinedPodIsRestoredButNotAssigned(t *testing.T) {
+	email := &mockEmail{}
+	o, _ := newTestOrch()
+	o.Email = email
+	o.FeatureCfg.Quarantine = service.QuarantineConfig{ReleaseAfter: 2}
+	o.Health = newTestHealth(t, o.FeatureCfg.Quarantine)
+	o.Health.RecordFailure("alice", "snapshot missing", time.Now())
+	var restored []service.UserVMPair
+	o.VMware = &mockVMware{
+		restoreFn: func(ctx context.Context, pairs []service.UserVMPair, policy service.SnapshotPolicy) []service.RestoreResult {
+			restored = pairs
+			return restoreWith(map[string]string{"alice": "pw-a", "bob": "pw-b"})(ctx, pairs, policy)
+		},
+	}
+
+	pairs := []service.UserVMPair{{User: "alice", VMs: []string{"vm-alice"}}, {User: "bob", VMs: []string{"vm-bob"}}}
+	require.NoError(t, o.RestoreVMs(pairs, []EventInfo{{Summary: "S1", Email: "s1@ex.com"}}))
+
+	assert.Equal(t, pairs, restored, "quarantined pods are still reverted")
+	require.Len(t, email.calls, 1)
+	assert.Equal(t, "bob", email.calls[0].username)
+	assert.True(t, o.Health.Quarantined("alice"), "one clean run of two")
+}
+
+func TestRestoreVMs_FailedRotationOrCheckKeepsQuarantine(t *testing.T) {
+	email := &mockEmail{}
+	o, _ := newTestOrch()
+	o.Email = email
+	o.FeatureCfg.Quarantine = service.QuarantineConfig{OperatorEmails: []string{"ops@ex.com"}}
+	o.Health = newTestHealth(t, o.FeatureCfg.Quarantine)
+	o.Health.RecordFailure("alice", "snapshot missing", time.Now())
+	o.Health.RecordFailure("bob", "snapshot missing", time.Now())
+	o.VMware = &mockVMware{
+		restoreFn: func(ctx context.Context, pairs []service.UserVMPair, policy service.SnapshotPolicy) []service.RestoreResult {
+			return []service.RestoreResult{
+				{User: "alice", VMs: []service.VMRestoreResult{{VM: "vm-alice"}}, RotationErr: fmt.Errorf("UpdateUser failed")},
+				{User: "bob", VMs: []service.VMRestoreResult{{VM: "vm-bob"}}, Password: "pw-b"},
+			}
+		},
+		verifyFn: func(ctx context.Context, username, password string, vms []string) error {
+			return fmt.Errorf("InvalidLogin")
+		},
+	}
+
+	pairs := []service.UserVMPair{{User: "alice", VMs: []string{"vm-alice"}}, {User: "bob", VMs: []string{"vm-bob"}}}
+	require.Error(t, o.RestoreVMs(pairs, []EventInfo{{Summary: "S1", Email: "s1@ex.com"}}))
+
+	assert.True(t, o.Health.Quarantined("alice"), "failed rotation is not a clean run")
+	assert.True(t, o.Health.Quarantined("bob"), "failed credential check is not a clean run")
+	assert.Empty(t, email.notices, "no release and quarantine notices for the same run")
+	assert.Empty(t, email.calls)
+}
+
+func TestRestoreVMs_CleanRestoreReleasesQuarantine(t *testing.T) {
+	email := &mockEmail{}
+	o, buf := newTestOrch()
+	o.Email = email
+	o.FeatureCfg.Quarantine = service.QuarantineConfig{OperatorEmails: []string{"ops@ex.com"}}
+	o.Health = newTestHealth(t, o.FeatureCfg.Quarantine)
+	o.Health.RecordFailure("alice", "snapshot missing", time.Now())
+	o.VMware = &mockVMware{restoreFn: restoreWith(map[string]string{"alice": "pw-a"})}
+
+	pairs := []service.UserVMPair{{User: "alice", VMs: []string{"vm-alice"}}}
+	require.NoError(t, o.RestoreVMs(pairs, []EventInfo{{Summary: "S1", Email: "s1@ex.com"}}))
+
+	assert.False(t, o.Health.Quarantined("alice"))
+	require.Len(t, email.calls, 1)
+	require.Len(t, email.notices, 1)
+	assert.Equal(t, "Pod released from quarantine: alice", email.notices[0].subject)
+	assert.Contains(t, buf.String(), "MESSAGE=Pod released from quarantine")
+}
+
+func TestRestoreVMs_NoHealthySpareSkipsEmail(t *testing.T) {
+	email := &mockEmail{}
+	o, buf := newTestOrch()
+	o.Email = email
+	o.FeatureCfg.Quarantine = service.QuarantineConfig{SpareUsers: []string{"bob"}}
+	o.VMware = &mockVMware{restoreFn: restoreWith(map[string]string{"alice": "pw-a"}, "vm-alice", "vm-bob")}
+
+	pairs := []service.UserVMPair{{User: "alice", VMs: []string{"vm-alice"}}, {User: "bob", VMs: []string{"vm-bob"}}}
+	require.Error(t, o.RestoreVMs(pairs, []EventInfo{{Summary: "S1", Email: "s1@ex.com"}}))
+
+	assert.Empty(t, email.calls)
+	assert.Contains(t, buf.String(), "MESSAGE=Credential email skipped")
+	assert.Contains(t, buf.String(), "no spare pod available")
+}
+
+func TestRun_ValidationFailureQuarantinesPod(t *testing.T) {
+	o, _ := newTestOrch()
+	o.FeatureCfg.ESXi.PodTemplates = []service.PodTemplate{{Name: "lab", Users: []string{"alice"}, Roles: []string{"FortiGate"}}}
+	o.FeatureCfg.Quarantine = service.QuarantineConfig{StatePath: filepath.Join(t.TempDir(), "pod_health.json")}
+	health, err := service.LoadHealthTracker(o.FeatureCfg.Quarantine)
+	require.NoError(t, err)
+	o.Health = health
+	o.VMware = &mockVMware{
+		listFn: func(ctx context.Context) (*models.VMListResponse, error) {
+			return &models.VMListResponse{VMs: []models.VM{{Name: "vm-alice"}, {Name: "vm-bob"}}}, nil
+		},
+		restoreFn: restoreWith(map[string]string{"bob": "pw-b"}),
+	}
+
+	require.NoError(t, o.Run())
+
+	reloaded, err := service.LoadHealthTracker(o.FeatureCfg.Quarantine)
+	require.NoError(t, err)
+	assert.True(t, reloaded.Quarantined("alice"), "state is saved at the end of the run")
+	assert.Equal(t, "no VM for role FortiGate", reloaded.Pods()[0].Reason)
+}
+
+func TestWriteQuarantineReport(t *testing.T) {
+	since := time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+	var out bytes.Buffer
+	require.NoError(t, WriteQuarantineReport(&out, []service.PodHealth{
+		{User: "alice", Failures: 2, Quarantined: true, Since: since, Reason: "vm-alice not restored"},
+		{User: "bob", Failures: 1, Reason: "no VM for role Client"},
+	}))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 3)
+	assert.Regexp(t, `^USER\s+STATUS\s+FAILURES\s+SINCE\s+REASON$`, lines[0])
+	assert.Regexp(t, `^alice\s+quarantined\s+2\s+2026-03-01T09:00:00Z\s+vm-alice not restored$`, lines[1])
+	assert.Regexp(t, `^bob\s+failing\s+1\s+-\s+no VM for role Client$`, lines[2])
+}
+
+// --- Power management tests ---
+
+func bookingAt(start time.Time, d time.Duration) *calendar.Event {
+	return &calendar.Event{
+		Start: &calendar.EventDateTime{DateTime: start.Format(time.RFC3339)},
+		End:   &calendar.EventDateTime{DateTime: start.Add(d).Format(time.RFC3339)},
+	}
+}
+
+func TestCountBookings(t *testing.T) {
+	now := time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+	events := []*calendar.Event{
+		bookingAt(now.Add(-time.Hour), 2*time.Hour),   // active
+		bookingAt(now.Add(20*time.Minute), time.Hour), // starts within the window
+		bookingAt(now.Add(45*time.Minute), time.Hour), // too late
+		bookingAt(now.Add(-2*time.Hour), time.Hour),   // already over
+		{Start: &calendar.EventDateTime{Date: "2026-03-02"}, End: &calendar.EventDateTime{Date: "2026-03-03"}},
+	}
+	assert.Equal(t, 2, CountBookings(events, now, now.Add(30*time.Minute)))
+}
+
+func TestManagePower_IdlesUnbookedPods(t *testing.T) {
+	o, buf := newTestOrch()
+	setTestMetrics(t, o)
+	o.FeatureCfg.Power = service.PowerConfig{Enabled: true, IdleAction: service.Suspend, AlwaysOn: []string{"Pod-3_OPNsense"}}
+	o.FeatureCfg.Quarantine.SpareUsers = []string{"alice"}
+	now := time.Now()
+	var window []string
+	o.Calendar = &mockCalendar{
+		listFn: func(min, max string) ([]*calendar.Event, error) {
+			window = []string{min, max}
+			return []*calendar.Event{bookingAt(now.Add(10*time.Minute), time.Hour)}, nil
+		},
+	}
+	actions := make(map[string]service.PowerAction)
+	o.VMware = &mockVMware{
+		powerFn: func(ctx context.Context, vm string, action service.PowerAction) (bool, error) {
+			actions[vm] = action
+			if vm == "Pod-3_Client" {
+				return false, fmt.Errorf("host busy")
+			}
+			return vm != "Pod-2_FortiGate", nil
+		},
+	}
+
+	pairs := []service.UserVMPair{
+		{User: "alice", VMs: []string{"Pod-1_FortiGate"}},
+		{User: "bob", VMs: []string{"Pod-2_FortiGate"}},
+		{User: "carol", VMs: []string{"Pod-3_OPNsense", "Pod-3_Client"}},
+	}
+	changes := o.ManagePower(pairs, nil, now)
+
+	assert.Equal(t, []string{now.Format(time.RFC3339), now.Add(30 * time.Minute).Format(time.RFC3339)}, window)
+	assert.Equal(t, map[string]service.PowerAction{
+		"Pod-1_FortiGate": service.Suspend, // spare, not needed
+		"Pod-2_FortiGate": service.PowerOn, // first regular pod takes the booking
+		"Pod-3_Client":    service.Suspend,
+	}, actions)
+	require.Len(t, changes, 2)
+	assert.Equal(t, PowerChange{User: "alice", VM: "Pod-1_FortiGate", Action: service.Suspend}, changes[0])
+	assert.EqualError(t, changes[1].Err, "host busy")
+
+	output := buf.String()
+	assert.Contains(t, output, "MESSAGE=Power action applied ACTION=suspend VM=Pod-1_FortiGate")
+	assert.Contains(t, output, "MESSAGE=Power action failed")
+	assert.Contains(t, output, "BOOKINGS=1")
+	assert.Contains(t, output, "IDLED=1")
+	assert.Contains(t, output, "FAILED=1")
+}
+
+func TestManagePower_QuarantinedPodStaysIdle(t *testing.T) {
+	o, _ := newTestOrch()
+	o.FeatureCfg.Power = service.PowerConfig{Enabled: true}
+	o.Health = newTestHealth(t, service.QuarantineConfig{})
+	o.Health.RecordFailure("alice", "broken", time.Now())
+	now := time.Now()
+	o.Calendar = &mockCalendar{
+		listFn: func(min, max string) ([]*calendar.Event, error) {
+			return []*calendar.Event{bookingAt(now, time.Hour)}, nil
+		},
+	}
+	actions := make(map[string]service.PowerAction)
+	o.VMware = &mockVMware{
+		powerFn: func(ctx context.Context, vm string, action service.PowerAction) (bool, error) {
+			actions[vm] = action
+			return true, nil
+		},
+	}
+
+	o.ManagePower([]service.UserVMPair{{User: "alice", VMs: []string{"vm-alice"}}, {User: "bob", VMs: []string{"vm-bob"}}}, nil, now)
+	assert.Equal(t, map[string]service.PowerAction{"vm-alice": service.PowerOff, "vm-bob": service.PowerOn}, actions)
+}
+
+func TestManagePower_SpareHoldingReassignedBookingStaysOn(t *testing.T) {
+	o, _ := newTestOrch()
+	o.FeatureCfg.Power = service.PowerConfig{Enabled: true}
+	o.FeatureCfg.Quarantine.SpareUsers = []string{"carol"}
+	now := time.Now()
+	o.Calendar = &mockCalendar{
+		listFn: func(min, max string) ([]*calendar.Event, error) {
+			return []*calendar.Event{bookingAt(now, time.Hour)}, nil
+		},
+	}
+	actions := make(map[string]service.PowerAction)
+	o.VMware = &mockVMware{
+		powerFn: func(ctx context.Context, vm string, action service.PowerAction) (bool, error) {
+			actions[vm] = action
+			return true, nil
+		},
+	}
+
+	// alice's rotation failed, not quarantined, and her booking went to
+	// the spare carol.
+	pairs := []service.UserVMPair{
+		{User: "alice", VMs: []string{"vm-alice"}},
+		{User: "bob", VMs: []string{"vm-bob"}},
+		{User: "carol", VMs: []string{"vm-carol"}},
+	}
+	o.ManagePower(pairs, map[string]bool{"carol": true}, now)
+	assert.Equal(t, map[string]service.PowerAction{
+		"vm-alice": service.PowerOff,
+		"vm-bob":   service.PowerOff,
+		"vm-carol": service.PowerOn,
+	}, actions)
+}
+
+func TestManagePower_DisabledOrCalendarError(t *testing.T) {
+	o, buf := newTestOrch()
+	called := false
+	o.VMware = &mockVMware{
+		powerFn: func(ctx context.Context, vm string, action service.PowerAction) (bool, error) {
+			called = true
+			return true, nil
+		},
+	}
+	pairs := []service.UserVMPair{{User: "alice", VMs: []string{"vm-alice"}}}
+
+	assert.Nil(t, o.ManagePower(pairs, nil, time.Now()))
+
+	o.FeatureCfg.Power.Enabled = true
+	o.Calendar = &mockCalendar{
+		listFn: func(min, max string) ([]*calendar.Event, error) {
+			return nil, fmt.Errorf("calendar down")
+		},
+	}
+	assert.Nil(t, o.ManagePower(pairs, nil, time.Now()))
+	assert.False(t, called)
+	assert.Contains(t, buf.String(), "Power management skipped")
+}
+
+func TestManagePower_RefusesPodsOverCapacity(t *testing.T) {
+	email := &mockEmail{}
+	o, buf := newTestOrch()
+	setTestMetrics(t, o)
+	o.Email = email
+	o.FeatureCfg.Quarantine.OperatorEmails = []string{"ops@ex.com"}
+	o.FeatureCfg.Power = service.PowerConfig{Enabled: true, Capacity: service.CapacityConfig{StaggerSeconds: 20}}
+	now := time.Now()
+	o.Calendar = &mockCalendar{
+		listFn: func(min, max string) ([]*calendar.Event, error) {
+			return []*calendar.Event{bookingAt(now, time.Hour), bookingAt(now, time.Hour), bookingAt(now, time.Hour)}, nil
+		},
+	}
+	var slept []time.Duration
+	prevSleep := sleep
+	sleep = func(d time.Duration) { slept = append(slept, d) }
+	t.Cleanup(func() { sleep = prevSleep })
+
+	var calls []string
+	o.VMware = &mockVMware{
+		powerFn: func(ctx context.Context, vm string, action service.PowerAction) (bool, error) {
+			calls = append(calls, string(action)+" "+vm)
+			return true, nil
+		},
+		planFn: func(ctx context.Context, pairs []service.UserVMPair, cfg service.CapacityConfig) ([]service.UserVMPair, []service.CapacityShortfall, error) {
+			assert.Equal(t, 20, cfg.StaggerSeconds)
+			return pairs[:2], []service.CapacityShortfall{{User: pairs[2].User, Host: "esxi-1", Resource: "memory", Needed: 8192, Free: 1024}}, nil
+		},
+	}
+
+	pairs := []service.UserVMPair{
+		{User: "alice", VMs: []string{"vm-alice"}},
+		{User: "bob", VMs: []string{"vm-bob"}},
+		{User: "carol", VMs: []string{"vm-carol"}},
+		{User: "dave", VMs: []string{"vm-dave"}},
+	}
+	o.ManagePower(pairs, nil, now)
+
+	assert.Equal(t, []string{"power_off vm-dave", "power_on vm-alice", "power_on vm-bob"}, calls, "idle first, refused pod untouched")
+	assert.Equal(t, []time.Duration{20 * time.Second}, slept, "stagger between pods only")
+	require.Len(t, email.notices, 1)
+	assert.Equal(t, "Host capacity shortfall: 1 pod(s) not powered on", email.notices[0].subject)
+	assert.Contains(t, email.notices[0].body, "pod of carol needs 8192 MB memory on host esxi-1, 1024 free within headroom")
+
+	output := buf.String()
+	assert.Contains(t, output, "MESSAGE=Pod power-on refused, host capacity exceeded")
+	assert.Contains(t, output, "REFUSED=1")
+}
+
+func TestRun_CapacityRefusedPodBookingMovesToSpare(t *testing.T) {
+	email := &mockEmail{}
+	o, buf := newTestOrch()
+	o.Email = email
+	// Power management is off; the capacity check still runs.
+	var planned []service.UserVMPair
+	o.VMware = &mockVMware{
+		listFn: func(ctx context.Context) (*models.VMListResponse, error) {
+			return &models.VMListResponse{VMs: []models.VM{{Name: "vm-alice"}, {Name: "vm-bob"}}}, nil
+		},
+		restoreFn: restoreWith(map[string]string{"alice": "pw-alice", "bob": "pw-bob"}),
+		planFn: func(ctx context.Context, pairs []service.UserVMPair, cfg service.CapacityConfig) ([]service.UserVMPair, []service.CapacityShortfall, error) {
+			planned = pairs
+			return nil, []service.CapacityShortfall{{User: "alice", Host: "esxi-1", Resource: "memory", Needed: 8192, Free: 1024}}, nil
+		},
+		powerFn: func(ctx context.Context, vm string, action service.PowerAction) (bool, error) {
+			t.Fatalf("unexpected power change %s %s", action, vm)
+			return false, nil
+		},
+	}
+	now := time.Now()
+	o.Calendar = &mockCalendar{
+		listFn: func(min, max string) ([]*calendar.Event, error) {
+			booking := bookingAt(now.Add(-time.Minute), time.Hour)
+			booking.Summary = "student@ex.com"
+			return []*calendar.Event{booking}, nil
+		},
+	}
+
+	require.NoError(t, o.Run())
+	assert.Equal(t, []service.UserVMPair{{User: "alice", VMs: []string{"vm-alice"}}}, planned, "only the pods the bookings take are planned")
+	require.Len(t, email.calls, 1)
+	assert.Equal(t, "bob", email.calls[0].username)
+	assert.Contains(t, buf.String(), "MESSAGE=Pod power-on refused, host capacity exceeded")
+	assert.Contains(t, buf.String(), "MESSAGE=Booking reassigned to spare pod")
+}
+
+func TestManagePower_CapacityUnavailablePowersOnUnchecked(t *testing.T) {
+	o, buf := newTestOrch()
+	o.FeatureCfg.Power = service.PowerConfig{Enabled: true}
+	now := time.Now()
+	o.Calendar = &mockCalendar{
+		listFn: func(min, max string) ([]*calendar.Event, error) {
+			return []*calendar.Event{bookingAt(now, time.Hour)}, nil
+		},
+	}
+	o.VMware = &mockVMware{
+		powerFn: func(ctx context.Context, vm string, action service.PowerAction) (bool, error) {
+			return true, nil
+		},
+		planFn: func(ctx context.Context, pairs []service.UserVMPair, cfg service.CapacityConfig) ([]service.UserVMPair, []service.CapacityShortfall, error) {
+			return nil, nil, fmt.Errorf("view failed")
+		},
+	}
+
+	changes := o.ManagePower([]service.UserVMPair{{User: "alice", VMs: []string{"vm-alice"}}}, nil, now)
+	assert.Equal(t, []PowerChange{{User: "alice", VM: "vm-alice", Action: service.PowerOn}}, changes)
+	assert.Contains(t, buf.String(), "Host capacity unavailable")
+}
+
+func TestCollectUsage_RecordsGaugesPerVM(t *testing.T) {
+	o, buf := newTestOrch()
+	reader := setTestMetrics(t, o)
+	var queried []string
+	o.VMware = &mockVMware{
+		usageFn: func(ctx context.Context, vmNames []string) ([]service.VMUsage, error) {
+			queried = vmNames
+			return []service.VMUsage{
+				{VM: "Pod-1_FortiGate", CPUPercent: 12.5, MemoryPercent: 40, DiskKBps: 3, NetworkKBps: 7},
+				{VM: "Pod-2_FortiGate", CPUPercent: 80, MemoryPercent: 65.25, DiskKBps: 120, NetworkKBps: 900},
+			}, nil
+		},
+	}
+
+	pairs := []service.UserVMPair{
+		{User: "alice", VMs: []string{"Pod-1_FortiGate"}},
+		{User: "bob", VMs: []string{"Pod-2_FortiGate"}},
+	}
+	require.NoError(t, o.CollectUsage(pairs, map[string]bool{"bob": true}))
+	assert.Equal(t, []string{"Pod-1_FortiGate", "Pod-2_FortiGate"}, queried)
+
+	cpu := gaugePoints[float64](t, reader, "lab.vm.cpu.usage")
+	require.Len(t, cpu, 2)
+	for _, dp := range cpu {
+		vm, _ := dp.Attributes.Value("vm")
+		active, _ := dp.Attributes.Value("active")
+		pod, _ := dp.Attributes.Value("pod")
+		switch vm.AsString() {
+		case "Pod-1_FortiGate":
+			assert.Equal(t, 12.5, dp.Value)
+			assert.Equal(t, "Pod-1", pod.AsString())
+			assert.False(t, active.AsBool())
+		case "Pod-2_FortiGate":
+			assert.Equal(t, 80.0, dp.Value)
+			assert.True(t, active.AsBool())
+		}
+	}
+
+	sessions := gaugePoints[int64](t, reader, "lab.pod.session.active")
+	active := make(map[string]int64)
+	for _, dp := range sessions {
+		user, _ := dp.Attributes.Value("user")
+		active[user.AsString()] = dp.Value
+	}
+	assert.Equal(t, map[string]int64{"alice": 0, "bob": 1}, active)
+	assert.Contains(t, buf.String(), "MESSAGE=VM usage collected")
+	assert.Contains(t, buf.String(), "ACTIVE_PODS=1")
+}
+
+func TestRun_SavesAssignmentForUsage(t *testing.T) {
+	o, _ := newTestOrch()
+	o.Email = &mockEmail{}
+	o.FeatureCfg.Quarantine.StatePath = filepath.Join(t.TempDir(), "pod_health.json")
+	o.Health = newTestHealth(t, o.FeatureCfg.Quarantine)
+	o.VMware = &mockVMware{
+		listFn: func(ctx context.Context) (*models.VMListResponse, error) {
+			return &models.VMListResponse{VMs: []models.VM{{Name: "vm-alice"}, {Name: "vm-bob"}}}, nil
+		},
+		// alice's pod breaks, so the booking moves to bob's.
+		restoreFn: restoreWith(map[string]string{"alice": "pw-alice", "bob": "pw-bob"}, "vm-alice"),
+	}
+	now := time.Now()
+	o.Calendar = &mockCalendar{
+		listFn: func(min, max string) ([]*calendar.Event, error) {
+			booking := bookingAt(now.Add(-time.Minute), time.Hour)
+			booking.Summary = "student@ex.com"
+			return []*calendar.Event{booking}, nil
+		},
+	}
+
+	require.Error(t, o.Run())
+	assert.Equal(t, map[string]bool{"bob": true}, o.AssignedPods([]EventInfo{{Email: "student@ex.com"}}))
+	assert.Empty(t, o.AssignedPods([]EventInfo{{Email: "other@ex.com"}}), "booking no longer active")
+}
+
+func TestCollectUsage_QueryError(t *testing.T) {
+	o, buf := newTestOrch()
+	o.VMware = &mockVMware{
+		usageFn: func(ctx context.Context, vmNames []string) ([]service.VMUsage, error) {
+			return nil, fmt.Errorf("perf manager down")
+		},
+	}
+
+	err := o.CollectUsage([]service.UserVMPair{{User: "alice", VMs: []string{"vm-alice"}}}, nil)
+	assert.EqualError(t, err, "perf manager down")
+	assert.Contains(t, buf.String(), "Failed to collect VM usage")
+	assert.NotContains(t, buf.String(), "VM usage collected")
+}
+
+func TestPodName(t *testing.T) {
+	assert.Equal(t, "Pod-1", podName(service.UserVMPair{User: "alice", VMs: []string{"Pod-1_FortiGate"}}))
+	assert.Equal(t, "alice", podName(service.UserVMPair{User: "alice", VMs: []string{"vm-alice"}}))
+	assert.Equal(t, "alice", podName(service.UserVMPair{User: "alice"}))
+}
+
+func TestCheckSnapshotHealth_WarnsAndConsolidatesIdlePods(t *testing.T) {
+	o, buf := newTestOrch()
+	reader := setTestMetrics(t, o)
+	o.FeatureCfg.SnapshotHealth = service.SnapshotHealthConfig{Enabled: true, Consolidate: true, QuietMinutes: 120}
+	now := time.Now()
+	var window []string
+	o.Calendar = &mockCalendar{
+		listFn: func(min, max string) ([]*calendar.Event, error) {
+			window = []string{min, max}
+			return []*calendar.Event{bookingAt(now.Add(90*time.Minute), time.Hour)}, nil
+		},
+	}
+	var consolidated []string
+	o.VMware = &mockVMware{
+		healthFn: func(ctx context.Context, vmNames []string) ([]service.VMSnapshotHealth, error) {
+			assert.Equal(t, []string{"vm-alice", "vm-bob"}, vmNames)
+			return []service.VMSnapshotHealth{
+				{VM: "vm-alice", ConsolidationNeeded: true, SnapshotDepth: 2},
+				{VM: "vm-bob", ConsolidationNeeded: true, SnapshotDepth: 7, Datastores: []service.DatastoreSpace{{Name: "ssd", CapacityMB: 100, FreeMB: 50}}},
+			}, nil
+		},
+		consolidFn: func(ctx context.Context, vm string) error {
+			consolidated = append(consolidated, vm)
+			return nil
+		},
+	}
+
+	checks := o.CheckSnapshotHealth([]service.UserVMPair{
+		{User: "alice", VMs: []string{"vm-alice"}},
+		{User: "bob", VMs: []string{"vm-bob"}},
+	}, nil, now)
+
+	assert.Equal(t, now.Add(2*time.Hour).Format(time.RFC3339), window[1])
+	assert.Equal(t, []string{"vm-bob"}, consolidated, "alice's pod takes the upcoming booking")
+	require.Len(t, checks, 2)
+	assert.False(t, checks[0].Consolidated)
+	assert.True(t, checks[1].Consolidated)
+	assert.Len(t, checks[1].Warnings, 2)
+
+	output := buf.String()
+	assert.Contains(t, output, "MESSAGE=Snapshot chain unhealthy VM=vm-bob USER=bob CHECK=deep_chain")
+	assert.Contains(t, output, "MESSAGE=Snapshot consolidation deferred, pod is booked ACTION=consolidate VM=vm-alice")
+	assert.Contains(t, output, "WARNED=2")
+	assert.Contains(t, output, "CONSOLIDATED=1")
+
+	depth := make(map[string]int64)
+	for _, dp := range gaugePoints[int64](t, reader, "lab.vm.snapshot.depth") {
+		vm, _ := dp.Attributes.Value("vm")
+		depth[vm.AsString()] = dp.Value
+	}
+	assert.Equal(t, map[string]int64{"vm-alice": 2, "vm-bob": 7}, depth)
+	free := gaugePoints[float64](t, reader, "lab.datastore.free")
+	require.Len(t, free, 1)
+	assert.Equal(t, 50.0, free[0].Value)
+}
+
+func TestCheckSnapshotHealth_SpareHoldingReassignedBookingIsBusy(t *testing.T) {
+	o, _ := newTestOrch()
+	o.FeatureCfg.SnapshotHealth = service.SnapshotHealthConfig{Enabled: true, Consolidate: true, QuietMinutes: 120}
+	now := time.Now()
+	o.Calendar = &mockCalendar{
+		listFn: func(min, max string) ([]*calendar.Event, error) {
+			return []*calendar.Event{bookingAt(now.Add(-time.Minute), time.Hour)}, nil
+		},
+	}
+	var consolidated []string
+	o.VMware = &mockVMware{
+		healthFn: func(ctx context.Context, vmNames []string) ([]service.VMSnapshotHealth, error) {
+			return []service.VMSnapshotHealth{{VM: "vm-alice", ConsolidationNeeded: true}, {VM: "vm-bob", ConsolidationNeeded: true}}, nil
+		},
+		consolidFn: func(ctx context.Context, vm string) error {
+			consolidated = append(consolidated, vm)
+			return nil
+		},
+	}
+
+	// alice's pod broke, so bob's holds the only booking.
+	o.CheckSnapshotHealth([]service.UserVMPair{
+		{User: "alice", VMs: []string{"vm-alice"}},
+		{User: "bob", VMs: []string{"vm-bob"}},
+	}, map[string]bool{"bob": true}, now)
+
+	assert.Equal(t, []string{"vm-alice"}, consolidated)
+}
+
+func TestCheckSnapshotHealth_CalendarErrorSkipsConsolidation(t *testing.T) {
+	o, buf := newTestOrch()
+	o.FeatureCfg.SnapshotHealth = service.SnapshotHealthConfig{Enabled: true, Consolidate: true}
+	o.Calendar = &mockCalendar{
+		listFn: func(min, max string) ([]*calendar.Event, error) {
+			return nil, fmt.Errorf("calendar down")
+		},
+	}
+	o.VMware = &mockVMware{
+		healthFn: func(ctx context.Context, vmNames []string) ([]service.VMSnapshotHealth, error) {
+			return []service.VMSnapshotHealth{{VM: "vm-alice", ConsolidationNeeded: true}}, nil
+		},
+		consolidFn: func(ctx context.Context, vm string) error {
+			t.Fatalf("consolidated %s without knowing the bookings", vm)
+			return nil
+		},
+	}
+
+	checks := o.CheckSnapshotHealth([]service.UserVMPair{{User: "alice", VMs: []string{"vm-alice"}}}, nil, time.Now())
+	require.Len(t, checks, 1)
+	assert.Contains(t, buf.String(), "Snapshot consolidation skipped")
+	assert.NotContains(t, buf.String(), "consolidation deferred")
+}
+
+func TestCheckSnapshotHealth_Disabled(t *testing.T) {
+	o, _ := newTestOrch()
+	o.VMware = &mockVMware{
+		healthFn: func(ctx context.Context, vmNames []string) ([]service.VMSnapshotHealth, error) {
+			t.Fatal("checked while disabled")
+			return nil, nil
+		},
+	}
+	assert.Nil(t, o.CheckSnapshotHealth([]service.UserVMPair{{User: "alice", VMs: []string{"vm-alice"}}}, nil, time.Now()))
+}
+
+func TestWriteSnapshotReport(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, WriteSnapshotReport(&buf, []SnapshotCheck{
+		{
+			User:     "alice",
+			Health:   service.VMSnapshotHealth{VM: "Pod-1_FortiGate", ConsolidationNeeded: true, SnapshotDepth: 3, DeltaDiskMB: 512, Datastores: []service.DatastoreSpace{{Name: "ssd", CapacityMB: 200, FreeMB: 50}}},
+			Warnings: []service.SnapshotWarning{{Kind: service.SnapshotWarnConsolidation}},
+		},
+		{User: "bob", Health: service.VMSnapshotHealth{VM: "Pod-2_FortiGate", SnapshotDepth: 1}},
+	}))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 3)
+	assert.Equal(t, []string{"VM", "USER", "DEPTH", "DELTA_MB", "CONSOLIDATE", "DATASTORE_FREE", "WARNINGS"}, strings.Fields(lines[0]))
+	assert.Equal(t, []string{"Pod-1_FortiGate", "alice", "3", "512", "needed", "ssd", "25%", "consolidation_needed"}, strings.Fields(lines[1]))
+	assert.Equal(t, []string{"Pod-2_FortiGate", "bob", "1", "0", "no", "-"}, strings.Fields(lines[2]))
+}
+
+func TestRecordRun_SavesScreenshotsWithRestoreOutcome(t *testing.T) {
+	o, buf := newTestOrch()
+	dir := t.TempDir()
+	o.FeatureCfg.RunRecords = service.RunRecordConfig{Enabled: true, Dir: dir, Screenshots: true, ReadyTimeoutSeconds: 30}
+	var shots []string
+	o.VMware = &mockVMware{
+		shotFn: func(ctx context.Context, vm, path string, readyTimeout time.Duration) (bool, error) {
+			assert.Equal(t, 30*time.Second, readyTimeout)
+			shots = append(shots, vm)
+			if vm == "Pod-2_Client" {
+				return false, fmt.Errorf("VM is poweredOff, no console to capture")
+			}
+			require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+			return true, os.WriteFile(path, []byte("png"), 0o644)
+		},
+	}
+
+	started := time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC)
+	results := []service.RestoreResult{
+		{User: "alice", VMs: []service.VMRestoreResult{{VM: "Pod-1_FortiGate", Snapshot: "golden", PowerState: "poweredOn"}}},
+		{User: "bob", VMs: []service.VMRestoreResult{
+			{VM: "Pod-2_FortiGate", Err: fmt.Errorf("revert task failed")},
+			{VM: "Pod-2_Client", Snapshot: "golden"},
+		}},
+	}
+	rec := o.RecordRun(results, []string{"student@ex.com", ""}, started)
+	require.NotNil(t, rec)
+	assert.Equal(t, []string{"Pod-1_FortiGate", "Pod-2_Client"}, shots, "failed restores are not captured")
+
+	runDir := filepath.Join(dir, "20261018T090000Z")
+	_, err := os.Stat(filepath.Join(runDir, "Pod-1_FortiGate.png"))
+	require.NoError(t, err)
+	data, err := os.ReadFile(filepath.Join(runDir, "run.json"))
+	require.NoError(t, err)
+	var saved service.RunRecord
+	require.NoError(t, json.Unmarshal(data, &saved))
+	require.Len(t, saved.Pods, 2)
+	assert.Equal(t, service.PodRecord{
+		User:    "alice",
+		Booking: "student@ex.com",
+		VMs:     []service.VMRecord{{VM: "Pod-1_FortiGate", Snapshot: "golden", PowerState: "poweredOn", Screenshot: "Pod-1_FortiGate.png", GuestReady: true}},
+	}, saved.Pods[0])
+	assert.Equal(t, "revert task failed", saved.Pods[1].VMs[0].Error)
+	assert.Equal(t, "VM is poweredOff, no console to capture", saved.Pods[1].VMs[1].ScreenshotError)
+
+	output := buf.String()
+	assert.Contains(t, output, "MESSAGE=Console screenshot failed")
+	assert.Contains(t, output, "MESSAGE=Run record saved")
+	assert.Contains(t, output, "SCREENSHOTS=1")
+}
+
+func TestRecordRun_Disabled(t *testing.T) {
+	o, _ := newTestOrch()
+	o.VMware = &mockVMware{
+		shotFn: func(ctx context.Context, vm, path string, readyTimeout time.Duration) (bool, error) {
+			t.Fatal("captured while disabled")
+			return false, nil
+		},
+	}
+	assert.Nil(t, o.RecordRun([]service.RestoreResult{{User: "alice", VMs: []service.VMRestoreResult{{VM: "vm-alice"}}}}, nil, time.Now()))
+}
+
+func TestReconcilePermissions_GrantsBookedPodsOnly(t *testing.T) {
+	o, buf := newTestOrch()
+	o.FeatureCfg.Permissions = service.PermissionConfig{Enabled: true}
+	type call struct{ vm, grantTo string }
+	var calls []call
+	o.VMware = &mockVMware{
+		permFn: func(ctx context.Context, vm, grantTo string, labUsers []string, role string) ([]service.PermissionChange, error) {
+			assert.Equal(t, []string{"alice", "bob"}, labUsers)
+			assert.Equal(t, "lab-console", role)
+			calls = append(calls, call{vm, grantTo})
+			switch vm {
+			case "vm-alice":
+				return []service.PermissionChange{{VM: vm, User: "alice", Action: service.PermissionGrant}}, nil
+			case "vm-bob":
+				return []service.PermissionChange{{VM: vm, User: "bob", Action: service.PermissionRevoke}}, fmt.Errorf("connection reset")
+			}
+			return nil, nil
+		},
+	}
+
+	pairs := []service.UserVMPair{{User: "alice", VMs: []string{"vm-alice"}}, {User: "bob", VMs: []string{"vm-bob"}}}
+	results := []service.RestoreResult{{User: "alice"}, {User: "bob"}}
+	changes := o.ReconcilePermissions(pairs, bookedUsers(results, []string{"student@ex.com", ""}))
+
+	assert.Equal(t, []call{{"vm-alice", "alice"}, {"vm-bob", ""}}, calls)
+	assert.Len(t, changes, 2)
+	output := buf.String()
+	assert.Contains(t, output, "MESSAGE=VM permission changed")
+	assert.Contains(t, output, "MESSAGE=Failed to reconcile VM permissions")
+	assert.Contains(t, output, "GRANTED=1")
+	assert.Contains(t, output, "REVOKED=1")
+	assert.Contains(t, output, "FAILED=1")
+}
+
+func TestReconcilePermissions_Disabled(t *testing.T) {
+	o, _ := newTestOrch()
+	o.VMware = &mockVMware{
+		permFn: func(ctx context.Context, vm, grantTo string, labUsers []string, role string) ([]service.PermissionChange, error) {
+			t.Fatal("reconciled while disabled")
+			return nil, nil
+		},
+	}
+	assert.Nil(t, o.ReconcilePermissions([]service.UserVMPair{{User: "alice", VMs: []string{"vm-alice"}}}, map[string]bool{"alice": true}))
+}
+
+func TestReconcileAccounts_DryRunAndApply(t *testing.T) {
+	o, buf := newTestOrch()
+	planned := []service.AccountChange{
+		{Host: "esxi-1", Kind: service.AccountCreateUser, Name: "bob"},
+		{Host: "esxi-1", Kind: service.AccountRemoveUser, Name: "lab-user-9"},
+		{Host: "esxi-2", Kind: service.AccountUpdateRole, Name: "lab-console", Added: []string{"VirtualMachine.Interact.Reset"}},
+	}
+	var applied []string
+	o.VMware = &mockVMware{
+		accountsFn: func(ctx context.Context, users []string, role string, cfg service.AccountConfig) ([]service.AccountChange, error) {
+			assert.Equal(t, []string{"alice", "bob"}, users)
+			assert.Equal(t, "lab-console", role)
+			return planned, nil
+		},
+		applyFn: func(ctx context.Context, c service.AccountChange) error {
+			applied = append(applied, c.Name)
+			if c.Kind == service.AccountRemoveUser {
+				return fmt.Errorf("user is logged in")
+			}
+			return nil
+		},
+	}
+
+	changes, err := o.ReconcileAccounts(false)
+	require.NoError(t, err)
+	assert.Equal(t, planned, changes)
+	assert.Empty(t, applied, "dry run changes nothing")
+	assert.Contains(t, buf.String(), "MESSAGE=Account change planned")
+
+	var diff bytes.Buffer
+	require.NoError(t, WriteAccountDiff(&diff, changes))
+	assert.Equal(t, "esxi-1:\n  + user bob\n  - user lab-user-9\nesxi-2:\n  ~ role lab-console [+VirtualMachine.Interact.Reset]\n", diff.String())
+
+	_, err = o.ReconcileAccounts(true)
+	assert.EqualError(t, err, "1 of 3 account changes failed")
+	assert.Equal(t, []string{"bob", "lab-user-9", "lab-console"}, applied)
+	assert.Contains(t, buf.String(), "MESSAGE=Account change failed")
+}
+
+func TestWriteAccountDiff_NoChanges(t *testing.T) {
+	var diff bytes.Buffer
+	require.NoError(t, WriteAccountDiff(&diff, nil))
+	assert.Equal(t, "No changes. ESXi accounts match the configuration.\n", diff.String())
+}
@@ -14,15 +14,26 @@ type CalendarConfig struct {
 }
 
 type FeatureConfig struct {
-	Calendar  CalendarConfig  `toml:"calendar"`
-	ESXi      ESXiConfig      `toml:"esxi"`
-	WireGuard WireGuardConfig `toml:"wireguard"`
+	Calendar       CalendarConfig       `toml:"calendar"`
+	ESXi           ESXiConfig           `toml:"esxi"`
+	WireGuard      WireGuardConfig      `toml:"wireguard"`
+	Quarantine     QuarantineConfig     `toml:"quarantine"`
+	Power          PowerConfig          `toml:"power"`
+	SnapshotHealth SnapshotHealthConfig `toml:"snapshot_health"`
+	RunRecords     RunRecordConfig      `toml:"run_records"`
+	Permissions    PermissionConfig     `toml:"permissions"`
+	Accounts       AccountConfig        `toml:"accounts"`
+	PasswordPolicy PasswordPolicy       `toml:"password_policy"`
 }
 
 type ESXiConfig struct {
-	URL            string              `toml:"url"`
-	UserVMMappings map[string][]string `toml:"user_vm_mappings"`
-	SnapshotName   *string             `toml:"snapshot_name"`
+	URL               string                  `toml:"url"`
+	UserVMMappings    map[string][]string     `toml:"user_vm_mappings"`
+	UserVMSelectors   map[string][]VMSelector `toml:"user_vm_selectors"`
+	SnapshotName      *string                 `toml:"snapshot_name"`
+	SnapshotRules     []SnapshotRule          `toml:"snapshot_rules"`
+	GuestProvisioning []GuestProvisionRule    `toml:"guest_provisioning"`
+	PodTemplates      []PodTemplate           `toml:"pod_templates"`
 }
 
 type UserVMPair struct {
@@ -52,12 +63,12 @@ func (c *ESXiConfig) VMs() []string {
 	return vms
 }
 
-// Users returns sorted usernames from user-VM mappings.
+// Users returns sorted usernames from user-VM mappings and selectors.
 func (c *ESXiConfig) Users() []string {
-	pairs := c.UserVMPairs()
-	users := make([]string, len(pairs))
-	for i, p := range pairs {
-		users[i] = p.User
+	selectors := c.UserSelectors()
+	users := make([]string, len(selectors))
+	for i, s := range selectors {
+		users[i] = s.User
 	}
 	return users
 }
@@ -67,6 +78,21 @@ func LoadFeatureConfig(path string) (*FeatureConfig, error) {
 	if _, err := toml.DecodeFile(path, &cfg); err != nil {
 		return nil, fmt.Errorf("failed to load feature config: %w", err)
 	}
+	if err := cfg.ESXi.SnapshotPolicy().Validate(); err != nil {
+		return nil, fmt.Errorf("invalid esxi config: %w", err)
+	}
+	if err := cfg.ESXi.validateSelectors(); err != nil {
+		return nil, fmt.Errorf("invalid esxi config: %w", err)
+	}
+	if err := cfg.ESXi.validatePodTemplates(); err != nil {
+		return nil, fmt.Errorf("invalid esxi config: %w", err)
+	}
+	if err := cfg.Power.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid power config: %w", err)
+	}
+	if err := cfg.PasswordPolicy.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid password_policy config: %w", err)
+	}
 	return &cfg, nil
 }
 
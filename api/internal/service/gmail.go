@@ -44,51 +44,102 @@ func (s *EmailService) SendPasswordEmail(to, vmName, username, password string)
 	return s.SendPasswordEmailWithAttachment(to, vmName, username, password, nil)
 }
 
+// VMAccess describes how to reach one VM of a lab session.
+type VMAccess struct {
+	Name          string
+	HostClientURL string
+	VMRCURL       string
+	// GuestPassword is the per-session guest password set by guest
+	// provisioning, if any.
+	GuestPassword string
+}
+
+// CredentialEmail is the content of a lab access email.
+type CredentialEmail struct {
+	To         string
+	Username   string
+	Password   string
+	VMs        []VMAccess
+	Attachment *EmailAttachment
+}
+
 // SendPasswordEmailWithAttachment sends an email with the new password and optional attachment
 func (s *EmailService) SendPasswordEmailWithAttachment(to, vmName, username, password string, attachment *EmailAttachment) error {
+	return s.SendCredentialsEmail(CredentialEmail{
+		To:         to,
+		Username:   username,
+		Password:   password,
+		VMs:        []VMAccess{{Name: vmName}},
+		Attachment: attachment,
+	})
+}
+
+// SendCredentialsEmail sends the lab credentials with access details for
+// every VM of the session and an optional attachment.
+func (s *EmailService) SendCredentialsEmail(msg CredentialEmail) error {
 	// Override recipient for testing if TEST_EMAIL_ONLY is set
-	actualRecipient := to
+	actualRecipient := msg.To
 	if s.testEmailOnly != "" {
 		actualRecipient = s.testEmailOnly
 	}
 
-	subject := fmt.Sprintf("ESXi Lab Access - VM: %s", vmName)
-	body := fmt.Sprintf(`Hello,
-
-Your ESXi lab environment is now ready!
-
-VM Name: %s
-Username: %s
-Password: %s
+	subject := "ESXi Lab Access"
+	names := make([]string, len(msg.VMs))
+	for i, vm := range msg.VMs {
+		names[i] = vm.Name
+	}
+	switch len(names) {
+	case 0:
+	case 1:
+		subject += " - VM: " + names[0]
+	default:
+		subject += " - VMs: " + strings.Join(names, ", ")
+	}
 
-`, vmName, username, password)
+	var body strings.Builder
+	body.WriteString("Hello,\n\nYour ESXi lab environment is now ready!\n\n")
+	fmt.Fprintf(&body, "Username: %s\nPassword: %s\n\n", msg.Username, msg.Password)
+	for _, vm := range msg.VMs {
+		fmt.Fprintf(&body, "VM Name: %s\n", vm.Name)
+		if vm.HostClientURL != "" {
+			fmt.Fprintf(&body, "  Web console: %s\n", vm.HostClientURL)
+		}
+		if vm.VMRCURL != "" {
+			fmt.Fprintf(&body, "  Remote Console (VMRC): %s\n", vm.VMRCURL)
+		}
+		if vm.GuestPassword != "" {
+			fmt.Fprintf(&body, "  Guest password: %s\n", vm.GuestPassword)
+		}
+	}
+	body.WriteString("\n")
 
 	// Add note if email is being sent to test address
-	if s.testEmailOnly != "" && to != actualRecipient {
-		body += fmt.Sprintf("[TEST MODE] Original recipient: %s\n\n", to)
+	if s.testEmailOnly != "" && msg.To != actualRecipient {
+		fmt.Fprintf(&body, "[TEST MODE] Original recipient: %s\n\n", msg.To)
 	}
 
-	if attachment != nil {
-		body += fmt.Sprintf(`A WireGuard VPN configuration file (%s) has been attached to this email.
+	if msg.Attachment != nil {
+		fmt.Fprintf(&body, `A WireGuard VPN configuration file (%s) has been attached to this email.
 To connect to the lab network:
 1. Install WireGuard from https://www.wireguard.com/install/
 2. Import the attached configuration file
 3. Activate the tunnel
 
-`, attachment.Filename)
+`, msg.Attachment.Filename)
 	}
 
-	body += `This password has been automatically generated for your lab session.
+	body.WriteString(`Log in to the consoles with the username and password above.
+This password has been automatically generated for your lab session.
 
 Best regards,
 ESXi Lab Provider
-`
+`)
 
 	var message string
-	if attachment != nil {
-		message = s.buildMIMEMessage(actualRecipient, subject, body, attachment)
+	if msg.Attachment != nil {
+		message = s.buildMIMEMessage(actualRecipient, subject, body.String(), msg.Attachment)
 	} else {
-		message = s.buildPlainMessage(actualRecipient, subject, body)
+		message = s.buildPlainMessage(actualRecipient, subject, body.String())
 	}
 
 	auth := smtp.PlainAuth("", s.from, s.password, s.host)
@@ -102,6 +153,24 @@ ESXi Lab Provider
 	return nil
 }
 
+// SendNotification sends a plain text notice, such as a pod quarantine
+// alert, to an operator.
+func (s *EmailService) SendNotification(to, subject, body string) error {
+	actualRecipient := to
+	if s.testEmailOnly != "" {
+		actualRecipient = s.testEmailOnly
+	}
+
+	auth := smtp.PlainAuth("", s.from, s.password, s.host)
+	addr := s.host + ":" + s.port
+
+	message := s.buildPlainMessage(actualRecipient, subject, body)
+	if err := s.sendMailFn(addr, auth, s.from, []string{actualRecipient}, []byte(message)); err != nil {
+		return fmt.Errorf("failed to send email to %s: %w", actualRecipient, err)
+	}
+	return nil
+}
+
 // buildPlainMessage builds a plain text email message
 func (s *EmailService) buildPlainMessage(to, subject, body string) string {
 	return fmt.Sprintf("From: %s\r\n"+
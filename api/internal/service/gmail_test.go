@@ -3,6 +3,7 @@ package service
 import (
 	"fmt"
 	"net/smtp"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -232,3 +233,53 @@ func TestSendPasswordEmailWithAttachment_TestEmailSameAsRecipient(t *testing.T)
 	// Should NOT contain test mode note when recipient matches test email
 	assert.NotContains(t, calls[0].msg, "[TEST MODE]")
 }
+
+func TestSendCredentialsEmail_AllVMsWithLinks(t *testing.T) {
+	var calls []smtpCall
+	svc := &EmailService{
+		host:       "smtp.example.com",
+		port:       "587",
+		from:       "from@example.com",
+		password:   "pass",
+		sendMailFn: newSpySendMail(&calls, nil),
+	}
+
+	err := svc.SendCredentialsEmail(CredentialEmail{
+		To:       "to@example.com",
+		Username: "alice",
+		Password: "secret",
+		VMs: []VMAccess{
+			{Name: "Pod-1_FortiGate", HostClientURL: "https://esxi/ui/#/console/1", VMRCURL: "vmrc://alice@esxi/?moid=1"},
+			{Name: "Pod-1_Client", HostClientURL: "https://esxi/ui/#/console/2", GuestPassword: "guest-pw"},
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, calls, 1)
+	msg := calls[0].msg
+	assert.Contains(t, msg, "Subject: ESXi Lab Access - VMs: Pod-1_FortiGate, Pod-1_Client")
+	assert.Contains(t, msg, "VM Name: Pod-1_FortiGate")
+	assert.Contains(t, msg, "Web console: https://esxi/ui/#/console/1")
+	assert.Contains(t, msg, "Remote Console (VMRC): vmrc://alice@esxi/?moid=1")
+	assert.Contains(t, msg, "VM Name: Pod-1_Client")
+	assert.Contains(t, msg, "Web console: https://esxi/ui/#/console/2")
+	assert.Contains(t, msg, "Guest password: guest-pw")
+	assert.Equal(t, 1, strings.Count(msg, "Remote Console (VMRC)"))
+}
+
+func TestSendNotification(t *testing.T) {
+	var calls []smtpCall
+	svc := &EmailService{
+		host:          "smtp.example.com",
+		port:          "587",
+		from:          "from@example.com",
+		password:      "pass",
+		testEmailOnly: "test@example.com",
+		sendMailFn:    newSpySendMail(&calls, nil),
+	}
+
+	require.NoError(t, svc.SendNotification("ops@example.com", "Pod quarantined: alice", "restore failed"))
+	require.Len(t, calls, 1)
+	assert.Equal(t, []string{"test@example.com"}, calls[0].to)
+	assert.Contains(t, calls[0].msg, "Subject: Pod quarantined: alice\r\n")
+	assert.Contains(t, calls[0].msg, "restore failed")
+}
@@ -2,6 +2,7 @@ package service
 
 import (
 	"context"
+	"time"
 
 	"github.com/EpicMandM/esxi-lab-provider/api/internal/models"
 	"google.golang.org/api/calendar/v3"
@@ -10,7 +11,19 @@ import (
 // VMwareClient abstracts VMware operations for testability.
 type VMwareClient interface {
 	ListVMSnapshots(ctx context.Context) (*models.VMListResponse, error)
-	RestoreVMsWithPasswordRotation(ctx context.Context, vmNames []string, userNames []string, snapshotName string) ([]string, map[string]string)
+	RestoreVMsWithPasswordRotation(ctx context.Context, pairs []UserVMPair, policy SnapshotPolicy) []RestoreResult
+	ProvisionGuests(ctx context.Context, rules []GuestProvisionRule, targets []GuestTarget) []GuestProvisionResult
+	ConsoleLinks(ctx context.Context, username string, vmNames []string) []ConsoleLink
+	SetPowerState(ctx context.Context, vmName string, action PowerAction) (bool, error)
+	PlanPowerOn(ctx context.Context, pairs []UserVMPair, cfg CapacityConfig) ([]UserVMPair, []CapacityShortfall, error)
+	VMUsage(ctx context.Context, vmNames []string) ([]VMUsage, error)
+	SnapshotHealth(ctx context.Context, vmNames []string) ([]VMSnapshotHealth, error)
+	ConsolidateDisks(ctx context.Context, vmName string) error
+	CaptureScreenshot(ctx context.Context, vmName, path string, readyTimeout time.Duration) (bool, error)
+	ReconcileVMPermissions(ctx context.Context, vmName, grantTo string, labUsers []string, role string) ([]PermissionChange, error)
+	PlanAccounts(ctx context.Context, users []string, role string, cfg AccountConfig) ([]AccountChange, error)
+	ApplyAccountChange(ctx context.Context, c AccountChange) error
+	VerifyCredentials(ctx context.Context, username, password string, vmNames []string) error
 	Close(ctx context.Context) error
 }
 
@@ -23,6 +36,8 @@ type CalendarClient interface {
 type EmailSender interface {
 	SendPasswordEmail(to, vmName, username, password string) error
 	SendPasswordEmailWithAttachment(to, vmName, username, password string, attachment *EmailAttachment) error
+	SendCredentialsEmail(msg CredentialEmail) error
+	SendNotification(to, subject, body string) error
 }
 
 // WireGuardManager abstracts WireGuard operations for testability.
@@ -0,0 +1,40 @@
+package service
+
+// passphraseWords are short, common English words that are easy to spell
+// and type, used for passphrases.
+var passphraseWords = []string{
+	"acorn", "actor", "agent", "alarm", "album", "amber", "angle", "apple",
+	"apron", "arena", "armor", "arrow", "atlas", "award", "bacon", "badge",
+	"baker", "basil", "beach", "beard", "berry", "bison", "blade", "blank",
+	"blaze", "bloom", "board", "boat", "bonus", "boots", "brave", "bread",
+	"brick", "brook", "brush", "bucket", "cabin", "cable", "camel", "candy",
+	"canoe", "canyon", "cargo", "carpet", "castle", "cedar", "chair", "chalk",
+	"charm", "cheese", "cherry", "chess", "chief", "cider", "circus", "civic",
+	"cliff", "clock", "cloud", "clover", "coach", "cobra", "cocoa", "comet",
+	"coral", "cotton", "couch", "crane", "crater", "crown", "cube", "daisy",
+	"dance", "delta", "denim", "desert", "dingo", "diner", "dolphin", "donut",
+	"dove", "dragon", "drum", "eagle", "easel", "ember", "engine", "falcon",
+	"fancy", "farm", "feast", "fern", "fiddle", "field", "flame", "flint",
+	"flute", "focus", "forest", "fossil", "fox", "frost", "fruit", "galaxy",
+	"garden", "gecko", "giant", "ginger", "glacier", "globe", "goose",
+	"grape", "gravel", "guitar", "hammer", "harbor", "hazel", "heron",
+	"hiker", "honey", "horse", "igloo", "index", "iris", "island", "ivory",
+	"jacket", "jaguar", "jelly", "jewel", "jungle", "kayak", "kettle", "kiwi",
+	"koala", "ladder", "lagoon", "lake", "lamp", "laser", "lemon", "lentil",
+	"lily", "lime", "lobster", "locket", "lotus", "lunar", "magnet", "mango",
+	"maple", "marble", "meadow", "melon", "meteor", "mint", "mirror", "mocha",
+	"moose", "mosaic", "muffin", "nectar", "needle", "nickel", "noodle",
+	"nutmeg", "oasis", "ocean", "olive", "onion", "opera", "orbit", "orchid",
+	"otter", "oyster", "paddle", "panda", "paper", "parrot", "pasta", "peach",
+	"pebble", "pepper", "piano", "pilot", "pine", "planet", "plum", "pocket",
+	"polar", "pony", "poppy", "potato", "prism", "pumpkin", "puzzle", "quail",
+	"quartz", "quiet", "rabbit", "radar", "radio", "raven", "reef", "ribbon",
+	"river", "robin", "rocket", "rose", "ruby", "saddle", "salmon", "sandal",
+	"saturn", "scarf", "shell", "silver", "sketch", "sloth", "snow", "sofa",
+	"solar", "spider", "spruce", "squid", "stamp", "star", "storm", "sugar",
+	"summit", "sunset", "swan", "table", "tango", "tiger", "timber", "toast",
+	"tomato", "topaz", "tower", "tulip", "tundra", "turtle", "umbrella",
+	"valley", "velvet", "violet", "volcano", "wagon", "walnut", "walrus",
+	"willow", "window", "winter", "wizard", "wolf", "yacht", "yogurt",
+	"zebra", "zephyr",
+}
@@ -4,29 +4,396 @@ import (
 	"crypto/rand"
 	"fmt"
 	"math/big"
+	"strconv"
+	"strings"
+	"unicode"
 )
 
 const (
 	defaultPasswordLength = 16
-	passwordChars         = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789!@#$%^&*"
+
+	lowerChars   = "abcdefghijklmnopqrstuvwxyz"
+	upperChars   = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	digitChars   = "0123456789"
+	specialChars = "!@#$%^&*"
+
+	// ambiguousChars are easily confused when read from an email.
+	ambiguousChars = "0O1lI"
+
+	defaultPassphraseWords = 4
+
+	// defaultPasswordQuality is ESXi's default Security.PasswordQualityControl.
+	defaultPasswordQuality = "retry=3 min=disabled,disabled,disabled,7,7"
 )
 
-// GeneratePassword generates a random password of specified length
-func GeneratePassword(length int) (string, error) {
-	if length <= 0 {
-		length = defaultPasswordLength
+// passwordClasses are the character classes in the order they are given
+// up when a host accepts fewer classes.
+var passwordClasses = []string{lowerChars, upperChars, digitChars, specialChars}
+
+// PasswordPolicy controls generated lab passwords from the
+// [password_policy] section of user_config.toml. The host's
+// Security.PasswordQualityControl is read on every rotation; settings here
+// can only tighten it.
+type PasswordPolicy struct {
+	// Length is the minimum length (default 16, or the host minimum when
+	// longer).
+	Length int `toml:"length"`
+	// ExcludeAmbiguous leaves out characters that are easily confused
+	// (0, O, 1, l, I).
+	ExcludeAmbiguous bool `toml:"exclude_ambiguous"`
+	// Exclude lists further characters never used.
+	Exclude string `toml:"exclude"`
+	// Passphrase generates capitalised words joined by "-" with a number
+	// in between, such as "Maple-Otter-42-Harbor-Quiet", which students can
+	// type more easily.
+	Passphrase bool `toml:"passphrase"`
+	// Words is the number of words in a passphrase (default 4).
+	Words int `toml:"words"`
+	// IgnoreHost skips reading the host's password quality setting.
+	IgnoreHost bool `toml:"ignore_host"`
+
+	// classes is the number of character classes required, from the
+	// host's setting (default 4).
+	classes int
+}
+
+// PasswordQuality is the subset of an ESXi Security.PasswordQualityControl
+// (pam_passwdqc) setting that decides which passwords a host accepts. Min
+// holds the minimum length of passwords with one, two and three or four
+// character classes and of passphrases, in passwdqc order; -1 means the
+// kind is not accepted.
+type PasswordQuality struct {
+	Min             [5]int
+	PassphraseWords int
+}
+
+// ParsePasswordQuality parses a Security.PasswordQualityControl value such
+// as "retry=3 min=disabled,disabled,disabled,7,7 passphrase=3". An empty
+// value is ESXi's default.
+func ParsePasswordQuality(setting string) (PasswordQuality, error) {
+	if strings.TrimSpace(setting) == "" {
+		setting = defaultPasswordQuality
 	}
+	q := PasswordQuality{Min: [5]int{-1, -1, -1, 7, 7}, PassphraseWords: 3}
+	for _, field := range strings.Fields(setting) {
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case "min":
+			parts := strings.Split(value, ",")
+			if len(parts) != len(q.Min) {
+				return q, fmt.Errorf("invalid password quality min=%s: want %d values", value, len(q.Min))
+			}
+			for i, p := range parts {
+				if p == "disabled" {
+					q.Min[i] = -1
+					continue
+				}
+				n, err := strconv.Atoi(p)
+				if err != nil || n < 0 {
+					return q, fmt.Errorf("invalid password quality min=%s", value)
+				}
+				q.Min[i] = n
+			}
+		case "passphrase":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return q, fmt.Errorf("invalid password quality passphrase=%s", value)
+			}
+			q.PassphraseWords = n
+		}
+	}
+	return q, nil
+}
 
-	password := make([]byte, length)
-	charsLength := big.NewInt(int64(len(passwordChars)))
+// minLength returns the minimum length of a password with the given number
+// of character classes, or -1 if such passwords are not accepted.
+func (q PasswordQuality) minLength(classes int) int {
+	switch classes {
+	case 1:
+		return q.Min[0]
+	case 2:
+		return q.Min[1]
+	case 3:
+		return q.Min[3]
+	default:
+		return q.Min[4]
+	}
+}
+
+// ForHost returns the policy tightened to what q accepts: as many character
+// classes as the host allows and at least its minimum length for them.
+func (p PasswordPolicy) ForHost(q PasswordQuality) (PasswordPolicy, error) {
+	if p.IgnoreHost {
+		return p, nil
+	}
+	for classes := 4; classes >= 1; classes-- {
+		n := q.minLength(classes)
+		if n < 0 {
+			continue
+		}
+		p.classes = classes
+		p.Length = max(p.length(), n)
+		if p.Passphrase {
+			p.Words = max(p.words(), q.PassphraseWords)
+		}
+		return p, nil
+	}
+	return p, fmt.Errorf("host password quality accepts no password kind")
+}
+
+func (p PasswordPolicy) length() int {
+	if p.Length <= 0 {
+		return defaultPasswordLength
+	}
+	return p.Length
+}
+
+func (p PasswordPolicy) words() int {
+	if p.Words <= 0 {
+		return defaultPassphraseWords
+	}
+	return p.Words
+}
+
+func (p PasswordPolicy) classCount() int {
+	if p.classes <= 0 {
+		return len(passwordClasses)
+	}
+	return p.classes
+}
+
+// excluded returns every character the policy never uses.
+func (p PasswordPolicy) excluded() string {
+	if p.ExcludeAmbiguous {
+		return p.Exclude + ambiguousChars
+	}
+	return p.Exclude
+}
+
+// charClasses returns the character classes in use with excluded
+// characters removed. Classes left empty by the exclusions are dropped.
+func (p PasswordPolicy) charClasses() []string {
+	exclude := p.excluded()
+	var classes []string
+	for _, class := range passwordClasses[:p.classCount()] {
+		kept := strings.Map(func(r rune) rune {
+			if strings.ContainsRune(exclude, r) {
+				return -1
+			}
+			return r
+		}, class)
+		if kept != "" {
+			classes = append(classes, kept)
+		}
+	}
+	return classes
+}
+
+// Generate returns a random password or passphrase meeting the policy.
+func (p PasswordPolicy) Generate() (string, error) {
+	classes := p.charClasses()
+	if len(classes) < p.classCount() {
+		return "", fmt.Errorf("password policy excludes every character of a required class")
+	}
+	// Upper case at the start and a digit at the end do not count towards
+	// the classes on ESXi, so a password that relies on them is rejected
+	// and generated again.
+	for range 100 {
+		var pw string
+		var err error
+		if p.Passphrase {
+			pw, err = p.generatePassphrase()
+		} else {
+			pw, err = generateFromClasses(classes, p.length())
+		}
+		if err != nil {
+			return "", err
+		}
+		if p.Check(pw) == nil {
+			return pw, nil
+		}
+	}
+	return "", fmt.Errorf("failed to generate a password meeting the policy")
+}
+
+// Validate reports whether passwords can be generated under the policy, so
+// that exclusions leaving a class or the passphrase separator unusable fail
+// at config load rather than on the first rotation.
+func (p PasswordPolicy) Validate() error {
+	_, err := p.Generate()
+	return err
+}
+
+// Check reports whether pw meets the policy, counting character classes
+// the way ESXi does.
+func (p PasswordPolicy) Check(pw string) error {
+	if len(pw) < p.length() {
+		return fmt.Errorf("password shorter than %d characters", p.length())
+	}
+	if got := passwordClassCount(pw); got < min(p.classCount(), len(pw)) {
+		return fmt.Errorf("password uses %d character classes, %d required", got, p.classCount())
+	}
+	return nil
+}
 
+// passwordClassCount counts the character classes of pw as pam_passwdqc
+// does: an upper case letter starting the password and a digit ending it
+// are not counted.
+func passwordClassCount(pw string) int {
+	var lower, upper, digit, other bool
+	for i, r := range pw {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = upper || i > 0
+		case unicode.IsDigit(r):
+			digit = digit || i < len(pw)-1
+		default:
+			other = true
+		}
+	}
+	n := 0
+	for _, ok := range []bool{lower, upper, digit, other} {
+		if ok {
+			n++
+		}
+	}
+	return n
+}
+
+// generateFromClasses returns length random characters from classes with
+// at least one character of each class, as far as length allows.
+func generateFromClasses(classes []string, length int) (string, error) {
+	all := strings.Join(classes, "")
+	password := make([]byte, length)
 	for i := range password {
-		randomIndex, err := rand.Int(rand.Reader, charsLength)
+		c, err := randomChar(all)
 		if err != nil {
-			return "", fmt.Errorf("failed to generate random number: %w", err)
+			return "", err
 		}
-		password[i] = passwordChars[randomIndex.Int64()]
+		password[i] = c
 	}
 
+	// Put one character of each class at distinct random positions.
+	positions, err := randomPerm(length)
+	if err != nil {
+		return "", err
+	}
+	for i, class := range classes {
+		if i >= length {
+			break
+		}
+		c, err := randomChar(class)
+		if err != nil {
+			return "", err
+		}
+		password[positions[i]] = c
+	}
 	return string(password), nil
 }
+
+// generatePassphrase returns capitalised random words and a two-digit
+// number joined by "-", with the number never first or last. Words and
+// digits with an excluded character are not used.
+func (p PasswordPolicy) generatePassphrase() (string, error) {
+	exclude := p.excluded()
+	if strings.Contains(exclude, "-") {
+		return "", fmt.Errorf("password policy excludes the passphrase separator \"-\"")
+	}
+	var words []string
+	for _, w := range passphraseWords {
+		if !strings.ContainsAny(w, exclude) && !strings.ContainsAny(capitalise(w), exclude) {
+			words = append(words, w)
+		}
+	}
+	digits := strings.Map(func(r rune) rune {
+		if strings.ContainsRune(exclude, r) {
+			return -1
+		}
+		return r
+	}, digitChars)
+	leading := strings.TrimPrefix(digits, "0")
+	if len(words) == 0 || leading == "" {
+		return "", fmt.Errorf("password policy excludes every passphrase word or digit")
+	}
+
+	count := p.words()
+	parts := make([]string, 0, count+1)
+	for range count {
+		i, err := randomInt(len(words))
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, capitalise(words[i]))
+	}
+	tens, err := randomChar(leading)
+	if err != nil {
+		return "", err
+	}
+	ones, err := randomChar(digits)
+	if err != nil {
+		return "", err
+	}
+	at, err := randomInt(max(count-1, 1))
+	if err != nil {
+		return "", err
+	}
+	parts = append(parts[:at+1], append([]string{string([]byte{tens, ones})}, parts[at+1:]...)...)
+	pw := strings.Join(parts, "-")
+	for len(pw) < p.length() {
+		i, err := randomInt(len(words))
+		if err != nil {
+			return "", err
+		}
+		pw += "-" + words[i]
+	}
+	return pw, nil
+}
+
+// capitalise upper-cases the first letter of an ASCII word.
+func capitalise(w string) string {
+	return strings.ToUpper(w[:1]) + w[1:]
+}
+
+// GeneratePassword generates a random password of specified length with a
+// lower case letter, an upper case letter, a digit and a special character
+// when the length allows.
+func GeneratePassword(length int) (string, error) {
+	if length <= 0 {
+		length = defaultPasswordLength
+	}
+	return generateFromClasses(passwordClasses, length)
+}
+
+func randomInt(n int) (int, error) {
+	i, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		return 0, fmt.Errorf("failed to generate random number: %w", err)
+	}
+	return int(i.Int64()), nil
+}
+
+func randomChar(chars string) (byte, error) {
+	i, err := randomInt(len(chars))
+	if err != nil {
+		return 0, err
+	}
+	return chars[i], nil
+}
+
+// randomPerm returns a random permutation of [0, n).
+func randomPerm(n int) ([]int, error) {
+	perm := make([]int, n)
+	for i := range perm {
+		perm[i] = i
+	}
+	for i := n - 1; i > 0; i-- {
+		j, err := randomInt(i + 1)
+		if err != nil {
+			return nil, err
+		}
+		perm[i], perm[j] = perm[j], perm[i]
+	}
+	return perm, nil
+}
@@ -1,6 +1,10 @@
 package service
 
 import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -33,8 +37,9 @@ func TestGeneratePassword_ValidChars(t *testing.T) {
 	pw, err := GeneratePassword(200)
 	require.NoError(t, err)
 
+	chars := strings.Join(passwordClasses, "")
 	for _, ch := range pw {
-		assert.Contains(t, passwordChars, string(ch), "unexpected character: %c", ch)
+		assert.Contains(t, chars, string(ch), "unexpected character: %c", ch)
 	}
 }
 
@@ -47,3 +52,134 @@ func TestGeneratePassword_Uniqueness(t *testing.T) {
 		seen[pw] = true
 	}
 }
+
+func TestGeneratePassword_AllClasses(t *testing.T) {
+	for range 200 {
+		pw, err := GeneratePassword(8)
+		require.NoError(t, err)
+		for _, class := range passwordClasses {
+			assert.True(t, strings.ContainsAny(pw, class), "%q lacks one of %q", pw, class)
+		}
+	}
+}
+
+func TestParsePasswordQuality(t *testing.T) {
+	q, err := ParsePasswordQuality("")
+	require.NoError(t, err)
+	assert.Equal(t, [5]int{-1, -1, -1, 7, 7}, q.Min, "ESXi default")
+
+	q, err = ParsePasswordQuality("retry=3 min=disabled,disabled,12,10,8 passphrase=4")
+	require.NoError(t, err)
+	assert.Equal(t, [5]int{-1, -1, 12, 10, 8}, q.Min)
+	assert.Equal(t, 4, q.PassphraseWords)
+
+	_, err = ParsePasswordQuality("min=8,8")
+	assert.Error(t, err)
+	_, err = ParsePasswordQuality("min=disabled,disabled,disabled,x,7")
+	assert.Error(t, err)
+}
+
+func TestPasswordPolicy_ForHost(t *testing.T) {
+	q, err := ParsePasswordQuality("min=disabled,disabled,disabled,disabled,24")
+	require.NoError(t, err)
+	p, err := PasswordPolicy{}.ForHost(q)
+	require.NoError(t, err)
+	assert.Equal(t, 24, p.Length, "host minimum longer than the default")
+
+	p, err = PasswordPolicy{Length: 30}.ForHost(q)
+	require.NoError(t, err)
+	assert.Equal(t, 30, p.Length, "config can only tighten")
+
+	// Four-class passwords are refused: generate lower, upper and digits.
+	q, err = ParsePasswordQuality("min=disabled,disabled,disabled,12,disabled")
+	require.NoError(t, err)
+	p, err = PasswordPolicy{}.ForHost(q)
+	require.NoError(t, err)
+	for range 50 {
+		pw, err := p.Generate()
+		require.NoError(t, err)
+		assert.Len(t, pw, 16)
+		assert.False(t, strings.ContainsAny(pw, specialChars), pw)
+		assert.Equal(t, 3, passwordClassCount(pw), pw)
+	}
+
+	p, err = PasswordPolicy{IgnoreHost: true, Length: 10}.ForHost(q)
+	require.NoError(t, err)
+	assert.Equal(t, 10, p.Length)
+
+	_, err = PasswordPolicy{}.ForHost(PasswordQuality{Min: [5]int{-1, -1, -1, -1, -1}})
+	assert.Error(t, err)
+}
+
+func TestPasswordPolicy_Exclusions(t *testing.T) {
+	p := PasswordPolicy{ExcludeAmbiguous: true, Exclude: "!@#$%^&"}
+	for range 100 {
+		pw, err := p.Generate()
+		require.NoError(t, err)
+		assert.False(t, strings.ContainsAny(pw, ambiguousChars+"!@#$%^&"), pw)
+		assert.Contains(t, pw, "*", "the only special character left is required")
+		require.NoError(t, p.Check(pw))
+	}
+
+	_, err := PasswordPolicy{Exclude: specialChars}.Generate()
+	assert.Error(t, err, "a required class cannot be excluded entirely")
+}
+
+func TestPasswordPolicy_Passphrase(t *testing.T) {
+	p := PasswordPolicy{Passphrase: true, Words: 5}
+	for range 50 {
+		pw, err := p.Generate()
+		require.NoError(t, err)
+		parts := strings.Split(pw, "-")
+		require.GreaterOrEqual(t, len(parts), 6, pw)
+		assert.Equal(t, 4, passwordClassCount(pw), pw)
+		_, err = strconv.Atoi(parts[0])
+		assert.Error(t, err, "number is not first: %s", pw)
+		_, err = strconv.Atoi(parts[len(parts)-1])
+		assert.Error(t, err, "number is not last: %s", pw)
+	}
+}
+
+func TestPasswordPolicy_PassphraseExclusions(t *testing.T) {
+	p := PasswordPolicy{Passphrase: true, ExcludeAmbiguous: true, Exclude: "e9"}
+	for range 50 {
+		pw, err := p.Generate()
+		require.NoError(t, err)
+		assert.False(t, strings.ContainsAny(pw, ambiguousChars+"e9"), pw)
+		require.NoError(t, p.Check(pw))
+	}
+
+	_, err := PasswordPolicy{Passphrase: true, Exclude: "aeiou"}.Generate()
+	assert.Error(t, err, "no word is left")
+	_, err = PasswordPolicy{Passphrase: true, Exclude: "-"}.Generate()
+	assert.Error(t, err)
+}
+
+func TestPasswordPolicy_CheckCountsClassesLikeESXi(t *testing.T) {
+	p := PasswordPolicy{Length: 8}
+	assert.Error(t, p.Check("Abcdef!1"), "leading upper case and trailing digit do not count")
+	assert.NoError(t, p.Check("aBcdef1!"))
+	assert.Error(t, p.Check("aB1!"), "too short")
+}
+
+func TestLoadFeatureConfig_InvalidPasswordPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"empty class", "[password_policy]\nexclude = \"!@#$%^&*\"\n", "excludes every character of a required class"},
+		{"no separator", "[password_policy]\npassphrase = true\nexclude = \"-\"\n", "passphrase separator"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpFile := filepath.Join(t.TempDir(), "config.toml")
+			require.NoError(t, os.WriteFile(tmpFile, []byte(tt.content), 0o644))
+
+			_, err := LoadFeatureConfig(tmpFile)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "invalid password_policy config")
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
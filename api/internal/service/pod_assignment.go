@@ -0,0 +1,58 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// PodAssignment is the booking a scheduler run handed to a pod.
+type PodAssignment struct {
+	User    string `json:"user"`
+	Booking string `json:"booking"`
+}
+
+// AssignmentPath is where the last run's pod assignment is kept, next to
+// the pod health state.
+func (c QuarantineConfig) AssignmentPath() string {
+	path := c.StatePath
+	if path == "" {
+		path = defaultHealthStatePath
+	}
+	return filepath.Join(filepath.Dir(path), "pod_assignment.json")
+}
+
+// LoadAssignment reads the pod assignment saved at path. A missing file
+// yields no assignment.
+func LoadAssignment(path string) ([]PodAssignment, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pod assignment: %w", err)
+	}
+	var pods []PodAssignment
+	if err := json.Unmarshal(data, &pods); err != nil {
+		return nil, fmt.Errorf("failed to parse pod assignment %s: %w", path, err)
+	}
+	return pods, nil
+}
+
+// SaveAssignment writes the pod assignment to path atomically, creating its
+// directory if needed.
+func SaveAssignment(path string, pods []PodAssignment) error {
+	if pods == nil {
+		pods = []PodAssignment{}
+	}
+	data, err := json.MarshalIndent(pods, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode pod assignment: %w", err)
+	}
+	if err := writeFileAtomic(path, ".pod_assignment-*", data); err != nil {
+		return fmt.Errorf("failed to write pod assignment: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+package service
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAssignment_SaveAndLoad(t *testing.T) {
+	cfg := QuarantineConfig{StatePath: filepath.Join(t.TempDir(), "data", "pod_health.json")}
+	path := cfg.AssignmentPath()
+	assert.Equal(t, "pod_assignment.json", filepath.Base(path))
+
+	pods, err := LoadAssignment(path)
+	require.NoError(t, err)
+	assert.Empty(t, pods, "missing file")
+
+	want := []PodAssignment{{User: "carol", Booking: "student@ex.com"}}
+	require.NoError(t, SaveAssignment(path, want))
+	pods, err = LoadAssignment(path)
+	require.NoError(t, err)
+	assert.Equal(t, want, pods)
+}
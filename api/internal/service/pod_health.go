@@ -0,0 +1,192 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const defaultHealthStatePath = "./data/pod_health.json"
+
+// QuarantineConfig controls pod quarantine and hot spares from the
+// [quarantine] section of user_config.toml.
+type QuarantineConfig struct {
+	// StatePath is where pod health is kept between runs.
+	StatePath string `toml:"state_path"`
+	// FailureThreshold is the number of consecutive failed runs after which
+	// a pod is quarantined (default 1).
+	FailureThreshold int `toml:"failure_threshold"`
+	// ReleaseAfter is the number of consecutive clean runs after which a
+	// quarantined pod is released (default 1).
+	ReleaseAfter int `toml:"release_after"`
+	// SpareUsers are pods kept back from regular assignment; they only take
+	// bookings whose pod is broken or quarantined.
+	SpareUsers []string `toml:"spare_users"`
+	// OperatorEmails receive a notice when a pod is quarantined or released.
+	OperatorEmails []string `toml:"operator_emails"`
+}
+
+// PodHealth is the persisted health of one pod.
+type PodHealth struct {
+	User        string    `json:"user"`
+	Failures    int       `json:"failures"`
+	Successes   int       `json:"successes"`
+	Quarantined bool      `json:"quarantined"`
+	Since       time.Time `json:"since,omitzero"`
+	Reason      string    `json:"reason,omitempty"`
+}
+
+// HealthTracker records pod failures across runs and decides when pods enter
+// and leave quarantine. It is not safe for concurrent use.
+type HealthTracker struct {
+	path         string
+	threshold    int
+	releaseAfter int
+	pods         map[string]*PodHealth
+}
+
+// LoadHealthTracker reads the health state file. A missing file yields an
+// empty tracker.
+func LoadHealthTracker(cfg QuarantineConfig) (*HealthTracker, error) {
+	t := &HealthTracker{
+		path:         cfg.StatePath,
+		threshold:    max(cfg.FailureThreshold, 1),
+		releaseAfter: max(cfg.ReleaseAfter, 1),
+		pods:         make(map[string]*PodHealth),
+	}
+	if t.path == "" {
+		t.path = defaultHealthStatePath
+	}
+
+	data, err := os.ReadFile(t.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pod health state: %w", err)
+	}
+	var pods []PodHealth
+	if err := json.Unmarshal(data, &pods); err != nil {
+		return nil, fmt.Errorf("failed to parse pod health state %s: %w", t.path, err)
+	}
+	for i := range pods {
+		t.pods[pods[i].User] = &pods[i]
+	}
+	return t, nil
+}
+
+// Quarantined reports whether the user's pod is quarantined.
+func (t *HealthTracker) Quarantined(user string) bool {
+	p, ok := t.pods[user]
+	return ok && p.Quarantined
+}
+
+// ReleasedBySuccess reports whether the user's pod is quarantined and one
+// more clean run releases it.
+func (t *HealthTracker) ReleasedBySuccess(user string) bool {
+	p, ok := t.pods[user]
+	return ok && p.Quarantined && p.Successes+1 >= t.releaseAfter
+}
+
+// RecordFailure records a failed run for the pod and reports whether it was
+// quarantined by this failure.
+func (t *HealthTracker) RecordFailure(user, reason string, now time.Time) bool {
+	p := t.pod(user)
+	p.Failures++
+	p.Successes = 0
+	p.Reason = reason
+	if p.Quarantined || p.Failures < t.threshold {
+		return false
+	}
+	p.Quarantined = true
+	p.Since = now
+	return true
+}
+
+// RecordSuccess records a clean run for the pod and reports whether it was
+// released from quarantine by it.
+func (t *HealthTracker) RecordSuccess(user string) bool {
+	p, ok := t.pods[user]
+	if !ok {
+		return false
+	}
+	p.Failures = 0
+	if !p.Quarantined {
+		delete(t.pods, user)
+		return false
+	}
+	p.Successes++
+	if p.Successes < t.releaseAfter {
+		return false
+	}
+	delete(t.pods, user)
+	return true
+}
+
+// Release removes the pod from quarantine, e.g. after a manual repair, and
+// reports whether it was quarantined.
+func (t *HealthTracker) Release(user string) bool {
+	p, ok := t.pods[user]
+	delete(t.pods, user)
+	return ok && p.Quarantined
+}
+
+// Pods returns the tracked pods sorted by user.
+func (t *HealthTracker) Pods() []PodHealth {
+	pods := make([]PodHealth, 0, len(t.pods))
+	for _, p := range t.pods {
+		pods = append(pods, *p)
+	}
+	sort.Slice(pods, func(i, j int) bool {
+		return pods[i].User < pods[j].User
+	})
+	return pods
+}
+
+// Save writes the state file atomically, creating its directory if needed.
+func (t *HealthTracker) Save() error {
+	data, err := json.MarshalIndent(t.Pods(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode pod health state: %w", err)
+	}
+	if err := writeFileAtomic(t.path, ".pod_health-*", data); err != nil {
+		return fmt.Errorf("failed to write pod health state: %w", err)
+	}
+	return nil
+}
+
+// writeFileAtomic writes data and a trailing newline to path through a
+// temporary file named after pattern in the same directory, creating the
+// directory if needed, so readers never see a partial file.
+func writeFileAtomic(path, pattern string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (t *HealthTracker) pod(user string) *PodHealth {
+	p, ok := t.pods[user]
+	if !ok {
+		p = &PodHealth{User: user}
+		t.pods[user] = p
+	}
+	return p
+}
@@ -0,0 +1,66 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthTracker_QuarantineAndRelease(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pod_health.json")
+	tracker, err := LoadHealthTracker(QuarantineConfig{StatePath: path, FailureThreshold: 2, ReleaseAfter: 2})
+	require.NoError(t, err)
+	now := time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+
+	assert.False(t, tracker.RecordFailure("alice", "restore failed", now))
+	assert.False(t, tracker.Quarantined("alice"))
+	assert.True(t, tracker.RecordFailure("alice", "restore failed again", now))
+	assert.True(t, tracker.Quarantined("alice"))
+	assert.False(t, tracker.RecordFailure("alice", "still failing", now), "already quarantined")
+
+	assert.False(t, tracker.ReleasedBySuccess("alice"))
+	assert.False(t, tracker.RecordSuccess("alice"))
+	assert.True(t, tracker.Quarantined("alice"))
+	assert.True(t, tracker.ReleasedBySuccess("alice"))
+	assert.True(t, tracker.RecordSuccess("alice"))
+	assert.False(t, tracker.Quarantined("alice"))
+	assert.Empty(t, tracker.Pods())
+}
+
+func TestHealthTracker_FailureStreakResetsOnSuccess(t *testing.T) {
+	tracker, err := LoadHealthTracker(QuarantineConfig{StatePath: filepath.Join(t.TempDir(), "h.json"), FailureThreshold: 2})
+	require.NoError(t, err)
+
+	tracker.RecordFailure("alice", "x", time.Now())
+	tracker.RecordSuccess("alice")
+	assert.False(t, tracker.RecordFailure("alice", "y", time.Now()))
+}
+
+func TestHealthTracker_SaveAndLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data", "pod_health.json")
+	tracker, err := LoadHealthTracker(QuarantineConfig{StatePath: path})
+	require.NoError(t, err)
+	now := time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+	require.True(t, tracker.RecordFailure("bob", "Pod-2_FortiGate: snapshot not found", now))
+	require.NoError(t, tracker.Save())
+
+	loaded, err := LoadHealthTracker(QuarantineConfig{StatePath: path})
+	require.NoError(t, err)
+	assert.Equal(t, []PodHealth{{User: "bob", Failures: 1, Quarantined: true, Since: now, Reason: "Pod-2_FortiGate: snapshot not found"}}, loaded.Pods())
+
+	assert.True(t, loaded.Release("bob"))
+	assert.False(t, loaded.Release("bob"))
+}
+
+func TestLoadHealthTracker_InvalidState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pod_health.json")
+	require.NoError(t, os.WriteFile(path, []byte("{"), 0o644))
+
+	_, err := LoadHealthTracker(QuarantineConfig{StatePath: path})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to parse pod health state")
+}
@@ -0,0 +1,101 @@
+package service
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/EpicMandM/esxi-lab-provider/api/internal/models"
+)
+
+// Pod issue kinds, used as the reason attribute of pod validation metrics.
+const (
+	PodIssueMissingRole     = "missing_role"
+	PodIssueNoSnapshots     = "no_snapshots"
+	PodIssueMissingSnapshot = "missing_snapshot"
+)
+
+// PodTemplate declares what a complete pod looks like: one VM per role
+// (matched like snapshot rule roles, "FortiGate" matches "Pod-1_FortiGate")
+// and, optionally, a snapshot every role VM must have. The template applies
+// to the listed users, or to every user when Users is empty.
+type PodTemplate struct {
+	Name     string   `toml:"name"`
+	Users    []string `toml:"users"`
+	Roles    []string `toml:"roles"`
+	Snapshot string   `toml:"snapshot"`
+}
+
+// PodIssue is one reason a pod does not match its template.
+type PodIssue struct {
+	Kind    string
+	VM      string
+	Message string
+}
+
+func (i PodIssue) String() string { return i.Message }
+
+// TemplateFor returns the first template that applies to user, or nil.
+func (c *ESXiConfig) TemplateFor(user string) *PodTemplate {
+	for i := range c.PodTemplates {
+		t := &c.PodTemplates[i]
+		if len(t.Users) == 0 || slices.Contains(t.Users, user) {
+			return t
+		}
+	}
+	return nil
+}
+
+// Check validates a pod's VMs against the template and returns every issue
+// found; an empty result means the pod is complete.
+func (t *PodTemplate) Check(vms []models.VM) []PodIssue {
+	var issues []PodIssue
+	for _, role := range t.Roles {
+		vm := findRoleVM(vms, role)
+		if vm == nil {
+			issues = append(issues, PodIssue{
+				Kind:    PodIssueMissingRole,
+				Message: fmt.Sprintf("no VM for role %s", role),
+			})
+			continue
+		}
+		snapshots := vm.AllSnapshots()
+		if len(snapshots) == 0 {
+			issues = append(issues, PodIssue{
+				Kind:    PodIssueNoSnapshots,
+				VM:      vm.Name,
+				Message: fmt.Sprintf("%s has no snapshots", vm.Name),
+			})
+			continue
+		}
+		if t.Snapshot != "" && !slices.ContainsFunc(snapshots, func(s models.VMSnapshot) bool { return s.Name == t.Snapshot }) {
+			issues = append(issues, PodIssue{
+				Kind:    PodIssueMissingSnapshot,
+				VM:      vm.Name,
+				Message: fmt.Sprintf("%s has no snapshot %q", vm.Name, t.Snapshot),
+			})
+		}
+	}
+	return issues
+}
+
+func (c *ESXiConfig) validatePodTemplates() error {
+	for i, t := range c.PodTemplates {
+		if t.Name == "" {
+			return fmt.Errorf("pod_templates[%d]: name is required", i)
+		}
+		if len(t.Roles) == 0 {
+			return fmt.Errorf("pod_templates[%d] %s: roles is required", i, t.Name)
+		}
+	}
+	return nil
+}
+
+func findRoleVM(vms []models.VM, role string) *models.VM {
+	for i := range vms {
+		if strings.HasSuffix(vms[i].Name, "_"+role) {
+			return &vms[i]
+		}
+	}
+	return nil
+}
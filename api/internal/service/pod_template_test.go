@@ -0,0 +1,69 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/EpicMandM/esxi-lab-provider/api/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPodTemplate_Check(t *testing.T) {
+	tmpl := PodTemplate{Name: "lab", Roles: []string{"FortiGate", "Client", "Server"}, Snapshot: "clean"}
+	vms := []models.VM{
+		{Name: "Pod-1_FortiGate", Snapshots: []models.VMSnapshot{{Name: "base", Children: []models.VMSnapshot{{Name: "clean"}}}}},
+		{Name: "Pod-1_Client", Snapshots: []models.VMSnapshot{{Name: "base"}}},
+	}
+
+	issues := tmpl.Check(vms)
+	assert.Equal(t, []PodIssue{
+		{Kind: PodIssueMissingSnapshot, VM: "Pod-1_Client", Message: `Pod-1_Client has no snapshot "clean"`},
+		{Kind: PodIssueMissingRole, Message: "no VM for role Server"},
+	}, issues)
+}
+
+func TestPodTemplate_CheckComplete(t *testing.T) {
+	tmpl := PodTemplate{Name: "lab", Roles: []string{"FortiGate"}}
+	assert.Empty(t, tmpl.Check([]models.VM{{Name: "Pod-1_FortiGate", Snapshots: []models.VMSnapshot{{Name: "any"}}}}))
+	assert.Equal(t, PodIssueNoSnapshots, tmpl.Check([]models.VM{{Name: "Pod-1_FortiGate"}})[0].Kind)
+}
+
+func TestESXiConfig_TemplateFor(t *testing.T) {
+	cfg := ESXiConfig{PodTemplates: []PodTemplate{
+		{Name: "special", Users: []string{"bob"}, Roles: []string{"Kali"}},
+		{Name: "default", Roles: []string{"FortiGate"}},
+	}}
+	assert.Equal(t, "special", cfg.TemplateFor("bob").Name)
+	assert.Equal(t, "default", cfg.TemplateFor("alice").Name)
+	assert.Nil(t, (&ESXiConfig{}).TemplateFor("alice"))
+}
+
+func TestLoadFeatureConfig_PodTemplates(t *testing.T) {
+	content := `
+[[esxi.pod_templates]]
+name = "fortigate-lab"
+roles = ["FortiGate", "Client_Deb"]
+snapshot = "clean"
+`
+	tmpFile := filepath.Join(t.TempDir(), "config.toml")
+	require.NoError(t, os.WriteFile(tmpFile, []byte(content), 0o644))
+
+	cfg, err := LoadFeatureConfig(tmpFile)
+	require.NoError(t, err)
+	assert.Equal(t, []PodTemplate{{Name: "fortigate-lab", Roles: []string{"FortiGate", "Client_Deb"}, Snapshot: "clean"}}, cfg.ESXi.PodTemplates)
+}
+
+func TestLoadFeatureConfig_PodTemplateWithoutRoles(t *testing.T) {
+	content := `
+[[esxi.pod_templates]]
+name = "empty"
+`
+	tmpFile := filepath.Join(t.TempDir(), "config.toml")
+	require.NoError(t, os.WriteFile(tmpFile, []byte(content), 0o644))
+
+	_, err := LoadFeatureConfig(tmpFile)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "pod_templates[0] empty: roles is required")
+}
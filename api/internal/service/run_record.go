@@ -0,0 +1,138 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	defaultRunRecordDir        = "./data/runs"
+	defaultRunRecordKeep       = 30
+	defaultReadyTimeoutSeconds = 180
+
+	// runDirLayout names each run's directory after its start time.
+	runDirLayout = "20060102T150405Z"
+)
+
+// RunRecordConfig controls the per-run records kept for support from the
+// [run_records] section of user_config.toml.
+type RunRecordConfig struct {
+	Enabled bool `toml:"enabled"`
+	// Dir holds one directory per run (default ./data/runs).
+	Dir string `toml:"dir"`
+	// Keep is the number of most recent runs kept (default 30).
+	Keep int `toml:"keep"`
+	// Screenshots adds a console screenshot of every restored VM, taken
+	// once power management has run.
+	Screenshots bool `toml:"screenshots"`
+	// ReadyTimeoutSeconds is how long to wait for VMware Tools in the guest
+	// before taking the screenshot anyway (default 180).
+	ReadyTimeoutSeconds int `toml:"ready_timeout_seconds"`
+}
+
+// ReadyTimeout returns ReadyTimeoutSeconds as a duration, or the default
+// when unset.
+func (c RunRecordConfig) ReadyTimeout() time.Duration {
+	if c.ReadyTimeoutSeconds <= 0 {
+		return defaultReadyTimeoutSeconds * time.Second
+	}
+	return time.Duration(c.ReadyTimeoutSeconds) * time.Second
+}
+
+// RunRecord is what one run did to each pod, saved as run.json in the run's
+// directory next to the pod screenshots.
+type RunRecord struct {
+	Started time.Time   `json:"started"`
+	Pods    []PodRecord `json:"pods"`
+
+	dir  string
+	root string
+	keep int
+}
+
+// PodRecord is the handover state of one pod.
+type PodRecord struct {
+	User    string     `json:"user"`
+	Booking string     `json:"booking,omitempty"`
+	VMs     []VMRecord `json:"vms"`
+}
+
+// VMRecord is the restore outcome and screenshot of one VM. Screenshot is a
+// file name within the run directory.
+type VMRecord struct {
+	VM              string `json:"vm"`
+	Snapshot        string `json:"snapshot,omitempty"`
+	PowerState      string `json:"power_state,omitempty"`
+	Error           string `json:"error,omitempty"`
+	Screenshot      string `json:"screenshot,omitempty"`
+	GuestReady      bool   `json:"guest_ready,omitempty"`
+	ScreenshotError string `json:"screenshot_error,omitempty"`
+}
+
+// NewRunRecord starts the record of a run that started at started, in a
+// directory under cfg.Dir named after the start time.
+func NewRunRecord(cfg RunRecordConfig, started time.Time) *RunRecord {
+	root := cfg.Dir
+	if root == "" {
+		root = defaultRunRecordDir
+	}
+	keep := cfg.Keep
+	if keep <= 0 {
+		keep = defaultRunRecordKeep
+	}
+	return &RunRecord{
+		Started: started.UTC(),
+		dir:     filepath.Join(root, started.UTC().Format(runDirLayout)),
+		root:    root,
+		keep:    keep,
+	}
+}
+
+// Dir returns the run's directory.
+func (r *RunRecord) Dir() string { return r.dir }
+
+// Save writes run.json to the run's directory and removes the oldest runs
+// beyond the configured number to keep.
+func (r *RunRecord) Save() error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode run record: %w", err)
+	}
+	if err := os.MkdirAll(r.dir, 0o755); err != nil {
+		return fmt.Errorf("failed to write run record: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(r.dir, "run.json"), append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("failed to write run record: %w", err)
+	}
+	return r.prune()
+}
+
+// prune removes the oldest run directories beyond keep. Run directory names
+// sort by start time. Anything else under the root, such as a directory an
+// operator put there, is left alone.
+func (r *RunRecord) prune() error {
+	entries, err := os.ReadDir(r.root)
+	if err != nil {
+		return fmt.Errorf("failed to prune run records: %w", err)
+	}
+	var runs []string
+	for _, e := range entries {
+		if _, err := time.Parse(runDirLayout, e.Name()); e.IsDir() && err == nil {
+			runs = append(runs, e.Name())
+		}
+	}
+	if len(runs) <= r.keep {
+		return nil
+	}
+	sort.Strings(runs)
+	for _, name := range runs[:len(runs)-r.keep] {
+		if err := os.RemoveAll(filepath.Join(r.root, name)); err != nil {
+			return fmt.Errorf("failed to prune run records: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package service
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunRecord_SaveAndPrune(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(root, "archive"), 0o755))
+	cfg := RunRecordConfig{Dir: root, Keep: 2}
+	start := time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC)
+
+	for i := range 3 {
+		rec := NewRunRecord(cfg, start.Add(time.Duration(i)*3*time.Hour))
+		rec.Pods = []PodRecord{{User: "alice", Booking: "student@ex.com", VMs: []VMRecord{{VM: "Pod-1_FortiGate", Snapshot: "golden", Screenshot: "Pod-1_FortiGate.png"}}}}
+		require.NoError(t, rec.Save())
+	}
+
+	entries, err := os.ReadDir(root)
+	require.NoError(t, err)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	assert.Equal(t, []string{"20261018T120000Z", "20261018T150000Z", "archive"}, names, "oldest run pruned, other directories kept")
+
+	data, err := os.ReadFile(filepath.Join(root, "20261018T150000Z", "run.json"))
+	require.NoError(t, err)
+	var saved RunRecord
+	require.NoError(t, json.Unmarshal(data, &saved))
+	assert.Equal(t, start.Add(6*time.Hour), saved.Started)
+	assert.Equal(t, "Pod-1_FortiGate.png", saved.Pods[0].VMs[0].Screenshot)
+}
+
+func TestRunRecordConfig_Defaults(t *testing.T) {
+	rec := NewRunRecord(RunRecordConfig{}, time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC))
+	assert.Equal(t, filepath.Join("data", "runs", "20261018T090000Z"), rec.Dir())
+	assert.Equal(t, 180*time.Second, RunRecordConfig{}.ReadyTimeout())
+}
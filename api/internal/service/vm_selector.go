@@ -0,0 +1,144 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/EpicMandM/esxi-lab-provider/api/internal/models"
+)
+
+// VMSelector selects inventory VMs by exactly one criterion:
+//
+//	prefix = "Pod-1_"                       VM name starts with the prefix
+//	attribute = "lab-pod", value = "1"      custom attribute equals value (vCenter only)
+//	annotation = "pod: 1"                   a line of the VM notes equals the text
+//	folder = "Pod-1"                        VM is in the named folder
+//	resource_pool = "Pod-1"                 VM is in the named resource pool
+type VMSelector struct {
+	Prefix       string `toml:"prefix"`
+	Attribute    string `toml:"attribute"`
+	Value        string `toml:"value"`
+	Annotation   string `toml:"annotation"`
+	Folder       string `toml:"folder"`
+	ResourcePool string `toml:"resource_pool"`
+}
+
+// UserVMSelectors is the list of selectors that defines one user's pod.
+type UserVMSelectors struct {
+	User      string
+	Selectors []VMSelector
+}
+
+// Matches reports whether vm is selected.
+func (s VMSelector) Matches(vm models.VM) bool {
+	switch {
+	case s.Prefix != "":
+		return strings.HasPrefix(vm.Name, s.Prefix)
+	case s.Attribute != "":
+		v, ok := vm.Attributes[s.Attribute]
+		return ok && v == s.Value
+	case s.Annotation != "":
+		for _, line := range strings.Split(vm.Annotation, "\n") {
+			if strings.TrimSpace(line) == s.Annotation {
+				return true
+			}
+		}
+		return false
+	case s.Folder != "":
+		return vm.Folder == s.Folder
+	case s.ResourcePool != "":
+		return vm.ResourcePool == s.ResourcePool
+	}
+	return false
+}
+
+// String describes the selector for logs and listings, e.g.
+// "attribute lab-pod=1".
+func (s VMSelector) String() string {
+	switch {
+	case s.Prefix != "":
+		return "prefix " + s.Prefix
+	case s.Attribute != "":
+		return fmt.Sprintf("attribute %s=%s", s.Attribute, s.Value)
+	case s.Annotation != "":
+		return fmt.Sprintf("annotation %q", s.Annotation)
+	case s.Folder != "":
+		return "folder " + s.Folder
+	case s.ResourcePool != "":
+		return "resource_pool " + s.ResourcePool
+	}
+	return "<empty>"
+}
+
+// Validate checks that exactly one criterion is set.
+func (s VMSelector) Validate() error {
+	set := 0
+	for _, v := range []string{s.Prefix, s.Attribute, s.Annotation, s.Folder, s.ResourcePool} {
+		if v != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return fmt.Errorf("exactly one of prefix, attribute, annotation, folder or resource_pool must be set")
+	}
+	if s.Value != "" && s.Attribute == "" {
+		return fmt.Errorf("value is only valid with attribute")
+	}
+	return nil
+}
+
+// UserSelectors returns every user's selectors sorted by username. Prefixes
+// from user_vm_mappings become prefix selectors, followed by the user's
+// user_vm_selectors.
+func (c *ESXiConfig) UserSelectors() []UserVMSelectors {
+	byUser := make(map[string][]VMSelector)
+	for user, prefixes := range c.UserVMMappings {
+		for _, prefix := range prefixes {
+			byUser[user] = append(byUser[user], VMSelector{Prefix: prefix})
+		}
+	}
+	for user, selectors := range c.UserVMSelectors {
+		byUser[user] = append(byUser[user], selectors...)
+	}
+
+	result := make([]UserVMSelectors, 0, len(byUser))
+	for user, selectors := range byUser {
+		result = append(result, UserVMSelectors{User: user, Selectors: selectors})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].User < result[j].User
+	})
+	return result
+}
+
+func (c *ESXiConfig) validateSelectors() error {
+	for user, selectors := range c.UserVMSelectors {
+		for i, s := range selectors {
+			if err := s.Validate(); err != nil {
+				return fmt.Errorf("user_vm_selectors.%s[%d]: %w", user, i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// CheckSelectors rejects attribute selectors when no endpoint can resolve
+// them. Custom attributes are defined by a vCenter CustomFieldsManager;
+// standalone ESXi hosts have none, so an attribute selector would never
+// match. With mixed endpoints, only VMs managed by a vCenter can match.
+func (s *VMwareService) CheckSelectors(c *ESXiConfig) error {
+	for _, conn := range s.conns {
+		if conn.client.ServiceContent.CustomFieldsManager != nil {
+			return nil
+		}
+	}
+	for _, us := range c.UserSelectors() {
+		for _, sel := range us.Selectors {
+			if sel.Attribute != "" {
+				return fmt.Errorf("user_vm_selectors.%s: %s needs a vCenter endpoint, standalone ESXi hosts have no custom attributes", us.User, sel)
+			}
+		}
+	}
+	return nil
+}
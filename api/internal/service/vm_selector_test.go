@@ -0,0 +1,133 @@
+package service
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/EpicMandM/esxi-lab-provider/api/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25"
+)
+
+func TestVMSelector_Matches(t *testing.T) {
+	vm := models.VM{
+		Name:         "Pod-1_FortiGate",
+		Folder:       "Pod-1",
+		ResourcePool: "Labs",
+		Annotation:   "Lab firewall\npod: 1\n",
+		Attributes:   map[string]string{"lab-pod": "1"},
+	}
+
+	tests := []struct {
+		name     string
+		selector VMSelector
+		want     bool
+	}{
+		{"prefix", VMSelector{Prefix: "Pod-1_"}, true},
+		{"prefix mismatch", VMSelector{Prefix: "Pod-2_"}, false},
+		{"attribute", VMSelector{Attribute: "lab-pod", Value: "1"}, true},
+		{"attribute other value", VMSelector{Attribute: "lab-pod", Value: "2"}, false},
+		{"attribute missing", VMSelector{Attribute: "owner"}, false},
+		{"annotation line", VMSelector{Annotation: "pod: 1"}, true},
+		{"annotation substring only", VMSelector{Annotation: "pod"}, false},
+		{"folder", VMSelector{Folder: "Pod-1"}, true},
+		{"folder mismatch", VMSelector{Folder: "Pod-10"}, false},
+		{"resource pool", VMSelector{ResourcePool: "Labs"}, true},
+		{"empty selector", VMSelector{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.selector.Matches(vm))
+		})
+	}
+}
+
+func TestVMSelector_String(t *testing.T) {
+	assert.Equal(t, "prefix Pod-1_", VMSelector{Prefix: "Pod-1_"}.String())
+	assert.Equal(t, "attribute lab-pod=1", VMSelector{Attribute: "lab-pod", Value: "1"}.String())
+	assert.Equal(t, `annotation "pod: 1"`, VMSelector{Annotation: "pod: 1"}.String())
+	assert.Equal(t, "folder Pod-1", VMSelector{Folder: "Pod-1"}.String())
+	assert.Equal(t, "resource_pool Labs", VMSelector{ResourcePool: "Labs"}.String())
+}
+
+func TestVMSelector_Validate(t *testing.T) {
+	assert.NoError(t, VMSelector{Folder: "Pod-1"}.Validate())
+	assert.NoError(t, VMSelector{Attribute: "lab-pod", Value: "1"}.Validate())
+	assert.Error(t, VMSelector{}.Validate())
+	assert.Error(t, VMSelector{Folder: "Pod-1", Prefix: "Pod-1_"}.Validate())
+
+	err := VMSelector{Folder: "Pod-1", Value: "1"}.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "value is only valid with attribute")
+}
+
+func TestESXiConfig_UserSelectors(t *testing.T) {
+	cfg := &ESXiConfig{
+		UserVMMappings: map[string][]string{"bob": {"Pod-2_"}, "alice": {"Pod-1_"}},
+		UserVMSelectors: map[string][]VMSelector{
+			"alice": {{Folder: "Pod-1-extra"}},
+			"carol": {{Attribute: "lab-pod", Value: "3"}},
+		},
+	}
+
+	got := cfg.UserSelectors()
+	assert.Equal(t, []UserVMSelectors{
+		{User: "alice", Selectors: []VMSelector{{Prefix: "Pod-1_"}, {Folder: "Pod-1-extra"}}},
+		{User: "bob", Selectors: []VMSelector{{Prefix: "Pod-2_"}}},
+		{User: "carol", Selectors: []VMSelector{{Attribute: "lab-pod", Value: "3"}}},
+	}, got)
+	assert.Equal(t, []string{"alice", "bob", "carol"}, cfg.Users())
+}
+
+func TestLoadFeatureConfig_UserVMSelectors(t *testing.T) {
+	content := `
+[[esxi.user_vm_selectors.alice]]
+attribute = "lab-pod"
+value = "1"
+
+[[esxi.user_vm_selectors.alice]]
+folder = "Pod-1"
+`
+	tmpFile := filepath.Join(t.TempDir(), "config.toml")
+	require.NoError(t, os.WriteFile(tmpFile, []byte(content), 0o644))
+
+	cfg, err := LoadFeatureConfig(tmpFile)
+	require.NoError(t, err)
+	assert.Equal(t, []VMSelector{{Attribute: "lab-pod", Value: "1"}, {Folder: "Pod-1"}}, cfg.ESXi.UserVMSelectors["alice"])
+}
+
+func TestLoadFeatureConfig_InvalidSelector(t *testing.T) {
+	content := `
+[[esxi.user_vm_selectors.alice]]
+folder = "Pod-1"
+prefix = "Pod-1_"
+`
+	tmpFile := filepath.Join(t.TempDir(), "config.toml")
+	require.NoError(t, os.WriteFile(tmpFile, []byte(content), 0o644))
+
+	_, err := LoadFeatureConfig(tmpFile)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "user_vm_selectors.alice[0]: exactly one of")
+}
+
+func TestCheckSelectors_AttributeNeedsVCenter(t *testing.T) {
+	cfg := &ESXiConfig{
+		UserVMMappings:  map[string][]string{"alice": {"Pod-1_"}},
+		UserVMSelectors: map[string][]VMSelector{"bob": {{Attribute: "lab-pod", Value: "2"}}},
+	}
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		svc, _ := newSimService(ctx, t, []*vim25.Client{c})
+		err := svc.CheckSelectors(cfg)
+		assert.ErrorContains(t, err, "user_vm_selectors.bob: attribute lab-pod=2 needs a vCenter endpoint")
+		assert.NoError(t, svc.CheckSelectors(&ESXiConfig{UserVMMappings: cfg.UserVMMappings}))
+	}, simulator.ESX())
+
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		svc, _ := newSimService(ctx, t, []*vim25.Client{c})
+		assert.NoError(t, svc.CheckSelectors(cfg))
+	}, simulator.VPX())
+}
@@ -2,266 +2,588 @@ package service
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"net/url"
+	"sort"
+	"strconv"
+	"time"
 
 	"github.com/EpicMandM/esxi-lab-provider/api/internal/config"
 	"github.com/EpicMandM/esxi-lab-provider/api/internal/logger"
 	"github.com/EpicMandM/esxi-lab-provider/api/internal/models"
 	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/fault"
 	"github.com/vmware/govmomi/find"
 	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/view"
 	"github.com/vmware/govmomi/vim25/methods"
 	"github.com/vmware/govmomi/vim25/mo"
-	"github.com/vmware/govmomi/vim25/soap"
 	"github.com/vmware/govmomi/vim25/types"
 )
 
+// VMwareService manages lab VMs across one or more vSphere endpoints. Each
+// endpoint is either a standalone ESXi host or a vCenter with several hosts;
+// VMs from all endpoints are merged into one inventory.
 type VMwareService struct {
-	client *govmomi.Client
-	finder *find.Finder
-	logger *logger.Logger
+	conns     []*hostConnection
+	locations map[string]vmLocation
+	retry     retryPolicy
+	passwords PasswordPolicy
+	logger    *logger.Logger
 }
 
+// NewVMwareService connects to every endpoint in cfg. Endpoints that cannot
+// be reached are logged and skipped; an error is returned only if no
+// endpoint is available.
 func NewVMwareService(ctx context.Context, cfg *config.Config, log *logger.Logger) (*VMwareService, error) {
 	if log == nil {
 		log = logger.NewWithWriter(io.Discard)
 	}
-	u, err := soap.ParseURL(cfg.ESXiURL)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse URL: %w", err)
-	}
 
-	u.User = url.UserPassword(cfg.ESXiUsername, cfg.ESXiPassword)
+	s := &VMwareService{
+		locations: make(map[string]vmLocation),
+		retry:     defaultRetryPolicy,
+		logger:    log,
+	}
 
-	client, err := govmomi.NewClient(ctx, u, cfg.ESXiInsecure)
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect: %w", err)
+	var errs []error
+	for _, ep := range cfg.Endpoints() {
+		conn, err := connect(ctx, ep)
+		if err != nil {
+			log.Warn("Failed to connect to vSphere endpoint", logger.F("ENDPOINT", ep.Name), logger.Error(err))
+			errs = append(errs, fmt.Errorf("%s: %w", ep.Name, err))
+			continue
+		}
+		log.Info("Connected to vSphere endpoint",
+			logger.F("ENDPOINT", ep.Name),
+			logger.F("API_TYPE", conn.client.ServiceContent.About.ApiType),
+			logger.Status("ready"))
+		s.conns = append(s.conns, conn)
 	}
-	finder := find.NewFinder(client.Client, true)
-	dc, err := finder.DefaultDatacenter(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get datacenter: %w", err)
+	if len(s.conns) == 0 {
+		return nil, errors.Join(errs...)
 	}
-	finder.SetDatacenter(dc)
 
-	return &VMwareService{
-		client: client,
-		finder: finder,
-		logger: log,
-	}, nil
+	return s, nil
+}
+
+// SetPasswordPolicy sets the policy for generated lab user passwords.
+func (s *VMwareService) SetPasswordPolicy(p PasswordPolicy) {
+	s.passwords = p
 }
 
+// GetFinder returns the finder of the primary endpoint.
 func (s *VMwareService) GetFinder() *find.Finder {
-	return s.finder
+	if len(s.conns) == 0 {
+		return nil
+	}
+	return s.conns[0].finder
 }
 
+// GetClient returns the client of the primary endpoint.
 func (s *VMwareService) GetClient() *govmomi.Client {
-	return s.client
+	if len(s.conns) == 0 {
+		return nil
+	}
+	return s.conns[0].client
 }
 
+// Close logs out of every endpoint.
 func (s *VMwareService) Close(ctx context.Context) error {
-	if s.client != nil {
-		return s.client.Logout(ctx)
+	var errs []error
+	for _, conn := range s.conns {
+		if err := conn.client.Logout(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", conn.name, err))
+		}
 	}
-	return nil
+	return errors.Join(errs...)
 }
 
 func (s *VMwareService) ListAllVMs(ctx context.Context) ([]*models.VM, error) {
 	if s == nil {
 		return nil, fmt.Errorf("service not initialized")
 	}
-	finder := s.GetFinder()
-	vms, err := finder.VirtualMachineList(ctx, "*")
-	if err != nil {
-		return nil, fmt.Errorf("failed to list virtual machines: %w", err)
-	}
 	var vmList []*models.VM
-	for _, vm := range vms {
-		vmList = append(vmList, &models.VM{
-			Name: vm.Name(),
-		})
+	for _, conn := range s.conns {
+		vms, err := conn.finder.VirtualMachineList(ctx, "*")
+		if err != nil {
+			return nil, fmt.Errorf("failed to list virtual machines on %s: %w", conn.name, err)
+		}
+		for _, vm := range vms {
+			vmList = append(vmList, &models.VM{
+				Name: vm.Name(),
+			})
+		}
 	}
 	return vmList, nil
 }
 
+// vmInventoryProperties are the VirtualMachine properties fetched for every
+// VM in a single PropertyCollector round trip.
+var vmInventoryProperties = []string{
+	"name",
+	"snapshot",
+	"runtime.powerState",
+	"runtime.host",
+	"guest",
+	"customValue",
+	"config.annotation",
+	"config.guestFullName",
+	"config.instanceUuid",
+	"resourcePool",
+	"parent",
+}
+
+// inventoryNameKinds are the entity types referenced by VMs (runtime host,
+// resource pool, parent folder) whose names are fetched alongside the VMs.
+var inventoryNameKinds = []string{"HostSystem", "ResourcePool", "Folder"}
+
+// ListVMSnapshots retrieves the inventory of all VMs on every endpoint and
+// merges it into one response. Each endpoint is read through a container
+// view so that the whole property set is fetched in one call. VMs whose
+// properties could not be read, and endpoints that could not be queried, are
+// reported in VMListResponse.Errors.
 func (s *VMwareService) ListVMSnapshots(ctx context.Context) (*models.VMListResponse, error) {
 	if s == nil {
 		return nil, fmt.Errorf("service not initialized")
 	}
-	client := s.GetClient()
-	finder := find.NewFinder(client.Client)
-	dc, err := finder.DefaultDatacenter(ctx)
+
+	response := &models.VMListResponse{
+		VMs: []models.VM{},
+	}
+	byUUID := make(map[string]bool)
+	byName := make(map[string]models.VM)
+	var lastErr error
+	queried := 0
+
+	for _, conn := range s.inventoryOrder() {
+		part, refs, err := s.listEndpointVMs(ctx, conn)
+		if err != nil {
+			s.logger.Warn("Failed to retrieve inventory from endpoint", logger.F("ENDPOINT", conn.name), logger.Error(err))
+			response.Errors = append(response.Errors, models.VMInventoryError{Ref: conn.name, Error: err.Error()})
+			lastErr = err
+			continue
+		}
+		queried++
+		if response.ESXiName == "" {
+			response.ESXiName = part.ESXiName
+		}
+		response.Errors = append(response.Errors, part.Errors...)
+
+		for _, vm := range part.VMs {
+			// A host managed by vCenter and also configured directly
+			// reports the same VMs twice; keep the first sighting.
+			if vm.InstanceUUID != "" && byUUID[vm.InstanceUUID] {
+				continue
+			}
+			if other, dup := byName[vm.Name]; dup {
+				s.logger.Warn("Duplicate VM name in inventory", logger.VM(vm.Name), logger.F("HOST", vm.Host), logger.F("OTHER_HOST", other.Host))
+				response.Errors = append(response.Errors, models.VMInventoryError{
+					VM:    vm.Name,
+					Ref:   refs[vm.Name].Value,
+					Error: fmt.Sprintf("duplicate VM name, already found on host %s", other.Host),
+				})
+				continue
+			}
+			if vm.InstanceUUID != "" {
+				byUUID[vm.InstanceUUID] = true
+			}
+			byName[vm.Name] = vm
+			s.locations[vm.Name] = vmLocation{conn: conn, ref: refs[vm.Name], hostName: vm.Host}
+			response.VMs = append(response.VMs, vm)
+		}
+	}
+
+	if queried == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+
+	sort.Slice(response.VMs, func(i, j int) bool {
+		return response.VMs[i].Name < response.VMs[j].Name
+	})
+	response.TotalVMs = len(response.VMs)
+	return response, nil
+}
+
+// listEndpointVMs retrieves the VM inventory of a single endpoint. It also
+// returns the managed object reference of every VM keyed by name.
+func (s *VMwareService) listEndpointVMs(ctx context.Context, conn *hostConnection) (*models.VMListResponse, map[string]types.ManagedObjectReference, error) {
+	client := conn.client
+
+	kinds := append([]string{"VirtualMachine"}, inventoryNameKinds...)
+	m := view.NewManager(client.Client)
+	v, err := m.CreateContainerView(ctx, client.ServiceContent.RootFolder, kinds, true)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get default datacenter: %w", err)
+		return nil, nil, fmt.Errorf("failed to create container view: %w", err)
+	}
+	defer func() {
+		if derr := v.Destroy(ctx); derr != nil {
+			s.logger.Warn("Failed to destroy container view", logger.Error(derr))
+		}
+	}()
+
+	var nameSpecs []types.PropertySpec
+	for _, kind := range inventoryNameKinds {
+		nameSpecs = append(nameSpecs, types.PropertySpec{Type: kind, PathSet: []string{"name"}})
+	}
+
+	var content []types.ObjectContent
+	if err := v.Retrieve(ctx, []string{"VirtualMachine"}, vmInventoryProperties, &content, nameSpecs...); err != nil {
+		return nil, nil, fmt.Errorf("failed to retrieve virtual machines: %w", err)
 	}
-	finder.SetDatacenter(dc)
 
-	vms, err := finder.VirtualMachineList(ctx, "*")
+	refs := make(map[string]types.ManagedObjectReference)
+	for _, oc := range content {
+		if oc.Obj.Type == "VirtualMachine" {
+			refs[objectContentName(oc)] = oc.Obj
+		}
+	}
+
+	response := s.buildVMListResponse(content, customFieldNames(ctx, conn, s.logger))
+	response.ESXiName = client.ServiceContent.About.FullName
+	return response, refs, nil
+}
+
+// customFieldNames returns the custom attribute names of an endpoint keyed
+// by field key. Standalone ESXi hosts have no CustomFieldsManager; an empty
+// map is returned and attributes are reported by numeric key.
+func customFieldNames(ctx context.Context, conn *hostConnection, log *logger.Logger) map[int32]string {
+	names := make(map[int32]string)
+	if conn.client.ServiceContent.CustomFieldsManager == nil {
+		return names
+	}
+	fields, err := object.NewCustomFieldsManager(conn.client.Client).Field(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to list virtual machines: %w", err)
+		log.Warn("Failed to list custom attribute definitions", logger.F("ENDPOINT", conn.name), logger.Error(err))
+		return names
 	}
+	for _, f := range fields {
+		names[f.Key] = f.Name
+	}
+	return names
+}
 
+// buildVMListResponse converts retrieved object content into the inventory
+// response. Objects with faults in their MissingSet are recorded as errors
+// instead of being dropped.
+func (s *VMwareService) buildVMListResponse(content []types.ObjectContent, fieldNames map[int32]string) *models.VMListResponse {
 	response := &models.VMListResponse{
-		ESXiName: client.ServiceContent.About.FullName,
-		VMs:      make([]models.VM, 0, len(vms)),
+		VMs: make([]models.VM, 0, len(content)),
+	}
+
+	entityNames := make(map[types.ManagedObjectReference]string)
+	for _, oc := range content {
+		if oc.Obj.Type != "VirtualMachine" {
+			entityNames[oc.Obj] = objectContentName(oc)
+		}
 	}
 
-	for _, vm := range vms {
-		var mvm mo.VirtualMachine
-		if err := vm.Properties(ctx, vm.Reference(), []string{"snapshot"}, &mvm); err != nil {
-			s.logger.Warn("Failed to get VM properties", logger.VM(vm.Name()), logger.Error(err))
+	for _, oc := range content {
+		if oc.Obj.Type != "VirtualMachine" {
 			continue
 		}
-		vmData := models.VM{
-			Name:      vm.Name(),
-			Snapshots: []models.VMSnapshot{},
+		obj, err := mo.ObjectContentToType(oc)
+		if err != nil {
+			name := objectContentName(oc)
+			s.logger.Warn("Failed to get VM properties", logger.VM(name), logger.F("REF", oc.Obj.Value), logger.Error(err))
+			response.Errors = append(response.Errors, models.VMInventoryError{
+				VM:    name,
+				Ref:   oc.Obj.Value,
+				Error: err.Error(),
+			})
+			continue
 		}
-		if mvm.Snapshot != nil {
-			vmData.Snapshots = s.extractSnapshots(mvm.Snapshot.RootSnapshotList)
+		mvm, ok := obj.(mo.VirtualMachine)
+		if !ok {
+			continue
 		}
-
-		response.VMs = append(response.VMs, vmData)
+		response.VMs = append(response.VMs, s.vmFromManagedObject(mvm, entityNames, fieldNames))
 	}
 
+	sort.Slice(response.VMs, func(i, j int) bool {
+		return response.VMs[i].Name < response.VMs[j].Name
+	})
+
 	response.TotalVMs = len(response.VMs)
-	return response, nil
+	return response
 }
 
-func (s *VMwareService) extractSnapshots(snapshots []types.VirtualMachineSnapshotTree) []models.VMSnapshot {
-	var result []models.VMSnapshot
+// vmFromManagedObject maps a retrieved VirtualMachine onto the inventory
+// model. References to hosts, resource pools and folders are resolved to
+// names through entityNames.
+func (s *VMwareService) vmFromManagedObject(mvm mo.VirtualMachine, entityNames map[types.ManagedObjectReference]string, fieldNames map[int32]string) models.VM {
+	vmData := models.VM{
+		Name:        mvm.Name,
+		PowerState:  string(mvm.Runtime.PowerState),
+		IPAddresses: []string{},
+		Attributes:  map[string]string{},
+		Snapshots:   []models.VMSnapshot{},
+	}
+
+	if mvm.Runtime.Host != nil {
+		vmData.Host = entityNames[*mvm.Runtime.Host]
+	}
+	if mvm.ResourcePool != nil {
+		vmData.ResourcePool = entityNames[*mvm.ResourcePool]
+	}
+	if mvm.Parent != nil {
+		vmData.Folder = entityNames[*mvm.Parent]
+	}
+
+	if mvm.Config != nil {
+		vmData.Annotation = mvm.Config.Annotation
+		vmData.InstanceUUID = mvm.Config.InstanceUuid
+		vmData.GuestOS = mvm.Config.GuestFullName
+	}
+
+	if mvm.Guest != nil {
+		if mvm.Guest.GuestFullName != "" {
+			vmData.GuestOS = mvm.Guest.GuestFullName
+		}
+		vmData.ToolsStatus = mvm.Guest.ToolsRunningStatus
+		vmData.IPAddresses = guestIPAddresses(mvm.Guest)
+	}
+
+	for _, cv := range mvm.CustomValue {
+		sv, ok := cv.(*types.CustomFieldStringValue)
+		if !ok {
+			continue
+		}
+		name, ok := fieldNames[sv.Key]
+		if !ok {
+			name = strconv.Itoa(int(sv.Key))
+		}
+		vmData.Attributes[name] = sv.Value
+	}
+
+	if mvm.Snapshot != nil {
+		vmData.Snapshots = s.extractSnapshots(mvm.Snapshot.RootSnapshotList, mvm.Snapshot.CurrentSnapshot)
+	}
+	return vmData
+}
+
+// guestIPAddresses returns the unique IP addresses reported by VMware Tools,
+// falling back to the primary address when no NIC details are available.
+func guestIPAddresses(guest *types.GuestInfo) []string {
+	ips := []string{}
+	seen := make(map[string]bool)
+	for _, nic := range guest.Net {
+		for _, ip := range nic.IpAddress {
+			if ip != "" && !seen[ip] {
+				seen[ip] = true
+				ips = append(ips, ip)
+			}
+		}
+	}
+	if len(ips) == 0 && guest.IpAddress != "" {
+		ips = append(ips, guest.IpAddress)
+	}
+	return ips
+}
+
+// objectContentName returns the "name" property from an ObjectContent, if it
+// was retrieved.
+func objectContentName(oc types.ObjectContent) string {
+	for _, p := range oc.PropSet {
+		if p.Name == "name" {
+			if name, ok := p.Val.(string); ok {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// extractSnapshots converts a vSphere snapshot tree into the model tree,
+// flagging the snapshot referenced by current.
+func (s *VMwareService) extractSnapshots(snapshots []types.VirtualMachineSnapshotTree, current *types.ManagedObjectReference) []models.VMSnapshot {
+	result := []models.VMSnapshot{}
 	for _, snapshot := range snapshots {
 		result = append(result, models.VMSnapshot{
+			ID:          snapshot.Snapshot.Value,
 			Name:        snapshot.Name,
 			Description: snapshot.Description,
 			Created:     snapshot.CreateTime,
 			State:       string(snapshot.State),
 			Quiesced:    snapshot.Quiesced,
+			Current:     current != nil && *current == snapshot.Snapshot,
+			Children:    s.extractSnapshots(snapshot.ChildSnapshotList, current),
 		})
-		if len(snapshot.ChildSnapshotList) > 0 {
-			result = append(result, s.extractSnapshots(snapshot.ChildSnapshotList)...)
-		}
 	}
 	return result
 }
 
-// RestoreVMsWithPasswordRotation restores VMs and rotates ESXi user passwords
-func (s *VMwareService) RestoreVMsWithPasswordRotation(ctx context.Context, vmNames []string, userNames []string, snapshotName string) ([]string, map[string]string) {
-	var errors []string
-	passwords := make(map[string]string)
+// VMRestoreResult is the outcome of reverting one VM.
+type VMRestoreResult struct {
+	VM string
+	// Selector is the snapshot rule that applied to the VM, e.g. "<latest>"
+	// or "glob:clean-*"; Snapshot is the name of the snapshot it chose.
+	Selector string
+	Snapshot string
+	Duration time.Duration
+	// PowerState is the VM power state after the revert.
+	PowerState string
+	Err        error
+}
 
-	// Get ESXi host
-	host, err := s.finder.DefaultHostSystem(ctx)
-	if err != nil {
-		errors = append(errors, fmt.Sprintf("failed to get ESXi host: %v", err))
-		return errors, passwords
+// RestoreResult is the outcome of restoring one user's VMs. VMs are in pair
+// order; the first is the primary VM, whose host carries the user's local
+// account.
+type RestoreResult struct {
+	User string
+	VMs  []VMRestoreResult
+	// Password is the rotated password; empty when rotation failed or was
+	// skipped because the primary VM failed. RotationErr is set only when a
+	// rotation was attempted and failed.
+	Password    string
+	RotationErr error
+}
+
+// Primary returns the result of the user's primary VM, or nil if the pair
+// has no VMs.
+func (r *RestoreResult) Primary() *VMRestoreResult {
+	if len(r.VMs) == 0 {
+		return nil
 	}
+	return &r.VMs[0]
+}
 
-	for i, vmName := range vmNames {
-		// Restore VM snapshot
-		if err := s.restoreVM(ctx, vmName, snapshotName); err != nil {
-			errors = append(errors, fmt.Sprintf("failed to restore %s: %v", vmName, err))
-			s.logger.Error("VM restore failed", logger.Action("vm_restore"), logger.Status("failed"), logger.VM(vmName), logger.Error(err))
-			continue
+// PasswordRotated reports whether the user's password was rotated.
+func (r *RestoreResult) PasswordRotated() bool {
+	return r.Password != "" && r.RotationErr == nil
+}
+
+// FailedVMs returns the results of the VMs that could not be restored.
+func (r *RestoreResult) FailedVMs() []VMRestoreResult {
+	var failed []VMRestoreResult
+	for _, vm := range r.VMs {
+		if vm.Err != nil {
+			failed = append(failed, vm)
+		}
+	}
+	return failed
+}
+
+// RestoreVMsWithPasswordRotation ends the user's open sessions on the host
+// of the primary VM, reverts every VM of each pair to the snapshot chosen by
+// policy and rotates the user's ESXi password on that host. Rotation is
+// skipped when the primary VM could not be restored.
+func (s *VMwareService) RestoreVMsWithPasswordRotation(ctx context.Context, pairs []UserVMPair, policy SnapshotPolicy) []RestoreResult {
+	results := make([]RestoreResult, 0, len(pairs))
+	for _, p := range pairs {
+		res := RestoreResult{User: p.User}
+		if len(p.VMs) > 0 && p.User != "" {
+			s.endUserSessions(ctx, p.VMs[0], p.User)
+		}
+		for _, vmName := range p.VMs {
+			res.VMs = append(res.VMs, s.restoreVMWithRetry(ctx, vmName, policy.For(vmName)))
 		}
-		s.logger.Info("VM restore successful", logger.Action("vm_restore"), logger.Status("success"), logger.VM(vmName))
 
-		// Rotate password for corresponding user if available.
-		// An empty username means this VM is revert-only (secondary VM in a
-		// multi-VM pair); skip password rotation entirely.
-		if i < len(userNames) {
-			username := userNames[i]
-			if username == "" {
-				continue
-			}
-			newPassword, err := s.RotateESXiUserPassword(ctx, host, username)
-			if err != nil {
-				s.logger.Error("Password rotation failed", logger.Action("password_rotate"), logger.Status("failed"), logger.User(username), logger.Error(err))
-				errors = append(errors, fmt.Sprintf("failed to rotate password for user %s: %v", username, err))
+		if primary := res.Primary(); primary != nil && p.User != "" {
+			if primary.Err != nil {
+				s.logger.Warn("Password rotation skipped", logger.Action("password_rotate"), logger.Status("skipped"), logger.User(p.User), logger.Reason("primary VM not restored"))
+			} else if password, err := s.RotateESXiUserPassword(ctx, primary.VM, p.User); err != nil {
+				res.RotationErr = err
+				s.logger.Error("Password rotation failed", logger.Action("password_rotate"), logger.Status("failed"), logger.User(p.User), logger.Error(err))
 			} else {
-				passwords[username] = newPassword
-				s.logger.Info("Password rotation successful", logger.Action("password_rotate"), logger.Status("success"), logger.User(username))
+				res.Password = password
+				s.logger.Info("Password rotation successful", logger.Action("password_rotate"), logger.Status("success"), logger.User(p.User))
 			}
 		}
+		results = append(results, res)
 	}
-
-	return errors, passwords
+	return results
 }
 
-func (s *VMwareService) restoreVM(ctx context.Context, vmName, snapshotName string) error {
-	vm, err := s.finder.VirtualMachine(ctx, vmName)
+// endUserSessions terminates the user's sessions and logs each one, so the
+// previous student cannot keep using the pod once it is handed over. Failures
+// are logged and do not stop the restore.
+func (s *VMwareService) endUserSessions(ctx context.Context, vmName, username string) {
+	sessions, err := s.TerminateUserSessions(ctx, vmName, username)
 	if err != nil {
-		return fmt.Errorf("VM not found: %w", err)
+		s.logger.Warn("Session termination failed", logger.Action("session_terminate"), logger.Status("failed"), logger.User(username), logger.Error(err))
+		return
+	}
+	for _, us := range sessions {
+		s.logger.Info("User session terminated",
+			logger.Action("session_terminate"),
+			logger.Status("terminated"),
+			logger.User(username),
+			logger.F("CLIENT_IP", us.IpAddress),
+			logger.F("USER_AGENT", us.UserAgent),
+			logger.F("LOGIN_TIME", us.LoginTime.Format(time.RFC3339)),
+			logger.F("LAST_ACTIVE", us.LastActiveTime.Format(time.RFC3339)))
 	}
+}
 
-	var snapshot *types.ManagedObjectReference
-
-	// If snapshot name is empty or "<latest>", use the latest snapshot
-	if snapshotName == "" || snapshotName == "<latest>" {
-		latest, err := s.findLatestSnapshot(ctx, vm)
-		if err != nil {
-			return fmt.Errorf("no snapshots found: %w", err)
-		}
-		snapshot = latest
-	} else {
-		// Use specific snapshot name
-		found, err := s.findSnapshot(ctx, vm, snapshotName)
-		if err != nil {
-			return fmt.Errorf("snapshot not found: %w", err)
-		}
-		snapshot = found
-	}
+func (s *VMwareService) restoreVMWithRetry(ctx context.Context, vmName string, rule SnapshotRule) VMRestoreResult {
+	res := VMRestoreResult{VM: vmName, Selector: rule.String()}
+	start := time.Now()
+	res.Err = s.withRetry(ctx, "vm_restore", vmName, func(ctx context.Context) error {
+		return s.restoreVM(ctx, &res, rule)
+	})
+	res.Duration = time.Since(start)
+
+	if res.Err != nil {
+		s.logger.Error("VM restore failed", logger.Action("vm_restore"), logger.Status("failed"), logger.VM(vmName), logger.F("SELECTOR", res.Selector), logger.Error(res.Err))
+		return res
+	}
+	s.logger.Info("VM restore successful",
+		logger.Action("vm_restore"),
+		logger.Status("success"),
+		logger.VM(vmName),
+		logger.Snapshot(res.Snapshot),
+		logger.F("SELECTOR", res.Selector),
+		logger.F("HOST", s.locations[vmName].hostName),
+		logger.F("DURATION", res.Duration.Round(time.Millisecond)),
+		logger.F("POWER_STATE", res.PowerState))
+	return res
+}
 
-	task, err := vm.RevertToSnapshot(ctx, snapshot.Reference().Value, true)
+// restoreVM reverts res.VM to the snapshot chosen by rule and records the
+// snapshot name and resulting power state in res.
+func (s *VMwareService) restoreVM(ctx context.Context, res *VMRestoreResult, rule SnapshotRule) error {
+	sel, err := parseSnapshotSelector(rule)
 	if err != nil {
-		return fmt.Errorf("failed to revert: %w", err)
+		return err
 	}
 
-	if err := task.Wait(ctx); err != nil {
-		return fmt.Errorf("revert task failed: %w", err)
+	vm, _, err := s.lookupVM(ctx, res.VM)
+	if err != nil {
+		return err
 	}
 
-	return nil
-}
-
-func (s *VMwareService) findSnapshot(ctx context.Context, vm *object.VirtualMachine, name string) (*types.ManagedObjectReference, error) {
 	var mvm mo.VirtualMachine
-
-	err := vm.Properties(ctx, vm.Reference(), []string{"snapshot"}, &mvm)
-	if err != nil {
-		return nil, err
+	if err := vm.Properties(ctx, vm.Reference(), []string{"snapshot"}, &mvm); err != nil {
+		return err
 	}
-	if mvm.Snapshot == nil || len(mvm.Snapshot.RootSnapshotList) == 0 {
-		return nil, fmt.Errorf("no snapshots found")
+	if mvm.Snapshot == nil {
+		return fmt.Errorf("no snapshots found")
 	}
 
-	ref := findSnapshotInTree(mvm.Snapshot.RootSnapshotList, name)
-	if ref == nil {
-		return nil, fmt.Errorf("snapshot '%s' not found", name)
+	snapshot, err := sel.selectFrom(mvm.Snapshot.RootSnapshotList, mvm.Snapshot.CurrentSnapshot)
+	if err != nil {
+		return err
 	}
+	res.Snapshot = snapshot.Name
 
-	return ref, nil
-}
-
-// findLatestSnapshot returns the most recently created snapshot
-func (s *VMwareService) findLatestSnapshot(ctx context.Context, vm *object.VirtualMachine) (*types.ManagedObjectReference, error) {
-	var mvm mo.VirtualMachine
-
-	err := vm.Properties(ctx, vm.Reference(), []string{"snapshot"}, &mvm)
+	task, err := vm.RevertToSnapshot(ctx, snapshot.Snapshot.Value, true)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("failed to revert: %w", err)
 	}
-	if mvm.Snapshot == nil || len(mvm.Snapshot.RootSnapshotList) == 0 {
-		return nil, fmt.Errorf("no snapshots found")
+
+	if err := task.Wait(ctx); err != nil {
+		return fmt.Errorf("revert task failed: %w", err)
 	}
 
-	latest := findLatestSnapshotInTree(mvm.Snapshot.RootSnapshotList)
-	if latest == nil {
-		return nil, fmt.Errorf("no snapshots found")
+	state, err := vm.PowerState(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read power state: %w", err)
 	}
+	res.PowerState = string(state)
 
-	return latest, nil
+	return nil
 }
 
 func findSnapshotInTree(tree []types.VirtualMachineSnapshotTree, name string) *types.ManagedObjectReference {
@@ -276,38 +598,59 @@ func findSnapshotInTree(tree []types.VirtualMachineSnapshotTree, name string) *t
 	return nil
 }
 
-// findLatestSnapshotInTree finds the most recently created snapshot in the tree
-func findLatestSnapshotInTree(tree []types.VirtualMachineSnapshotTree) *types.ManagedObjectReference {
-	if len(tree) == 0 {
-		return nil
-	}
-
-	var latest *types.VirtualMachineSnapshotTree
+// findSnapshotByRef returns the tree node of the snapshot ref, or nil.
+func findSnapshotByRef(tree []types.VirtualMachineSnapshotTree, ref types.ManagedObjectReference) *types.VirtualMachineSnapshotTree {
 	for i := range tree {
-		if latest == nil || tree[i].CreateTime.After(latest.CreateTime) {
-			latest = &tree[i]
+		if tree[i].Snapshot == ref {
+			return &tree[i]
+		}
+		if node := findSnapshotByRef(tree[i].ChildSnapshotList, ref); node != nil {
+			return node
 		}
 	}
+	return nil
+}
 
-	// Check child snapshots recursively
-	if latestChild := findLatestSnapshotInTree(latest.ChildSnapshotList); latestChild != nil {
-		return latestChild
+// findLatestSnapshotInTree finds the most recently created snapshot
+// anywhere in the tree, the one every "newest" snapshot selector picks.
+func findLatestSnapshotInTree(tree []types.VirtualMachineSnapshotTree) *types.ManagedObjectReference {
+	var latest *types.VirtualMachineSnapshotTree
+	walkSnapshotTree(tree, func(node *types.VirtualMachineSnapshotTree) {
+		if latest == nil || node.CreateTime.After(latest.CreateTime) {
+			latest = node
+		}
+	})
+	if latest == nil {
+		return nil
 	}
-
 	return &latest.Snapshot
 }
 
-// RotateESXiUserPassword rotates the password for an ESXi local user
-func (s *VMwareService) RotateESXiUserPassword(ctx context.Context, host *object.HostSystem, username string) (string, error) {
-	newPassword, err := GeneratePassword(16)
+// RotateESXiUserPassword rotates the password for an ESXi local user on the
+// host that runs vmName.
+func (s *VMwareService) RotateESXiUserPassword(ctx context.Context, vmName, username string) (string, error) {
+	vm, loc, err := s.lookupVM(ctx, vmName)
 	if err != nil {
-		return "", fmt.Errorf("failed to generate password: %w", err)
+		return "", err
+	}
+	conn, err := s.accountConnection(loc)
+	if err != nil {
+		return "", err
+	}
+	// The host running the VM carries the account; through vCenter its
+	// settings are read on the VM's own connection.
+	host, err := vm.HostSystem(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get host of %s: %w", vmName, err)
+	}
+	accountMgr := conn.client.ServiceContent.AccountManager
+	if accountMgr == nil {
+		return "", fmt.Errorf("endpoint %s has no HostLocalAccountManager", conn.name)
 	}
 
-	// Get the HostLocalAccountManager reference from the host
-	accountMgr := types.ManagedObjectReference{
-		Type:  "HostLocalAccountManager",
-		Value: "ha-localacctmgr",
+	newPassword, err := s.generateLabPassword(ctx, conn, host)
+	if err != nil {
+		return "", err
 	}
 
 	spec := types.HostAccountSpec{
@@ -317,14 +660,67 @@ func (s *VMwareService) RotateESXiUserPassword(ctx context.Context, host *object
 	}
 
 	req := types.UpdateUser{
-		This: accountMgr,
+		This: *accountMgr,
 		User: &spec,
 	}
 
-	_, err = methods.UpdateUser(ctx, host.Client(), &req)
+	err = s.withRetry(ctx, "password_rotate", vmName, func(ctx context.Context) error {
+		_, err := methods.UpdateUser(ctx, conn.client.Client, &req)
+		return err
+	})
 	if err != nil {
-		return "", fmt.Errorf("failed to update user password: %w", err)
+		return "", fmt.Errorf("failed to update user password on %s: %w", loc.hostName, err)
 	}
 
 	return newPassword, nil
 }
+
+// generateLabPassword generates a lab user password meeting the password
+// policy tightened to the Security.PasswordQualityControl of host, the
+// host carrying the account on conn. ESXi's default applies when the host
+// does not report the setting.
+func (s *VMwareService) generateLabPassword(ctx context.Context, conn *hostConnection, host *object.HostSystem) (string, error) {
+	policy := s.passwords
+	if !policy.IgnoreHost {
+		setting, err := passwordQualitySetting(ctx, host)
+		if err != nil {
+			s.logger.Warn("Failed to read host password quality, using ESXi default", logger.F("HOST", conn.name), logger.Error(err))
+		}
+		quality, err := ParsePasswordQuality(setting)
+		if err != nil {
+			return "", fmt.Errorf("host %s: %w", conn.name, err)
+		}
+		if policy, err = policy.ForHost(quality); err != nil {
+			return "", fmt.Errorf("host %s: %w", conn.name, err)
+		}
+	}
+	password, err := policy.Generate()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate password: %w", err)
+	}
+	s.logger.AddSecret(password)
+	return password, nil
+}
+
+// passwordQualitySetting returns the host's Security.PasswordQualityControl
+// advanced option, or "" when the host does not have it.
+func passwordQualitySetting(ctx context.Context, host *object.HostSystem) (string, error) {
+	om, err := host.ConfigManager().OptionManager(ctx)
+	if err != nil {
+		return "", err
+	}
+	opts, err := om.Query(ctx, "Security.PasswordQualityControl")
+	if err != nil {
+		if fault.Is(err, &types.InvalidName{}) {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to read Security.PasswordQualityControl: %w", err)
+	}
+	for _, o := range opts {
+		if v := o.GetOptionValue(); v.Key == "Security.PasswordQualityControl" {
+			value, _ := v.Value.(string)
+			return value, nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,259 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/EpicMandM/esxi-lab-provider/api/internal/logger"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const defaultLabUserPrefix = "lab-user-"
+
+// defaultRolePrivileges are the privileges of the lab role: console access
+// and VM power operations, matching the esxi-users Terraform module.
+var defaultRolePrivileges = []string{
+	"VirtualMachine.Interact.ConsoleInteract",
+	"VirtualMachine.Interact.DeviceConnection",
+	"VirtualMachine.Interact.PowerOff",
+	"VirtualMachine.Interact.PowerOn",
+	"VirtualMachine.Interact.Reset",
+	"System.Anonymous",
+	"System.Read",
+	"System.View",
+}
+
+// systemPrivileges are part of every ESXi role whether requested or not, so
+// they are never reported as extra.
+var systemPrivileges = []string{"System.Anonymous", "System.Read", "System.View"}
+
+// AccountConfig controls the lab accounts reconciled by the accounts
+// command from the [accounts] section of user_config.toml. The role name is
+// taken from [permissions].
+type AccountConfig struct {
+	// UserPrefix marks the local accounts managed by the provider (default
+	// "lab-user-"). Accounts with the prefix that are not in the user
+	// mappings are removed; other accounts are never touched.
+	UserPrefix string `toml:"user_prefix"`
+	// Privileges of the lab role (default: console access and power
+	// operations).
+	Privileges []string `toml:"privileges"`
+}
+
+// Prefix returns UserPrefix, or the default when unset.
+func (c AccountConfig) Prefix() string {
+	if c.UserPrefix == "" {
+		return defaultLabUserPrefix
+	}
+	return c.UserPrefix
+}
+
+// RolePrivileges returns Privileges, or the defaults when unset.
+func (c AccountConfig) RolePrivileges() []string {
+	if len(c.Privileges) == 0 {
+		return defaultRolePrivileges
+	}
+	return c.Privileges
+}
+
+// Account changes planned by PlanAccounts.
+const (
+	AccountCreateUser = "create_user"
+	AccountRemoveUser = "remove_user"
+	AccountCreateRole = "create_role"
+	AccountUpdateRole = "update_role"
+)
+
+// AccountChange is one difference between a host's local accounts or lab
+// role and the configuration. For roles, Added and Removed list the
+// privileges to add and remove.
+type AccountChange struct {
+	Host    string
+	Kind    string
+	Name    string
+	Added   []string
+	Removed []string
+}
+
+// String returns the change as a line of a diff.
+func (c AccountChange) String() string {
+	switch c.Kind {
+	case AccountCreateUser:
+		return fmt.Sprintf("+ user %s", c.Name)
+	case AccountRemoveUser:
+		return fmt.Sprintf("- user %s", c.Name)
+	case AccountCreateRole:
+		return fmt.Sprintf("+ role %s [%s]", c.Name, strings.Join(c.Added, ", "))
+	default:
+		var privs []string
+		for _, p := range c.Added {
+			privs = append(privs, "+"+p)
+		}
+		for _, p := range c.Removed {
+			privs = append(privs, "-"+p)
+		}
+		return fmt.Sprintf("~ role %s [%s]", c.Name, strings.Join(privs, ", "))
+	}
+}
+
+// PlanAccounts compares the local accounts and the lab role on every
+// directly connected ESXi host with the expected state: one account per
+// lab user, no other account with the managed prefix, and role holding
+// exactly the configured privileges. Lab users without the managed prefix
+// are not managed and are logged. It changes nothing.
+func (s *VMwareService) PlanAccounts(ctx context.Context, users []string, role string, cfg AccountConfig) ([]AccountChange, error) {
+	var managed []string
+	for _, u := range users {
+		if strings.HasPrefix(u, cfg.Prefix()) {
+			managed = append(managed, u)
+			continue
+		}
+		s.logger.Warn("Lab user account not managed, name lacks the account prefix",
+			logger.Action("accounts"),
+			logger.User(u),
+			logger.F("PREFIX", cfg.Prefix()))
+	}
+	users = managed
+
+	var changes []AccountChange
+	for _, conn := range s.conns {
+		if conn.client.IsVC() {
+			continue
+		}
+		existing, err := localUsers(ctx, conn, cfg.Prefix())
+		if err != nil {
+			return changes, err
+		}
+		for _, u := range users {
+			if !slices.Contains(existing, u) {
+				changes = append(changes, AccountChange{Host: conn.name, Kind: AccountCreateUser, Name: u})
+			}
+		}
+		for _, u := range existing {
+			if !slices.Contains(users, u) {
+				changes = append(changes, AccountChange{Host: conn.name, Kind: AccountRemoveUser, Name: u})
+			}
+		}
+
+		roles, err := object.NewAuthorizationManager(conn.client.Client).RoleList(ctx)
+		if err != nil {
+			return changes, fmt.Errorf("failed to list roles on %s: %w", conn.name, err)
+		}
+		want := cfg.RolePrivileges()
+		r := roles.ByName(role)
+		if r == nil {
+			changes = append(changes, AccountChange{Host: conn.name, Kind: AccountCreateRole, Name: role, Added: slices.Clone(want)})
+			continue
+		}
+		var added, removed []string
+		for _, p := range want {
+			if !slices.Contains(r.Privilege, p) {
+				added = append(added, p)
+			}
+		}
+		for _, p := range r.Privilege {
+			if !slices.Contains(want, p) && !slices.Contains(systemPrivileges, p) {
+				removed = append(removed, p)
+			}
+		}
+		if len(added) > 0 || len(removed) > 0 {
+			changes = append(changes, AccountChange{Host: conn.name, Kind: AccountUpdateRole, Name: role, Added: added, Removed: removed})
+		}
+	}
+	return changes, nil
+}
+
+// ApplyAccountChange applies one change returned by PlanAccounts. New
+// accounts get a random password meeting the password policy; it is
+// rotated when the pod is first booked.
+func (s *VMwareService) ApplyAccountChange(ctx context.Context, c AccountChange) error {
+	var conn *hostConnection
+	for _, hc := range s.conns {
+		if hc.name == c.Host && !hc.client.IsVC() {
+			conn = hc
+			break
+		}
+	}
+	if conn == nil {
+		return fmt.Errorf("no direct ESXi connection configured for host %q", c.Host)
+	}
+
+	switch c.Kind {
+	case AccountCreateUser, AccountRemoveUser:
+		if conn.client.ServiceContent.AccountManager == nil {
+			return fmt.Errorf("endpoint %s has no HostLocalAccountManager", conn.name)
+		}
+		accounts := object.NewHostAccountManager(conn.client.Client, *conn.client.ServiceContent.AccountManager)
+		if c.Kind == AccountRemoveUser {
+			return s.withRetry(ctx, "account_remove", c.Name, func(ctx context.Context) error {
+				return accounts.Remove(ctx, c.Name)
+			})
+		}
+		// A direct ESXi connection has the one host carrying its accounts.
+		host, err := conn.finder.DefaultHostSystem(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get ESXi host of %s: %w", conn.name, err)
+		}
+		password, err := s.generateLabPassword(ctx, conn, host)
+		if err != nil {
+			return err
+		}
+		spec := &types.HostAccountSpec{Id: c.Name, Password: password, Description: "Lab user managed by esxi-lab-provider"}
+		return s.withRetry(ctx, "account_create", c.Name, func(ctx context.Context) error {
+			return accounts.Create(ctx, spec)
+		})
+
+	case AccountCreateRole, AccountUpdateRole:
+		am := object.NewAuthorizationManager(conn.client.Client)
+		if c.Kind == AccountCreateRole {
+			return s.withRetry(ctx, "role_create", c.Name, func(ctx context.Context) error {
+				_, err := am.AddRole(ctx, c.Name, c.Added)
+				return err
+			})
+		}
+		roles, err := am.RoleList(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list roles on %s: %w", conn.name, err)
+		}
+		r := roles.ByName(c.Name)
+		if r == nil {
+			return fmt.Errorf("role %q not found on %s", c.Name, conn.name)
+		}
+		privileges := slices.DeleteFunc(slices.Clone(r.Privilege), func(p string) bool { return slices.Contains(c.Removed, p) })
+		privileges = append(privileges, c.Added...)
+		return s.withRetry(ctx, "role_update", c.Name, func(ctx context.Context) error {
+			return am.UpdateRole(ctx, r.RoleId, r.Name, privileges)
+		})
+	}
+	return fmt.Errorf("unknown account change %q", c.Kind)
+}
+
+// localUsers returns the local accounts on conn whose name starts with
+// prefix.
+func localUsers(ctx context.Context, conn *hostConnection, prefix string) ([]string, error) {
+	if conn.client.ServiceContent.UserDirectory == nil {
+		return nil, fmt.Errorf("endpoint %s has no UserDirectory", conn.name)
+	}
+	req := types.RetrieveUserGroups{
+		This:      *conn.client.ServiceContent.UserDirectory,
+		SearchStr: prefix,
+		FindUsers: true,
+	}
+	res, err := methods.RetrieveUserGroups(ctx, conn.client.Client, &req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list local users on %s: %w", conn.name, err)
+	}
+	var users []string
+	for _, r := range res.Returnval {
+		u := r.GetUserSearchResult()
+		if !u.Group && strings.HasPrefix(u.Principal, prefix) {
+			users = append(users, u.Principal)
+		}
+	}
+	slices.Sort(users)
+	return users, nil
+}
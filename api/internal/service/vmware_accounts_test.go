@@ -0,0 +1,58 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+func TestPlanAndApplyAccounts(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		svc, buf := newSimService(ctx, t, []*vim25.Client{c})
+		host := svc.conns[0].name
+
+		accounts := object.NewHostAccountManager(c, *c.ServiceContent.AccountManager)
+		require.NoError(t, accounts.Create(ctx, &types.HostAccountSpec{Id: "lab-user-1", Password: "x"}))
+		require.NoError(t, accounts.Create(ctx, &types.HostAccountSpec{Id: "lab-user-9", Password: "x"}))
+		require.NoError(t, accounts.Create(ctx, &types.HostAccountSpec{Id: "backup", Password: "x"}))
+		am := object.NewAuthorizationManager(c)
+		_, err := am.AddRole(ctx, "lab-console", []string{"VirtualMachine.Interact.PowerOn", "VirtualMachine.Config.Rename"})
+		require.NoError(t, err)
+
+		// backup lacks the prefix, so it is not managed even when mapped.
+		users := []string{"backup", "lab-user-1", "lab-user-2"}
+		changes, err := svc.PlanAccounts(ctx, users, "lab-console", AccountConfig{})
+		require.NoError(t, err)
+		require.Len(t, changes, 3)
+		assert.Contains(t, buf.String(), "MESSAGE=Lab user account not managed, name lacks the account prefix ACTION=accounts USER=backup PREFIX=lab-user-")
+		assert.Equal(t, AccountChange{Host: host, Kind: AccountCreateUser, Name: "lab-user-2"}, changes[0])
+		assert.Equal(t, AccountChange{Host: host, Kind: AccountRemoveUser, Name: "lab-user-9"}, changes[1], "accounts without the prefix are kept")
+		assert.Equal(t, AccountUpdateRole, changes[2].Kind)
+		assert.NotContains(t, changes[2].Added, "VirtualMachine.Interact.PowerOn")
+		assert.Contains(t, changes[2].Added, "VirtualMachine.Interact.ConsoleInteract")
+		assert.Equal(t, []string{"VirtualMachine.Config.Rename"}, changes[2].Removed)
+		assert.Equal(t, "- user lab-user-9", changes[1].String())
+
+		for _, ch := range changes {
+			require.NoError(t, svc.ApplyAccountChange(ctx, ch))
+		}
+		changes, err = svc.PlanAccounts(ctx, users, "lab-console", AccountConfig{})
+		require.NoError(t, err)
+		assert.Empty(t, changes, "reconciled")
+
+		changes, err = svc.PlanAccounts(ctx, users, "lab-proctor", AccountConfig{Privileges: []string{"System.View"}})
+		require.NoError(t, err)
+		require.Len(t, changes, 1)
+		assert.Equal(t, "+ role lab-proctor [System.View]", changes[0].String())
+		require.NoError(t, svc.ApplyAccountChange(ctx, changes[0]))
+		roles, err := am.RoleList(ctx)
+		require.NoError(t, err)
+		assert.NotNil(t, roles.ByName("lab-proctor"))
+	}, simulator.ESX())
+}
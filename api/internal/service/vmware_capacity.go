@@ -0,0 +1,211 @@
+package service
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/EpicMandM/esxi-lab-provider/api/internal/logger"
+	"github.com/vmware/govmomi/view"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const defaultMemoryHeadroomPercent = 10
+
+// CapacityConfig limits how much of each host powered-on pods may commit,
+// from the [power.capacity] section of user_config.toml.
+type CapacityConfig struct {
+	// MemoryHeadroomPercent is the share of host memory kept free of
+	// configured VM memory (default 10).
+	MemoryHeadroomPercent float64 `toml:"memory_headroom_percent"`
+	// MaxVCPUPerCore caps configured vCPUs per physical core; 0 means no
+	// CPU limit.
+	MaxVCPUPerCore float64 `toml:"max_vcpu_per_core"`
+	// StaggerSeconds is the pause between pod power-ons, so pods do not all
+	// boot at once.
+	StaggerSeconds int `toml:"stagger_seconds"`
+}
+
+func (c CapacityConfig) memoryHeadroom() float64 {
+	if c.MemoryHeadroomPercent <= 0 {
+		return defaultMemoryHeadroomPercent
+	}
+	return c.MemoryHeadroomPercent
+}
+
+// HostCapacity is a host's size and what its powered-on VMs commit.
+type HostCapacity struct {
+	Host              string
+	MemoryMB          int64
+	Cores             int32
+	CommittedMemoryMB int64
+	CommittedVCPUs    int32
+}
+
+// CapacityShortfall explains why a pod could not be powered on.
+type CapacityShortfall struct {
+	User     string
+	Host     string
+	Resource string // "memory" (MB) or "cpu" (vCPUs)
+	Needed   int64
+	Free     int64
+}
+
+func (c CapacityShortfall) String() string {
+	unit := "MB memory"
+	if c.Resource == "cpu" {
+		unit = "vCPUs"
+	}
+	return fmt.Sprintf("pod of %s needs %d %s on host %s, %d free within headroom",
+		c.User, c.Needed, unit, c.Host, c.Free)
+}
+
+// vmCapacity is the configured size and placement of one VM.
+type vmCapacity struct {
+	host      string
+	memoryMB  int64
+	vcpus     int32
+	poweredOn bool
+}
+
+// PlanPowerOn checks which pods can be powered on within the configured
+// headroom. Pods are admitted in order and all-or-nothing: a pod is admitted
+// only if all its powered-off VMs fit on their hosts, and admitted pods
+// count against the capacity left for later ones. Pods that do not fit are
+// returned as shortfalls. VMs the capacity query did not return are not
+// checked.
+func (s *VMwareService) PlanPowerOn(ctx context.Context, pairs []UserVMPair, cfg CapacityConfig) ([]UserVMPair, []CapacityShortfall, error) {
+	hosts, vms, err := s.readCapacity(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var admitted []UserVMPair
+	var shortfalls []CapacityShortfall
+	for _, p := range pairs {
+		var podHosts []string
+		memory := make(map[string]int64)
+		vcpus := make(map[string]int32)
+		for _, name := range p.VMs {
+			vm, ok := vms[name]
+			if !ok || vm.poweredOn {
+				continue
+			}
+			if _, seen := memory[vm.host]; !seen {
+				podHosts = append(podHosts, vm.host)
+			}
+			memory[vm.host] += vm.memoryMB
+			vcpus[vm.host] += vm.vcpus
+		}
+
+		var short *CapacityShortfall
+		for _, host := range podHosts {
+			h, ok := hosts[host]
+			if !ok {
+				continue
+			}
+			needed := memory[host]
+			if free := memoryLimit(h, cfg) - h.CommittedMemoryMB; needed > free {
+				short = &CapacityShortfall{User: p.User, Host: host, Resource: "memory", Needed: needed, Free: max(free, 0)}
+				break
+			}
+			if limit := vcpuLimit(h, cfg); limit > 0 {
+				if free := limit - int64(h.CommittedVCPUs); int64(vcpus[host]) > free {
+					short = &CapacityShortfall{User: p.User, Host: host, Resource: "cpu", Needed: int64(vcpus[host]), Free: max(free, 0)}
+					break
+				}
+			}
+		}
+		if short != nil {
+			shortfalls = append(shortfalls, *short)
+			continue
+		}
+
+		for _, host := range podHosts {
+			if h, ok := hosts[host]; ok {
+				h.CommittedMemoryMB += memory[host]
+				h.CommittedVCPUs += vcpus[host]
+			}
+		}
+		admitted = append(admitted, p)
+	}
+	return admitted, shortfalls, nil
+}
+
+func memoryLimit(h *HostCapacity, cfg CapacityConfig) int64 {
+	return int64(float64(h.MemoryMB) * (1 - cfg.memoryHeadroom()/100))
+}
+
+func vcpuLimit(h *HostCapacity, cfg CapacityConfig) int64 {
+	return int64(float64(h.Cores) * cfg.MaxVCPUPerCore)
+}
+
+// readCapacity reads every host's hardware summary and every VM's
+// configured size and power state. Hosts and VMs seen through more than one
+// endpoint are counted once.
+func (s *VMwareService) readCapacity(ctx context.Context) (map[string]*HostCapacity, map[string]vmCapacity, error) {
+	hosts := make(map[string]*HostCapacity)
+	vms := make(map[string]vmCapacity)
+	var lastErr error
+	queried := 0
+
+	for _, conn := range s.inventoryOrder() {
+		m := view.NewManager(conn.client.Client)
+		v, err := m.CreateContainerView(ctx, conn.client.ServiceContent.RootFolder, []string{"HostSystem", "VirtualMachine"}, true)
+		if err != nil {
+			lastErr = fmt.Errorf("failed to create container view: %w", err)
+			continue
+		}
+
+		var hostObjs []mo.HostSystem
+		var vmObjs []mo.VirtualMachine
+		err = v.Retrieve(ctx, []string{"HostSystem"}, []string{"name", "summary.hardware"}, &hostObjs)
+		if err == nil {
+			err = v.Retrieve(ctx, []string{"VirtualMachine"}, []string{"name", "runtime.host", "runtime.powerState", "config.hardware"}, &vmObjs)
+		}
+		if derr := v.Destroy(ctx); derr != nil {
+			s.logger.Warn("Failed to destroy container view", logger.Error(derr))
+		}
+		if err != nil {
+			s.logger.Warn("Failed to read host capacity from endpoint", logger.F("ENDPOINT", conn.name), logger.Error(err))
+			lastErr = err
+			continue
+		}
+		queried++
+
+		hostNames := make(map[types.ManagedObjectReference]string)
+		for _, h := range hostObjs {
+			hostNames[h.Self] = h.Name
+			if _, seen := hosts[h.Name]; seen || h.Summary.Hardware == nil {
+				continue
+			}
+			hosts[h.Name] = &HostCapacity{
+				Host:     h.Name,
+				MemoryMB: h.Summary.Hardware.MemorySize / (1024 * 1024),
+				Cores:    int32(h.Summary.Hardware.NumCpuCores),
+			}
+		}
+
+		for _, vm := range vmObjs {
+			if _, seen := vms[vm.Name]; seen || vm.Config == nil || vm.Runtime.Host == nil {
+				continue
+			}
+			c := vmCapacity{
+				host:      hostNames[*vm.Runtime.Host],
+				memoryMB:  int64(vm.Config.Hardware.MemoryMB),
+				vcpus:     vm.Config.Hardware.NumCPU,
+				poweredOn: vm.Runtime.PowerState == types.VirtualMachinePowerStatePoweredOn,
+			}
+			vms[vm.Name] = c
+			if h, ok := hosts[c.host]; ok && c.poweredOn {
+				h.CommittedMemoryMB += c.memoryMB
+				h.CommittedVCPUs += c.vcpus
+			}
+		}
+	}
+
+	if queried == 0 && lastErr != nil {
+		return nil, nil, lastErr
+	}
+	return hosts, vms, nil
+}
@@ -0,0 +1,52 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25"
+)
+
+func TestPlanPowerOn(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		svc, _ := newSimService(ctx, t, []*vim25.Client{c})
+		// vcsim: one 4095 MB, 2-core host; both VMs 32 MB, 1 vCPU.
+		for _, vm := range []string{"ha-host_VM0", "ha-host_VM1"} {
+			_, err := svc.SetPowerState(ctx, vm, PowerOff)
+			require.NoError(t, err)
+		}
+		pods := []UserVMPair{
+			{User: "alice", VMs: []string{"ha-host_VM0"}},
+			{User: "bob", VMs: []string{"ha-host_VM1", "not-in-inventory"}},
+		}
+
+		admitted, shortfalls, err := svc.PlanPowerOn(ctx, pods, CapacityConfig{})
+		require.NoError(t, err)
+		assert.Equal(t, pods, admitted)
+		assert.Empty(t, shortfalls)
+
+		admitted, shortfalls, err = svc.PlanPowerOn(ctx, pods, CapacityConfig{MemoryHeadroomPercent: 99.2})
+		require.NoError(t, err)
+		assert.Equal(t, pods[:1], admitted)
+		assert.Equal(t, []CapacityShortfall{{User: "bob", Host: "localhost.localdomain", Resource: "memory", Needed: 32, Free: 0}}, shortfalls)
+
+		_, shortfalls, err = svc.PlanPowerOn(ctx, pods, CapacityConfig{MaxVCPUPerCore: 0.5})
+		require.NoError(t, err)
+		assert.Equal(t, []CapacityShortfall{{User: "bob", Host: "localhost.localdomain", Resource: "cpu", Needed: 1, Free: 0}}, shortfalls)
+		assert.Equal(t, "pod of bob needs 1 vCPUs on host localhost.localdomain, 0 free within headroom", shortfalls[0].String())
+	}, simulator.ESX())
+}
+
+func TestPlanPowerOn_PoweredOnVMsAlreadyCommitted(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		svc, _ := newSimService(ctx, t, []*vim25.Client{c})
+		// Both VMs are on: nothing to admit against capacity, even with no headroom left.
+		admitted, shortfalls, err := svc.PlanPowerOn(ctx, []UserVMPair{{User: "alice", VMs: []string{"ha-host_VM0"}}}, CapacityConfig{MemoryHeadroomPercent: 99.9})
+		require.NoError(t, err)
+		assert.Len(t, admitted, 1)
+		assert.Empty(t, shortfalls)
+	}, simulator.ESX())
+}
@@ -0,0 +1,72 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/EpicMandM/esxi-lab-provider/api/internal/logger"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// ConsoleLink holds the console URLs for one VM.
+type ConsoleLink struct {
+	VM string
+	// HostClientURL opens the VM in the ESXi Host Client, or in the vSphere
+	// Client when the VM is only reachable through vCenter.
+	HostClientURL string
+	// VMRCURL opens VMware Remote Console. It carries the lab username but
+	// no ticket: session clone tickets grant the full service account session
+	// and are single use, so they must never be mailed to students.
+	VMRCURL string
+}
+
+// ConsoleLinks returns console links for each VM, addressed to username.
+// VMs on a vCenter-managed host link to the host directly when it is also
+// configured in ESXI_HOSTS, since lab accounts are local ESXi accounts.
+// VMs that cannot be found are logged and skipped.
+func (s *VMwareService) ConsoleLinks(ctx context.Context, username string, vmNames []string) []ConsoleLink {
+	links := make([]ConsoleLink, 0, len(vmNames))
+	for _, name := range vmNames {
+		vm, loc, err := s.lookupVM(ctx, name)
+		if err != nil {
+			s.logger.Warn("Console link unavailable", logger.VM(name), logger.Error(err))
+			continue
+		}
+
+		conn, ref := loc.conn, vm.Reference()
+		if direct, err := s.accountConnection(loc); err == nil && direct != loc.conn {
+			if dvm, err := direct.finder.VirtualMachine(ctx, name); err == nil {
+				conn, ref = direct, dvm.Reference()
+			}
+		}
+		links = append(links, consoleLink(conn, name, username, ref))
+	}
+	return links
+}
+
+// consoleLink builds the console URLs for the VM ref on conn.
+func consoleLink(conn *hostConnection, name, username string, ref types.ManagedObjectReference) ConsoleLink {
+	host := conn.client.URL().Host
+	base := url.URL{Scheme: "https", Host: host, Path: "/ui/"}
+
+	link := ConsoleLink{VM: name}
+	if conn.client.IsVC() {
+		urn := fmt.Sprintf("urn:vmomi:VirtualMachine:%s:%s", ref.Value, conn.client.ServiceContent.About.InstanceUuid)
+		link.HostClientURL = base.String() + "app/vm;nav=v/" + urn + "/summary"
+	} else {
+		link.HostClientURL = base.String() + "#/console/" + ref.Value
+	}
+
+	vmrc := url.URL{
+		Scheme:   "vmrc",
+		Host:     host,
+		Path:     "/",
+		RawQuery: url.Values{"moid": {ref.Value}}.Encode(),
+	}
+	if username != "" {
+		vmrc.User = url.User(username)
+	}
+	link.VMRCURL = vmrc.String()
+	return link
+}
@@ -0,0 +1,56 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25"
+)
+
+func TestConsoleLinks_StandaloneHost(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		svc, _ := newSimService(ctx, t, []*vim25.Client{c})
+		vm, _, err := svc.lookupVM(ctx, "ha-host_VM0")
+		require.NoError(t, err)
+		moid := vm.Reference().Value
+		host := c.URL().Host
+
+		links := svc.ConsoleLinks(ctx, "alice", []string{"ha-host_VM0"})
+		require.Len(t, links, 1)
+		assert.Equal(t, "ha-host_VM0", links[0].VM)
+		assert.Equal(t, "https://"+host+"/ui/#/console/"+moid, links[0].HostClientURL)
+		assert.Equal(t, "vmrc://alice@"+host+"/?moid="+moid, links[0].VMRCURL)
+	}, simulator.ESX())
+}
+
+func TestConsoleLinks_VCenter(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		svc, _ := newSimService(ctx, t, []*vim25.Client{c})
+		resp, err := svc.ListVMSnapshots(ctx)
+		require.NoError(t, err)
+		require.NotEmpty(t, resp.VMs)
+		name := resp.VMs[0].Name
+
+		links := svc.ConsoleLinks(ctx, "alice", []string{name})
+		require.Len(t, links, 1)
+		assert.Contains(t, links[0].HostClientURL, "/ui/app/vm;nav=v/urn:vmomi:VirtualMachine:vm-")
+		assert.Contains(t, links[0].HostClientURL, c.ServiceContent.About.InstanceUuid)
+		assert.True(t, strings.HasPrefix(links[0].VMRCURL, "vmrc://alice@"+c.URL().Host+"/?moid=vm-"))
+	}, simulator.VPX())
+}
+
+func TestConsoleLinks_MissingVMSkipped(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		svc, buf := newSimService(ctx, t, []*vim25.Client{c})
+
+		links := svc.ConsoleLinks(ctx, "alice", []string{"ha-host_VM0", "does-not-exist", "ha-host_VM1"})
+		require.Len(t, links, 2)
+		assert.Equal(t, "ha-host_VM0", links[0].VM)
+		assert.Equal(t, "ha-host_VM1", links[1].VM)
+		assert.Contains(t, buf.String(), "Console link unavailable")
+	}, simulator.ESX())
+}
@@ -0,0 +1,113 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/http/cookiejar"
+	"net/url"
+	"slices"
+
+	"github.com/EpicMandM/esxi-lab-provider/api/internal/logger"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/view"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/mo"
+)
+
+// VerifyCredentials logs in as username with password, in a session of its
+// own on the host carrying the user's local account, and checks that the
+// user can see every VM in vmNames. A pod spread over several hosts is
+// checked on each of them, against the VMs that host runs. Each session is
+// logged out afterwards.
+func (s *VMwareService) VerifyCredentials(ctx context.Context, username, password string, vmNames []string) error {
+	if len(vmNames) == 0 {
+		return fmt.Errorf("no VMs to check for %s", username)
+	}
+	var hosts []*hostConnection
+	byHost := make(map[*hostConnection][]string)
+	for _, name := range vmNames {
+		_, loc, err := s.lookupVM(ctx, name)
+		if err != nil {
+			return err
+		}
+		conn, err := s.accountConnection(loc)
+		if err != nil {
+			return err
+		}
+		if _, ok := byHost[conn]; !ok {
+			hosts = append(hosts, conn)
+		}
+		byHost[conn] = append(byHost[conn], name)
+	}
+	for _, conn := range hosts {
+		if err := s.verifyOnHost(ctx, conn, username, password, byHost[conn]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyOnHost logs in as username on conn and checks that the user can see
+// every VM in vmNames there.
+func (s *VMwareService) verifyOnHost(ctx context.Context, conn *hostConnection, username, password string, vmNames []string) error {
+	// Same endpoint and TLS settings as the service's own session, but a
+	// fresh cookie jar so the service session is not reused.
+	sc := conn.client.Client.Client.NewServiceClient(vim25.Path, vim25.Namespace)
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return err
+	}
+	sc.Jar = jar
+	vc, err := vim25.NewClient(ctx, sc)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", conn.name, err)
+	}
+	sm := session.NewManager(vc)
+	err = s.withRetry(ctx, "credential_check", vmNames[0], func(ctx context.Context) error {
+		return sm.Login(ctx, url.UserPassword(username, password))
+	})
+	if err != nil {
+		return fmt.Errorf("login as %s on %s failed: %w", username, conn.name, err)
+	}
+	defer func() {
+		if err := sm.Logout(context.WithoutCancel(ctx)); err != nil {
+			s.logger.Warn("Failed to log out credential check session", logger.User(username), logger.Error(err))
+		}
+	}()
+
+	visible, err := visibleVMs(ctx, vc)
+	if err != nil {
+		return fmt.Errorf("failed to list VMs as %s on %s: %w", username, conn.name, err)
+	}
+	var missing []string
+	for _, vm := range vmNames {
+		if !slices.Contains(visible, vm) {
+			missing = append(missing, vm)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%s cannot see %v on %s", username, missing, conn.name)
+	}
+	return nil
+}
+
+// visibleVMs returns the names of the VMs the session of c can see.
+func visibleVMs(ctx context.Context, c *vim25.Client) ([]string, error) {
+	v, err := view.NewManager(c).CreateContainerView(ctx, c.ServiceContent.RootFolder, []string{"VirtualMachine"}, true)
+	if err != nil {
+		return nil, err
+	}
+	// The view ends with the session at the latest, so a failed destroy is
+	// harmless.
+	defer func() { _ = v.Destroy(ctx) }()
+
+	var vms []mo.VirtualMachine
+	if err := v.Retrieve(ctx, []string{"VirtualMachine"}, []string{"name"}, &vms); err != nil {
+		return nil, err
+	}
+	names := make([]string, len(vms))
+	for i, vm := range vms {
+		names[i] = vm.Name
+	}
+	return names, nil
+}
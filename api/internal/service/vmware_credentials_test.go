@@ -0,0 +1,51 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25"
+)
+
+func TestVerifyCredentials(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		svc, _ := newSimService(ctx, t, []*vim25.Client{c})
+		password, err := svc.RotateESXiUserPassword(ctx, "ha-host_VM0", "lab-user-1")
+		require.NoError(t, err)
+
+		require.NoError(t, svc.VerifyCredentials(ctx, "lab-user-1", password, []string{"ha-host_VM0", "ha-host_VM1"}))
+		sessions, err := svc.TerminateUserSessions(ctx, "ha-host_VM0", "lab-user-1")
+		require.NoError(t, err)
+		assert.Empty(t, sessions, "check session logged out")
+		own, err := svc.conns[0].client.SessionManager.UserSession(ctx)
+		require.NoError(t, err)
+		assert.NotNil(t, own, "service session kept")
+
+		err = svc.VerifyCredentials(ctx, "lab-user-1", password, []string{"ha-host_VM0", "Pod-9_Client"})
+		assert.ErrorContains(t, err, "Pod-9_Client")
+		assert.ErrorContains(t, svc.VerifyCredentials(ctx, "lab-user-1", password, nil), "no VMs")
+	}, simulator.ESX())
+}
+
+func TestVerifyCredentials_PodOnTwoHosts(t *testing.T) {
+	simulator.Test(func(ctx context.Context, a *vim25.Client) {
+		simulator.Test(func(ctx context.Context, b *vim25.Client) {
+			// Give the second host's VM a name of its own, so the pod's
+			// second VM only runs there.
+			vm, err := find.NewFinder(b).VirtualMachine(ctx, "ha-host_VM1")
+			require.NoError(t, err)
+			task, err := vm.Rename(ctx, "Pod-1_Client")
+			require.NoError(t, err)
+			require.NoError(t, task.Wait(ctx))
+
+			svc, _ := newSimService(ctx, t, []*vim25.Client{a, b})
+			vms := []string{"ha-host_VM0", "Pod-1_Client"}
+			require.NoError(t, svc.VerifyCredentials(ctx, "lab-user-1", "Rotated-pw-1", vms), "each VM is checked on its own host")
+			assert.Same(t, svc.conns[1], svc.locations["Pod-1_Client"].conn)
+		}, simulator.ESX())
+	}, simulator.ESX())
+}
@@ -0,0 +1,301 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/EpicMandM/esxi-lab-provider/api/internal/logger"
+	"github.com/vmware/govmomi/guest/toolbox"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const (
+	defaultGuestTimeout      = 5 * time.Minute
+	guestProcessPollInterval = 2 * time.Second
+)
+
+// GuestProvisionRule describes the guest operations run inside matching VMs
+// after each restore. Guest credentials come from .env
+// (GUEST_<CREDENTIALS>_USERNAME, GUEST_<CREDENTIALS>_PASSWORD).
+type GuestProvisionRule struct {
+	VMPrefixes     []string       `toml:"vm_prefixes"`
+	Credentials    string         `toml:"credentials"`
+	TimeoutSeconds int            `toml:"timeout_seconds"`
+	Files          []GuestFile    `toml:"files"`
+	Commands       []GuestCommand `toml:"commands"`
+	GuestUsername  string         `toml:"-"`
+	GuestPassword  string         `toml:"-"`
+}
+
+// GuestFile is a local text/template rendered with GuestVars and uploaded
+// to Path inside the guest.
+type GuestFile struct {
+	Template string `toml:"template"`
+	Path     string `toml:"path"`
+}
+
+// GuestCommand is a program started inside the guest. Args is a
+// text/template rendered with GuestVars.
+type GuestCommand struct {
+	Path    string `toml:"path"`
+	Args    string `toml:"args"`
+	WorkDir string `toml:"work_dir"`
+}
+
+// GuestTarget is a restored VM to provision, with the lab user it belongs to.
+type GuestTarget struct {
+	VM   string
+	User string
+}
+
+// GuestVars are the per-session values available to file and argument
+// templates. Password and Token are freshly generated for every run.
+type GuestVars struct {
+	VM       string
+	User     string
+	Password string
+	Token    string
+}
+
+// GuestStepResult is the outcome of one upload or program run.
+type GuestStepResult struct {
+	Step     string
+	ExitCode int32
+	Err      error
+}
+
+// GuestProvisionResult is the outcome of provisioning one VM. Password is
+// the per-session guest password made available to templates.
+type GuestProvisionResult struct {
+	VM       string
+	User     string
+	Password string
+	Steps    []GuestStepResult
+	Err      error
+}
+
+func (r *GuestProvisionRule) timeout() time.Duration {
+	if r.TimeoutSeconds > 0 {
+		return time.Duration(r.TimeoutSeconds) * time.Second
+	}
+	return defaultGuestTimeout
+}
+
+// matches reports whether vmName starts with one of the rule's prefixes.
+func (r *GuestProvisionRule) matches(vmName string) bool {
+	for _, prefix := range r.VMPrefixes {
+		if strings.HasPrefix(vmName, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadGuestCredentials fills guest credentials for every provisioning rule
+// from GUEST_<CREDENTIALS>_USERNAME and GUEST_<CREDENTIALS>_PASSWORD.
+func (c *ESXiConfig) LoadGuestCredentials() error {
+	for i := range c.GuestProvisioning {
+		r := &c.GuestProvisioning[i]
+		if r.Credentials == "" {
+			return fmt.Errorf("guest_provisioning rule %d: credentials is required", i)
+		}
+		key := "GUEST_" + strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(r.Credentials))
+		r.GuestUsername = os.Getenv(key + "_USERNAME")
+		r.GuestPassword = os.Getenv(key + "_PASSWORD")
+		if r.GuestUsername == "" {
+			return fmt.Errorf("guest_provisioning rule %d: %s_USERNAME is not set", i, key)
+		}
+	}
+	return nil
+}
+
+// matchGuestRule returns the first rule matching vmName, or nil.
+func matchGuestRule(rules []GuestProvisionRule, vmName string) *GuestProvisionRule {
+	for i := range rules {
+		if rules[i].matches(vmName) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// newGuestVars generates the per-session template values for a target.
+func newGuestVars(t GuestTarget) (GuestVars, error) {
+	password, err := GeneratePassword(defaultPasswordLength)
+	if err != nil {
+		return GuestVars{}, err
+	}
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return GuestVars{}, fmt.Errorf("failed to generate token: %w", err)
+	}
+	return GuestVars{
+		VM:       t.VM,
+		User:     t.User,
+		Password: password,
+		Token:    hex.EncodeToString(token),
+	}, nil
+}
+
+// renderGuestTemplate executes text as a template with vars.
+func renderGuestTemplate(name, text string, vars GuestVars) (string, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse template %s: %w", name, err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, vars); err != nil {
+		return "", fmt.Errorf("failed to render template %s: %w", name, err)
+	}
+	return buf.String(), nil
+}
+
+// ProvisionGuests runs the matching provisioning rule inside every target
+// VM. VMs without a matching rule are skipped. One result is returned per
+// provisioned VM; a failure in one VM does not stop the others.
+func (s *VMwareService) ProvisionGuests(ctx context.Context, rules []GuestProvisionRule, targets []GuestTarget) []GuestProvisionResult {
+	var results []GuestProvisionResult
+	for _, t := range targets {
+		rule := matchGuestRule(rules, t.VM)
+		if rule == nil {
+			continue
+		}
+		res := s.provisionGuest(ctx, rule, t)
+		if res.Err != nil {
+			s.logger.Error("Guest provisioning failed", logger.Action("guest_provision"), logger.Status("failed"), logger.VM(t.VM), logger.Error(res.Err))
+		} else {
+			s.logger.Info("Guest provisioning successful", logger.Action("guest_provision"), logger.Status("success"), logger.VM(t.VM), logger.Count(len(res.Steps)))
+		}
+		results = append(results, res)
+	}
+	return results
+}
+
+func (s *VMwareService) provisionGuest(ctx context.Context, rule *GuestProvisionRule, t GuestTarget) GuestProvisionResult {
+	res := GuestProvisionResult{VM: t.VM, User: t.User}
+
+	vars, err := newGuestVars(t)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	s.logger.AddSecret(vars.Password, vars.Token)
+	res.Password = vars.Password
+
+	vm, loc, err := s.lookupVM(ctx, t.VM)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, rule.timeout())
+	defer cancel()
+
+	if err := waitForGuestTools(ctx, vm); err != nil {
+		res.Err = fmt.Errorf("guest tools not running: %w", err)
+		return res
+	}
+
+	auth := &types.NamePasswordAuthentication{Username: rule.GuestUsername, Password: rule.GuestPassword}
+	tc, err := toolbox.NewClient(ctx, loc.conn.client.Client, vm, auth)
+	if err != nil {
+		res.Err = fmt.Errorf("failed to open guest operations: %w", err)
+		return res
+	}
+
+	for _, f := range rule.Files {
+		step := GuestStepResult{Step: "upload " + f.Path}
+		step.Err = uploadGuestFile(ctx, tc, f, vars)
+		res.Steps = append(res.Steps, step)
+		if step.Err != nil {
+			res.Err = fmt.Errorf("%s: %w", step.Step, step.Err)
+			return res
+		}
+	}
+
+	for _, c := range rule.Commands {
+		step := GuestStepResult{Step: c.Path}
+		step.ExitCode, step.Err = runGuestCommand(ctx, tc, c, vars)
+		if step.Err == nil && step.ExitCode != 0 {
+			step.Err = fmt.Errorf("exited with code %d", step.ExitCode)
+		}
+		res.Steps = append(res.Steps, step)
+		if step.Err != nil {
+			res.Err = fmt.Errorf("%s: %w", step.Step, step.Err)
+			return res
+		}
+	}
+
+	return res
+}
+
+// waitForGuestTools blocks until VMware Tools reports running in the guest,
+// which is needed before any guest operation after a revert.
+func waitForGuestTools(ctx context.Context, vm *object.VirtualMachine) error {
+	pc := property.DefaultCollector(vm.Client())
+	return property.Wait(ctx, pc, vm.Reference(), []string{"guest.toolsRunningStatus"}, func(changes []types.PropertyChange) bool {
+		for _, c := range changes {
+			if status, ok := c.Val.(string); ok && status == string(types.VirtualMachineToolsRunningStatusGuestToolsRunning) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func uploadGuestFile(ctx context.Context, tc *toolbox.Client, f GuestFile, vars GuestVars) error {
+	text, err := os.ReadFile(f.Template)
+	if err != nil {
+		return fmt.Errorf("failed to read template: %w", err)
+	}
+	content, err := renderGuestTemplate(f.Template, string(text), vars)
+	if err != nil {
+		return err
+	}
+	return tc.Upload(ctx, strings.NewReader(content), f.Path, soap.DefaultUpload, &types.GuestFileAttributes{}, true)
+}
+
+// runGuestCommand starts a program in the guest and waits for it to exit,
+// returning its exit code.
+func runGuestCommand(ctx context.Context, tc *toolbox.Client, c GuestCommand, vars GuestVars) (int32, error) {
+	args, err := renderGuestTemplate(c.Path, c.Args, vars)
+	if err != nil {
+		return 0, err
+	}
+
+	pid, err := tc.ProcessManager.StartProgram(ctx, tc.Authentication, &types.GuestProgramSpec{
+		ProgramPath:      c.Path,
+		Arguments:        args,
+		WorkingDirectory: c.WorkDir,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to start program: %w", err)
+	}
+
+	ticker := time.NewTicker(guestProcessPollInterval)
+	defer ticker.Stop()
+	for {
+		procs, err := tc.ProcessManager.ListProcesses(ctx, tc.Authentication, []int64{pid})
+		if err != nil {
+			return 0, fmt.Errorf("failed to query process %d: %w", pid, err)
+		}
+		if len(procs) == 1 && procs[0].EndTime != nil {
+			return procs[0].ExitCode, nil
+		}
+		select {
+		case <-ctx.Done():
+			return 0, fmt.Errorf("process %d did not exit: %w", pid, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
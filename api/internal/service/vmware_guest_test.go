@@ -0,0 +1,167 @@
+package service
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25"
+)
+
+func TestMatchGuestRule(t *testing.T) {
+	rules := []GuestProvisionRule{
+		{VMPrefixes: []string{"Pod-1_Client"}, Credentials: "linux"},
+		{VMPrefixes: []string{"Pod-", "Lab-"}, Credentials: "any"},
+	}
+
+	tests := []struct {
+		name   string
+		vmName string
+		want   string
+	}{
+		{"first rule wins", "Pod-1_Client_Deb", "linux"},
+		{"second prefix of later rule", "Lab-3_Server", "any"},
+		{"no match", "Other-VM", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := matchGuestRule(rules, tt.vmName)
+			if tt.want == "" {
+				assert.Nil(t, got)
+				return
+			}
+			require.NotNil(t, got)
+			assert.Equal(t, tt.want, got.Credentials)
+		})
+	}
+}
+
+func TestRenderGuestTemplate(t *testing.T) {
+	vars := GuestVars{VM: "vm-alice", User: "alice", Password: "s3cret", Token: "abcd"}
+
+	out, err := renderGuestTemplate("args", "--user {{.User}} --password {{.Password}} --token {{.Token}}", vars)
+	require.NoError(t, err)
+	assert.Equal(t, "--user alice --password s3cret --token abcd", out)
+}
+
+func TestRenderGuestTemplate_UnknownField(t *testing.T) {
+	_, err := renderGuestTemplate("args", "{{.Missing}}", GuestVars{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to render template args")
+}
+
+func TestRenderGuestTemplate_ParseError(t *testing.T) {
+	_, err := renderGuestTemplate("args", "{{.User", GuestVars{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to parse template args")
+}
+
+func TestNewGuestVars_FreshPerSession(t *testing.T) {
+	a, err := newGuestVars(GuestTarget{VM: "vm-alice", User: "alice"})
+	require.NoError(t, err)
+	b, err := newGuestVars(GuestTarget{VM: "vm-alice", User: "alice"})
+	require.NoError(t, err)
+
+	assert.Equal(t, "vm-alice", a.VM)
+	assert.Equal(t, "alice", a.User)
+	assert.Len(t, a.Password, defaultPasswordLength)
+	assert.Len(t, a.Token, 32)
+	assert.NotEqual(t, a.Password, b.Password)
+	assert.NotEqual(t, a.Token, b.Token)
+}
+
+func TestLoadGuestCredentials(t *testing.T) {
+	t.Setenv("GUEST_LAB_LINUX_USERNAME", "root")
+	t.Setenv("GUEST_LAB_LINUX_PASSWORD", "toor")
+	cfg := &ESXiConfig{GuestProvisioning: []GuestProvisionRule{{Credentials: "lab-linux"}}}
+
+	require.NoError(t, cfg.LoadGuestCredentials())
+	assert.Equal(t, "root", cfg.GuestProvisioning[0].GuestUsername)
+	assert.Equal(t, "toor", cfg.GuestProvisioning[0].GuestPassword)
+}
+
+func TestLoadGuestCredentials_MissingUsername(t *testing.T) {
+	cfg := &ESXiConfig{GuestProvisioning: []GuestProvisionRule{{Credentials: "windows"}}}
+
+	err := cfg.LoadGuestCredentials()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "GUEST_WINDOWS_USERNAME is not set")
+}
+
+func TestLoadGuestCredentials_CredentialsRequired(t *testing.T) {
+	cfg := &ESXiConfig{GuestProvisioning: []GuestProvisionRule{{VMPrefixes: []string{"Pod-"}}}}
+
+	err := cfg.LoadGuestCredentials()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "credentials is required")
+}
+
+func TestLoadFeatureConfig_GuestProvisioning(t *testing.T) {
+	content := `
+[esxi]
+url = "https://esxi.local"
+
+[[esxi.guest_provisioning]]
+vm_prefixes = ["Pod-1_Client"]
+credentials = "linux"
+timeout_seconds = 120
+
+[[esxi.guest_provisioning.files]]
+template = "/etc/lab/motd.tmpl"
+path = "/etc/motd"
+
+[[esxi.guest_provisioning.commands]]
+path = "/usr/local/bin/lab-setup"
+args = "--user {{.User}}"
+`
+	tmpFile := filepath.Join(t.TempDir(), "config.toml")
+	require.NoError(t, os.WriteFile(tmpFile, []byte(content), 0o644))
+
+	cfg, err := LoadFeatureConfig(tmpFile)
+	require.NoError(t, err)
+	require.Len(t, cfg.ESXi.GuestProvisioning, 1)
+	rule := cfg.ESXi.GuestProvisioning[0]
+	assert.Equal(t, []string{"Pod-1_Client"}, rule.VMPrefixes)
+	assert.Equal(t, 120, rule.TimeoutSeconds)
+	assert.Equal(t, []GuestFile{{Template: "/etc/lab/motd.tmpl", Path: "/etc/motd"}}, rule.Files)
+	assert.Equal(t, []GuestCommand{{Path: "/usr/local/bin/lab-setup", Args: "--user {{.User}}"}}, rule.Commands)
+}
+
+func TestProvisionGuests_SkipsUnmatchedVMs(t *testing.T) {
+	svc := &VMwareService{}
+	rules := []GuestProvisionRule{{VMPrefixes: []string{"Pod-"}}}
+
+	results := svc.ProvisionGuests(context.Background(), rules, []GuestTarget{{VM: "Other", User: "alice"}})
+	assert.Empty(t, results)
+}
+
+func TestProvisionGuests_FailureReportedPerVM(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		svc, buf := newSimService(ctx, t, []*vim25.Client{c})
+		_, err := svc.ListVMSnapshots(ctx)
+		require.NoError(t, err)
+
+		rules := []GuestProvisionRule{{
+			VMPrefixes:     []string{"ha-host_VM0"},
+			TimeoutSeconds: 1,
+			GuestUsername:  "root",
+			Commands:       []GuestCommand{{Path: "/bin/true"}},
+		}}
+		targets := []GuestTarget{
+			{VM: "ha-host_VM0", User: "alice"},
+			{VM: "ha-host_VM1", User: "bob"},
+		}
+
+		results := svc.ProvisionGuests(ctx, rules, targets)
+		require.Len(t, results, 1)
+		assert.Equal(t, "ha-host_VM0", results[0].VM)
+		assert.Equal(t, "alice", results[0].User)
+		assert.NotEmpty(t, results[0].Password)
+		assert.Error(t, results[0].Err)
+		assert.Contains(t, buf.String(), "Guest provisioning failed")
+	}, simulator.ESX())
+}
@@ -0,0 +1,132 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+
+	"github.com/EpicMandM/esxi-lab-provider/api/internal/config"
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// hostConnection is a session to one vSphere endpoint: either a standalone
+// ESXi host or a vCenter managing several hosts.
+type hostConnection struct {
+	name     string
+	address  string // host part of the endpoint URL
+	hostName string // inventory name of the host; standalone ESXi only
+	client   *govmomi.Client
+	finder   *find.Finder
+}
+
+// vmLocation records which endpoint and host a VM was found on.
+type vmLocation struct {
+	conn     *hostConnection
+	ref      types.ManagedObjectReference
+	hostName string
+}
+
+func connect(ctx context.Context, ep config.Endpoint) (*hostConnection, error) {
+	u, err := soap.ParseURL(ep.URL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse URL: %w", err)
+	}
+
+	u.User = url.UserPassword(ep.Username, ep.Password)
+
+	client, err := govmomi.NewClient(ctx, u, ep.Insecure)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect: %w", err)
+	}
+	return newHostConnection(ctx, ep.Name, client)
+}
+
+func newHostConnection(ctx context.Context, name string, client *govmomi.Client) (*hostConnection, error) {
+	conn := &hostConnection{
+		name:    name,
+		address: client.URL().Hostname(),
+		client:  client,
+		finder:  find.NewFinder(client.Client, true),
+	}
+
+	// A vCenter may have several datacenters, in which case there is no
+	// default; VMs are then located through the inventory instead.
+	if dc, err := conn.finder.DefaultDatacenter(ctx); err == nil {
+		conn.finder.SetDatacenter(dc)
+	}
+
+	if !client.IsVC() {
+		host, err := conn.finder.DefaultHostSystem(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get ESXi host: %w", err)
+		}
+		conn.hostName = host.Name()
+	}
+
+	return conn, nil
+}
+
+// inventoryOrder returns the connections with vCenter endpoints first, so
+// that VMs on vCenter-managed hosts are reverted through vCenter even when
+// the host is also configured directly for account management.
+func (s *VMwareService) inventoryOrder() []*hostConnection {
+	conns := append([]*hostConnection(nil), s.conns...)
+	sort.SliceStable(conns, func(i, j int) bool {
+		return conns[i].client.IsVC() && !conns[j].client.IsVC()
+	})
+	return conns
+}
+
+// lookupVM resolves a VM by name using the locations recorded by the last
+// inventory, falling back to a finder search on every endpoint.
+func (s *VMwareService) lookupVM(ctx context.Context, name string) (*object.VirtualMachine, vmLocation, error) {
+	if loc, ok := s.locations[name]; ok {
+		return object.NewVirtualMachine(loc.conn.client.Client, loc.ref), loc, nil
+	}
+
+	var lastErr error
+	for _, conn := range s.conns {
+		vm, err := conn.finder.VirtualMachine(ctx, name)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		loc := vmLocation{conn: conn, ref: vm.Reference()}
+		if host, err := vm.HostSystem(ctx); err == nil {
+			if hostName, err := host.ObjectName(ctx); err == nil {
+				loc.hostName = hostName
+			}
+		}
+		s.locations[name] = loc
+		return vm, loc, nil
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no vSphere endpoints connected")
+	}
+	return nil, vmLocation{}, fmt.Errorf("VM not found: %w", lastErr)
+}
+
+// accountConnection returns the connection whose HostLocalAccountManager
+// manages local accounts on the host running the VM at loc. Local accounts
+// can only be changed through a direct ESXi session, so VMs found through
+// vCenter need their host listed in ESXI_HOSTS, matched by endpoint name,
+// URL host or ESXi host name.
+func (s *VMwareService) accountConnection(loc vmLocation) (*hostConnection, error) {
+	if !loc.conn.client.IsVC() {
+		return loc.conn, nil
+	}
+	for _, conn := range s.conns {
+		if conn.client.IsVC() {
+			continue
+		}
+		if conn.name == loc.hostName || conn.address == loc.hostName || conn.hostName == loc.hostName {
+			return conn, nil
+		}
+	}
+	return nil, fmt.Errorf("no direct ESXi connection configured for host %q", loc.hostName)
+}
@@ -0,0 +1,130 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const defaultLabRole = "lab-console"
+
+// PermissionConfig controls time-boxed VM permissions from the
+// [permissions] section of user_config.toml. When enabled, a lab user holds
+// Role on their pod's VMs only while the pod serves an active booking.
+type PermissionConfig struct {
+	Enabled bool `toml:"enabled"`
+	// Role is the ESXi role granted on the pod's VMs (default
+	// "lab-console", the role the esxi-users module creates).
+	Role string `toml:"role"`
+}
+
+// RoleName returns Role, or the default when unset.
+func (c PermissionConfig) RoleName() string {
+	if c.Role == "" {
+		return defaultLabRole
+	}
+	return c.Role
+}
+
+// Permission changes applied by ReconcileVMPermissions.
+const (
+	PermissionGrant  = "grant"
+	PermissionRevoke = "revoke"
+)
+
+// PermissionChange is one permission set or removed on a VM.
+type PermissionChange struct {
+	VM     string
+	User   string
+	Action string
+}
+
+// ReconcileVMPermissions makes the lab users' permissions on vmName match
+// the expected set: grantTo holds role on the VM, without propagation, and
+// no other principal in labUsers holds any permission on it. An empty
+// grantTo revokes every lab user. Permissions of principals outside labUsers
+// are left alone. Permissions are set through the AuthorizationManager of
+// the host running the VM, where the lab users' local accounts live.
+func (s *VMwareService) ReconcileVMPermissions(ctx context.Context, vmName, grantTo string, labUsers []string, role string) ([]PermissionChange, error) {
+	vm, loc, err := s.lookupVM(ctx, vmName)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := s.accountConnection(loc)
+	if err != nil {
+		return nil, err
+	}
+	if conn.client.ServiceContent.AuthorizationManager == nil {
+		return nil, fmt.Errorf("endpoint %s has no AuthorizationManager", conn.name)
+	}
+	am := object.NewAuthorizationManager(conn.client.Client)
+
+	// Through vCenter the VM reference belongs to the vCenter inventory;
+	// look the VM up again on the host.
+	ref := vm.Reference()
+	if conn != loc.conn {
+		hostVM, err := conn.finder.VirtualMachine(ctx, vmName)
+		if err != nil {
+			return nil, fmt.Errorf("VM not found on host %s: %w", conn.name, err)
+		}
+		ref = hostVM.Reference()
+	}
+
+	var roleID int32
+	if grantTo != "" {
+		roles, err := am.RoleList(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list roles on %s: %w", conn.name, err)
+		}
+		r := roles.ByName(role)
+		if r == nil {
+			return nil, fmt.Errorf("role %q not found on %s", role, conn.name)
+		}
+		roleID = r.RoleId
+	}
+
+	perms, err := am.RetrieveEntityPermissions(ctx, ref, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read permissions of %s: %w", vmName, err)
+	}
+
+	isLabUser := func(principal string) bool {
+		return slices.ContainsFunc(labUsers, func(u string) bool { return strings.EqualFold(u, principal) })
+	}
+
+	var changes []PermissionChange
+	granted := false
+	for _, p := range perms {
+		if p.Group || !isLabUser(p.Principal) {
+			continue
+		}
+		if grantTo != "" && strings.EqualFold(p.Principal, grantTo) {
+			// A wrong role or propagation is replaced by the grant below.
+			granted = p.RoleId == roleID && !p.Propagate
+			continue
+		}
+		err := s.withRetry(ctx, "permission_revoke", vmName, func(ctx context.Context) error {
+			return am.RemoveEntityPermission(ctx, ref, p.Principal, false)
+		})
+		if err != nil {
+			return changes, fmt.Errorf("failed to revoke %s on %s: %w", p.Principal, vmName, err)
+		}
+		changes = append(changes, PermissionChange{VM: vmName, User: p.Principal, Action: PermissionRevoke})
+	}
+
+	if grantTo != "" && !granted {
+		perm := types.Permission{Principal: grantTo, RoleId: roleID, Propagate: false}
+		err := s.withRetry(ctx, "permission_grant", vmName, func(ctx context.Context) error {
+			return am.SetEntityPermissions(ctx, ref, []types.Permission{perm})
+		})
+		if err != nil {
+			return changes, fmt.Errorf("failed to grant %s on %s: %w", grantTo, vmName, err)
+		}
+		changes = append(changes, PermissionChange{VM: vmName, User: grantTo, Action: PermissionGrant})
+	}
+	return changes, nil
+}
@@ -0,0 +1,62 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25"
+)
+
+func TestReconcileVMPermissions(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		svc, _ := newSimService(ctx, t, []*vim25.Client{c})
+		labUsers := []string{"lab-user-1", "lab-user-2"}
+
+		am := object.NewAuthorizationManager(c)
+		vm, err := find.NewFinder(c).VirtualMachine(ctx, "ha-host_VM0")
+		require.NoError(t, err)
+		perms := func() map[string]int32 {
+			list, err := am.RetrieveEntityPermissions(ctx, vm.Reference(), false)
+			require.NoError(t, err)
+			m := map[string]int32{}
+			for _, p := range list {
+				m[p.Principal] = p.RoleId
+			}
+			return m
+		}
+		roles, err := am.RoleList(ctx)
+		require.NoError(t, err)
+		readOnly := roles.ByName("ReadOnly").RoleId
+
+		changes, err := svc.ReconcileVMPermissions(ctx, "ha-host_VM0", "lab-user-1", labUsers, "ReadOnly")
+		require.NoError(t, err)
+		assert.Equal(t, []PermissionChange{{VM: "ha-host_VM0", User: "lab-user-1", Action: PermissionGrant}}, changes)
+		assert.Equal(t, readOnly, perms()["lab-user-1"])
+
+		changes, err = svc.ReconcileVMPermissions(ctx, "ha-host_VM0", "lab-user-1", labUsers, "ReadOnly")
+		require.NoError(t, err)
+		assert.Empty(t, changes, "expected permission kept")
+
+		// The next booking goes to another lab user: the previous grant is
+		// drift and is revoked.
+		changes, err = svc.ReconcileVMPermissions(ctx, "ha-host_VM0", "lab-user-2", labUsers, "ReadOnly")
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []PermissionChange{
+			{VM: "ha-host_VM0", User: "lab-user-1", Action: PermissionRevoke},
+			{VM: "ha-host_VM0", User: "lab-user-2", Action: PermissionGrant},
+		}, changes)
+
+		changes, err = svc.ReconcileVMPermissions(ctx, "ha-host_VM0", "", labUsers, "ReadOnly")
+		require.NoError(t, err)
+		assert.Equal(t, []PermissionChange{{VM: "ha-host_VM0", User: "lab-user-2", Action: PermissionRevoke}}, changes)
+		assert.NotContains(t, perms(), "lab-user-2")
+
+		_, err = svc.ReconcileVMPermissions(ctx, "ha-host_VM0", "lab-user-1", labUsers, "no-such-role")
+		assert.ErrorContains(t, err, `role "no-such-role" not found`)
+	}, simulator.ESX())
+}
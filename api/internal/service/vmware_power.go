@@ -0,0 +1,115 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// PowerAction is a VM power operation.
+type PowerAction string
+
+const (
+	PowerOn  PowerAction = "power_on"
+	PowerOff PowerAction = "power_off"
+	Suspend  PowerAction = "suspend"
+)
+
+// PowerConfig controls idle pod power management from the [power] section
+// of user_config.toml. Pods without a booking starting within
+// WarmupMinutes are idled with IdleAction; pods with one are powered on.
+type PowerConfig struct {
+	Enabled bool `toml:"enabled"`
+	// IdleAction is "power_off" (default) or "suspend".
+	IdleAction PowerAction `toml:"idle_action"`
+	// WarmupMinutes is how long before a booking its pod is powered on
+	// (default 30).
+	WarmupMinutes int `toml:"warmup_minutes"`
+	// AlwaysOn lists VM name prefixes that are never idled.
+	AlwaysOn []string `toml:"always_on"`
+	// Capacity limits how many pods are powered on per host.
+	Capacity CapacityConfig `toml:"capacity"`
+}
+
+const defaultWarmupMinutes = 30
+
+// Warmup returns WarmupMinutes, or the default when unset.
+func (c PowerConfig) Warmup() int {
+	if c.WarmupMinutes <= 0 {
+		return defaultWarmupMinutes
+	}
+	return c.WarmupMinutes
+}
+
+// Idle returns IdleAction, or PowerOff when unset.
+func (c PowerConfig) Idle() PowerAction {
+	if c.IdleAction == "" {
+		return PowerOff
+	}
+	return c.IdleAction
+}
+
+// IsAlwaysOn reports whether vmName must never be idled.
+func (c PowerConfig) IsAlwaysOn(vmName string) bool {
+	return slices.ContainsFunc(c.AlwaysOn, func(prefix string) bool {
+		return strings.HasPrefix(vmName, prefix)
+	})
+}
+
+// Validate checks the idle action.
+func (c PowerConfig) Validate() error {
+	switch c.Idle() {
+	case PowerOff, Suspend:
+		return nil
+	}
+	return fmt.Errorf("power.idle_action must be %q or %q, got %q", PowerOff, Suspend, c.IdleAction)
+}
+
+// SetPowerState applies action to vmName and reports whether the VM changed
+// state. VMs already in the target state are left alone, and suspending a
+// powered-off VM is a no-op.
+func (s *VMwareService) SetPowerState(ctx context.Context, vmName string, action PowerAction) (bool, error) {
+	vm, _, err := s.lookupVM(ctx, vmName)
+	if err != nil {
+		return false, err
+	}
+
+	state, err := vm.PowerState(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to read power state: %w", err)
+	}
+
+	var start func(context.Context) (*object.Task, error)
+	switch action {
+	case PowerOn:
+		if state == types.VirtualMachinePowerStatePoweredOn {
+			return false, nil
+		}
+		start = vm.PowerOn
+	case PowerOff:
+		if state == types.VirtualMachinePowerStatePoweredOff {
+			return false, nil
+		}
+		start = vm.PowerOff
+	case Suspend:
+		if state != types.VirtualMachinePowerStatePoweredOn {
+			return false, nil
+		}
+		start = vm.Suspend
+	default:
+		return false, fmt.Errorf("unknown power action %q", action)
+	}
+
+	err = s.withRetry(ctx, string(action), vmName, func(ctx context.Context) error {
+		task, err := start(ctx)
+		if err != nil {
+			return err
+		}
+		return task.Wait(ctx)
+	})
+	return err == nil, err
+}
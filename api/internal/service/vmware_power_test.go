@@ -0,0 +1,71 @@
+package service
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+func TestSetPowerState(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		svc, _ := newSimService(ctx, t, []*vim25.Client{c})
+		state := func() types.VirtualMachinePowerState {
+			vm, _, err := svc.lookupVM(ctx, "ha-host_VM0")
+			require.NoError(t, err)
+			s, err := vm.PowerState(ctx)
+			require.NoError(t, err)
+			return s
+		}
+
+		steps := []struct {
+			action  PowerAction
+			changed bool
+			want    types.VirtualMachinePowerState
+		}{
+			{PowerOff, true, types.VirtualMachinePowerStatePoweredOff},
+			{PowerOff, false, types.VirtualMachinePowerStatePoweredOff},
+			{Suspend, false, types.VirtualMachinePowerStatePoweredOff},
+			{PowerOn, true, types.VirtualMachinePowerStatePoweredOn},
+			{Suspend, true, types.VirtualMachinePowerStateSuspended},
+		}
+		for _, step := range steps {
+			changed, err := svc.SetPowerState(ctx, "ha-host_VM0", step.action)
+			require.NoError(t, err, step.action)
+			assert.Equal(t, step.changed, changed, step.action)
+			assert.Equal(t, step.want, state(), step.action)
+		}
+
+		_, err := svc.SetPowerState(ctx, "missing", PowerOn)
+		assert.Error(t, err)
+	}, simulator.ESX())
+}
+
+func TestPowerConfig_Defaults(t *testing.T) {
+	cfg := PowerConfig{AlwaysOn: []string{"Pod-1_OPNsense"}}
+	assert.Equal(t, 30, cfg.Warmup())
+	assert.Equal(t, PowerOff, cfg.Idle())
+	assert.True(t, cfg.IsAlwaysOn("Pod-1_OPNsense"))
+	assert.False(t, cfg.IsAlwaysOn("Pod-1_Client"))
+	assert.NoError(t, cfg.Validate())
+}
+
+func TestLoadFeatureConfig_InvalidIdleAction(t *testing.T) {
+	content := `
+[power]
+enabled = true
+idle_action = "hibernate"
+`
+	tmpFile := filepath.Join(t.TempDir(), "config.toml")
+	require.NoError(t, os.WriteFile(tmpFile, []byte(content), 0o644))
+
+	_, err := LoadFeatureConfig(tmpFile)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `idle_action must be "power_off" or "suspend"`)
+}
@@ -0,0 +1,187 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"reflect"
+	"syscall"
+	"time"
+
+	"github.com/EpicMandM/esxi-lab-provider/api/internal/logger"
+	"github.com/vmware/govmomi/fault"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// FaultClass tells whether a failed vSphere operation is worth retrying.
+type FaultClass string
+
+const (
+	// FaultTransient covers faults that usually clear on their own: another
+	// task holding the object, a busy or briefly disconnected host, or a
+	// dropped connection.
+	FaultTransient FaultClass = "transient"
+	// FaultPermanent covers everything else, e.g. NotFound or InvalidState.
+	// Unknown faults are treated as permanent so they are not retried blindly.
+	FaultPermanent FaultClass = "permanent"
+)
+
+// OperationError is returned when a vSphere operation fails for good, either
+// on a permanent fault or after transient retries ran out. It unwraps to the
+// last underlying error, so the original fault stays reachable through
+// errors.As and fault.As.
+type OperationError struct {
+	Op       string
+	VM       string
+	Attempts int
+	Class    FaultClass
+	// Fault is the first vSphere fault found in Err, or nil for non-fault
+	// errors such as network failures.
+	Fault types.BaseMethodFault
+	Err   error
+}
+
+func (e *OperationError) Error() string {
+	if name := faultName(e.Fault); name != "" {
+		return fmt.Sprintf("%s %s failed after %d attempt(s), %s fault %s: %v", e.Op, e.VM, e.Attempts, e.Class, name, e.Err)
+	}
+	return fmt.Sprintf("%s %s failed after %d attempt(s), %s: %v", e.Op, e.VM, e.Attempts, e.Class, e.Err)
+}
+
+func (e *OperationError) Unwrap() error { return e.Err }
+
+// retryPolicy controls retries of transient faults. The zero value makes a
+// single attempt.
+type retryPolicy struct {
+	MaxAttempts  int
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	// Deadline bounds the total time spent on one operation, retries included.
+	Deadline time.Duration
+}
+
+var defaultRetryPolicy = retryPolicy{
+	MaxAttempts:  6,
+	InitialDelay: 2 * time.Second,
+	MaxDelay:     30 * time.Second,
+	Deadline:     5 * time.Minute,
+}
+
+// backoff returns the jittered delay before retry number attempt (1-based):
+// exponential growth capped at MaxDelay, randomised to between half and all
+// of it so parallel runs do not retry in lockstep.
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	d := p.InitialDelay << (attempt - 1)
+	if d <= 0 || (p.MaxDelay > 0 && d > p.MaxDelay) {
+		d = p.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	half := d / 2
+	return half + rand.N(d-half+1)
+}
+
+// classifyFault returns the class of err and the first vSphere fault in it.
+func classifyFault(err error) (FaultClass, types.BaseMethodFault) {
+	var first types.BaseMethodFault
+	class := FaultPermanent
+	fault.In(err, func(f types.BaseMethodFault, _ string, _ []types.LocalizableMessage) bool {
+		if first == nil {
+			first = f
+		}
+		if isTransientFault(f) {
+			class = FaultTransient
+			return true
+		}
+		return false
+	})
+	if first != nil {
+		return class, first
+	}
+
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return FaultPermanent, nil
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		return FaultTransient, nil
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return FaultTransient, nil
+	}
+	return FaultPermanent, nil
+}
+
+func isTransientFault(f types.BaseMethodFault) bool {
+	switch f.(type) {
+	case *types.TaskInProgress,
+		*types.ConcurrentAccess,
+		*types.ResourceInUse,
+		*types.HostCommunication,
+		*types.HostNotConnected,
+		*types.HostNotReachable,
+		*types.NetworkDisruptedAndConfigRolledBack:
+		return true
+	}
+	return false
+}
+
+// faultName returns the vSphere type name of f, e.g. "TaskInProgress".
+func faultName(f types.BaseMethodFault) string {
+	if f == nil {
+		return ""
+	}
+	t := reflect.TypeOf(f)
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t.Name()
+}
+
+// withRetry runs fn until it succeeds, fails with a permanent fault, or the
+// policy's attempts or deadline run out. Failures are returned as
+// *OperationError.
+func (s *VMwareService) withRetry(ctx context.Context, op, vmName string, fn func(ctx context.Context) error) error {
+	p := s.retry
+	if p.Deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Deadline)
+		defer cancel()
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil {
+			return nil
+		}
+
+		class, f := classifyFault(err)
+		opErr := &OperationError{Op: op, VM: vmName, Attempts: attempt, Class: class, Fault: f, Err: err}
+		if class != FaultTransient || attempt >= p.MaxAttempts {
+			return opErr
+		}
+
+		delay := p.backoff(attempt)
+		s.logger.Warn("vSphere operation failed, retrying",
+			logger.Action(op),
+			logger.VM(vmName),
+			logger.F("ATTEMPT", attempt),
+			logger.F("FAULT", faultName(f)),
+			logger.F("RETRY_IN", delay),
+			logger.Error(err))
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			opErr.Err = fmt.Errorf("%w (retry deadline: %v)", err, ctx.Err())
+			return opErr
+		case <-timer.C:
+		}
+	}
+}
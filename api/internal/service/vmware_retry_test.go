@@ -0,0 +1,161 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/EpicMandM/esxi-lab-provider/api/internal/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware/govmomi/fault"
+	"github.com/vmware/govmomi/task"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+func taskFault(f types.BaseMethodFault) error {
+	return task.Error{LocalizedMethodFault: &types.LocalizedMethodFault{Fault: f}}
+}
+
+func TestClassifyFault(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		wantClass FaultClass
+		wantFault string
+	}{
+		{"task in progress from task", fmt.Errorf("revert task failed: %w", taskFault(&types.TaskInProgress{})), FaultTransient, "TaskInProgress"},
+		{"host not connected from vim fault", soap.WrapVimFault(&types.HostNotConnected{}), FaultTransient, "HostNotConnected"},
+		{"resource in use", taskFault(&types.ResourceInUse{}), FaultTransient, "ResourceInUse"},
+		{"not found", soap.WrapVimFault(&types.NotFound{}), FaultPermanent, "NotFound"},
+		{"invalid state", taskFault(&types.InvalidState{}), FaultPermanent, "InvalidState"},
+		{"unknown fault is permanent", taskFault(&types.NoPermission{}), FaultPermanent, "NoPermission"},
+		{
+			"transient cause under permanent fault",
+			taskFault(&types.SystemError{RuntimeFault: types.RuntimeFault{MethodFault: types.MethodFault{
+				FaultCause: &types.LocalizedMethodFault{Fault: &types.TaskInProgress{}},
+			}}}),
+			FaultTransient, "SystemError",
+		},
+		{"connection reset", &url.Error{Op: "Post", URL: "https://esxi/sdk", Err: syscall.ECONNRESET}, FaultTransient, ""},
+		{"unexpected EOF", fmt.Errorf("read response: %w", io.ErrUnexpectedEOF), FaultTransient, ""},
+		{"context canceled", context.Canceled, FaultPermanent, ""},
+		{"plain error", errors.New("VM not found"), FaultPermanent, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			class, f := classifyFault(tt.err)
+			assert.Equal(t, tt.wantClass, class)
+			assert.Equal(t, tt.wantFault, faultName(f))
+		})
+	}
+}
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	p := retryPolicy{InitialDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+
+	for attempt, max := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 4: 800 * time.Millisecond, 10: time.Second} {
+		for range 20 {
+			d := p.backoff(attempt)
+			assert.GreaterOrEqual(t, d, max/2, "attempt %d", attempt)
+			assert.LessOrEqual(t, d, max, "attempt %d", attempt)
+		}
+	}
+	assert.Zero(t, retryPolicy{}.backoff(1))
+}
+
+func newRetryService(p retryPolicy) (*VMwareService, *bytes.Buffer) {
+	var buf bytes.Buffer
+	return &VMwareService{retry: p, logger: logger.NewWithWriter(&buf)}, &buf
+}
+
+func TestWithRetry_TransientThenSuccess(t *testing.T) {
+	svc, buf := newRetryService(retryPolicy{MaxAttempts: 5, InitialDelay: time.Millisecond, MaxDelay: time.Millisecond})
+	calls := 0
+
+	err := svc.withRetry(context.Background(), "vm_restore", "vm1", func(ctx context.Context) error {
+		calls++
+		if calls < 3 {
+			return taskFault(&types.TaskInProgress{})
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 3, calls)
+	assert.Contains(t, buf.String(), "vSphere operation failed, retrying")
+	assert.Contains(t, buf.String(), "FAULT=TaskInProgress")
+}
+
+func TestWithRetry_PermanentNotRetried(t *testing.T) {
+	svc, _ := newRetryService(retryPolicy{MaxAttempts: 5, InitialDelay: time.Millisecond})
+	calls := 0
+
+	err := svc.withRetry(context.Background(), "vm_restore", "vm1", func(ctx context.Context) error {
+		calls++
+		return fmt.Errorf("revert task failed: %w", taskFault(&types.InvalidState{}))
+	})
+	require.Error(t, err)
+	assert.Equal(t, 1, calls)
+
+	var opErr *OperationError
+	require.True(t, errors.As(err, &opErr))
+	assert.Equal(t, FaultPermanent, opErr.Class)
+	assert.Equal(t, 1, opErr.Attempts)
+	assert.Equal(t, "vm1", opErr.VM)
+	assert.IsType(t, &types.InvalidState{}, opErr.Fault)
+	assert.True(t, fault.Is(err, &types.InvalidState{}))
+	assert.Contains(t, err.Error(), "vm_restore vm1 failed after 1 attempt(s), permanent fault InvalidState")
+}
+
+func TestWithRetry_AttemptsExhausted(t *testing.T) {
+	svc, _ := newRetryService(retryPolicy{MaxAttempts: 3, InitialDelay: time.Millisecond, MaxDelay: time.Millisecond})
+	calls := 0
+
+	err := svc.withRetry(context.Background(), "password_rotate", "vm1", func(ctx context.Context) error {
+		calls++
+		return soap.WrapVimFault(&types.HostNotConnected{})
+	})
+	require.Error(t, err)
+	assert.Equal(t, 3, calls)
+
+	var opErr *OperationError
+	require.True(t, errors.As(err, &opErr))
+	assert.Equal(t, FaultTransient, opErr.Class)
+	assert.Equal(t, 3, opErr.Attempts)
+	assert.True(t, fault.Is(err, &types.HostNotConnected{}))
+}
+
+func TestWithRetry_DeadlineStopsRetries(t *testing.T) {
+	svc, _ := newRetryService(retryPolicy{MaxAttempts: 100, InitialDelay: 50 * time.Millisecond, MaxDelay: 50 * time.Millisecond, Deadline: 80 * time.Millisecond})
+	calls := 0
+
+	start := time.Now()
+	err := svc.withRetry(context.Background(), "vm_restore", "vm1", func(ctx context.Context) error {
+		calls++
+		return taskFault(&types.TaskInProgress{})
+	})
+	require.Error(t, err)
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Less(t, calls, 100)
+	assert.Contains(t, err.Error(), "retry deadline")
+	assert.True(t, fault.Is(err, &types.TaskInProgress{}))
+}
+
+func TestWithRetry_ZeroPolicySingleAttempt(t *testing.T) {
+	svc, _ := newRetryService(retryPolicy{})
+	calls := 0
+
+	err := svc.withRetry(context.Background(), "vm_restore", "vm1", func(ctx context.Context) error {
+		calls++
+		return taskFault(&types.TaskInProgress{})
+	})
+	require.Error(t, err)
+	assert.Equal(t, 1, calls)
+}
@@ -0,0 +1,141 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/EpicMandM/esxi-lab-provider/api/internal/logger"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// CaptureScreenshot waits up to readyTimeout for VMware Tools to report
+// running in the guest, then takes a console screenshot of vmName through
+// CreateScreenshot, downloads it from the VM's datastore to path and removes
+// it from the datastore. The screenshot is taken even when the guest does
+// not become ready, since it then shows where the boot is stuck; ready
+// reports whether it did. Powered-off VMs have no console and return an
+// error.
+func (s *VMwareService) CaptureScreenshot(ctx context.Context, vmName, path string, readyTimeout time.Duration) (bool, error) {
+	vm, _, err := s.lookupVM(ctx, vmName)
+	if err != nil {
+		return false, err
+	}
+
+	state, err := vm.PowerState(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to read power state: %w", err)
+	}
+	if state != types.VirtualMachinePowerStatePoweredOn {
+		return false, fmt.Errorf("VM is %s, no console to capture", state)
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, readyTimeout)
+	ready := waitForGuestTools(waitCtx, vm) == nil
+	cancel()
+
+	var dsPath string
+	err = s.withRetry(ctx, "screenshot", vmName, func(ctx context.Context) error {
+		res, err := methods.CreateScreenshot_Task(ctx, vm.Client(), &types.CreateScreenshot_Task{This: vm.Reference()})
+		if err != nil {
+			return err
+		}
+		info, err := object.NewTask(vm.Client(), res.Returnval).WaitForResult(ctx)
+		if err != nil {
+			return err
+		}
+		p, ok := info.Result.(string)
+		if !ok {
+			return fmt.Errorf("screenshot task returned no file")
+		}
+		dsPath = p
+		return nil
+	})
+	if err != nil {
+		return ready, err
+	}
+
+	ds, file, err := screenshotDatastore(ctx, vm, dsPath)
+	if err != nil {
+		return ready, err
+	}
+	if err := downloadDatastoreFile(ctx, ds, file, path); err != nil {
+		return ready, err
+	}
+
+	if err := deleteDatastoreFile(ctx, ds, dsPath); err != nil {
+		s.logger.Warn("Screenshot left on datastore", logger.VM(vmName), logger.F("FILE", dsPath), logger.Error(err))
+	}
+	return ready, nil
+}
+
+// screenshotDatastore resolves "[datastore] path" to one of the VM's
+// datastores, with the inventory path set so it can be downloaded from.
+func screenshotDatastore(ctx context.Context, vm *object.VirtualMachine, dsPath string) (*object.Datastore, string, error) {
+	var p object.DatastorePath
+	if !p.FromString(dsPath) {
+		return nil, "", fmt.Errorf("unexpected screenshot path %q", dsPath)
+	}
+
+	var mvm mo.VirtualMachine
+	if err := vm.Properties(ctx, vm.Reference(), []string{"datastore"}, &mvm); err != nil {
+		return nil, "", fmt.Errorf("failed to read VM datastores: %w", err)
+	}
+	for _, ref := range mvm.Datastore {
+		ds := object.NewDatastore(vm.Client(), ref)
+		name, err := ds.ObjectName(ctx)
+		if err != nil || name != p.Datastore {
+			continue
+		}
+		if err := ds.FindInventoryPath(ctx); err != nil {
+			return nil, "", fmt.Errorf("failed to locate datastore %s: %w", name, err)
+		}
+		return ds, p.Path, nil
+	}
+	return nil, "", fmt.Errorf("datastore %s not found for VM", p.Datastore)
+}
+
+func downloadDatastoreFile(ctx context.Context, ds *object.Datastore, file, path string) error {
+	r, _, err := ds.Download(ctx, file, &soap.DefaultDownload)
+	if err != nil {
+		return fmt.Errorf("failed to download screenshot: %w", err)
+	}
+	defer r.Close()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to save screenshot: %w", err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to save screenshot: %w", err)
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to save screenshot: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to save screenshot: %w", err)
+	}
+	return nil
+}
+
+func deleteDatastoreFile(ctx context.Context, ds *object.Datastore, dsPath string) error {
+	c := ds.Client()
+	dc, err := find.NewFinder(c).Datacenter(ctx, ds.DatacenterPath)
+	if err != nil {
+		return err
+	}
+	task, err := object.NewFileManager(c).DeleteDatastoreFile(ctx, dsPath, dc)
+	if err != nil {
+		return err
+	}
+	return task.Wait(ctx)
+}
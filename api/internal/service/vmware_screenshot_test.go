@@ -0,0 +1,67 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// screenshotVM adds CreateScreenshot, which the simulator does not
+// implement, returning a file uploaded to the datastore beforehand.
+type screenshotVM struct {
+	*simulator.VirtualMachine
+	file string
+}
+
+func (vm *screenshotVM) CreateScreenshotTask(ctx *simulator.Context, req *types.CreateScreenshot_Task) soap.HasFault {
+	task := simulator.CreateTask(req.This, "createScreenshot", func(*simulator.Task) (types.AnyType, types.BaseMethodFault) {
+		return vm.file, nil
+	})
+	return &methods.CreateScreenshot_TaskBody{
+		Res: &types.CreateScreenshot_TaskResponse{Returnval: task.Run(ctx)},
+	}
+}
+
+func TestCaptureScreenshot(t *testing.T) {
+	model := simulator.ESX()
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		svc, _ := newSimService(ctx, t, []*vim25.Client{c})
+		ds, err := find.NewFinder(c).DefaultDatastore(ctx)
+		require.NoError(t, err)
+		png := []byte("\x89PNG console")
+		require.NoError(t, ds.Upload(ctx, bytes.NewReader(png), "ha-host_VM0/ha-host_VM0-1.png", &soap.DefaultUpload))
+
+		vm0, _, err := svc.lookupVM(ctx, "ha-host_VM0")
+		require.NoError(t, err)
+		obj := model.Map().Get(vm0.Reference()).(*simulator.VirtualMachine)
+		obj.Guest.ToolsRunningStatus = string(types.VirtualMachineToolsRunningStatusGuestToolsRunning)
+		model.Map().Put(&screenshotVM{VirtualMachine: obj, file: ds.Path("ha-host_VM0/ha-host_VM0-1.png")})
+
+		path := filepath.Join(t.TempDir(), "run", "ha-host_VM0.png")
+		ready, err := svc.CaptureScreenshot(ctx, "ha-host_VM0", path, time.Second)
+		require.NoError(t, err)
+		assert.True(t, ready)
+		saved, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, png, saved)
+		_, err = ds.Stat(ctx, "ha-host_VM0/ha-host_VM0-1.png")
+		assert.Error(t, err, "screenshot removed from the datastore")
+
+		_, err = svc.SetPowerState(ctx, "ha-host_VM1", PowerOff)
+		require.NoError(t, err)
+		_, err = svc.CaptureScreenshot(ctx, "ha-host_VM1", filepath.Join(t.TempDir(), "vm1.png"), time.Second)
+		assert.EqualError(t, err, "VM is poweredOff, no console to capture")
+	}, model)
+}
@@ -0,0 +1,62 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// TerminateUserSessions ends every session username holds on the host
+// running vmName, such as a Host Client login left open by the previous
+// student, and returns the sessions it ended. Lab users are local ESXi
+// accounts, so their sessions live on the same direct host connection used
+// for password rotation. The service's own session is never terminated.
+func (s *VMwareService) TerminateUserSessions(ctx context.Context, vmName, username string) ([]types.UserSession, error) {
+	_, loc, err := s.lookupVM(ctx, vmName)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := s.accountConnection(loc)
+	if err != nil {
+		return nil, err
+	}
+	if conn.client.ServiceContent.SessionManager == nil {
+		return nil, fmt.Errorf("endpoint %s has no SessionManager", conn.name)
+	}
+
+	var sm mo.SessionManager
+	pc := property.DefaultCollector(conn.client.Client)
+	if err := pc.RetrieveOne(ctx, *conn.client.ServiceContent.SessionManager, []string{"sessionList"}, &sm); err != nil {
+		return nil, fmt.Errorf("failed to list sessions on %s: %w", conn.name, err)
+	}
+
+	own := ""
+	if current, err := conn.client.SessionManager.UserSession(ctx); err == nil && current != nil {
+		own = current.Key
+	}
+
+	var sessions []types.UserSession
+	var keys []string
+	for _, us := range sm.SessionList {
+		if us.Key == own || !strings.EqualFold(us.UserName, username) {
+			continue
+		}
+		sessions = append(sessions, us)
+		keys = append(keys, us.Key)
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	err = s.withRetry(ctx, "session_terminate", vmName, func(ctx context.Context) error {
+		return conn.client.SessionManager.TerminateSession(ctx, keys)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to terminate sessions of %s on %s: %w", username, conn.name, err)
+	}
+	return sessions, nil
+}
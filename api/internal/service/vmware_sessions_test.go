@@ -0,0 +1,43 @@
+package service
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25"
+)
+
+func TestTerminateUserSessions(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		svc, buf := newSimService(ctx, t, []*vim25.Client{c})
+
+		u := *c.URL()
+		u.User = url.UserPassword("lab-user-1", "old-password")
+		student, err := govmomi.NewClient(ctx, &u, true)
+		require.NoError(t, err)
+
+		sessions, err := svc.TerminateUserSessions(ctx, "ha-host_VM0", "lab-user-1")
+		require.NoError(t, err)
+		require.Len(t, sessions, 1)
+		assert.Equal(t, "lab-user-1", sessions[0].UserName)
+
+		gone, err := student.SessionManager.UserSession(ctx)
+		require.NoError(t, err)
+		assert.Nil(t, gone, "student session ended")
+		own, err := svc.conns[0].client.SessionManager.UserSession(ctx)
+		require.NoError(t, err)
+		assert.NotNil(t, own, "service session kept")
+
+		sessions, err = svc.TerminateUserSessions(ctx, "ha-host_VM0", "lab-user-1")
+		require.NoError(t, err)
+		assert.Empty(t, sessions)
+
+		svc.endUserSessions(ctx, "missing", "lab-user-1")
+		assert.Contains(t, buf.String(), "MESSAGE=Session termination failed")
+	}, simulator.ESX())
+}
@@ -0,0 +1,292 @@
+package service
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/EpicMandM/esxi-lab-provider/api/internal/logger"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// Snapshot chain warning kinds, used as the kind attribute of snapshot
+// warning metrics.
+const (
+	SnapshotWarnConsolidation = "consolidation_needed"
+	SnapshotWarnDeepChain     = "deep_chain"
+	SnapshotWarnLargeDelta    = "large_delta"
+	SnapshotWarnLowDatastore  = "low_datastore_space"
+)
+
+const (
+	defaultMaxSnapshotDepth        = 5
+	defaultMaxDeltaMB              = 20 * 1024
+	defaultMinDatastoreFreePercent = 10
+	defaultConsolidateQuietMinutes = 60
+)
+
+// SnapshotHealthConfig controls snapshot chain checks from the
+// [snapshot_health] section of user_config.toml.
+type SnapshotHealthConfig struct {
+	Enabled bool `toml:"enabled"`
+	// MaxDepth is the deepest acceptable chain of snapshots above the base
+	// disk (default 5).
+	MaxDepth int `toml:"max_depth"`
+	// MaxDeltaMB is the largest acceptable total size of a VM's delta disks
+	// (default 20480).
+	MaxDeltaMB int64 `toml:"max_delta_mb"`
+	// MinDatastoreFreePercent is the free space below which a datastore
+	// holding a pod VM is reported (default 10).
+	MinDatastoreFreePercent float64 `toml:"min_datastore_free_percent"`
+	// Consolidate consolidates the disks of VMs that need it, as long as
+	// their pod has no booking active or starting within QuietMinutes.
+	Consolidate bool `toml:"consolidate"`
+	// QuietMinutes is how far ahead a pod must be free of bookings before
+	// its disks are consolidated (default 60).
+	QuietMinutes int `toml:"quiet_minutes"`
+}
+
+func (c SnapshotHealthConfig) maxDepth() int {
+	if c.MaxDepth <= 0 {
+		return defaultMaxSnapshotDepth
+	}
+	return c.MaxDepth
+}
+
+func (c SnapshotHealthConfig) maxDeltaMB() int64 {
+	if c.MaxDeltaMB <= 0 {
+		return defaultMaxDeltaMB
+	}
+	return c.MaxDeltaMB
+}
+
+func (c SnapshotHealthConfig) minFreePercent() float64 {
+	if c.MinDatastoreFreePercent <= 0 {
+		return defaultMinDatastoreFreePercent
+	}
+	return c.MinDatastoreFreePercent
+}
+
+// Quiet returns QuietMinutes, or the default when unset.
+func (c SnapshotHealthConfig) Quiet() int {
+	if c.QuietMinutes <= 0 {
+		return defaultConsolidateQuietMinutes
+	}
+	return c.QuietMinutes
+}
+
+// DatastoreSpace is the size and free space of a datastore.
+type DatastoreSpace struct {
+	Name       string
+	CapacityMB int64
+	FreeMB     int64
+}
+
+// FreePercent returns the free share of the datastore.
+func (d DatastoreSpace) FreePercent() float64 {
+	if d.CapacityMB <= 0 {
+		return 0
+	}
+	return float64(d.FreeMB) / float64(d.CapacityMB) * 100
+}
+
+// VMSnapshotHealth is the state of one VM's snapshot chain.
+type VMSnapshotHealth struct {
+	VM                  string
+	ConsolidationNeeded bool
+	// SnapshotDepth is the number of snapshots from the root of the tree to
+	// the one the VM runs from.
+	SnapshotDepth int
+	// DeltaDiskMB is the total size of the VM's delta disks.
+	DeltaDiskMB int64
+	Datastores  []DatastoreSpace
+}
+
+// SnapshotWarning is one problem found in a VM's snapshot chain.
+type SnapshotWarning struct {
+	Kind    string
+	VM      string
+	Message string
+}
+
+func (w SnapshotWarning) String() string { return w.Message }
+
+// Warnings checks the chain against the configured limits and returns every
+// problem found; an empty result means the chain is healthy.
+func (h VMSnapshotHealth) Warnings(cfg SnapshotHealthConfig) []SnapshotWarning {
+	var warnings []SnapshotWarning
+	if h.ConsolidationNeeded {
+		warnings = append(warnings, SnapshotWarning{
+			Kind:    SnapshotWarnConsolidation,
+			VM:      h.VM,
+			Message: fmt.Sprintf("%s needs disk consolidation", h.VM),
+		})
+	}
+	if limit := cfg.maxDepth(); h.SnapshotDepth > limit {
+		warnings = append(warnings, SnapshotWarning{
+			Kind:    SnapshotWarnDeepChain,
+			VM:      h.VM,
+			Message: fmt.Sprintf("%s runs from snapshot depth %d, limit %d", h.VM, h.SnapshotDepth, limit),
+		})
+	}
+	if limit := cfg.maxDeltaMB(); h.DeltaDiskMB > limit {
+		warnings = append(warnings, SnapshotWarning{
+			Kind:    SnapshotWarnLargeDelta,
+			VM:      h.VM,
+			Message: fmt.Sprintf("%s has %d MB of delta disks, limit %d MB", h.VM, h.DeltaDiskMB, limit),
+		})
+	}
+	for _, ds := range h.Datastores {
+		if free := ds.FreePercent(); free < cfg.minFreePercent() {
+			warnings = append(warnings, SnapshotWarning{
+				Kind:    SnapshotWarnLowDatastore,
+				VM:      h.VM,
+				Message: fmt.Sprintf("datastore %s of %s has %.1f%% free (%d MB)", ds.Name, h.VM, free, ds.FreeMB),
+			})
+		}
+	}
+	return warnings
+}
+
+// SnapshotHealth reads the snapshot chain state of the given VMs: whether
+// vSphere flags them for consolidation, their snapshot depth, the size of
+// their delta disks and the free space of their datastores. VMs that cannot
+// be found are logged and left out.
+func (s *VMwareService) SnapshotHealth(ctx context.Context, vmNames []string) ([]VMSnapshotHealth, error) {
+	byConn := make(map[*hostConnection][]types.ManagedObjectReference)
+	names := make(map[types.ManagedObjectReference]string)
+	var order []*hostConnection
+	for _, name := range vmNames {
+		vm, loc, err := s.lookupVM(ctx, name)
+		if err != nil {
+			s.logger.Warn("Snapshot health unavailable", logger.VM(name), logger.Error(err))
+			continue
+		}
+		if _, ok := byConn[loc.conn]; !ok {
+			order = append(order, loc.conn)
+		}
+		byConn[loc.conn] = append(byConn[loc.conn], vm.Reference())
+		names[vm.Reference()] = name
+	}
+
+	var health []VMSnapshotHealth
+	for _, conn := range order {
+		pc := property.DefaultCollector(conn.client.Client)
+		var vms []mo.VirtualMachine
+		if err := pc.Retrieve(ctx, byConn[conn], []string{"runtime.consolidationNeeded", "snapshot", "layoutEx", "datastore"}, &vms); err != nil {
+			return health, fmt.Errorf("failed to read snapshot state on %s: %w", conn.name, err)
+		}
+
+		var dsRefs []types.ManagedObjectReference
+		seen := make(map[types.ManagedObjectReference]bool)
+		for _, vm := range vms {
+			for _, ref := range vm.Datastore {
+				if !seen[ref] {
+					seen[ref] = true
+					dsRefs = append(dsRefs, ref)
+				}
+			}
+		}
+		space := make(map[types.ManagedObjectReference]DatastoreSpace)
+		if len(dsRefs) > 0 {
+			var datastores []mo.Datastore
+			if err := pc.Retrieve(ctx, dsRefs, []string{"summary"}, &datastores); err != nil {
+				return health, fmt.Errorf("failed to read datastore space on %s: %w", conn.name, err)
+			}
+			for _, ds := range datastores {
+				space[ds.Self] = DatastoreSpace{
+					Name:       ds.Summary.Name,
+					CapacityMB: ds.Summary.Capacity / (1024 * 1024),
+					FreeMB:     ds.Summary.FreeSpace / (1024 * 1024),
+				}
+			}
+		}
+
+		for _, vm := range vms {
+			h := VMSnapshotHealth{
+				VM:                  names[vm.Self],
+				ConsolidationNeeded: vm.Runtime.ConsolidationNeeded,
+				DeltaDiskMB:         deltaDiskBytes(vm.LayoutEx) / (1024 * 1024),
+			}
+			if vm.Snapshot != nil {
+				h.SnapshotDepth = snapshotDepth(vm.Snapshot.RootSnapshotList, vm.Snapshot.CurrentSnapshot)
+			}
+			for _, ref := range vm.Datastore {
+				if ds, ok := space[ref]; ok {
+					h.Datastores = append(h.Datastores, ds)
+				}
+			}
+			health = append(health, h)
+		}
+	}
+	return health, nil
+}
+
+// snapshotDepth returns the 1-based depth of current in the snapshot tree,
+// or the depth of the deepest snapshot when the VM runs from none.
+func snapshotDepth(tree []types.VirtualMachineSnapshotTree, current *types.ManagedObjectReference) int {
+	deepest := 0
+	var walk func(nodes []types.VirtualMachineSnapshotTree, depth int) int
+	walk = func(nodes []types.VirtualMachineSnapshotTree, depth int) int {
+		for _, n := range nodes {
+			if current != nil && n.Snapshot == *current {
+				return depth
+			}
+			deepest = max(deepest, depth)
+			if d := walk(n.ChildSnapshotList, depth+1); d > 0 {
+				return d
+			}
+		}
+		return 0
+	}
+	if d := walk(tree, 1); d > 0 {
+		return d
+	}
+	return deepest
+}
+
+// deltaDiskBytes sums the files of every disk's chain except its base disk.
+// The chain lists the base disk first and the running delta last.
+func deltaDiskBytes(layout *types.VirtualMachineFileLayoutEx) int64 {
+	if layout == nil {
+		return 0
+	}
+	sizes := make(map[int32]int64)
+	for _, f := range layout.File {
+		sizes[f.Key] = f.Size
+	}
+	counted := make(map[int32]bool)
+	var total int64
+	for _, disk := range layout.Disk {
+		if len(disk.Chain) < 2 {
+			continue
+		}
+		for _, unit := range disk.Chain[1:] {
+			for _, key := range unit.FileKey {
+				if !counted[key] {
+					counted[key] = true
+					total += sizes[key]
+				}
+			}
+		}
+	}
+	return total
+}
+
+// ConsolidateDisks merges the VM's redundant delta disks into their parents.
+func (s *VMwareService) ConsolidateDisks(ctx context.Context, vmName string) error {
+	vm, _, err := s.lookupVM(ctx, vmName)
+	if err != nil {
+		return err
+	}
+	return s.withRetry(ctx, "consolidate", vmName, func(ctx context.Context) error {
+		res, err := methods.ConsolidateVMDisks_Task(ctx, vm.Client(), &types.ConsolidateVMDisks_Task{This: vm.Reference()})
+		if err != nil {
+			return err
+		}
+		return object.NewTask(vm.Client(), res.Returnval).Wait(ctx)
+	})
+}
@@ -0,0 +1,94 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+func TestSnapshotHealth(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		svc, buf := newSimService(ctx, t, []*vim25.Client{c})
+		vm, _, err := svc.lookupVM(ctx, "ha-host_VM0")
+		require.NoError(t, err)
+		for _, name := range []string{"golden", "patched"} {
+			task, err := vm.CreateSnapshot(ctx, name, "", false, false)
+			require.NoError(t, err)
+			require.NoError(t, task.Wait(ctx))
+		}
+
+		health, err := svc.SnapshotHealth(ctx, []string{"ha-host_VM0", "ha-host_VM1", "missing"})
+		require.NoError(t, err)
+		require.Len(t, health, 2)
+		byVM := map[string]VMSnapshotHealth{health[0].VM: health[0], health[1].VM: health[1]}
+
+		assert.Equal(t, 2, byVM["ha-host_VM0"].SnapshotDepth)
+		assert.Equal(t, 0, byVM["ha-host_VM1"].SnapshotDepth)
+		assert.False(t, byVM["ha-host_VM0"].ConsolidationNeeded)
+		require.NotEmpty(t, byVM["ha-host_VM0"].Datastores)
+		assert.Positive(t, byVM["ha-host_VM0"].Datastores[0].CapacityMB)
+		assert.Contains(t, buf.String(), "MESSAGE=Snapshot health unavailable VM=missing")
+	}, simulator.ESX())
+}
+
+func TestVMSnapshotHealth_Warnings(t *testing.T) {
+	h := VMSnapshotHealth{
+		VM:                  "Pod-1_FortiGate",
+		ConsolidationNeeded: true,
+		SnapshotDepth:       6,
+		DeltaDiskMB:         30000,
+		Datastores: []DatastoreSpace{
+			{Name: "ssd", CapacityMB: 1000, FreeMB: 50},
+			{Name: "hdd", CapacityMB: 1000, FreeMB: 500},
+		},
+	}
+	var kinds []string
+	for _, w := range h.Warnings(SnapshotHealthConfig{}) {
+		kinds = append(kinds, w.Kind)
+	}
+	assert.Equal(t, []string{SnapshotWarnConsolidation, SnapshotWarnDeepChain, SnapshotWarnLargeDelta, SnapshotWarnLowDatastore}, kinds)
+	assert.Equal(t, "datastore ssd of Pod-1_FortiGate has 5.0% free (50 MB)", h.Warnings(SnapshotHealthConfig{})[3].String())
+
+	cfg := SnapshotHealthConfig{MaxDepth: 10, MaxDeltaMB: 40000, MinDatastoreFreePercent: 4}
+	h.ConsolidationNeeded = false
+	assert.Empty(t, h.Warnings(cfg))
+}
+
+func TestSnapshotDepth(t *testing.T) {
+	ref := func(v string) types.ManagedObjectReference {
+		return types.ManagedObjectReference{Type: "VirtualMachineSnapshot", Value: v}
+	}
+	tree := []types.VirtualMachineSnapshotTree{{
+		Snapshot: ref("a"),
+		ChildSnapshotList: []types.VirtualMachineSnapshotTree{
+			{Snapshot: ref("b"), ChildSnapshotList: []types.VirtualMachineSnapshotTree{{Snapshot: ref("c")}}},
+			{Snapshot: ref("d")},
+		},
+	}}
+	current := ref("d")
+	assert.Equal(t, 2, snapshotDepth(tree, &current))
+	assert.Equal(t, 3, snapshotDepth(tree, nil), "deepest snapshot without a current one")
+	assert.Equal(t, 0, snapshotDepth(nil, nil))
+}
+
+func TestDeltaDiskBytes(t *testing.T) {
+	layout := &types.VirtualMachineFileLayoutEx{
+		File: []types.VirtualMachineFileLayoutExFileInfo{
+			{Key: 1, Size: 4 << 30},   // base
+			{Key: 2, Size: 50 << 20},  // delta 1
+			{Key: 3, Size: 100 << 20}, // delta 2
+			{Key: 4, Size: 2 << 30},   // second disk's base
+		},
+		Disk: []types.VirtualMachineFileLayoutExDiskLayout{
+			{Key: 2000, Chain: []types.VirtualMachineFileLayoutExDiskUnit{{FileKey: []int32{1}}, {FileKey: []int32{2}}, {FileKey: []int32{3}}}},
+			{Key: 2001, Chain: []types.VirtualMachineFileLayoutExDiskUnit{{FileKey: []int32{4}}}},
+		},
+	}
+	assert.Equal(t, int64(150<<20), deltaDiskBytes(layout))
+	assert.Zero(t, deltaDiskBytes(nil))
+}
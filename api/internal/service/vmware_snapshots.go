@@ -0,0 +1,196 @@
+package service
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const (
+	snapshotLatest  = "<latest>"
+	snapshotCurrent = "<current>"
+)
+
+// SnapshotRule chooses the snapshot for VMs whose name starts with one of
+// VMPrefixes or ends with "_" followed by one of Roles (role "FortiGate"
+// matches "Pod-1_FortiGate"). Snapshot is one of:
+//
+//	<latest>         newest snapshot (the default)
+//	<current>        the snapshot the VM is currently running from
+//	glob:PATTERN     newest snapshot whose name matches the glob
+//	regex:PATTERN    newest snapshot whose name matches the regular expression
+//	NAME             the snapshot with exactly this name
+//
+// Before restricts <latest>, glob: and regex: to snapshots created before
+// the given date.
+type SnapshotRule struct {
+	VMPrefixes []string   `toml:"vm_prefixes"`
+	Roles      []string   `toml:"roles"`
+	Snapshot   string     `toml:"snapshot"`
+	Before     *time.Time `toml:"before"`
+}
+
+// matches reports whether the rule applies to vmName.
+func (r *SnapshotRule) matches(vmName string) bool {
+	for _, prefix := range r.VMPrefixes {
+		if strings.HasPrefix(vmName, prefix) {
+			return true
+		}
+	}
+	for _, role := range r.Roles {
+		if strings.HasSuffix(vmName, "_"+role) {
+			return true
+		}
+	}
+	return false
+}
+
+// String describes the rule's selection for logs, e.g. "glob:clean-*
+// before 2025-09-01".
+func (r SnapshotRule) String() string {
+	s := r.Snapshot
+	if s == "" {
+		s = snapshotLatest
+	}
+	if r.Before != nil {
+		s += " before " + r.Before.Format(time.DateOnly)
+	}
+	return s
+}
+
+// SnapshotPolicy chooses the snapshot each VM is reverted to: the first
+// matching rule, or Default for VMs without one.
+type SnapshotPolicy struct {
+	Default string
+	Rules   []SnapshotRule
+}
+
+// For returns the rule that applies to vmName.
+func (p SnapshotPolicy) For(vmName string) SnapshotRule {
+	for _, r := range p.Rules {
+		if r.matches(vmName) {
+			return r
+		}
+	}
+	return SnapshotRule{Snapshot: p.Default}
+}
+
+// Validate checks that every selector in the policy can be parsed.
+func (p SnapshotPolicy) Validate() error {
+	if _, err := parseSnapshotSelector(SnapshotRule{Snapshot: p.Default}); err != nil {
+		return fmt.Errorf("snapshot_name: %w", err)
+	}
+	for i, r := range p.Rules {
+		if len(r.VMPrefixes) == 0 && len(r.Roles) == 0 {
+			return fmt.Errorf("snapshot_rules[%d]: vm_prefixes or roles is required", i)
+		}
+		if _, err := parseSnapshotSelector(r); err != nil {
+			return fmt.Errorf("snapshot_rules[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// SnapshotPolicy returns the snapshot policy configured by snapshot_name
+// and snapshot_rules.
+func (c *ESXiConfig) SnapshotPolicy() SnapshotPolicy {
+	p := SnapshotPolicy{Default: snapshotLatest, Rules: c.SnapshotRules}
+	if c.SnapshotName != nil {
+		p.Default = *c.SnapshotName
+	}
+	return p
+}
+
+// snapshotSelector picks a snapshot from a VM's snapshot tree.
+type snapshotSelector struct {
+	rule    SnapshotRule
+	current bool
+	exact   string
+	match   func(name string) bool // nil matches every name
+}
+
+func parseSnapshotSelector(r SnapshotRule) (snapshotSelector, error) {
+	sel := snapshotSelector{rule: r}
+	switch s := r.Snapshot; {
+	case s == "" || s == snapshotLatest:
+	case s == snapshotCurrent:
+		sel.current = true
+	case strings.HasPrefix(s, "glob:"):
+		pattern := strings.TrimPrefix(s, "glob:")
+		if _, err := path.Match(pattern, ""); err != nil {
+			return sel, fmt.Errorf("invalid glob %q: %w", pattern, err)
+		}
+		sel.match = func(name string) bool {
+			ok, _ := path.Match(pattern, name)
+			return ok
+		}
+	case strings.HasPrefix(s, "regex:"):
+		re, err := regexp.Compile(strings.TrimPrefix(s, "regex:"))
+		if err != nil {
+			return sel, fmt.Errorf("invalid regex: %w", err)
+		}
+		sel.match = re.MatchString
+	default:
+		sel.exact = s
+	}
+	if r.Before != nil && (sel.current || sel.exact != "") {
+		return sel, fmt.Errorf("before cannot be combined with %q", r.Snapshot)
+	}
+	return sel, nil
+}
+
+// selectFrom returns the snapshot chosen from tree. current is the VM's
+// current snapshot, if any.
+func (sel snapshotSelector) selectFrom(tree []types.VirtualMachineSnapshotTree, current *types.ManagedObjectReference) (*types.VirtualMachineSnapshotTree, error) {
+	if len(tree) == 0 {
+		return nil, fmt.Errorf("no snapshots found")
+	}
+
+	switch {
+	case sel.current:
+		if current == nil {
+			return nil, fmt.Errorf("VM has no current snapshot")
+		}
+		if node := findSnapshotByRef(tree, *current); node != nil {
+			return node, nil
+		}
+		return nil, fmt.Errorf("current snapshot %s not in tree", current.Value)
+	case sel.exact != "":
+		ref := findSnapshotInTree(tree, sel.exact)
+		if ref == nil {
+			return nil, fmt.Errorf("snapshot '%s' not found", sel.exact)
+		}
+		return findSnapshotByRef(tree, *ref), nil
+	}
+
+	// Like findLatestSnapshotInTree, the newest snapshot is the one created
+	// last anywhere in the tree, not the tip of the newest root's branch.
+	var newest *types.VirtualMachineSnapshotTree
+	walkSnapshotTree(tree, func(node *types.VirtualMachineSnapshotTree) {
+		if sel.match != nil && !sel.match(node.Name) {
+			return
+		}
+		if sel.rule.Before != nil && !node.CreateTime.Before(*sel.rule.Before) {
+			return
+		}
+		if newest == nil || node.CreateTime.After(newest.CreateTime) {
+			newest = node
+		}
+	})
+	if newest == nil {
+		return nil, fmt.Errorf("no snapshot matches %s", sel.rule)
+	}
+	return newest, nil
+}
+
+// walkSnapshotTree calls fn for every node of tree, parents first.
+func walkSnapshotTree(tree []types.VirtualMachineSnapshotTree, fn func(*types.VirtualMachineSnapshotTree)) {
+	for i := range tree {
+		fn(&tree[i])
+		walkSnapshotTree(tree[i].ChildSnapshotList, fn)
+	}
+}
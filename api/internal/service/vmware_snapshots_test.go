@@ -0,0 +1,245 @@
+package service
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// testSnapshotTree returns:
+//
+//	base (2025-01-01)
+//	└── clean-1 (2025-03-01)
+//	    ├── clean-2 (2025-06-01)
+//	    └── debug (2025-07-01)
+func testSnapshotTree() []types.VirtualMachineSnapshotTree {
+	node := testSnapshotNode
+	return []types.VirtualMachineSnapshotTree{
+		node("base", time.January,
+			node("clean-1", time.March,
+				node("clean-2", time.June),
+				node("debug", time.July))),
+	}
+}
+
+// testSnapshotNode returns a snapshot created on the first of month m, 2025.
+func testSnapshotNode(name string, m time.Month, children ...types.VirtualMachineSnapshotTree) types.VirtualMachineSnapshotTree {
+	return types.VirtualMachineSnapshotTree{
+		Name:              name,
+		Snapshot:          types.ManagedObjectReference{Type: "VirtualMachineSnapshot", Value: "snap-" + name},
+		CreateTime:        time.Date(2025, m, 1, 0, 0, 0, 0, time.UTC),
+		ChildSnapshotList: children,
+	}
+}
+
+func TestSnapshotSelector_SelectFrom(t *testing.T) {
+	before := time.Date(2025, 6, 15, 0, 0, 0, 0, time.UTC)
+	current := types.ManagedObjectReference{Type: "VirtualMachineSnapshot", Value: "snap-clean-1"}
+
+	tests := []struct {
+		name string
+		rule SnapshotRule
+		want string
+	}{
+		{"empty is latest", SnapshotRule{}, "debug"},
+		{"latest", SnapshotRule{Snapshot: "<latest>"}, "debug"},
+		{"current", SnapshotRule{Snapshot: "<current>"}, "clean-1"},
+		{"exact", SnapshotRule{Snapshot: "base"}, "base"},
+		{"glob newest match", SnapshotRule{Snapshot: "glob:clean-*"}, "clean-2"},
+		{"regex newest match", SnapshotRule{Snapshot: `regex:^clean-1$`}, "clean-1"},
+		{"latest before date", SnapshotRule{Snapshot: "<latest>", Before: &before}, "clean-2"},
+		{"glob before date", SnapshotRule{Snapshot: "glob:clean-*", Before: &before}, "clean-2"},
+		{"regex before earlier date", SnapshotRule{Snapshot: "regex:^(base|clean-2)$", Before: timePtr(time.Date(2025, 5, 1, 0, 0, 0, 0, time.UTC))}, "base"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sel, err := parseSnapshotSelector(tt.rule)
+			require.NoError(t, err)
+			got, err := sel.selectFrom(testSnapshotTree(), &current)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got.Name)
+		})
+	}
+}
+
+func timePtr(t time.Time) *time.Time { return &t }
+
+// A bare <latest> and a filtered selector agree on the newest snapshot even
+// when it sits on a branch below an older root:
+//
+//	base (2025-01-01)
+//	├── clean (2025-03-01)
+//	└── rebuilt (2025-08-01)
+//	golden (2025-05-01)
+func TestSnapshotSelector_LatestAcrossBranches(t *testing.T) {
+	node := testSnapshotNode
+	tree := []types.VirtualMachineSnapshotTree{
+		node("base", time.January, node("clean", time.March), node("rebuilt", time.August)),
+		node("golden", time.May),
+	}
+
+	for _, rule := range []SnapshotRule{
+		{Snapshot: "<latest>"},
+		{Snapshot: "<latest>", Before: timePtr(time.Date(2025, 9, 1, 0, 0, 0, 0, time.UTC))},
+		{Snapshot: "glob:*"},
+		{Snapshot: "regex:."},
+	} {
+		sel, err := parseSnapshotSelector(rule)
+		require.NoError(t, err)
+		got, err := sel.selectFrom(tree, nil)
+		require.NoError(t, err)
+		assert.Equal(t, "rebuilt", got.Name, rule.String())
+	}
+}
+
+func TestSnapshotSelector_SelectFromErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    SnapshotRule
+		tree    []types.VirtualMachineSnapshotTree
+		wantErr string
+	}{
+		{"no snapshots", SnapshotRule{}, nil, "no snapshots found"},
+		{"exact missing", SnapshotRule{Snapshot: "gone"}, testSnapshotTree(), "snapshot 'gone' not found"},
+		{"no current", SnapshotRule{Snapshot: "<current>"}, testSnapshotTree(), "VM has no current snapshot"},
+		{"glob no match", SnapshotRule{Snapshot: "glob:prod-*"}, testSnapshotTree(), "no snapshot matches glob:prod-*"},
+		{"before too early", SnapshotRule{Before: timePtr(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))}, testSnapshotTree(), "no snapshot matches <latest> before 2024-01-01"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sel, err := parseSnapshotSelector(tt.rule)
+			require.NoError(t, err)
+			_, err = sel.selectFrom(tt.tree, nil)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
+func TestSnapshotPolicy_For(t *testing.T) {
+	p := SnapshotPolicy{
+		Default: "clean",
+		Rules: []SnapshotRule{
+			{VMPrefixes: []string{"Pod-1_"}, Snapshot: "pod1"},
+			{Roles: []string{"FortiGate"}, Snapshot: "fgt-baseline"},
+			{Roles: []string{"Client_Deb"}, Snapshot: "glob:deb-*"},
+		},
+	}
+
+	assert.Equal(t, "pod1", p.For("Pod-1_FortiGate").Snapshot, "first matching rule wins")
+	assert.Equal(t, "fgt-baseline", p.For("Pod-2_FortiGate").Snapshot)
+	assert.Equal(t, "glob:deb-*", p.For("Pod-2_Client_Deb").Snapshot)
+	assert.Equal(t, "clean", p.For("Pod-2_Client_Win").Snapshot)
+}
+
+func TestSnapshotPolicy_Validate(t *testing.T) {
+	before := time.Now()
+	tests := []struct {
+		name    string
+		policy  SnapshotPolicy
+		wantErr string
+	}{
+		{"valid", SnapshotPolicy{Default: "<latest>", Rules: []SnapshotRule{{Roles: []string{"FortiGate"}, Snapshot: "regex:^fgt-[0-9]+$", Before: &before}}}, ""},
+		{"bad regex", SnapshotPolicy{Rules: []SnapshotRule{{VMPrefixes: []string{"Pod-"}, Snapshot: "regex:("}}}, "snapshot_rules[0]: invalid regex"},
+		{"bad glob", SnapshotPolicy{Rules: []SnapshotRule{{VMPrefixes: []string{"Pod-"}, Snapshot: "glob:["}}}, "snapshot_rules[0]: invalid glob"},
+		{"no selector", SnapshotPolicy{Rules: []SnapshotRule{{Snapshot: "clean"}}}, "vm_prefixes or roles is required"},
+		{"before with exact", SnapshotPolicy{Rules: []SnapshotRule{{VMPrefixes: []string{"Pod-"}, Snapshot: "clean", Before: &before}}}, `before cannot be combined with "clean"`},
+		{"bad default", SnapshotPolicy{Default: "regex:["}, "snapshot_name: invalid regex"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.Validate()
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
+func TestESXiConfig_SnapshotPolicy(t *testing.T) {
+	assert.Equal(t, "<latest>", (&ESXiConfig{}).SnapshotPolicy().Default)
+
+	name := "clean-state"
+	cfg := &ESXiConfig{SnapshotName: &name, SnapshotRules: []SnapshotRule{{Roles: []string{"FortiGate"}}}}
+	p := cfg.SnapshotPolicy()
+	assert.Equal(t, "clean-state", p.Default)
+	assert.Len(t, p.Rules, 1)
+}
+
+func TestLoadFeatureConfig_SnapshotRules(t *testing.T) {
+	content := `
+[esxi]
+snapshot_name = "clean"
+
+[[esxi.snapshot_rules]]
+roles = ["FortiGate"]
+snapshot = "glob:fgt-*"
+before = 2025-09-01
+
+[[esxi.snapshot_rules]]
+vm_prefixes = ["Pod-1_Client_Deb"]
+snapshot = "<current>"
+`
+	tmpFile := filepath.Join(t.TempDir(), "config.toml")
+	require.NoError(t, os.WriteFile(tmpFile, []byte(content), 0o644))
+
+	cfg, err := LoadFeatureConfig(tmpFile)
+	require.NoError(t, err)
+	require.Len(t, cfg.ESXi.SnapshotRules, 2)
+	rule := cfg.ESXi.SnapshotRules[0]
+	require.NotNil(t, rule.Before)
+	assert.Equal(t, "glob:fgt-* before 2025-09-01", rule.String())
+	assert.Equal(t, "<current>", cfg.ESXi.SnapshotPolicy().For("Pod-1_Client_Deb").Snapshot)
+}
+
+func TestLoadFeatureConfig_InvalidSnapshotRule(t *testing.T) {
+	content := `
+[[esxi.snapshot_rules]]
+roles = ["FortiGate"]
+snapshot = "regex:("
+`
+	tmpFile := filepath.Join(t.TempDir(), "config.toml")
+	require.NoError(t, os.WriteFile(tmpFile, []byte(content), 0o644))
+
+	_, err := LoadFeatureConfig(tmpFile)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid esxi config: snapshot_rules[0]: invalid regex")
+}
+
+func TestRestoreVMsWithPasswordRotation_SnapshotRules(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		svc, _ := newSimService(ctx, t, []*vim25.Client{c})
+		for _, name := range []string{"clean-1", "clean-2", "debug"} {
+			createSimSnapshot(ctx, t, svc, "ha-host_VM0", name)
+		}
+		createSimSnapshot(ctx, t, svc, "ha-host_VM1", "base")
+
+		policy := SnapshotPolicy{
+			Default: "base",
+			Rules:   []SnapshotRule{{Roles: []string{"VM0"}, Snapshot: "glob:clean-*"}},
+		}
+		results := svc.RestoreVMsWithPasswordRotation(ctx, []UserVMPair{
+			{VMs: []string{"ha-host_VM0", "ha-host_VM1"}},
+		}, policy)
+		require.Len(t, results, 1)
+		vms := results[0].VMs
+		require.Len(t, vms, 2)
+		require.NoError(t, vms[0].Err)
+		assert.Equal(t, "glob:clean-*", vms[0].Selector)
+		assert.Equal(t, "clean-2", vms[0].Snapshot)
+		require.NoError(t, vms[1].Err)
+		assert.Equal(t, "base", vms[1].Selector)
+		assert.Equal(t, "base", vms[1].Snapshot)
+	}, simulator.ESX())
+}
@@ -1,15 +1,47 @@
 package service
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"testing"
 	"time"
 
+	"github.com/EpicMandM/esxi-lab-provider/api/internal/logger"
 	"github.com/EpicMandM/esxi-lab-provider/api/internal/models"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/mo"
 	"github.com/vmware/govmomi/vim25/types"
 )
 
+// newSimService wraps vcsim clients in a VMwareService the same way
+// NewVMwareService does for real endpoints. Each client becomes one
+// endpoint, named "sim-<index>" unless names are given.
+func newSimService(ctx context.Context, t *testing.T, clients []*vim25.Client, names ...string) (*VMwareService, *bytes.Buffer) {
+	t.Helper()
+	var buf bytes.Buffer
+	svc := &VMwareService{
+		locations: make(map[string]vmLocation),
+		logger:    logger.NewWithWriter(&buf),
+	}
+	for i, c := range clients {
+		name := fmt.Sprintf("sim-%d", i)
+		if i < len(names) {
+			name = names[i]
+		}
+		conn, err := newHostConnection(ctx, name, &govmomi.Client{Client: c, SessionManager: session.NewManager(c)})
+		require.NoError(t, err)
+		svc.conns = append(svc.conns, conn)
+	}
+	return svc, &buf
+}
+
 // --- findSnapshotInTree tests ---
 
 func TestFindSnapshotInTree_Found(t *testing.T) {
@@ -142,12 +174,9 @@ func TestFindLatestSnapshotInTree_ParentNewerThanChild(t *testing.T) {
 		},
 	}
 
-	// The function recurses into the latest root's children.
-	// The child snapshot is returned because the function always recurses into
-	// the latest root's child list, even if the child is older.
 	got := findLatestSnapshotInTree(tree)
 	require.NotNil(t, got)
-	assert.Equal(t, "snap-child", got.Value)
+	assert.Equal(t, "snap-parent", got.Value)
 }
 
 // --- extractSnapshots tests ---
@@ -160,7 +189,7 @@ func TestExtractSnapshots_Flat(t *testing.T) {
 	}
 
 	svc := &VMwareService{}
-	result := svc.extractSnapshots(tree)
+	result := svc.extractSnapshots(tree, nil)
 
 	assert.Len(t, result, 2)
 	assert.Equal(t, "snap1", result[0].Name)
@@ -183,35 +212,416 @@ func TestExtractSnapshots_WithChildren(t *testing.T) {
 	}
 
 	svc := &VMwareService{}
-	result := svc.extractSnapshots(tree)
+	result := svc.extractSnapshots(tree, nil)
 
-	assert.Len(t, result, 2)
+	require.Len(t, result, 1)
 	assert.Equal(t, "parent", result[0].Name)
-	assert.Equal(t, "child", result[1].Name)
+	require.Len(t, result[0].Children, 1)
+	assert.Equal(t, "child", result[0].Children[0].Name)
+	assert.Empty(t, result[0].Children[0].Children)
 }
 
 func TestExtractSnapshots_Empty(t *testing.T) {
 	svc := &VMwareService{}
-	result := svc.extractSnapshots(nil)
-	assert.Nil(t, result)
+	result := svc.extractSnapshots(nil, nil)
+	assert.Empty(t, result)
 }
 
 func TestExtractSnapshots_FieldMapping(t *testing.T) {
 	ts := time.Date(2025, 3, 15, 12, 30, 0, 0, time.UTC)
+	ref := types.ManagedObjectReference{Type: "VirtualMachineSnapshot", Value: "snap-7"}
 	tree := []types.VirtualMachineSnapshotTree{
-		{Name: "test", Description: "desc", CreateTime: ts, State: "poweredOff", Quiesced: true},
+		{Name: "test", Description: "desc", CreateTime: ts, State: "poweredOff", Quiesced: true, Snapshot: ref},
 	}
 
 	svc := &VMwareService{}
-	result := svc.extractSnapshots(tree)
+	result := svc.extractSnapshots(tree, &ref)
 	require.Len(t, result, 1)
 
 	expected := models.VMSnapshot{
+		ID:          "snap-7",
 		Name:        "test",
 		Description: "desc",
 		Created:     ts,
 		State:       "poweredOff",
 		Quiesced:    true,
+		Current:     true,
+		Children:    []models.VMSnapshot{},
 	}
 	assert.Equal(t, expected, result[0])
 }
+
+func TestExtractSnapshots_CurrentFlagOnChild(t *testing.T) {
+	current := types.ManagedObjectReference{Type: "VirtualMachineSnapshot", Value: "snap-child"}
+	tree := []types.VirtualMachineSnapshotTree{
+		{
+			Name:     "parent",
+			Snapshot: types.ManagedObjectReference{Type: "VirtualMachineSnapshot", Value: "snap-parent"},
+			ChildSnapshotList: []types.VirtualMachineSnapshotTree{
+				{Name: "child", Snapshot: current},
+			},
+		},
+	}
+
+	svc := &VMwareService{}
+	result := svc.extractSnapshots(tree, &current)
+	require.Len(t, result, 1)
+	assert.False(t, result[0].Current)
+	assert.True(t, result[0].Children[0].Current)
+}
+
+// --- vmFromManagedObject tests ---
+
+func TestVMFromManagedObject_MapsRuntimeAndGuest(t *testing.T) {
+	hostRef := types.ManagedObjectReference{Type: "HostSystem", Value: "host-1"}
+	poolRef := types.ManagedObjectReference{Type: "ResourcePool", Value: "pool-1"}
+	folderRef := types.ManagedObjectReference{Type: "Folder", Value: "folder-1"}
+	mvm := mo.VirtualMachine{
+		ManagedEntity: mo.ManagedEntity{
+			Name:   "Pod-1_Client_Deb",
+			Parent: &folderRef,
+			CustomValue: []types.BaseCustomFieldValue{
+				&types.CustomFieldStringValue{CustomFieldValue: types.CustomFieldValue{Key: 101}, Value: "pod-1"},
+				&types.CustomFieldStringValue{CustomFieldValue: types.CustomFieldValue{Key: 202}, Value: "x"},
+			},
+		},
+		Runtime:      types.VirtualMachineRuntimeInfo{PowerState: types.VirtualMachinePowerStatePoweredOn, Host: &hostRef},
+		ResourcePool: &poolRef,
+		Config:       &types.VirtualMachineConfigInfo{Annotation: "student client", GuestFullName: "Debian (config)"},
+		Guest: &types.GuestInfo{
+			GuestFullName:      "Debian GNU/Linux 12 (64-bit)",
+			ToolsRunningStatus: "guestToolsRunning",
+			IpAddress:          "10.0.1.10",
+			Net: []types.GuestNicInfo{
+				{IpAddress: []string{"10.0.1.10", "fe80::1"}},
+				{IpAddress: []string{"10.0.1.10"}},
+			},
+		},
+	}
+	names := map[types.ManagedObjectReference]string{
+		hostRef:   "esxi-01.lab",
+		poolRef:   "Resources",
+		folderRef: "vm",
+	}
+
+	svc := &VMwareService{}
+	vm := svc.vmFromManagedObject(mvm, names, map[int32]string{101: "lab.pod"})
+
+	assert.Equal(t, "Pod-1_Client_Deb", vm.Name)
+	assert.Equal(t, "poweredOn", vm.PowerState)
+	assert.Equal(t, "Debian GNU/Linux 12 (64-bit)", vm.GuestOS)
+	assert.Equal(t, []string{"10.0.1.10", "fe80::1"}, vm.IPAddresses)
+	assert.Equal(t, "guestToolsRunning", vm.ToolsStatus)
+	assert.Equal(t, "esxi-01.lab", vm.Host)
+	assert.Equal(t, "Resources", vm.ResourcePool)
+	assert.Equal(t, "vm", vm.Folder)
+	assert.Equal(t, "student client", vm.Annotation)
+	assert.Equal(t, map[string]string{"lab.pod": "pod-1", "202": "x"}, vm.Attributes)
+	assert.Empty(t, vm.Snapshots)
+}
+
+func TestVMFromManagedObject_NoGuestInfo(t *testing.T) {
+	mvm := mo.VirtualMachine{
+		ManagedEntity: mo.ManagedEntity{Name: "vm1"},
+		Runtime:       types.VirtualMachineRuntimeInfo{PowerState: types.VirtualMachinePowerStatePoweredOff},
+		Config:        &types.VirtualMachineConfigInfo{GuestFullName: "Other Linux"},
+	}
+
+	svc := &VMwareService{}
+	vm := svc.vmFromManagedObject(mvm, nil, nil)
+
+	assert.Equal(t, "poweredOff", vm.PowerState)
+	assert.Equal(t, "Other Linux", vm.GuestOS)
+	assert.NotNil(t, vm.IPAddresses)
+	assert.Empty(t, vm.IPAddresses)
+	assert.Empty(t, vm.Host)
+}
+
+// --- ListVMSnapshots / buildVMListResponse tests ---
+
+func TestListVMSnapshots_Simulator(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		svc, _ := newSimService(ctx, t, []*vim25.Client{c})
+
+		resp, err := svc.ListVMSnapshots(ctx)
+		require.NoError(t, err)
+		assert.NotEmpty(t, resp.ESXiName)
+		assert.Equal(t, len(resp.VMs), resp.TotalVMs)
+		assert.NotZero(t, resp.TotalVMs)
+		assert.Empty(t, resp.Errors)
+		for _, vm := range resp.VMs {
+			assert.NotEmpty(t, vm.PowerState)
+			assert.NotEmpty(t, vm.Host)
+			assert.NotEmpty(t, vm.ResourcePool)
+		}
+		for i := 1; i < len(resp.VMs); i++ {
+			assert.LessOrEqual(t, resp.VMs[i-1].Name, resp.VMs[i].Name)
+		}
+	}, simulator.ESX())
+}
+
+func TestBuildVMListResponse_MissingSetRecordedAsError(t *testing.T) {
+	svc := &VMwareService{logger: logger.NewWithWriter(&bytes.Buffer{})}
+	content := []types.ObjectContent{
+		{
+			Obj: types.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-2"},
+			PropSet: []types.DynamicProperty{
+				{Name: "name", Val: "Pod-2_FortiGate"},
+			},
+			MissingSet: []types.MissingProperty{
+				{Path: "snapshot", Fault: types.LocalizedMethodFault{Fault: &types.NoPermission{}, LocalizedMessage: "denied"}},
+			},
+		},
+		{
+			Obj: types.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-1"},
+			PropSet: []types.DynamicProperty{
+				{Name: "name", Val: "Pod-1_FortiGate"},
+			},
+		},
+	}
+
+	resp := svc.buildVMListResponse(content, nil)
+	require.Len(t, resp.VMs, 1)
+	assert.Equal(t, "Pod-1_FortiGate", resp.VMs[0].Name)
+	assert.Equal(t, 1, resp.TotalVMs)
+	require.Len(t, resp.Errors, 1)
+	assert.Equal(t, "Pod-2_FortiGate", resp.Errors[0].VM)
+	assert.Equal(t, "vm-2", resp.Errors[0].Ref)
+	assert.NotEmpty(t, resp.Errors[0].Error)
+}
+
+// --- multi-endpoint tests ---
+
+func TestListVMSnapshots_MergesEndpoints(t *testing.T) {
+	simulator.Test(func(ctx context.Context, vc *vim25.Client) {
+		simulator.Test(func(ctx context.Context, esx *vim25.Client) {
+			svc, _ := newSimService(ctx, t, []*vim25.Client{esx, vc})
+
+			resp, err := svc.ListVMSnapshots(ctx)
+			require.NoError(t, err)
+
+			hosts := map[string]bool{}
+			for _, vm := range resp.VMs {
+				hosts[vm.Host] = true
+			}
+			assert.Greater(t, len(hosts), 1, "VMs from several hosts should be merged")
+
+			// The vCenter endpoint is queried first even though it was
+			// configured second.
+			assert.True(t, svc.inventoryOrder()[0].client.IsVC())
+			for _, vm := range resp.VMs {
+				assert.NotNil(t, svc.locations[vm.Name].conn, vm.Name)
+			}
+		}, simulator.ESX())
+	}, simulator.VPX())
+}
+
+func TestListVMSnapshots_SameVMOnTwoEndpointsCollapsed(t *testing.T) {
+	simulator.Test(func(ctx context.Context, a *vim25.Client) {
+		simulator.Test(func(ctx context.Context, b *vim25.Client) {
+			// Two identical ESX models report VMs with the same instance
+			// UUIDs, as a host seen through vCenter and directly would.
+			single, _ := newSimService(ctx, t, []*vim25.Client{a})
+			want, err := single.ListVMSnapshots(ctx)
+			require.NoError(t, err)
+
+			svc, _ := newSimService(ctx, t, []*vim25.Client{a, b})
+			resp, err := svc.ListVMSnapshots(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, want.TotalVMs, resp.TotalVMs)
+			assert.Empty(t, resp.Errors)
+		}, simulator.ESX())
+	}, simulator.ESX())
+}
+
+func TestListVMSnapshots_DuplicateNamesReported(t *testing.T) {
+	simulator.Test(func(ctx context.Context, a *vim25.Client) {
+		simulator.Test(func(ctx context.Context, b *vim25.Client) {
+			vm, err := find.NewFinder(b).VirtualMachine(ctx, "ha-host_VM0")
+			require.NoError(t, err)
+			task, err := vm.Reconfigure(ctx, types.VirtualMachineConfigSpec{InstanceUuid: "00000000-0000-0000-0000-00000000beef"})
+			require.NoError(t, err)
+			require.NoError(t, task.Wait(ctx))
+
+			svc, buf := newSimService(ctx, t, []*vim25.Client{a, b})
+			resp, err := svc.ListVMSnapshots(ctx)
+			require.NoError(t, err)
+			require.Len(t, resp.Errors, 1)
+			assert.Equal(t, "ha-host_VM0", resp.Errors[0].VM)
+			assert.Contains(t, resp.Errors[0].Error, "duplicate VM name")
+			assert.Contains(t, buf.String(), "Duplicate VM name in inventory")
+		}, simulator.ESX())
+	}, simulator.ESX())
+}
+
+func TestRotateESXiUserPassword_StandaloneHost(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		svc, _ := newSimService(ctx, t, []*vim25.Client{c})
+		resp, err := svc.ListVMSnapshots(ctx)
+		require.NoError(t, err)
+		require.NotEmpty(t, resp.VMs)
+
+		password, err := svc.RotateESXiUserPassword(ctx, resp.VMs[0].Name, "lab-user-1")
+		require.NoError(t, err)
+		assert.Len(t, password, 16)
+	}, simulator.ESX())
+}
+
+func TestRotateESXiUserPassword_HostPasswordQuality(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		svc, _ := newSimService(ctx, t, []*vim25.Client{c})
+		host, err := find.NewFinder(c).DefaultHostSystem(ctx)
+		require.NoError(t, err)
+		om, err := host.ConfigManager().OptionManager(ctx)
+		require.NoError(t, err)
+		require.NoError(t, om.Update(ctx, []types.BaseOptionValue{&types.OptionValue{
+			Key:   "Security.PasswordQualityControl",
+			Value: "retry=3 min=disabled,disabled,disabled,disabled,20",
+		}}))
+
+		password, err := svc.RotateESXiUserPassword(ctx, "ha-host_VM0", "lab-user-1")
+		require.NoError(t, err)
+		assert.Len(t, password, 20)
+		assert.Equal(t, 4, passwordClassCount(password))
+
+		svc.SetPasswordPolicy(PasswordPolicy{Passphrase: true})
+		password, err = svc.RotateESXiUserPassword(ctx, "ha-host_VM0", "lab-user-1")
+		require.NoError(t, err)
+		assert.GreaterOrEqual(t, len(password), 20)
+		assert.Contains(t, password, "-")
+	}, simulator.ESX())
+}
+
+func TestRotateESXiUserPassword_VCenterRequiresDirectHost(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		svc, _ := newSimService(ctx, t, []*vim25.Client{c})
+		resp, err := svc.ListVMSnapshots(ctx)
+		require.NoError(t, err)
+		require.NotEmpty(t, resp.VMs)
+
+		_, err = svc.RotateESXiUserPassword(ctx, resp.VMs[0].Name, "lab-user-1")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "no direct ESXi connection configured for host")
+	}, simulator.VPX())
+}
+
+func TestRotateESXiUserPassword_VCenterWithDirectHost(t *testing.T) {
+	simulator.Test(func(ctx context.Context, vc *vim25.Client) {
+		simulator.Test(func(ctx context.Context, esx *vim25.Client) {
+			// Name the direct endpoint after the vCenter host the VM runs on.
+			probe, _ := newSimService(ctx, t, []*vim25.Client{vc})
+			resp, err := probe.ListVMSnapshots(ctx)
+			require.NoError(t, err)
+			require.NotEmpty(t, resp.VMs)
+			vm := resp.VMs[0]
+
+			svc, _ := newSimService(ctx, t, []*vim25.Client{vc, esx}, "vcenter", vm.Host)
+			_, err = svc.ListVMSnapshots(ctx)
+			require.NoError(t, err)
+
+			password, err := svc.RotateESXiUserPassword(ctx, vm.Name, "lab-user-1")
+			require.NoError(t, err)
+			assert.NotEmpty(t, password)
+		}, simulator.ESX())
+	}, simulator.VPX())
+}
+
+func TestRotateESXiUserPassword_QualityFromVMHost(t *testing.T) {
+	simulator.Test(func(ctx context.Context, vc *vim25.Client) {
+		simulator.Test(func(ctx context.Context, esx *vim25.Client) {
+			probe, _ := newSimService(ctx, t, []*vim25.Client{vc})
+			resp, err := probe.ListVMSnapshots(ctx)
+			require.NoError(t, err)
+			require.NotEmpty(t, resp.VMs)
+			vm := resp.VMs[0]
+
+			// Only the host running the VM carries the stricter setting.
+			host, err := find.NewFinder(vc).HostSystem(ctx, "*/"+vm.Host)
+			require.NoError(t, err)
+			om, err := host.ConfigManager().OptionManager(ctx)
+			require.NoError(t, err)
+			require.NoError(t, om.Update(ctx, []types.BaseOptionValue{&types.OptionValue{
+				Key:   "Security.PasswordQualityControl",
+				Value: "retry=3 min=disabled,disabled,disabled,disabled,20",
+			}}))
+
+			svc, _ := newSimService(ctx, t, []*vim25.Client{vc, esx}, "vcenter", vm.Host)
+			_, err = svc.ListVMSnapshots(ctx)
+			require.NoError(t, err)
+
+			password, err := svc.RotateESXiUserPassword(ctx, vm.Name, "lab-user-1")
+			require.NoError(t, err)
+			assert.Len(t, password, 20)
+		}, simulator.ESX())
+	}, simulator.VPX())
+}
+
+func TestLookupVM_NotFound(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		svc, _ := newSimService(ctx, t, []*vim25.Client{c})
+		_, _, err := svc.lookupVM(ctx, "does-not-exist")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "VM not found")
+	}, simulator.ESX())
+}
+
+func createSimSnapshot(ctx context.Context, t *testing.T, svc *VMwareService, vmName, snapshotName string) {
+	t.Helper()
+	vm, _, err := svc.lookupVM(ctx, vmName)
+	require.NoError(t, err)
+	task, err := vm.CreateSnapshot(ctx, snapshotName, "", false, false)
+	require.NoError(t, err)
+	require.NoError(t, task.Wait(ctx))
+}
+
+func TestRestoreVMsWithPasswordRotation_Results(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		svc, _ := newSimService(ctx, t, []*vim25.Client{c})
+		createSimSnapshot(ctx, t, svc, "ha-host_VM0", "base")
+		createSimSnapshot(ctx, t, svc, "ha-host_VM0", "newer")
+
+		results := svc.RestoreVMsWithPasswordRotation(ctx, []UserVMPair{
+			{User: "alice", VMs: []string{"ha-host_VM0", "ha-host_VM1"}},
+		}, SnapshotPolicy{Default: "<latest>"})
+		require.Len(t, results, 1)
+		r := results[0]
+		assert.Equal(t, "alice", r.User)
+		require.Len(t, r.VMs, 2)
+
+		primary := r.Primary()
+		require.NoError(t, primary.Err)
+		assert.Equal(t, "ha-host_VM0", primary.VM)
+		assert.Equal(t, "newer", primary.Snapshot)
+		assert.NotEmpty(t, primary.PowerState)
+		assert.Positive(t, primary.Duration)
+
+		// The secondary VM has no snapshots.
+		require.Error(t, r.VMs[1].Err)
+		assert.Contains(t, r.VMs[1].Err.Error(), "no snapshots found")
+		assert.Equal(t, []VMRestoreResult{r.VMs[1]}, r.FailedVMs())
+
+		assert.True(t, r.PasswordRotated())
+		assert.Len(t, r.Password, 16)
+	}, simulator.ESX())
+}
+
+func TestRestoreVMsWithPasswordRotation_PrimaryFailureSkipsRotation(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		svc, buf := newSimService(ctx, t, []*vim25.Client{c})
+		createSimSnapshot(ctx, t, svc, "ha-host_VM1", "base")
+
+		results := svc.RestoreVMsWithPasswordRotation(ctx, []UserVMPair{
+			{User: "alice", VMs: []string{"ha-host_VM0", "ha-host_VM1"}},
+		}, SnapshotPolicy{Default: "base"})
+		require.Len(t, results, 1)
+		r := results[0]
+		require.Error(t, r.VMs[0].Err)
+		assert.Contains(t, r.VMs[0].Err.Error(), "no snapshots found")
+		require.NoError(t, r.VMs[1].Err)
+		assert.Equal(t, "base", r.VMs[1].Snapshot)
+
+		assert.False(t, r.PasswordRotated())
+		assert.NoError(t, r.RotationErr)
+		assert.Contains(t, buf.String(), "Password rotation skipped")
+	}, simulator.ESX())
+}
@@ -0,0 +1,92 @@
+package service
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/EpicMandM/esxi-lab-provider/api/internal/logger"
+	"github.com/vmware/govmomi/performance"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// usageCounters are the real-time performance counters sampled per VM,
+// aggregated over all instances.
+var usageCounters = []string{
+	"cpu.usage.average",
+	"mem.usage.average",
+	"disk.usage.average",
+	"net.usage.average",
+}
+
+// realtimeInterval is the vSphere real-time sampling interval in seconds.
+const realtimeInterval = 20
+
+// VMUsage is the latest real-time resource usage sample of one VM.
+type VMUsage struct {
+	VM            string
+	CPUPercent    float64
+	MemoryPercent float64
+	DiskKBps      int64
+	NetworkKBps   int64
+}
+
+// VMUsage samples the latest real-time CPU, memory, disk and network
+// counters of the given VMs through each endpoint's PerformanceManager.
+// VMs that cannot be found or return no samples are logged and left out.
+func (s *VMwareService) VMUsage(ctx context.Context, vmNames []string) ([]VMUsage, error) {
+	byConn := make(map[*hostConnection][]types.ManagedObjectReference)
+	names := make(map[types.ManagedObjectReference]string)
+	var order []*hostConnection
+	for _, name := range vmNames {
+		vm, loc, err := s.lookupVM(ctx, name)
+		if err != nil {
+			s.logger.Warn("VM usage unavailable", logger.VM(name), logger.Error(err))
+			continue
+		}
+		if _, ok := byConn[loc.conn]; !ok {
+			order = append(order, loc.conn)
+		}
+		byConn[loc.conn] = append(byConn[loc.conn], vm.Reference())
+		names[vm.Reference()] = name
+	}
+
+	var usage []VMUsage
+	for _, conn := range order {
+		m := performance.NewManager(conn.client.Client)
+		spec := types.PerfQuerySpec{
+			IntervalId: realtimeInterval,
+			MaxSample:  1,
+			MetricId:   []types.PerfMetricId{{Instance: ""}},
+		}
+		sample, err := m.SampleByName(ctx, spec, usageCounters, byConn[conn])
+		if err != nil {
+			return usage, fmt.Errorf("failed to query performance counters on %s: %w", conn.name, err)
+		}
+		series, err := m.ToMetricSeries(ctx, sample)
+		if err != nil {
+			return usage, fmt.Errorf("failed to read performance counters on %s: %w", conn.name, err)
+		}
+
+		for _, entity := range series {
+			u := VMUsage{VM: names[entity.Entity]}
+			for _, v := range entity.Value {
+				if v.Instance != "" || len(v.Value) == 0 {
+					continue
+				}
+				latest := v.Value[len(v.Value)-1]
+				switch v.Name {
+				case "cpu.usage.average":
+					u.CPUPercent = float64(latest) / 100
+				case "mem.usage.average":
+					u.MemoryPercent = float64(latest) / 100
+				case "disk.usage.average":
+					u.DiskKBps = latest
+				case "net.usage.average":
+					u.NetworkKBps = latest
+				}
+			}
+			usage = append(usage, u)
+		}
+	}
+	return usage, nil
+}
@@ -0,0 +1,27 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25"
+)
+
+func TestVMUsage(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		svc, buf := newSimService(ctx, t, []*vim25.Client{c})
+
+		usage, err := svc.VMUsage(ctx, []string{"ha-host_VM0", "ha-host_VM1", "missing"})
+		require.NoError(t, err)
+		require.Len(t, usage, 2)
+		assert.ElementsMatch(t, []string{"ha-host_VM0", "ha-host_VM1"}, []string{usage[0].VM, usage[1].VM})
+		for _, u := range usage {
+			assert.GreaterOrEqual(t, u.CPUPercent, 0.0)
+			assert.LessOrEqual(t, u.CPUPercent, 100.0)
+		}
+		assert.Contains(t, buf.String(), "MESSAGE=VM usage unavailable VM=missing")
+	}, simulator.ESX())
+}
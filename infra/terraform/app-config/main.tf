@@ -56,6 +56,9 @@ resource "local_file" "user_config" {
     esxi_user_vm_mappings = local.esxi_user_vm_mappings_normalized
     esxi_snapshot_name    = var.esxi_snapshot_name
 
+    permissions_enabled = try(data.terraform_remote_state.esxi_users.outputs.time_boxed_permissions, false)
+    permissions_role    = data.terraform_remote_state.esxi_users.outputs.role_name
+
     wg_server_public_key     = local.lab.wireguard_server_public_key
     wg_server_endpoint       = local.lab.wireguard_public_endpoint
     wg_opnsense_url          = local.lab.opnsense_url
@@ -159,10 +159,12 @@ resource "null_resource" "esxi_users" {
   depends_on = [null_resource.esxi_role]
 }
 
+# Permanent VM permissions, only when the provider does not manage
+# time-boxed grants (see var.permanent_vm_permissions).
 resource "null_resource" "fortigate_permissions" {
   for_each = {
     for name, user in local.users : name => user
-    if contains(var.fortigate_pod_indices, user.index)
+    if var.permanent_vm_permissions && contains(var.fortigate_pod_indices, user.index)
   }
 
   triggers = {
@@ -215,7 +217,7 @@ resource "null_resource" "fortigate_permissions" {
 }
 
 resource "null_resource" "client_deb_permissions" {
-  for_each = local.users
+  for_each = var.permanent_vm_permissions ? local.users : {}
 
   triggers = {
     username      = each.key
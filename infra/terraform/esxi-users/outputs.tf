@@ -45,3 +45,8 @@ output "role_privileges" {
   description = "Privileges assigned to the lab-console role"
   value       = local.role_privileges
 }
+
+output "time_boxed_permissions" {
+  description = "Whether the provider grants role_name on pod VMs per booking instead of permanently"
+  value       = !var.permanent_vm_permissions
+}
@@ -12,3 +12,12 @@ variable "role_name" {
   type    = string
   default = "lab-console"
 }
+
+# When false, lab users get no permanent permissions on their pod's VMs; the
+# provider grants role_name only while a booking is active. The default keeps
+# the permanent grants of existing deployments; set it to false to hand VM
+# access over to the provider.
+variable "permanent_vm_permissions" {
+  type    = bool
+  default = true
+}